@@ -3,13 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"jjr-tec-backend/internal/logging"
 	"jjr-tec-backend/internal/server"
+	"jjr-tec-backend/internal/tracing"
 )
 
 func gracefulShutdown(apiServer *http.Server, done chan bool) {
@@ -20,25 +22,40 @@ func gracefulShutdown(apiServer *http.Server, done chan bool) {
 	// Listen for the interrupt signal.
 	<-ctx.Done()
 
-	log.Println("shutting down gracefully, press Ctrl+C again to force")
+	slog.Info("shutting down gracefully, press Ctrl+C again to force")
 
 	// The context is used to inform the server it has 5 seconds to finish
 	// the request it is currently handling
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := apiServer.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown with error: %v", err)
+		slog.Error("server forced to shutdown", "error", err)
 	}
 
-	log.Println("Server exiting")
+	slog.Info("server exiting")
 
 	// Notify the main goroutine that the shutdown is complete
 	done <- true
 }
 
 func main() {
+	// Structured logging, JSON when APP_ENV is production. Lines of the standard log package go through it too.
+	logger, err := logging.FromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("logging configuration error: %s", err))
+	}
+	slog.SetDefault(logger)
+
+	// Spans of requests and database calls, exported over OTLP when OTEL_TRACES_EXPORTER is otlp
+	shutdownTracing, err := tracing.FromEnv(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("tracing configuration error: %s", err))
+	}
 
-	server := server.NewServer()
+	// The mail worker and the LDAP sync stop once the server shut down
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	server := server.NewServer(background)
 
 	// Create a done channel to signal when the shutdown is complete
 	done := make(chan bool, 1)
@@ -46,12 +63,20 @@ func main() {
 	// Run graceful shutdown in a separate goroutine
 	go gracefulShutdown(server, done)
 
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
 		panic(fmt.Sprintf("http server error: %s", err))
 	}
 
 	// Wait for the graceful shutdown to complete
 	<-done
-	log.Println("Graceful shutdown complete.")
+	stopBackground()
+
+	// Export the spans still buffered
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("flushing traces failed", "error", err)
+	}
+	slog.Info("graceful shutdown complete")
 }
@@ -0,0 +1,71 @@
+// Package auth verifies user credentials for the login handler.
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
+)
+
+// ErrInvalidCredentials is returned when the username is unknown or the password is wrong.
+// Callers must not tell the two apart in their responses.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrUnlinkedAccount is returned when the credentials are valid for a directory entry, but a local user that
+// isn't linked to the entry already has its username. Taking over that account would hand it to whoever the
+// directory names like it, so it has to be renamed or linked explicitly.
+var ErrUnlinkedAccount = errors.New("username belongs to a local account not linked to the directory entry")
+
+// Authenticator verifies a username and password and returns the local user they belong to
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, password string) (*modals.User, error)
+}
+
+// Chain tries each authenticator in order and returns the first success. Only ErrInvalidCredentials moves on
+// to the next authenticator, any other error (like an unreachable directory) is returned right away.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username string, password string) (*modals.User, error) {
+	for _, authenticator := range c {
+		user, err := authenticator.Authenticate(ctx, username, password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			continue
+		}
+		return user, err
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// SyncRoles grants the roles that groupRoles maps the user's groups onto and revokes mapped roles whose groups
+// the user is no longer in. Roles no group maps to are left alone, so locally assigned roles survive a sync.
+func SyncRoles(ctx context.Context, db database.Service, username string, groupRoles map[string]string, groups []string) error {
+	if len(groupRoles) == 0 {
+		return nil
+	}
+	current, err := db.GetRolesByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for group, role := range groupRoles {
+		if !wanted[role] {
+			wanted[role] = slices.Contains(groups, group)
+		}
+	}
+	for role, want := range wanted {
+		has := slices.Contains(current, role)
+		if want && !has {
+			err = db.AssignRoleToUser(ctx, username, role)
+		} else if !want && has {
+			err = db.RemoveRoleFromUser(ctx, username, role)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
+)
+
+// ldapProvider is the provider name LDAP users are linked under in external_identities, their subject is the DN
+const ldapProvider = "ldap"
+
+// defaultRole is assigned to users provisioned on their first directory login
+const defaultRole = "standard"
+
+// LDAPConfig describes the directory to authenticate against
+type LDAPConfig struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds a user entry, %s is replaced by the escaped username
+	UserFilter        string
+	UsernameAttribute string
+	EmailAttribute    string
+	GroupAttribute    string
+	// GroupRoles maps group DNs (values of GroupAttribute) onto local role names
+	GroupRoles   map[string]string
+	SyncInterval time.Duration
+}
+
+// LDAPConfigFromEnv reads the LDAP_* environment variables, it returns nil if LDAP_URL is not set
+func LDAPConfigFromEnv() (*LDAPConfig, error) {
+	if os.Getenv("LDAP_URL") == "" {
+		return nil, nil
+	}
+	config := &LDAPConfig{
+		URL:               os.Getenv("LDAP_URL"),
+		BindDN:            os.Getenv("LDAP_BIND_DN"),
+		BindPassword:      os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:            os.Getenv("LDAP_BASE_DN"),
+		UserFilter:        envOr("LDAP_USER_FILTER", "(&(objectClass=person)(uid=%s))"),
+		UsernameAttribute: envOr("LDAP_USERNAME_ATTRIBUTE", "uid"),
+		EmailAttribute:    envOr("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		GroupAttribute:    envOr("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+	}
+	if roles := os.Getenv("LDAP_GROUP_ROLES"); roles != "" {
+		if err := json.Unmarshal([]byte(roles), &config.GroupRoles); err != nil {
+			return nil, fmt.Errorf("LDAP_GROUP_ROLES: %w", err)
+		}
+	}
+	if interval := os.Getenv("LDAP_SYNC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("LDAP_SYNC_INTERVAL: %w", err)
+		}
+		config.SyncInterval = d
+	}
+	return config, nil
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Conn is the part of *ldap.Conn the LDAP authenticator uses, tests substitute an in-process directory
+type Conn interface {
+	Bind(username string, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAP authenticates users with a bind as their directory entry. Users are provisioned locally on their first
+// login and their mapped group roles are synced on every login and by RunSync.
+type LDAP struct {
+	Config LDAPConfig
+	DB     database.Service
+	Dial   func() (Conn, error)
+}
+
+func NewLDAP(config LDAPConfig, db database.Service) *LDAP {
+	return &LDAP{
+		Config: config,
+		DB:     db,
+		Dial: func() (Conn, error) {
+			return ldap.DialURL(config.URL)
+		},
+	}
+}
+
+// connect dials the directory and binds as the configured service account
+func (l *LDAP) connect() (Conn, error) {
+	conn, err := l.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if l.Config.BindDN != "" {
+		if err := conn.Bind(l.Config.BindDN, l.Config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (l *LDAP) search(conn Conn, filter string) ([]*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(
+		l.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{l.Config.UsernameAttribute, l.Config.EmailAttribute, l.Config.GroupAttribute},
+		nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, username string, password string) (*modals.User, error) {
+	// An empty password would be an unauthenticated bind, which many directories accept
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entries, err := l.search(conn, fmt.Sprintf(l.Config.UserFilter, ldap.EscapeFilter(username)))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	user, err := l.provision(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := SyncRoles(ctx, l.DB, user.Username, l.Config.GroupRoles, entry.GetAttributeValues(l.Config.GroupAttribute)); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// provision returns the local user linked to the directory entry, or creates one without a local password so it
+// can only log in through the directory. Users are only ever found through their link: a local user that
+// merely has the same username is refused with ErrUnlinkedAccount.
+func (l *LDAP) provision(ctx context.Context, entry *ldap.Entry) (*modals.User, error) {
+	user, err := l.DB.GetUserByExternalIdentity(ctx, ldapProvider, entry.DN)
+	if err != nil || user != nil {
+		return user, err
+	}
+
+	username := entry.GetAttributeValue(l.Config.UsernameAttribute)
+	email := entry.GetAttributeValue(l.Config.EmailAttribute)
+	existing, err := l.DB.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		slog.WarnContext(ctx, "directory user matches an unlinked local account", "username", username, "dn", entry.DN)
+		return nil, ErrUnlinkedAccount
+	}
+
+	// The directory is authoritative for its users' addresses
+	user, err = l.DB.ProvisionExternalUser(ctx, username, email, true, []string{defaultRole}, ldapProvider, entry.DN)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "provisioned directory user", "username", username, "dn", entry.DN)
+	return user, nil
+}
+
+// Sync maps the directory groups of every linked user onto their roles. Users whose entry is gone from the
+// directory lose all mapped roles.
+func (l *LDAP) Sync(ctx context.Context) error {
+	conn, err := l.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	entries, err := l.search(conn, fmt.Sprintf(l.Config.UserFilter, "*"))
+	if err != nil {
+		return err
+	}
+	inDirectory := map[string]bool{}
+	for _, entry := range entries {
+		inDirectory[entry.DN] = true
+		user, err := l.DB.GetUserByExternalIdentity(ctx, ldapProvider, entry.DN)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			continue // Never logged in, nothing to sync
+		}
+		if err := SyncRoles(ctx, l.DB, user.Username, l.Config.GroupRoles, entry.GetAttributeValues(l.Config.GroupAttribute)); err != nil {
+			return err
+		}
+	}
+
+	linked, err := l.DB.ListExternalIdentitiesByProvider(ctx, ldapProvider)
+	if err != nil {
+		return err
+	}
+	for _, identity := range linked {
+		if inDirectory[identity.Subject] {
+			continue
+		}
+		user, err := l.DB.GetUserByID(ctx, identity.UserID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			continue // Deleted while the sync ran
+		}
+		if err := SyncRoles(ctx, l.DB, user.Username, l.Config.GroupRoles, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunSync calls Sync every SyncInterval until ctx is done
+func (l *LDAP) RunSync(ctx context.Context) {
+	ticker := time.NewTicker(l.Config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Sync(ctx); err != nil {
+				slog.ErrorContext(ctx, "LDAP group sync failed", "error", err)
+			}
+		}
+	}
+}
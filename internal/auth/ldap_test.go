@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
+)
+
+// directory is an in-process LDAP stand-in holding entries by uid
+type directory struct {
+	passwords map[string]string // DN -> password
+	entries   map[string]*ldap.Entry
+	filter    string
+}
+
+func (d *directory) Bind(username string, password string) error {
+	if pw, ok := d.passwords[username]; ok && pw == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (d *directory) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+	for uid, entry := range d.entries {
+		if request.Filter == fmt.Sprintf(d.filter, "*") || request.Filter == fmt.Sprintf(d.filter, uid) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (d *directory) Close() error { return nil }
+
+func (d *directory) add(uid string, password string, groups ...string) {
+	dn := "uid=" + uid + ",ou=people,dc=example,dc=com"
+	d.passwords[dn] = password
+	d.entries[uid] = ldap.NewEntry(dn, map[string][]string{
+		"uid":      {uid},
+		"mail":     {uid + "@example.com"},
+		"memberOf": groups,
+	})
+}
+
+// usersDB keeps users, roles and identities in memory
+type usersDB struct {
+	database.Service
+
+	users      []modals.User
+	passwords  map[string]string
+	roles      map[string][]string
+	identities []modals.ExternalIdentity
+}
+
+func (f *usersDB) CreateUser(ctx context.Context, username string, email string, password string) error {
+	f.users = append(f.users, modals.User{ID: len(f.users) + 1, Username: username, Email: email})
+	f.passwords[username] = password
+	return nil
+}
+
+func (f *usersDB) ProvisionExternalUser(ctx context.Context, username string, email string, emailVerified bool, roles []string, provider string, subject string) (*modals.User, error) {
+	f.users = append(f.users, modals.User{ID: len(f.users) + 1, Username: username, Email: email, EmailVerified: emailVerified && email != ""})
+	f.roles[username] = append(f.roles[username], roles...)
+	f.identities = append(f.identities, modals.ExternalIdentity{UserID: len(f.users), Provider: provider, Subject: subject, Email: email})
+	return f.GetUserByID(ctx, len(f.users))
+}
+
+// GetPasswordHash returns the password as is, the tests only tell users with and without one apart
+func (f *usersDB) GetPasswordHash(ctx context.Context, username string) (string, error) {
+	return f.passwords[username], nil
+}
+
+func (f *usersDB) GetUserByUsername(ctx context.Context, username string) (*modals.User, error) {
+	for _, user := range f.users {
+		if user.Username == username {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *usersDB) GetUserByID(ctx context.Context, id int) (*modals.User, error) {
+	if id > len(f.users) || f.users[id-1].ID == 0 {
+		return nil, nil
+	}
+	return &f.users[id-1], nil
+}
+
+func (f *usersDB) SetEmailVerified(ctx context.Context, userID int, verified bool) error {
+	f.users[userID-1].EmailVerified = verified
+	return nil
+}
+
+func (f *usersDB) GetRolesByUsername(ctx context.Context, username string) ([]string, error) {
+	return f.roles[username], nil
+}
+
+func (f *usersDB) AssignRoleToUser(ctx context.Context, username string, role_name string) error {
+	f.roles[username] = append(f.roles[username], role_name)
+	return nil
+}
+
+func (f *usersDB) RemoveRoleFromUser(ctx context.Context, username string, role_name string) error {
+	f.roles[username] = slices.DeleteFunc(f.roles[username], func(role string) bool { return role == role_name })
+	return nil
+}
+
+func (f *usersDB) GetUserByExternalIdentity(ctx context.Context, provider string, subject string) (*modals.User, error) {
+	for _, identity := range f.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return f.GetUserByID(ctx, identity.UserID)
+		}
+	}
+	return nil, nil
+}
+
+func (f *usersDB) LinkExternalIdentity(ctx context.Context, userID int, provider string, subject string, email string) error {
+	f.identities = append(f.identities, modals.ExternalIdentity{UserID: userID, Provider: provider, Subject: subject, Email: email})
+	return nil
+}
+
+func (f *usersDB) ListExternalIdentitiesByProvider(ctx context.Context, provider string) ([]modals.ExternalIdentity, error) {
+	return f.identities, nil
+}
+
+func newTestLDAP() (*LDAP, *directory, *usersDB) {
+	dir := &directory{passwords: map[string]string{}, entries: map[string]*ldap.Entry{}, filter: "(&(objectClass=person)(uid=%s))"}
+	dir.passwords["cn=svc,dc=example,dc=com"] = "svc-password"
+	db := &usersDB{passwords: map[string]string{}, roles: map[string][]string{}}
+	l := &LDAP{
+		Config: LDAPConfig{
+			BindDN:            "cn=svc,dc=example,dc=com",
+			BindPassword:      "svc-password",
+			BaseDN:            "dc=example,dc=com",
+			UserFilter:        dir.filter,
+			UsernameAttribute: "uid",
+			EmailAttribute:    "mail",
+			GroupAttribute:    "memberOf",
+			GroupRoles:        map[string]string{"cn=admins,ou=groups,dc=example,dc=com": "admin"},
+		},
+		DB:   db,
+		Dial: func() (Conn, error) { return dir, nil },
+	}
+	return l, dir, db
+}
+
+func TestLDAPAuthenticateProvisionsUser(t *testing.T) {
+	l, dir, db := newTestLDAP()
+	dir.add("carol", "correct horse", "cn=admins,ou=groups,dc=example,dc=com")
+
+	if _, err := l.Authenticate(context.Background(), "carol", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials for a wrong password; got %v", err)
+	}
+	if _, err := l.Authenticate(context.Background(), "carol", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials for an empty password; got %v", err)
+	}
+
+	user, err := l.Authenticate(context.Background(), "carol", "correct horse")
+	if err != nil {
+		t.Fatalf("expected carol to authenticate. Err: %v", err)
+	}
+	if user.Email != "carol@example.com" || !user.EmailVerified {
+		t.Errorf("expected provisioned user to get the verified directory email; got %+v", user)
+	}
+	if roles := db.roles["carol"]; !slices.Equal(roles, []string{"standard", "admin"}) {
+		t.Errorf("expected default and group mapped roles; got %v", roles)
+	}
+	// Without a local password, the directory decides whether carol may log in
+	if _, err := (Local{DB: db}).Authenticate(context.Background(), "carol", "correct horse"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected the provisioned user to have no local password; got %v", err)
+	}
+
+	// A second login reuses the linked user
+	if _, err := l.Authenticate(context.Background(), "carol", "correct horse"); err != nil || len(db.users) != 1 {
+		t.Errorf("expected the linked user to be reused; got %d users, err %v", len(db.users), err)
+	}
+}
+
+func TestLDAPSyncRevokesRolesOfRemovedGroups(t *testing.T) {
+	l, dir, db := newTestLDAP()
+	dir.add("dave", "pw", "cn=admins,ou=groups,dc=example,dc=com")
+	dir.add("erin", "pw", "cn=admins,ou=groups,dc=example,dc=com")
+	l.Authenticate(context.Background(), "dave", "pw")
+	l.Authenticate(context.Background(), "erin", "pw")
+	db.AssignRoleToUser(context.Background(), "dave", "auditor") // assigned locally, not managed by the mapping
+
+	dir.add("dave", "pw") // left the admins group
+	delete(dir.entries, "erin")
+
+	if err := l.Sync(context.Background()); err != nil {
+		t.Fatalf("sync failed. Err: %v", err)
+	}
+	if roles := db.roles["dave"]; !slices.Equal(roles, []string{"standard", "auditor"}) {
+		t.Errorf("expected admin to be revoked from dave; got %v", roles)
+	}
+	if roles := db.roles["erin"]; slices.Contains(roles, "admin") {
+		t.Errorf("expected admin to be revoked from erin, who left the directory; got %v", roles)
+	}
+}
+
+func TestLDAPRefusesUnlinkedLocalUser(t *testing.T) {
+	l, dir, db := newTestLDAP()
+	db.CreateUser(context.Background(), "admin", "root@example.com", "local")
+	db.AssignRoleToUser(context.Background(), "admin", "admin")
+	dir.add("admin", "directory password")
+
+	if _, err := l.Authenticate(context.Background(), "admin", "directory password"); !errors.Is(err, ErrUnlinkedAccount) {
+		t.Fatalf("expected ErrUnlinkedAccount for a local user of the same name; got %v", err)
+	}
+	if len(db.identities) != 0 || len(db.users) != 1 {
+		t.Errorf("expected the local user to stay unlinked; got %d identities, %d users", len(db.identities), len(db.users))
+	}
+
+	// Once linked, the entry logs in as the local user
+	db.LinkExternalIdentity(context.Background(), 1, ldapProvider, "uid=admin,ou=people,dc=example,dc=com", "")
+	if user, err := l.Authenticate(context.Background(), "admin", "directory password"); err != nil || user.ID != 1 {
+		t.Errorf("expected the linked local user; got %+v, err %v", user, err)
+	}
+}
+
+func TestLDAPSyncSkipsDeletedUsers(t *testing.T) {
+	l, dir, db := newTestLDAP()
+	dir.add("frank", "pw")
+	l.Authenticate(context.Background(), "frank", "pw")
+	delete(dir.entries, "frank")
+	db.users[0] = modals.User{} // deleted, the identity row is still listed
+
+	if err := l.Sync(context.Background()); err != nil {
+		t.Errorf("expected the sync to skip the deleted user. Err: %v", err)
+	}
+}
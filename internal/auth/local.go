@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"context"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
+)
+
+// Local checks passwords against the bcrypt hashes in the users table
+type Local struct {
+	DB database.Service
+}
+
+func (l Local) Authenticate(ctx context.Context, username string, password string) (*modals.User, error) {
+	hash, err := l.DB.GetPasswordHash(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" {
+		// Compare against a dummy hash so unknown usernames take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return l.DB.GetUserByUsername(ctx, username)
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
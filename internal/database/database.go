@@ -3,54 +3,108 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"jjr-tec-backend/internal/modals"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"golang.org/x/crypto/bcrypt"
 	_ "github.com/joho/godotenv/autoload"
 )
 
-// CreateUser inserts a new user into Users Table
-func (s *service) CreateUser(username string, email string, password string) error {
+// CreateUser inserts a new user into Users Table, the password is stored as a bcrypt hash.
+// A taken username or email fails with ErrConflict.
+func (s *service) CreateUser(ctx context.Context, username string, email string, password string) (err error) {
+    ctx, span := startSpan(ctx, "CreateUser")
+    defer func() { endSpan(span, err) }()
+
     query := `INSERT INTO users (username, email, password) VALUES ($1, $2, $3)`
 
-    _, err := s.db.Exec(query, username, email, password)
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
     if err != nil {
-        log.Printf("Error inserting user: %v", err)
         return err
     }
+
+    _, err = s.db.ExecContext(ctx, query, username, email, string(hash))
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting user failed", "error", err)
+        return mapError(err)
+    }
     return nil
 }
 
-// CreateRole inserts a new user into Users Table
-func (s *service) CreateRole(role_name string) error {
+// CreateRole inserts a new role into Roles Table, an existing role_name fails with ErrConflict
+func (s *service) CreateRole(ctx context.Context, role_name string) (err error) {
+    ctx, span := startSpan(ctx, "CreateRole")
+    defer func() { endSpan(span, err) }()
+
     query := `INSERT INTO roles (role_name) VALUES ($1)`
 
-    _, err := s.db.Exec(query, role_name)
+    _, err = s.db.ExecContext(ctx, query, role_name)
     if err != nil {
-        log.Printf("Error inserting role: %v", err)
-        return err
+        slog.ErrorContext(ctx, "inserting role failed", "error", err)
+        return mapError(err)
     }
     return nil
 }
 
-func (s *service) GetUserByUsername(username string) (*modals.User, error) {
+// userColumns are the users columns scanUser reads, in its order
+const userColumns = `id, username, COALESCE(email, ''), email_verified, display_name, locale, timezone, status,
+    created_at, updated_at, last_login_at, tokens_valid_after, attributes`
+
+type rowScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+// scanUser reads a row selected with userColumns, it returns nil if the row doesn't exist
+func scanUser(row rowScanner) (*modals.User, error) {
     var user modals.User
-    query := `SELECT id, username, email, created_at FROM users WHERE username = $1`
-    err := s.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
+    var attributes []byte
+    err := row.Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.DisplayName, &user.Locale, &user.Timezone,
+        &user.Status, &user.CreatedAt, &user.UpdatedAt, &user.LastLoginAt, &user.TokensValidAfter, &attributes)
     if err == sql.ErrNoRows {
         return nil, nil // User not found
     } else if err != nil {
         return nil, err
     }
+    if err := json.Unmarshal(attributes, &user.Attributes); err != nil {
+        return nil, err
+    }
     return &user, nil
 }
 
-func (s *service) GetRolesByUsername(username string) ([]string, error) {
+func (s *service) GetUserByUsername(ctx context.Context, username string) (_ *modals.User, err error) {
+    ctx, span := startSpan(ctx, "GetUserByUsername")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
+    return scanUser(s.db.QueryRowContext(ctx, query, username))
+}
+
+// GetPasswordHash returns the bcrypt hash of the user's password, or an empty string if the user doesn't exist
+func (s *service) GetPasswordHash(ctx context.Context, username string) (_ string, err error) {
+    ctx, span := startSpan(ctx, "GetPasswordHash")
+    defer func() { endSpan(span, err) }()
+
+    var hash string
+    query := `SELECT password FROM users WHERE username = $1`
+    err = s.db.QueryRowContext(ctx, query, username).Scan(&hash)
+    if err == sql.ErrNoRows {
+        return "", nil // User not found
+    } else if err != nil {
+        return "", err
+    }
+    return hash, nil
+}
+
+func (s *service) GetRolesByUsername(ctx context.Context, username string) (_ []string, err error) {
+    ctx, span := startSpan(ctx, "GetRolesByUsername")
+    defer func() { endSpan(span, err) }()
+
     var roles []string
     query := `
         SELECT r.role_name
@@ -59,7 +113,7 @@ func (s *service) GetRolesByUsername(username string) ([]string, error) {
         INNER JOIN users u ON u.id = ur.user_id
         WHERE u.username = $1
     `
-    rows, err := s.db.Query(query, username)
+    rows, err := s.db.QueryContext(ctx, query, username)
     if err != nil {
         return nil, err
     }
@@ -82,17 +136,225 @@ func (s *service) GetRolesByUsername(username string) ([]string, error) {
     return roles, nil
 }
 
-func (s *service) AssignRoleToUser(username string, role_name string) error {
+func (s *service) GetUserByID(ctx context.Context, id int) (_ *modals.User, err error) {
+    ctx, span := startSpan(ctx, "GetUserByID")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+    return scanUser(s.db.QueryRowContext(ctx, query, id))
+}
+
+func (s *service) GetUserByEmail(ctx context.Context, email string) (_ *modals.User, err error) {
+    ctx, span := startSpan(ctx, "GetUserByEmail")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT ` + userColumns + ` FROM users WHERE LOWER(email) = LOWER($1) ORDER BY id LIMIT 1`
+    return scanUser(s.db.QueryRowContext(ctx, query, email))
+}
+
+// UpdatePassword stores the bcrypt hash of the new password and rejects all refresh tokens issued before now.
+// The previous hash moves to password_history.
+func (s *service) UpdatePassword(ctx context.Context, userID int, password string) (err error) {
+    ctx, span := startSpan(ctx, "UpdatePassword")
+    defer func() { endSpan(span, err) }()
+
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    now := time.Now()
+    query := `
+        INSERT INTO password_history (user_id, password_hash, created_at)
+        SELECT id, password, $2 FROM users WHERE id = $1
+    `
+    if _, err := tx.ExecContext(ctx, query, userID, now); err != nil {
+        slog.ErrorContext(ctx, "archiving password failed", "error", err)
+        return err
+    }
+
+    query = `UPDATE users SET password = $2, tokens_valid_after = $3 WHERE id = $1`
+    _, err = tx.ExecContext(ctx, query, userID, string(hash), now.Truncate(time.Second))
+    if err != nil {
+        slog.ErrorContext(ctx, "updating password failed", "error", err)
+        return err
+    }
+    return tx.Commit()
+}
+
+// PasswordHistory returns the bcrypt hashes of the user's current password and up to limit-1 previous ones, newest first
+func (s *service) PasswordHistory(ctx context.Context, userID int, limit int) (_ []string, err error) {
+    ctx, span := startSpan(ctx, "PasswordHistory")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        SELECT hash FROM (
+            SELECT password AS hash, NULL::TIMESTAMP AS created_at FROM users WHERE id = $1
+            UNION ALL
+            SELECT password_hash, created_at FROM password_history WHERE user_id = $1
+        ) hashes
+        ORDER BY created_at DESC NULLS FIRST
+        LIMIT $2
+    `
+    rows, err := s.db.QueryContext(ctx, query, userID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var hashes []string
+    for rows.Next() {
+        var hash string
+        if err := rows.Scan(&hash); err != nil {
+            return nil, err
+        }
+        hashes = append(hashes, hash)
+    }
+    return hashes, rows.Err()
+}
+
+// UpdateUserProfile writes the fields users edit themselves: email, email_verified, display_name, locale and timezone.
+// An email address used by another user fails with ErrConflict.
+func (s *service) UpdateUserProfile(ctx context.Context, user *modals.User) (err error) {
+    ctx, span := startSpan(ctx, "UpdateUserProfile")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE users SET email = $2, email_verified = $3, display_name = $4, locale = $5, timezone = $6 WHERE id = $1`
+    _, err = s.db.ExecContext(ctx, query, user.ID, user.Email, user.EmailVerified, user.DisplayName, user.Locale, user.Timezone)
+    if err != nil {
+        slog.ErrorContext(ctx, "updating user profile failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// SetUserStatus changes the status of the user, it returns false if the user doesn't exist
+func (s *service) SetUserStatus(ctx context.Context, userID int, status string) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "SetUserStatus")
+    defer func() { endSpan(span, err) }()
+
+    result, err := s.db.ExecContext(ctx, `UPDATE users SET status = $2 WHERE id = $1`, userID, status)
+    if err != nil {
+        slog.ErrorContext(ctx, "updating user status failed", "error", err)
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// RecordLogin sets last_login_at of the user to now
+func (s *service) RecordLogin(ctx context.Context, userID int) (err error) {
+    ctx, span := startSpan(ctx, "RecordLogin")
+    defer func() { endSpan(span, err) }()
+
+    _, err = s.db.ExecContext(ctx, `UPDATE users SET last_login_at = $2 WHERE id = $1`, userID, time.Now())
+    if err != nil {
+        slog.ErrorContext(ctx, "recording login failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// DeleteUser removes the user, their roles, tokens and linked identities are deleted with them.
+// It returns false if the user didn't exist.
+func (s *service) DeleteUser(ctx context.Context, userID int) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "DeleteUser")
+    defer func() { endSpan(span, err) }()
+
+    result, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+    if err != nil {
+        slog.ErrorContext(ctx, "deleting user failed", "error", err)
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+func (s *service) SetEmailVerified(ctx context.Context, userID int, verified bool) (err error) {
+    ctx, span := startSpan(ctx, "SetEmailVerified")
+    defer func() { endSpan(span, err) }()
+
+    _, err = s.db.ExecContext(ctx, `UPDATE users SET email_verified = $2 WHERE id = $1`, userID, verified)
+    if err != nil {
+        slog.ErrorContext(ctx, "updating email_verified failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// ListRoles returns the names of all roles in alphabetical order
+func (s *service) ListRoles(ctx context.Context) (_ []string, err error) {
+    ctx, span := startSpan(ctx, "ListRoles")
+    defer func() { endSpan(span, err) }()
+
+    rows, err := s.db.QueryContext(ctx, `SELECT role_name FROM roles ORDER BY role_name`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    roles := []string{}
+    for rows.Next() {
+        var role string
+        if err := rows.Scan(&role); err != nil {
+            return nil, err
+        }
+        roles = append(roles, role)
+    }
+    return roles, rows.Err()
+}
+
+// AssignRoleToUser gives the user the role. It fails with ErrNotFound if the user or the role doesn't exist and
+// with ErrConflict if the user already has the role.
+func (s *service) AssignRoleToUser(ctx context.Context, username string, role_name string) (err error) {
+    ctx, span := startSpan(ctx, "AssignRoleToUser")
+    defer func() { endSpan(span, err) }()
+
     query := `
         INSERT INTO user_roles (user_id, role_id)
         SELECT u.id, r.id
         FROM users u, roles r
         WHERE u.username = $1 AND r.role_name = $2
     `
-    _, err := s.db.Exec(query, username, role_name)
+    result, err := s.db.ExecContext(ctx, query, username, role_name)
     if err != nil {
-        log.Printf("Error assigning role: %v", err)
+        slog.ErrorContext(ctx, "assigning role failed", "error", err)
+        return mapError(err)
+    }
+    // The SELECT yields no row unless both exist
+    if n, err := result.RowsAffected(); err != nil {
         return err
+    } else if n == 0 {
+        return fmt.Errorf("user %q or role %q %w", username, role_name, ErrNotFound)
+    }
+    return nil
+}
+
+// RemoveRoleFromUser takes the role from the user, it fails with ErrNotFound if the user doesn't have the role
+func (s *service) RemoveRoleFromUser(ctx context.Context, username string, role_name string) (err error) {
+    ctx, span := startSpan(ctx, "RemoveRoleFromUser")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        DELETE FROM user_roles ur
+        USING users u, roles r
+        WHERE ur.user_id = u.id AND ur.role_id = r.id AND u.username = $1 AND r.role_name = $2
+    `
+    result, err := s.db.ExecContext(ctx, query, username, role_name)
+    if err != nil {
+        slog.ErrorContext(ctx, "removing role failed", "error", err)
+        return err
+    }
+    if n, err := result.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return fmt.Errorf("role %q of user %q %w", role_name, username, ErrNotFound)
     }
     return nil
 }
@@ -102,18 +364,110 @@ type Service interface {
     // The keys and values in the map are service-specific.
     Health() map[string]string
 
+    // Stats returns the statistics of the connection pool, for the metrics endpoint
+    Stats() sql.DBStats
+
     // Close terminates the database connection.
     // It returns an error if the connection cannot be closed.
     Close() error
 
+    // Writes fail with errors wrapping ErrNotFound, ErrConflict or ErrReferenced where the data rather than the
+    // database is at fault, see errors.go
+
     // Creates a User in the Postgres DB, Table Users
-    CreateUser(username string, email string, password string) error
-    GetUserByUsername(username string) (*modals.User, error)
+    CreateUser(ctx context.Context, username string, email string, password string) error
+    GetUserByUsername(ctx context.Context, username string) (*modals.User, error)
+    GetUserByID(ctx context.Context, id int) (*modals.User, error)
+    GetUserByEmail(ctx context.Context, email string) (*modals.User, error)
+    GetPasswordHash(ctx context.Context, username string) (string, error)
+    SetEmailVerified(ctx context.Context, userID int, verified bool) error
+    UpdatePassword(ctx context.Context, userID int, password string) error
+    PasswordHistory(ctx context.Context, userID int, limit int) ([]string, error)
+    UpdateUserProfile(ctx context.Context, user *modals.User) error
+    DeleteUser(ctx context.Context, userID int) (bool, error)
+    SetUserStatus(ctx context.Context, userID int, status string) (bool, error)
+    RecordLogin(ctx context.Context, userID int) error
+
+    // Custom user attributes, column users.attributes and Table user_attribute_schema
+    UpdateUserAttributes(ctx context.Context, userID int, attributes map[string]interface{}) error
+    ListUsers(ctx context.Context, filter modals.UserFilter) ([]modals.User, error)
+    GetAttributeSchema(ctx context.Context) (*modals.AttributeSchema, error)
+    SaveAttributeSchema(ctx context.Context, schema *modals.AttributeSchema) error
 
     // Creates a Role in Postgres DB, Table Roles
-    CreateRole(role_name string) error
-    GetRolesByUsername(username string) ([]string, error)
-    AssignRoleToUser(username string, role_name string) error
+    CreateRole(ctx context.Context, role_name string) error
+    ListRoles(ctx context.Context) ([]string, error)
+    GetRolesByUsername(ctx context.Context, username string) ([]string, error)
+    AssignRoleToUser(ctx context.Context, username string, role_name string) error
+    RemoveRoleFromUser(ctx context.Context, username string, role_name string) error
+
+    // OAuth 2.0 / OpenID Connect provider, Tables oauth_clients, oauth_consents and oauth_authorization_codes
+    CreateOAuthClient(ctx context.Context, client *modals.OAuthClient) error
+    GetOAuthClient(ctx context.Context, clientID string) (*modals.OAuthClient, error)
+    ListOAuthClients(ctx context.Context) ([]modals.OAuthClient, error)
+    GetOAuthConsent(ctx context.Context, userID int, clientID string) (string, error)
+    SaveOAuthConsent(ctx context.Context, userID int, clientID string, scope string) error
+    CreateAuthorizationCode(ctx context.Context, code *modals.AuthorizationCode) error
+    ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*modals.AuthorizationCode, error)
+
+    // Service accounts for the client_credentials grant, Tables service_accounts and service_account_roles
+    CreateServiceAccount(ctx context.Context, account *modals.ServiceAccount) error
+    GetServiceAccountByClientID(ctx context.Context, clientID string) (*modals.ServiceAccount, error)
+    ListServiceAccounts(ctx context.Context) ([]modals.ServiceAccount, error)
+    DeleteServiceAccount(ctx context.Context, clientID string) (bool, error)
+
+    // Personal access tokens, Table personal_access_tokens
+    CreatePersonalAccessToken(ctx context.Context, token *modals.PersonalAccessToken) error
+    ListPersonalAccessTokens(ctx context.Context, userID int) ([]modals.PersonalAccessToken, error)
+    GetPersonalAccessTokenByHash(ctx context.Context, tokenHash string) (*modals.PersonalAccessToken, error)
+    RevokePersonalAccessToken(ctx context.Context, userID int, id int) (bool, error)
+    TouchPersonalAccessToken(ctx context.Context, id int) error
+
+    // Identities at upstream OIDC providers, Table external_identities
+    GetUserByExternalIdentity(ctx context.Context, provider string, subject string) (*modals.User, error)
+    LinkExternalIdentity(ctx context.Context, userID int, provider string, subject string, email string) error
+    ProvisionExternalUser(ctx context.Context, username string, email string, emailVerified bool, roles []string, provider string, subject string) (*modals.User, error)
+    ListExternalIdentities(ctx context.Context, userID int) ([]modals.ExternalIdentity, error)
+    UnlinkExternalIdentity(ctx context.Context, userID int, provider string) (bool, error)
+    ListExternalIdentitiesByProvider(ctx context.Context, provider string) ([]modals.ExternalIdentity, error)
+
+    // Single-use tokens mailed to users, Table user_tokens
+    CreateUserToken(ctx context.Context, token *modals.UserToken) error
+    ConsumeUserToken(ctx context.Context, purpose string, tokenHash string) (*modals.UserToken, error)
+    GetUserToken(ctx context.Context, purpose string, tokenHash string) (*modals.UserToken, error)
+    LatestUserToken(ctx context.Context, userID int, purpose string) (*modals.UserToken, error)
+    RevokeUserTokens(ctx context.Context, userID int, purpose string) error
+
+    // Logins and the refresh tokens issued with them, Table sessions
+    CreateSession(ctx context.Context, session *modals.Session) error
+    GetSession(ctx context.Context, id int) (*modals.Session, error)
+    ListSessions(ctx context.Context, userID int) ([]modals.Session, error)
+    TouchSession(ctx context.Context, id int, ip string, userAgent string) error
+    RevokeSession(ctx context.Context, userID int, id int) (bool, error)
+    RevokeUserSessions(ctx context.Context, userID int, exceptID int) error
+
+    // Invitations of new users by admins, Table invitations
+    CreateInvitation(ctx context.Context, invitation *modals.Invitation) error
+    GetInvitation(ctx context.Context, id int) (*modals.Invitation, error)
+    GetInvitationByTokenHash(ctx context.Context, tokenHash string) (*modals.Invitation, error)
+    ListInvitations(ctx context.Context) ([]modals.Invitation, error)
+    RenewInvitation(ctx context.Context, id int, tokenHash string, sentAt time.Time, expiresAt time.Time) (bool, error)
+    RevokeInvitation(ctx context.Context, id int) (bool, error)
+    AcceptInvitation(ctx context.Context, id int, username string, password string) (*modals.User, error)
+
+    // Login history and suspicious logins, Tables login_attempts and security_events
+    RecordLoginAttempt(ctx context.Context, attempt *modals.LoginAttempt) error
+    ListLoginAttempts(ctx context.Context, userID int, onlySuccessful bool, limit int) ([]modals.LoginAttempt, error)
+    CreateSecurityEvent(ctx context.Context, event *modals.SecurityEvent) error
+    ListSecurityEvents(ctx context.Context, userID int, limit int) ([]modals.SecurityEvent, error)
+
+    // Mails waiting for delivery, Table mail_outbox
+    EnqueueMail(ctx context.Context, mail *modals.OutboxMail) error
+    ClaimOutboxMails(ctx context.Context, limit int, leaseUntil time.Time) ([]modals.OutboxMail, error)
+    MarkOutboxMailSent(ctx context.Context, id int) error
+    RetryOutboxMail(ctx context.Context, id int, lastError string, nextAttemptAt time.Time) error
+    DeadLetterOutboxMail(ctx context.Context, id int, lastError string) error
+    PurgeDeadOutboxMails(ctx context.Context, createdBefore time.Time) (int64, error)
 }
 
 type service struct {
@@ -138,7 +492,8 @@ func New() Service {
     connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s", username, password, host, port, database, schema)
     db, err := sql.Open("pgx", connStr)
     if err != nil {
-        log.Fatal(err)
+        slog.Error("opening database failed", "error", err)
+        os.Exit(1)
     }
     dbInstance = &service{
         db: db,
@@ -159,7 +514,7 @@ func (s *service) Health() map[string]string {
     if err != nil {
         stats["status"] = "down"
         stats["error"] = fmt.Sprintf("db down: %v", err)
-        log.Fatalf("db down: %v", err) // Log the error and terminate the program
+        slog.ErrorContext(ctx, "database is down", "error", err) // Keep serving, /health reports the outage
         return stats
     }
 
@@ -197,11 +552,15 @@ func (s *service) Health() map[string]string {
     return stats
 }
 
+func (s *service) Stats() sql.DBStats {
+    return s.db.Stats()
+}
+
 // Close closes the database connection.
 // It logs a message indicating the disconnection from the specific database.
 // If the connection is successfully closed, it returns nil.
 // If an error occurs while closing the connection, it returns the error.
 func (s *service) Close() error {
-    log.Printf("Disconnected from database: %s", database)
+    slog.Info("disconnected from database", "database", database)
     return s.db.Close()
 }
\ No newline at end of file
@@ -2,7 +2,14 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -53,11 +60,37 @@ func mustStartPostgresContainer() (func(context.Context) error, error) {
 	return dbContainer.Terminate, err
 }
 
+// migrateUp runs the up migrations in the order of their version numbers, like the migrate service does
+func migrateUp(s *service) error {
+	files, err := filepath.Glob("../../migrations/*.up.sql")
+	if err != nil {
+		return err
+	}
+	version := func(file string) int {
+		n, _ := strconv.Atoi(strings.SplitN(filepath.Base(file), "_", 2)[0])
+		return n
+	}
+	slices.SortFunc(files, func(a, b string) int { return version(a) - version(b) })
+	for _, file := range files {
+		migration, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(string(migration)); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+	}
+	return nil
+}
+
 func TestMain(m *testing.M) {
 	teardown, err := mustStartPostgresContainer()
 	if err != nil {
 		log.Fatalf("could not start postgres container: %v", err)
 	}
+	if err := migrateUp(New().(*service)); err != nil {
+		log.Fatalf("could not migrate the database: %v", err)
+	}
 
 	m.Run()
 
@@ -98,3 +131,40 @@ func TestClose(t *testing.T) {
 		t.Fatalf("expected Close() to return nil")
 	}
 }
+
+func TestCreateUserConflict(t *testing.T) {
+	srv := New()
+	ctx := context.Background()
+
+	if err := srv.CreateUser(ctx, "conflict", "conflict@example.com", "password"); err != nil {
+		t.Fatalf("expected the first user to be created. Err: %v", err)
+	}
+	if err := srv.CreateUser(ctx, "conflict", "other@example.com", "password"); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict for a taken username; got %v", err)
+	}
+}
+
+func TestAssignRoleToUserNotFound(t *testing.T) {
+	srv := New()
+	ctx := context.Background()
+
+	if err := srv.CreateUser(ctx, "assignee", "assignee@example.com", "password"); err != nil {
+		t.Fatalf("expected the user to be created. Err: %v", err)
+	}
+	if err := srv.AssignRoleToUser(ctx, "nobody", "standard"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown user; got %v", err)
+	}
+	if err := srv.AssignRoleToUser(ctx, "assignee", "ghost"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown role; got %v", err)
+	}
+}
+
+func TestForeignKeyViolation(t *testing.T) {
+	srv := New()
+	ctx := context.Background()
+
+	err := srv.LinkExternalIdentity(ctx, 1<<30, "corp", "missing-user", "")
+	if !errors.Is(err, ErrMissingReference) || !errors.Is(err, ErrReferenced) {
+		t.Errorf("expected ErrMissingReference for a link to a missing user; got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Errors the Service returns wrapped, so callers can tell them apart with errors.Is
+var (
+    // ErrNotFound means a row the call needs, like the user or role of an assignment, doesn't exist
+    ErrNotFound = errors.New("does not exist")
+    // ErrConflict means a unique constraint was violated, like a taken username
+    ErrConflict = errors.New("already exists")
+    // ErrReferenced means a foreign key was violated, the row refers to a missing one or is still referred to
+    ErrReferenced = errors.New("violates a reference")
+    // ErrMissingReference is the ErrReferenced of an insert or update that refers to a missing row, errors.Is
+    // matches both. Deletes of rows that are still referred to fail with ErrReferenced only.
+    ErrMissingReference = errors.New("refers to a missing row")
+)
+
+// PostgreSQL error codes mapError translates, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+    uniqueViolation     = "23505"
+    foreignKeyViolation = "23503"
+)
+
+// mapError wraps constraint violations in ErrConflict, ErrMissingReference or ErrReferenced, keeping the driver
+// error for logging. Other errors are returned as they are.
+func mapError(err error) error {
+    var pgErr *pgconn.PgError
+    if !errors.As(err, &pgErr) {
+        return err
+    }
+    switch pgErr.Code {
+    case uniqueViolation:
+        return fmt.Errorf("%w: %w", ErrConflict, err)
+    case foreignKeyViolation:
+        // Both directions share the code, only the message tells the write from the delete
+        if strings.HasPrefix(pgErr.Message, "insert or update") {
+            return fmt.Errorf("%w: %w: %w", ErrMissingReference, ErrReferenced, err)
+        }
+        return fmt.Errorf("%w: %w", ErrReferenced, err)
+    }
+    return err
+}
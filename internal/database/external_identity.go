@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+)
+
+// GetUserByExternalIdentity returns the user linked to the subject at the provider, or nil if there is none
+func (s *service) GetUserByExternalIdentity(ctx context.Context, provider string, subject string) (_ *modals.User, err error) {
+    ctx, span := startSpan(ctx, "GetUserByExternalIdentity")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        SELECT ` + userColumns + ` FROM users
+        WHERE id = (SELECT user_id FROM external_identities WHERE provider = $1 AND subject = $2)
+    `
+    return scanUser(s.db.QueryRowContext(ctx, query, provider, subject))
+}
+
+func (s *service) LinkExternalIdentity(ctx context.Context, userID int, provider string, subject string, email string) (err error) {
+    ctx, span := startSpan(ctx, "LinkExternalIdentity")
+    defer func() { endSpan(span, err) }()
+
+    query := `INSERT INTO external_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, NULLIF($4, ''))`
+
+    _, err = s.db.ExecContext(ctx, query, userID, provider, subject, email)
+    if err != nil {
+        slog.ErrorContext(ctx, "linking external identity failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// ProvisionExternalUser creates the local user for an external identity on its first login, with the roles and the
+// link to the identity, all in one transaction. The user has no password, it signs in through the identity only.
+// A taken username or email address fails with ErrConflict, a role that doesn't exist with ErrNotFound.
+func (s *service) ProvisionExternalUser(ctx context.Context, username string, email string, emailVerified bool, roles []string, provider string, subject string) (_ *modals.User, err error) {
+    ctx, span := startSpan(ctx, "ProvisionExternalUser")
+    defer func() { endSpan(span, err) }()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    var userID int
+    err = tx.QueryRowContext(ctx, `
+        INSERT INTO users (username, email, password, email_verified) VALUES ($1, $2, '', $3)
+        RETURNING id
+    `, username, email, emailVerified && email != "").Scan(&userID)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting provisioned user failed", "error", err)
+        return nil, mapError(err)
+    }
+
+    for _, role := range roles {
+        result, err := tx.ExecContext(ctx, `INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE role_name = $2`, userID, role)
+        if err != nil {
+            slog.ErrorContext(ctx, "assigning role to provisioned user failed", "error", err)
+            return nil, mapError(err)
+        }
+        if n, err := result.RowsAffected(); err != nil {
+            return nil, err
+        } else if n == 0 {
+            return nil, fmt.Errorf("role %q %w", role, ErrNotFound)
+        }
+    }
+
+    _, err = tx.ExecContext(ctx, `INSERT INTO external_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, NULLIF($4, ''))`,
+        userID, provider, subject, email)
+    if err != nil {
+        slog.ErrorContext(ctx, "linking external identity failed", "error", err)
+        return nil, mapError(err)
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return s.GetUserByID(ctx, userID)
+}
+
+func (s *service) ListExternalIdentities(ctx context.Context, userID int) (_ []modals.ExternalIdentity, err error) {
+    ctx, span := startSpan(ctx, "ListExternalIdentities")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT id, user_id, provider, subject, COALESCE(email, ''), created_at FROM external_identities WHERE user_id = $1 ORDER BY id`
+    return s.queryExternalIdentities(ctx, query, userID)
+}
+
+// ListExternalIdentitiesByProvider returns every identity linked at the provider, for syncing them with it
+func (s *service) ListExternalIdentitiesByProvider(ctx context.Context, provider string) (_ []modals.ExternalIdentity, err error) {
+    ctx, span := startSpan(ctx, "ListExternalIdentitiesByProvider")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT id, user_id, provider, subject, COALESCE(email, ''), created_at FROM external_identities WHERE provider = $1 ORDER BY id`
+    return s.queryExternalIdentities(ctx, query, provider)
+}
+
+func (s *service) queryExternalIdentities(ctx context.Context, query string, args ...interface{}) ([]modals.ExternalIdentity, error) {
+    var identities []modals.ExternalIdentity
+    rows, err := s.db.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var identity modals.ExternalIdentity
+        if err := rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt); err != nil {
+            return nil, err
+        }
+        identities = append(identities, identity)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return identities, nil
+}
+
+// UnlinkExternalIdentity removes the user's link to the provider, it returns false if there was none
+func (s *service) UnlinkExternalIdentity(ctx context.Context, userID int, provider string) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "UnlinkExternalIdentity")
+    defer func() { endSpan(span, err) }()
+
+    result, err := s.db.ExecContext(ctx, `DELETE FROM external_identities WHERE user_id = $1 AND provider = $2`, userID, provider)
+    if err != nil {
+        slog.ErrorContext(ctx, "unlinking external identity failed", "error", err)
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const invitationColumns = `i.id, i.email, i.roles, i.token_hash, COALESCE(i.invited_by, 0), COALESCE(u.username, ''),
+    i.created_at, i.sent_at, i.expires_at, i.accepted_at, i.user_id, i.revoked_at`
+
+func scanInvitation(row rowScanner) (*modals.Invitation, error) {
+    var invitation modals.Invitation
+    var roles string
+    var userID sql.NullInt64
+    err := row.Scan(&invitation.ID, &invitation.Email, &roles, &invitation.TokenHash, &invitation.InvitedBy,
+        &invitation.InvitedByUsername, &invitation.CreatedAt, &invitation.SentAt, &invitation.ExpiresAt,
+        &invitation.AcceptedAt, &userID, &invitation.RevokedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    invitation.Roles = strings.Fields(roles)
+    if userID.Valid {
+        id := int(userID.Int64)
+        invitation.UserID = &id
+    }
+    return &invitation, nil
+}
+
+// CreateInvitation inserts the invitation, it fails with ErrNotFound if one of its roles doesn't exist
+func (s *service) CreateInvitation(ctx context.Context, invitation *modals.Invitation) (err error) {
+    ctx, span := startSpan(ctx, "CreateInvitation")
+    defer func() { endSpan(span, err) }()
+
+    for _, role := range invitation.Roles {
+        var exists bool
+        if err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE role_name = $1)`, role).Scan(&exists); err != nil {
+            return err
+        }
+        if !exists {
+            return fmt.Errorf("role %q %w", role, ErrNotFound)
+        }
+    }
+
+    var invitedBy sql.NullInt64
+    if invitation.InvitedBy != 0 {
+        invitedBy = sql.NullInt64{Int64: int64(invitation.InvitedBy), Valid: true}
+    }
+    query := `
+        INSERT INTO invitations (email, roles, token_hash, invited_by, created_at, sent_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id
+    `
+    err = s.db.QueryRowContext(ctx, query, invitation.Email, strings.Join(invitation.Roles, " "), invitation.TokenHash, invitedBy,
+        invitation.CreatedAt, invitation.SentAt, invitation.ExpiresAt).Scan(&invitation.ID)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting invitation failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// GetInvitation returns the invitation whatever its state, or nil if it doesn't exist
+func (s *service) GetInvitation(ctx context.Context, id int) (_ *modals.Invitation, err error) {
+    ctx, span := startSpan(ctx, "GetInvitation")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT ` + invitationColumns + ` FROM invitations i LEFT JOIN users u ON u.id = i.invited_by WHERE i.id = $1`
+    return scanInvitation(s.db.QueryRowContext(ctx, query, id))
+}
+
+// GetInvitationByTokenHash returns the invitation the token was mailed for whatever its state, or nil
+func (s *service) GetInvitationByTokenHash(ctx context.Context, tokenHash string) (_ *modals.Invitation, err error) {
+    ctx, span := startSpan(ctx, "GetInvitationByTokenHash")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT ` + invitationColumns + ` FROM invitations i LEFT JOIN users u ON u.id = i.invited_by WHERE i.token_hash = $1`
+    return scanInvitation(s.db.QueryRowContext(ctx, query, tokenHash))
+}
+
+// ListInvitations returns all invitations, newest first
+func (s *service) ListInvitations(ctx context.Context) (_ []modals.Invitation, err error) {
+    ctx, span := startSpan(ctx, "ListInvitations")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT ` + invitationColumns + ` FROM invitations i LEFT JOIN users u ON u.id = i.invited_by ORDER BY i.created_at DESC`
+    rows, err := s.db.QueryContext(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var invitations []modals.Invitation
+    for rows.Next() {
+        invitation, err := scanInvitation(rows)
+        if err != nil {
+            return nil, err
+        }
+        invitations = append(invitations, *invitation)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return invitations, nil
+}
+
+// RenewInvitation replaces the token of an invitation that is neither accepted nor revoked, which invalidates
+// the link mailed before. It returns false if there was no such invitation.
+func (s *service) RenewInvitation(ctx context.Context, id int, tokenHash string, sentAt time.Time, expiresAt time.Time) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "RenewInvitation")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        UPDATE invitations SET token_hash = $2, sent_at = $3, expires_at = $4
+        WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+    `
+    result, err := s.db.ExecContext(ctx, query, id, tokenHash, sentAt, expiresAt)
+    if err != nil {
+        slog.ErrorContext(ctx, "renewing invitation failed", "error", err)
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// RevokeInvitation makes the link of an open invitation stop working, it returns false if there was no such invitation
+func (s *service) RevokeInvitation(ctx context.Context, id int) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "RevokeInvitation")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE invitations SET revoked_at = $2 WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL`
+    result, err := s.db.ExecContext(ctx, query, id, time.Now())
+    if err != nil {
+        slog.ErrorContext(ctx, "revoking invitation failed", "error", err)
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// AcceptInvitation creates the user with the invited, already verified email address and the preassigned roles,
+// and marks the invitation accepted, all in one transaction. It returns nil if the invitation is no longer open,
+// fails with ErrConflict if the username or the email address is taken and with ErrNotFound if one of the roles
+// was deleted since.
+func (s *service) AcceptInvitation(ctx context.Context, id int, username string, password string) (_ *modals.User, err error) {
+    ctx, span := startSpan(ctx, "AcceptInvitation")
+    defer func() { endSpan(span, err) }()
+
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return nil, err
+    }
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    var email, roles string
+    now := time.Now()
+    err = tx.QueryRowContext(ctx, `
+        SELECT email, roles FROM invitations
+        WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > $2
+        FOR UPDATE
+    `, id, now).Scan(&email, &roles)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    var userID int
+    err = tx.QueryRowContext(ctx, `
+        INSERT INTO users (username, email, password, email_verified) VALUES ($1, $2, $3, TRUE)
+        RETURNING id
+    `, username, email, string(hash)).Scan(&userID)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting invited user failed", "error", err)
+        return nil, mapError(err)
+    }
+
+    for _, role := range strings.Fields(roles) {
+        result, err := tx.ExecContext(ctx, `INSERT INTO user_roles (user_id, role_id) SELECT $1, id FROM roles WHERE role_name = $2`, userID, role)
+        if err != nil {
+            slog.ErrorContext(ctx, "assigning role to invited user failed", "error", err)
+            return nil, mapError(err)
+        }
+        if n, err := result.RowsAffected(); err != nil {
+            return nil, err
+        } else if n == 0 {
+            return nil, fmt.Errorf("role %q %w", role, ErrNotFound)
+        }
+    }
+
+    _, err = tx.ExecContext(ctx, `UPDATE invitations SET accepted_at = $2, user_id = $3 WHERE id = $1`, id, now, userID)
+    if err != nil {
+        slog.ErrorContext(ctx, "accepting invitation failed", "error", err)
+        return nil, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return s.GetUserByID(ctx, userID)
+}
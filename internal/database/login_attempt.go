@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+)
+
+func (s *service) RecordLoginAttempt(ctx context.Context, attempt *modals.LoginAttempt) (err error) {
+    ctx, span := startSpan(ctx, "RecordLoginAttempt")
+    defer func() { endSpan(span, err) }()
+
+    var userID sql.NullInt64
+    if attempt.UserID != 0 {
+        userID = sql.NullInt64{Int64: int64(attempt.UserID), Valid: true}
+    }
+    query := `
+        INSERT INTO login_attempts (user_id, username, method, success, reason, ip, user_agent, device, country, city, latitude, longitude, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        RETURNING id
+    `
+    err = s.db.QueryRowContext(ctx, query, userID, attempt.Username, attempt.Method, attempt.Success, attempt.Reason, attempt.IP,
+        attempt.UserAgent, attempt.Device, attempt.Country, attempt.City, attempt.Latitude, attempt.Longitude, attempt.CreatedAt).
+        Scan(&attempt.ID)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting login attempt failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// ListLoginAttempts returns the newest login attempts of the user, onlySuccessful leaves out failed ones
+func (s *service) ListLoginAttempts(ctx context.Context, userID int, onlySuccessful bool, limit int) (_ []modals.LoginAttempt, err error) {
+    ctx, span := startSpan(ctx, "ListLoginAttempts")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        SELECT id, user_id, username, method, success, reason, ip, user_agent, device, country, city, latitude, longitude, created_at
+        FROM login_attempts
+        WHERE user_id = $1 AND (success OR NOT $2)
+        ORDER BY created_at DESC
+        LIMIT $3
+    `
+    rows, err := s.db.QueryContext(ctx, query, userID, onlySuccessful, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var attempts []modals.LoginAttempt
+    for rows.Next() {
+        var attempt modals.LoginAttempt
+        err := rows.Scan(&attempt.ID, &attempt.UserID, &attempt.Username, &attempt.Method, &attempt.Success, &attempt.Reason,
+            &attempt.IP, &attempt.UserAgent, &attempt.Device, &attempt.Country, &attempt.City, &attempt.Latitude,
+            &attempt.Longitude, &attempt.CreatedAt)
+        if err != nil {
+            return nil, err
+        }
+        attempts = append(attempts, attempt)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return attempts, nil
+}
+
+func (s *service) CreateSecurityEvent(ctx context.Context, event *modals.SecurityEvent) (err error) {
+    ctx, span := startSpan(ctx, "CreateSecurityEvent")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO security_events (user_id, login_attempt_id, kind, detail, action, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id
+    `
+    err = s.db.QueryRowContext(ctx, query, event.UserID, event.LoginAttemptID, event.Kind, event.Detail, event.Action, event.CreatedAt).
+        Scan(&event.ID)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting security event failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// ListSecurityEvents returns the newest security events of the user
+func (s *service) ListSecurityEvents(ctx context.Context, userID int, limit int) (_ []modals.SecurityEvent, err error) {
+    ctx, span := startSpan(ctx, "ListSecurityEvents")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        SELECT id, user_id, login_attempt_id, kind, detail, action, created_at
+        FROM security_events
+        WHERE user_id = $1
+        ORDER BY created_at DESC
+        LIMIT $2
+    `
+    rows, err := s.db.QueryContext(ctx, query, userID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var events []modals.SecurityEvent
+    for rows.Next() {
+        var event modals.SecurityEvent
+        if err := rows.Scan(&event.ID, &event.UserID, &event.LoginAttemptID, &event.Kind, &event.Detail, &event.Action, &event.CreatedAt); err != nil {
+            return nil, err
+        }
+        events = append(events, event)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return events, nil
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// CreateOAuthClient inserts a new client into the oauth_clients Table, SecretHash is left empty for public clients
+func (s *service) CreateOAuthClient(ctx context.Context, client *modals.OAuthClient) (err error) {
+    ctx, span := startSpan(ctx, "CreateOAuthClient")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO oauth_clients (client_id, client_secret_hash, name, client_type, redirect_uris)
+        VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+        RETURNING id, created_at
+    `
+    err = s.db.QueryRowContext(ctx, query, client.ClientID, client.SecretHash, client.Name, client.Type, strings.Join(client.RedirectURIs, " ")).
+        Scan(&client.ID, &client.CreatedAt)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting oauth client failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+func (s *service) GetOAuthClient(ctx context.Context, clientID string) (_ *modals.OAuthClient, err error) {
+    ctx, span := startSpan(ctx, "GetOAuthClient")
+    defer func() { endSpan(span, err) }()
+
+    var client modals.OAuthClient
+    var secretHash sql.NullString
+    var redirectURIs string
+    query := `SELECT id, client_id, client_secret_hash, name, client_type, redirect_uris, created_at FROM oauth_clients WHERE client_id = $1`
+    err = s.db.QueryRowContext(ctx, query, clientID).
+        Scan(&client.ID, &client.ClientID, &secretHash, &client.Name, &client.Type, &redirectURIs, &client.CreatedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil // Client not found
+    } else if err != nil {
+        return nil, err
+    }
+    client.SecretHash = secretHash.String
+    client.RedirectURIs = strings.Fields(redirectURIs)
+    return &client, nil
+}
+
+func (s *service) ListOAuthClients(ctx context.Context) (_ []modals.OAuthClient, err error) {
+    ctx, span := startSpan(ctx, "ListOAuthClients")
+    defer func() { endSpan(span, err) }()
+
+    var clients []modals.OAuthClient
+    query := `SELECT id, client_id, name, client_type, redirect_uris, created_at FROM oauth_clients ORDER BY id`
+    rows, err := s.db.QueryContext(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var client modals.OAuthClient
+        var redirectURIs string
+        if err := rows.Scan(&client.ID, &client.ClientID, &client.Name, &client.Type, &redirectURIs, &client.CreatedAt); err != nil {
+            return nil, err
+        }
+        client.RedirectURIs = strings.Fields(redirectURIs)
+        clients = append(clients, client)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return clients, nil
+}
+
+// GetOAuthConsent returns the scope the user already granted to the client, or an empty string if there is none
+func (s *service) GetOAuthConsent(ctx context.Context, userID int, clientID string) (_ string, err error) {
+    ctx, span := startSpan(ctx, "GetOAuthConsent")
+    defer func() { endSpan(span, err) }()
+
+    var scope string
+    query := `SELECT scope FROM oauth_consents WHERE user_id = $1 AND client_id = $2`
+    err = s.db.QueryRowContext(ctx, query, userID, clientID).Scan(&scope)
+    if err == sql.ErrNoRows {
+        return "", nil
+    } else if err != nil {
+        return "", err
+    }
+    return scope, nil
+}
+
+// SaveOAuthConsent stores or replaces the scope the user granted to the client
+func (s *service) SaveOAuthConsent(ctx context.Context, userID int, clientID string, scope string) (err error) {
+    ctx, span := startSpan(ctx, "SaveOAuthConsent")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO oauth_consents (user_id, client_id, scope) VALUES ($1, $2, $3)
+        ON CONFLICT (user_id, client_id) DO UPDATE SET scope = EXCLUDED.scope, created_at = CURRENT_TIMESTAMP
+    `
+    _, err = s.db.ExecContext(ctx, query, userID, clientID, scope)
+    if err != nil {
+        slog.ErrorContext(ctx, "saving oauth consent failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+func (s *service) CreateAuthorizationCode(ctx context.Context, code *modals.AuthorizationCode) (err error) {
+    ctx, span := startSpan(ctx, "CreateAuthorizationCode")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO oauth_authorization_codes
+            (code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, code_challenge_method, auth_time, expires_at)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), $9, $10)
+    `
+    _, err = s.db.ExecContext(ctx, query, code.CodeHash, code.ClientID, code.UserID, code.RedirectURI, code.Scope,
+        code.Nonce, code.CodeChallenge, code.CodeChallengeMethod, code.AuthTime, code.ExpiresAt)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting authorization code failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// ConsumeAuthorizationCode marks the code as used and returns it. A code can only be consumed once,
+// unknown, already used or expired codes return nil.
+func (s *service) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (_ *modals.AuthorizationCode, err error) {
+    ctx, span := startSpan(ctx, "ConsumeAuthorizationCode")
+    defer func() { endSpan(span, err) }()
+
+    var code modals.AuthorizationCode
+    var nonce, challenge, method sql.NullString
+    query := `
+        UPDATE oauth_authorization_codes SET used_at = $2
+        WHERE code_hash = $1 AND used_at IS NULL
+        RETURNING code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, code_challenge_method, auth_time, expires_at
+    `
+    now := time.Now()
+    err = s.db.QueryRowContext(ctx, query, codeHash, now).Scan(&code.CodeHash, &code.ClientID, &code.UserID, &code.RedirectURI,
+        &code.Scope, &nonce, &challenge, &method, &code.AuthTime, &code.ExpiresAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    if now.After(code.ExpiresAt) {
+        return nil, nil
+    }
+    code.Nonce = nonce.String
+    code.CodeChallenge = challenge.String
+    code.CodeChallengeMethod = method.String
+    return &code, nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"time"
+)
+
+// EnqueueMail inserts a pending mail into the mail_outbox Table, it is due right away
+func (s *service) EnqueueMail(ctx context.Context, mail *modals.OutboxMail) (err error) {
+    ctx, span := startSpan(ctx, "EnqueueMail")
+    defer func() { endSpan(span, err) }()
+
+    now := time.Now()
+    query := `
+        INSERT INTO mail_outbox (recipient, subject, text_body, html_body, status, created_at, next_attempt_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $6)
+        RETURNING id
+    `
+    err = s.db.QueryRowContext(ctx, query, mail.Recipient, mail.Subject, mail.TextBody, mail.HTMLBody, modals.OutboxMailPending, now).Scan(&mail.ID)
+    if err != nil {
+        slog.ErrorContext(ctx, "enqueueing mail failed", "error", err)
+        return err
+    }
+    mail.Status = modals.OutboxMailPending
+    mail.CreatedAt = now
+    mail.NextAttemptAt = now
+    return nil
+}
+
+// ClaimOutboxMails returns up to limit due mails and moves their next attempt to leaseUntil, so other workers
+// skip them while they are being sent. A worker that dies mid-send leaves them to be retried after the lease.
+func (s *service) ClaimOutboxMails(ctx context.Context, limit int, leaseUntil time.Time) (_ []modals.OutboxMail, err error) {
+    ctx, span := startSpan(ctx, "ClaimOutboxMails")
+    defer func() { endSpan(span, err) }()
+
+    var mails []modals.OutboxMail
+    query := `
+        UPDATE mail_outbox SET next_attempt_at = $3
+        WHERE id IN (
+            SELECT id FROM mail_outbox
+            WHERE status = $1 AND next_attempt_at <= $2
+            ORDER BY next_attempt_at
+            LIMIT $4
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, recipient, subject, text_body, html_body, status, attempts, last_error, created_at, next_attempt_at, sent_at
+    `
+    rows, err := s.db.QueryContext(ctx, query, modals.OutboxMailPending, time.Now(), leaseUntil, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var mail modals.OutboxMail
+        err := rows.Scan(&mail.ID, &mail.Recipient, &mail.Subject, &mail.TextBody, &mail.HTMLBody, &mail.Status,
+            &mail.Attempts, &mail.LastError, &mail.CreatedAt, &mail.NextAttemptAt, &mail.SentAt)
+        if err != nil {
+            return nil, err
+        }
+        mails = append(mails, mail)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return mails, nil
+}
+
+// MarkOutboxMailSent records the delivery and clears the bodies, they carry links with live tokens.
+// Recipient and subject stay as a record of what was sent.
+func (s *service) MarkOutboxMailSent(ctx context.Context, id int) (err error) {
+    ctx, span := startSpan(ctx, "MarkOutboxMailSent")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE mail_outbox SET status = $2, attempts = attempts + 1, sent_at = $3, text_body = '', html_body = '' WHERE id = $1`
+    _, err = s.db.ExecContext(ctx, query, id, modals.OutboxMailSent, time.Now())
+    if err != nil {
+        slog.ErrorContext(ctx, "marking mail sent failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// RetryOutboxMail records a failed attempt and schedules the next one
+func (s *service) RetryOutboxMail(ctx context.Context, id int, lastError string, nextAttemptAt time.Time) (err error) {
+    ctx, span := startSpan(ctx, "RetryOutboxMail")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE mail_outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1`
+    _, err = s.db.ExecContext(ctx, query, id, lastError, nextAttemptAt)
+    if err != nil {
+        slog.ErrorContext(ctx, "scheduling mail retry failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// DeadLetterOutboxMail records the last failed attempt and stops retrying the mail
+func (s *service) DeadLetterOutboxMail(ctx context.Context, id int, lastError string) (err error) {
+    ctx, span := startSpan(ctx, "DeadLetterOutboxMail")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE mail_outbox SET status = $2, attempts = attempts + 1, last_error = $3 WHERE id = $1`
+    _, err = s.db.ExecContext(ctx, query, id, modals.OutboxMailDead, lastError)
+    if err != nil {
+        slog.ErrorContext(ctx, "dead-lettering mail failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// PurgeDeadOutboxMails deletes dead mails queued before createdBefore and returns how many were deleted
+func (s *service) PurgeDeadOutboxMails(ctx context.Context, createdBefore time.Time) (_ int64, err error) {
+    ctx, span := startSpan(ctx, "PurgeDeadOutboxMails")
+    defer func() { endSpan(span, err) }()
+
+    result, err := s.db.ExecContext(ctx, `DELETE FROM mail_outbox WHERE status = $1 AND created_at < $2`, modals.OutboxMailDead, createdBefore)
+    if err != nil {
+        slog.ErrorContext(ctx, "purging dead mails failed", "error", err)
+        return 0, err
+    }
+    return result.RowsAffected()
+}
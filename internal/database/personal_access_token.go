@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// CreatePersonalAccessToken inserts a new token for token.UserID into the personal_access_tokens Table
+func (s *service) CreatePersonalAccessToken(ctx context.Context, token *modals.PersonalAccessToken) (err error) {
+    ctx, span := startSpan(ctx, "CreatePersonalAccessToken")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO personal_access_tokens (user_id, name, token_prefix, token_hash, scopes, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at
+    `
+    err = s.db.QueryRowContext(ctx, query, token.UserID, token.Name, token.Prefix, token.TokenHash, strings.Join(token.Scopes, " "), token.ExpiresAt).
+        Scan(&token.ID, &token.CreatedAt)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting personal access token failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// ListPersonalAccessTokens returns the user's tokens that have not been revoked
+func (s *service) ListPersonalAccessTokens(ctx context.Context, userID int) (_ []modals.PersonalAccessToken, err error) {
+    ctx, span := startSpan(ctx, "ListPersonalAccessTokens")
+    defer func() { endSpan(span, err) }()
+
+    var tokens []modals.PersonalAccessToken
+    query := `
+        SELECT id, user_id, name, token_prefix, scopes, created_at, last_used_at, expires_at
+        FROM personal_access_tokens
+        WHERE user_id = $1 AND revoked_at IS NULL
+        ORDER BY id
+    `
+    rows, err := s.db.QueryContext(ctx, query, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var token modals.PersonalAccessToken
+        var scopes string
+        if err := rows.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &scopes, &token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt); err != nil {
+            return nil, err
+        }
+        token.Scopes = strings.Fields(scopes)
+        tokens = append(tokens, token)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return tokens, nil
+}
+
+// GetPersonalAccessTokenByHash looks a presented token up by its hash, including revoked and expired ones
+func (s *service) GetPersonalAccessTokenByHash(ctx context.Context, tokenHash string) (_ *modals.PersonalAccessToken, err error) {
+    ctx, span := startSpan(ctx, "GetPersonalAccessTokenByHash")
+    defer func() { endSpan(span, err) }()
+
+    var token modals.PersonalAccessToken
+    var scopes string
+    query := `
+        SELECT t.id, t.user_id, u.username, t.name, t.token_prefix, t.scopes, t.created_at, t.last_used_at, t.expires_at, t.revoked_at
+        FROM personal_access_tokens t
+        INNER JOIN users u ON u.id = t.user_id
+        WHERE t.token_hash = $1
+    `
+    err = s.db.QueryRowContext(ctx, query, tokenHash).Scan(&token.ID, &token.UserID, &token.Username, &token.Name, &token.Prefix, &scopes,
+        &token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt, &token.RevokedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil // Token not found
+    } else if err != nil {
+        return nil, err
+    }
+    token.Scopes = strings.Fields(scopes)
+    return &token, nil
+}
+
+// RevokePersonalAccessToken revokes one of the user's tokens, it returns false if the user has no such active token
+func (s *service) RevokePersonalAccessToken(ctx context.Context, userID int, id int) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "RevokePersonalAccessToken")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE personal_access_tokens SET revoked_at = $3 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+    result, err := s.db.ExecContext(ctx, query, id, userID, time.Now())
+    if err != nil {
+        slog.ErrorContext(ctx, "revoking personal access token failed", "error", err)
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// TouchPersonalAccessToken records that the token was just used
+func (s *service) TouchPersonalAccessToken(ctx context.Context, id int) (err error) {
+    ctx, span := startSpan(ctx, "TouchPersonalAccessToken")
+    defer func() { endSpan(span, err) }()
+
+    _, err = s.db.ExecContext(ctx, `UPDATE personal_access_tokens SET last_used_at = $2 WHERE id = $1`, id, time.Now())
+    return err
+}
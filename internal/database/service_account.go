@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"strings"
+)
+
+// CreateServiceAccount inserts a service account and its roles in one transaction, an unknown role fails the whole
+// insert with ErrNotFound
+func (s *service) CreateServiceAccount(ctx context.Context, account *modals.ServiceAccount) (err error) {
+    ctx, span := startSpan(ctx, "CreateServiceAccount")
+    defer func() { endSpan(span, err) }()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    query := `
+        INSERT INTO service_accounts (name, client_id, client_secret_hash) VALUES ($1, $2, $3)
+        RETURNING id, created_at
+    `
+    err = tx.QueryRowContext(ctx, query, account.Name, account.ClientID, account.SecretHash).Scan(&account.ID, &account.CreatedAt)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting service account failed", "error", err)
+        return mapError(err)
+    }
+
+    for _, role := range account.Roles {
+        result, err := tx.ExecContext(ctx, `
+            INSERT INTO service_account_roles (service_account_id, role_id)
+            SELECT $1, r.id FROM roles r WHERE r.role_name = $2
+        `, account.ID, role)
+        if err != nil {
+            slog.ErrorContext(ctx, "assigning role to service account failed", "error", err)
+            return err
+        }
+        if n, _ := result.RowsAffected(); n == 0 {
+            return fmt.Errorf("role %q %w", role, ErrNotFound)
+        }
+    }
+
+    return tx.Commit()
+}
+
+func (s *service) GetServiceAccountByClientID(ctx context.Context, clientID string) (_ *modals.ServiceAccount, err error) {
+    ctx, span := startSpan(ctx, "GetServiceAccountByClientID")
+    defer func() { endSpan(span, err) }()
+
+    var account modals.ServiceAccount
+    var roles string
+    query := `
+        SELECT sa.id, sa.name, sa.client_id, sa.client_secret_hash, sa.created_at, COALESCE(string_agg(r.role_name, ' '), '')
+        FROM service_accounts sa
+        LEFT JOIN service_account_roles sar ON sar.service_account_id = sa.id
+        LEFT JOIN roles r ON r.id = sar.role_id
+        WHERE sa.client_id = $1
+        GROUP BY sa.id
+    `
+    err = s.db.QueryRowContext(ctx, query, clientID).Scan(&account.ID, &account.Name, &account.ClientID, &account.SecretHash, &account.CreatedAt, &roles)
+    if err == sql.ErrNoRows {
+        return nil, nil // Service account not found
+    } else if err != nil {
+        return nil, err
+    }
+    account.Roles = strings.Fields(roles)
+    return &account, nil
+}
+
+func (s *service) ListServiceAccounts(ctx context.Context) (_ []modals.ServiceAccount, err error) {
+    ctx, span := startSpan(ctx, "ListServiceAccounts")
+    defer func() { endSpan(span, err) }()
+
+    var accounts []modals.ServiceAccount
+    query := `
+        SELECT sa.id, sa.name, sa.client_id, sa.created_at, COALESCE(string_agg(r.role_name, ' '), '')
+        FROM service_accounts sa
+        LEFT JOIN service_account_roles sar ON sar.service_account_id = sa.id
+        LEFT JOIN roles r ON r.id = sar.role_id
+        GROUP BY sa.id
+        ORDER BY sa.id
+    `
+    rows, err := s.db.QueryContext(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var account modals.ServiceAccount
+        var roles string
+        if err := rows.Scan(&account.ID, &account.Name, &account.ClientID, &account.CreatedAt, &roles); err != nil {
+            return nil, err
+        }
+        account.Roles = strings.Fields(roles)
+        accounts = append(accounts, account)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return accounts, nil
+}
+
+// DeleteServiceAccount removes the service account, it returns false if no account has that client ID
+func (s *service) DeleteServiceAccount(ctx context.Context, clientID string) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "DeleteServiceAccount")
+    defer func() { endSpan(span, err) }()
+
+    result, err := s.db.ExecContext(ctx, `DELETE FROM service_accounts WHERE client_id = $1`, clientID)
+    if err != nil {
+        slog.ErrorContext(ctx, "deleting service account failed", "error", err)
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
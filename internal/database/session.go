@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"time"
+)
+
+const sessionColumns = `s.id, s.user_id, u.username, s.device, s.user_agent, s.ip, s.created_at, s.last_seen_at, s.expires_at, s.revoked_at`
+
+func scanSession(row rowScanner) (*modals.Session, error) {
+    var session modals.Session
+    err := row.Scan(&session.ID, &session.UserID, &session.Username, &session.Device, &session.UserAgent, &session.IP,
+        &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.RevokedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return &session, nil
+}
+
+func (s *service) CreateSession(ctx context.Context, session *modals.Session) (err error) {
+    ctx, span := startSpan(ctx, "CreateSession")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO sessions (user_id, device, user_agent, ip, created_at, last_seen_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id
+    `
+    err = s.db.QueryRowContext(ctx, query, session.UserID, session.Device, session.UserAgent, session.IP,
+        session.CreatedAt, session.LastSeenAt, session.ExpiresAt).Scan(&session.ID)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting session failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// GetSession returns the session including revoked and expired ones, or nil if it doesn't exist
+func (s *service) GetSession(ctx context.Context, id int) (_ *modals.Session, err error) {
+    ctx, span := startSpan(ctx, "GetSession")
+    defer func() { endSpan(span, err) }()
+
+    query := `SELECT ` + sessionColumns + ` FROM sessions s JOIN users u ON u.id = s.user_id WHERE s.id = $1`
+    return scanSession(s.db.QueryRowContext(ctx, query, id))
+}
+
+// ListSessions returns the sessions that are neither revoked nor expired, most recently seen first.
+// A userID of 0 lists the sessions of all users.
+func (s *service) ListSessions(ctx context.Context, userID int) (_ []modals.Session, err error) {
+    ctx, span := startSpan(ctx, "ListSessions")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        SELECT ` + sessionColumns + ` FROM sessions s JOIN users u ON u.id = s.user_id
+        WHERE ($1 = 0 OR s.user_id = $1) AND s.revoked_at IS NULL AND s.expires_at > $2
+        ORDER BY s.last_seen_at DESC
+    `
+    rows, err := s.db.QueryContext(ctx, query, userID, time.Now())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var sessions []modals.Session
+    for rows.Next() {
+        session, err := scanSession(rows)
+        if err != nil {
+            return nil, err
+        }
+        sessions = append(sessions, *session)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return sessions, nil
+}
+
+// TouchSession records that the session was just used from ip with userAgent
+func (s *service) TouchSession(ctx context.Context, id int, ip string, userAgent string) (err error) {
+    ctx, span := startSpan(ctx, "TouchSession")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE sessions SET last_seen_at = $2, ip = $3, user_agent = $4 WHERE id = $1`
+    _, err = s.db.ExecContext(ctx, query, id, time.Now(), ip, userAgent)
+    if err != nil {
+        slog.ErrorContext(ctx, "touching session failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// RevokeSession ends the session if it belongs to the user, it returns false if there was no such active session
+func (s *service) RevokeSession(ctx context.Context, userID int, id int) (_ bool, err error) {
+    ctx, span := startSpan(ctx, "RevokeSession")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE sessions SET revoked_at = $3 WHERE id = $2 AND user_id = $1 AND revoked_at IS NULL`
+    result, err := s.db.ExecContext(ctx, query, userID, id, time.Now())
+    if err != nil {
+        slog.ErrorContext(ctx, "revoking session failed", "error", err)
+        return false, mapError(err)
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// RevokeUserSessions ends all sessions of the user except exceptID, which may be 0 to end all of them
+func (s *service) RevokeUserSessions(ctx context.Context, userID int, exceptID int) (err error) {
+    ctx, span := startSpan(ctx, "RevokeUserSessions")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE sessions SET revoked_at = $3 WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`
+    _, err = s.db.ExecContext(ctx, query, userID, exceptID, time.Now())
+    if err != nil {
+        slog.ErrorContext(ctx, "revoking sessions failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
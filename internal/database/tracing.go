@@ -0,0 +1,38 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the Service spans
+const tracerName = "jjr-tec-backend/internal/database"
+
+// startSpan starts the child span of a Service call, named after the method like "database.GetUserByUsername".
+// The tracer is looked up per call so the spans follow the provider installed last, tests install their own.
+func startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+    return otel.Tracer(tracerName).Start(ctx, "database."+operation,
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            attribute.String("db.system", "postgresql"),
+            attribute.String("db.name", database),
+            attribute.String("db.operation", operation),
+        ),
+    )
+}
+
+// endSpan ends the span of a Service call and marks it failed if err is set.
+// sql.ErrNoRows isn't a failure, callers ask for rows that may not exist.
+func endSpan(span trace.Span, err error) {
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        span.RecordError(err)
+        span.SetStatus(codes.Error, err.Error())
+    }
+    span.End()
+}
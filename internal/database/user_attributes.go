@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"strings"
+)
+
+// UpdateUserAttributes replaces the attributes of the user, validating them is up to the caller
+func (s *service) UpdateUserAttributes(ctx context.Context, userID int, attributes map[string]interface{}) (err error) {
+    ctx, span := startSpan(ctx, "UpdateUserAttributes")
+    defer func() { endSpan(span, err) }()
+
+    if attributes == nil {
+        attributes = map[string]interface{}{}
+    }
+    data, err := json.Marshal(attributes)
+    if err != nil {
+        return err
+    }
+    _, err = s.db.ExecContext(ctx, `UPDATE users SET attributes = $2 WHERE id = $1`, userID, data)
+    if err != nil {
+        slog.ErrorContext(ctx, "updating user attributes failed", "error", err)
+        return err
+    }
+    return nil
+}
+
+// ListUsers returns the users matching the filter ordered by username. Attribute filters use JSONB containment,
+// which idx_users_attributes serves.
+func (s *service) ListUsers(ctx context.Context, filter modals.UserFilter) (_ []modals.User, err error) {
+    ctx, span := startSpan(ctx, "ListUsers")
+    defer func() { endSpan(span, err) }()
+
+    var conditions []string
+    var args []interface{}
+    if filter.Status != "" {
+        args = append(args, filter.Status)
+        conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+    }
+    if len(filter.Attributes) > 0 {
+        data, err := json.Marshal(filter.Attributes)
+        if err != nil {
+            return nil, err
+        }
+        args = append(args, data)
+        conditions = append(conditions, fmt.Sprintf("attributes @> $%d", len(args)))
+    }
+
+    query := `SELECT ` + userColumns + ` FROM users`
+    if len(conditions) > 0 {
+        query += ` WHERE ` + strings.Join(conditions, " AND ")
+    }
+    args = append(args, filter.Limit, filter.Offset)
+    query += fmt.Sprintf(` ORDER BY username LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+    rows, err := s.db.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var users []modals.User
+    for rows.Next() {
+        user, err := scanUser(rows)
+        if err != nil {
+            return nil, err
+        }
+        users = append(users, *user)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return users, nil
+}
+
+// GetAttributeSchema returns the attribute schema, or nil if admins haven't defined one
+func (s *service) GetAttributeSchema(ctx context.Context) (_ *modals.AttributeSchema, err error) {
+    ctx, span := startSpan(ctx, "GetAttributeSchema")
+    defer func() { endSpan(span, err) }()
+
+    var schema modals.AttributeSchema
+    var document []byte
+    var claimAttributes, userEditableAttributes string
+    query := `SELECT schema, claim_attributes, user_editable_attributes, updated_at FROM user_attribute_schema WHERE id = 1`
+    err = s.db.QueryRowContext(ctx, query).Scan(&document, &claimAttributes, &userEditableAttributes, &schema.UpdatedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    schema.Schema = document
+    schema.ClaimAttributes = strings.Fields(claimAttributes)
+    schema.UserEditableAttributes = strings.Fields(userEditableAttributes)
+    return &schema, nil
+}
+
+// SaveAttributeSchema creates or replaces the attribute schema
+func (s *service) SaveAttributeSchema(ctx context.Context, schema *modals.AttributeSchema) (err error) {
+    ctx, span := startSpan(ctx, "SaveAttributeSchema")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO user_attribute_schema (id, schema, claim_attributes, user_editable_attributes, updated_at) VALUES (1, $1, $2, $3, $4)
+        ON CONFLICT (id) DO UPDATE SET schema = $1, claim_attributes = $2, user_editable_attributes = $3, updated_at = $4
+    `
+    _, err = s.db.ExecContext(ctx, query, []byte(schema.Schema), strings.Join(schema.ClaimAttributes, " "),
+        strings.Join(schema.UserEditableAttributes, " "), schema.UpdatedAt)
+    if err != nil {
+        slog.ErrorContext(ctx, "saving attribute schema failed", "error", err)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"jjr-tec-backend/internal/modals"
+	"log/slog"
+	"time"
+)
+
+func (s *service) CreateUserToken(ctx context.Context, token *modals.UserToken) (err error) {
+    ctx, span := startSpan(ctx, "CreateUserToken")
+    defer func() { endSpan(span, err) }()
+
+    query := `
+        INSERT INTO user_tokens (user_id, purpose, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)
+        RETURNING id
+    `
+    err = s.db.QueryRowContext(ctx, query, token.UserID, token.Purpose, token.TokenHash, token.CreatedAt, token.ExpiresAt).Scan(&token.ID)
+    if err != nil {
+        slog.ErrorContext(ctx, "inserting user token failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
+
+// ConsumeUserToken marks the token as used and returns it. Unknown, already used or expired tokens return nil.
+func (s *service) ConsumeUserToken(ctx context.Context, purpose string, tokenHash string) (_ *modals.UserToken, err error) {
+    ctx, span := startSpan(ctx, "ConsumeUserToken")
+    defer func() { endSpan(span, err) }()
+
+    var token modals.UserToken
+    now := time.Now()
+    query := `
+        UPDATE user_tokens SET used_at = $3
+        WHERE purpose = $1 AND token_hash = $2 AND used_at IS NULL
+        RETURNING id, user_id, purpose, token_hash, created_at, expires_at, used_at
+    `
+    err = s.db.QueryRowContext(ctx, query, purpose, tokenHash, now).
+        Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &token.UsedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    if now.After(token.ExpiresAt) {
+        return nil, nil
+    }
+    return &token, nil
+}
+
+// GetUserToken returns the token without using it up, so a flow can validate its input first. Unknown, already
+// used or expired tokens return nil.
+func (s *service) GetUserToken(ctx context.Context, purpose string, tokenHash string) (_ *modals.UserToken, err error) {
+    ctx, span := startSpan(ctx, "GetUserToken")
+    defer func() { endSpan(span, err) }()
+
+    var token modals.UserToken
+    query := `
+        SELECT id, user_id, purpose, token_hash, created_at, expires_at, used_at
+        FROM user_tokens WHERE purpose = $1 AND token_hash = $2 AND used_at IS NULL AND expires_at > $3
+    `
+    err = s.db.QueryRowContext(ctx, query, purpose, tokenHash, time.Now()).
+        Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &token.UsedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return &token, nil
+}
+
+// LatestUserToken returns the most recently created token of the user for the purpose, or nil if there is none
+func (s *service) LatestUserToken(ctx context.Context, userID int, purpose string) (_ *modals.UserToken, err error) {
+    ctx, span := startSpan(ctx, "LatestUserToken")
+    defer func() { endSpan(span, err) }()
+
+    var token modals.UserToken
+    query := `
+        SELECT id, user_id, purpose, token_hash, created_at, expires_at, used_at
+        FROM user_tokens WHERE user_id = $1 AND purpose = $2
+        ORDER BY created_at DESC LIMIT 1
+    `
+    err = s.db.QueryRowContext(ctx, query, userID, purpose).
+        Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &token.UsedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return &token, nil
+}
+
+// RevokeUserTokens marks all unused tokens of the user for the purpose as used, so older links stop working
+func (s *service) RevokeUserTokens(ctx context.Context, userID int, purpose string) (err error) {
+    ctx, span := startSpan(ctx, "RevokeUserTokens")
+    defer func() { endSpan(span, err) }()
+
+    query := `UPDATE user_tokens SET used_at = $3 WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`
+    _, err = s.db.ExecContext(ctx, query, userID, purpose, time.Now())
+    if err != nil {
+        slog.ErrorContext(ctx, "revoking user tokens failed", "error", err)
+        return mapError(err)
+    }
+    return nil
+}
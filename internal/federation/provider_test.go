@@ -0,0 +1,185 @@
+package federation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// upstream is an identity provider serving discovery and a JWKS whose keys tests can rotate
+type upstream struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys []jsonWebKey
+}
+
+func newUpstream(t *testing.T) *upstream {
+	t.Helper()
+	u := &upstream{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discoveryDocument{Issuer: u.URL, JWKSURI: u.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": u.keys})
+	})
+	u.Server = httptest.NewServer(mux)
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) publish(keys ...jsonWebKey) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.keys = append(u.keys, keys...)
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{Kty: "RSA", Kid: kid, N: encodeInt(key.N), E: encodeInt(big.NewInt(int64(key.E)))}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{Kty: "EC", Kid: kid, Crv: key.Curve.Params().Name, X: encodeInt(key.X), Y: encodeInt(key.Y)}
+}
+
+func signIDToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("error signing ID token. Err: %v", err)
+	}
+	return signed
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	u := newUpstream(t)
+	u.publish(rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey))
+	provider := NewProvider(Config{Name: "corp", Issuer: u.URL, ClientID: "backend"}, u.Client())
+
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{"iss": u.URL, "aud": "backend", "sub": "u-1", "nonce": "n-1", "exp": time.Now().Add(time.Minute).Unix()}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RSA", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)), true},
+		{"EC", signIDToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(nil)), true},
+		{"audience list", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["aud"] = []string{"other", "backend"} })), true},
+		{"wrong issuer", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" })), false},
+		{"wrong audience", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["aud"] = "other" })), false},
+		{"wrong nonce", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["nonce"] = "n-2" })), false},
+		{"no nonce", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { delete(c, "nonce") })), false},
+		{"expired", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), false},
+		{"no expiry", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { delete(c, "exp") })), false},
+		{"key of another kid", signIDToken(t, jwt.SigningMethodES256, "rsa-1", ecKey, claims(nil)), false},
+		{"unknown kid", signIDToken(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, claims(nil)), false},
+		{"HMAC", signIDToken(t, jwt.SigningMethodHS256, "rsa-1", []byte("secret"), claims(nil)), false},
+		{"tampered", signIDToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)) + "x", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			verified, err := provider.VerifyIDToken(context.Background(), tc.token, "n-1")
+			if tc.valid && (err != nil || verified["sub"] != "u-1") {
+				t.Errorf("expected the token to verify; got %v %v", verified, err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("expected the token to be rejected")
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenAfterKeyRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	u := newUpstream(t)
+	u.publish(rsaJWK("old", &oldKey.PublicKey))
+	provider := NewProvider(Config{Name: "corp", Issuer: u.URL, ClientID: "backend"}, u.Client())
+	claims := jwt.MapClaims{"iss": u.URL, "aud": "backend", "sub": "u-1", "nonce": "n-1", "exp": time.Now().Add(time.Minute).Unix()}
+
+	if _, err := provider.VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodRS256, "old", oldKey, claims), "n-1"); err != nil {
+		t.Fatalf("expected a token of the old key to verify; got %v", err)
+	}
+	u.publish(rsaJWK("new", &newKey.PublicKey))
+	if _, err := provider.VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodRS256, "new", newKey, claims), "n-1"); err != nil {
+		t.Errorf("expected the JWKS to be refetched for the new kid; got %v", err)
+	}
+}
+
+func TestJSONWebKeyPublicKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	offCurve := ecJWK("ec", &p256.PublicKey)
+	offCurve.Y = encodeInt(new(big.Int).Add(p256.Y, big.NewInt(1)))
+
+	for _, tc := range []struct {
+		name string
+		jwk  jsonWebKey
+		want interface{}
+	}{
+		{"RSA", rsaJWK("rsa", &rsaKey.PublicKey), &rsaKey.PublicKey},
+		{"P-256", ecJWK("ec", &p256.PublicKey), &p256.PublicKey},
+		{"P-384", ecJWK("ec", &p384.PublicKey), &p384.PublicKey},
+		{"point off the curve", offCurve, nil},
+		{"unsupported curve", jsonWebKey{Kty: "EC", Crv: "P-521", X: "AQ", Y: "AQ"}, nil},
+		{"unsupported key type", jsonWebKey{Kty: "oct"}, nil},
+		{"invalid modulus", jsonWebKey{Kty: "RSA", N: "not base64!", E: "AQAB"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := tc.jwk.publicKey()
+			if tc.want == nil {
+				if err == nil {
+					t.Errorf("expected an error; got %v", key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected a key; got %v", err)
+			}
+			if equal, ok := key.(interface{ Equal(crypto.PublicKey) bool }); !ok || !equal.Equal(tc.want) {
+				t.Errorf("expected %v; got %v", tc.want, key)
+			}
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	provider := NewProvider(Config{Name: "corp"}, nil)
+	if groups := provider.Groups(jwt.MapClaims{"groups": []interface{}{"admins", 7, "staff"}}); strings.Join(groups, ",") != "admins,staff" {
+		t.Errorf("expected the string groups of a list; got %v", groups)
+	}
+	if groups := provider.Groups(jwt.MapClaims{"groups": "admins staff"}); strings.Join(groups, ",") != "admins,staff" {
+		t.Errorf("expected a space separated claim to be split; got %v", groups)
+	}
+}
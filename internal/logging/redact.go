@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces secrets in log lines
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are never logged, compared case-insensitively
+var sensitiveKeys = map[string]bool{
+	"password":         true,
+	"current_password": true,
+	"new_password":     true,
+	"token":            true,
+	"access_token":     true,
+	"refresh_token":    true,
+	"id_token":         true,
+	"client_secret":    true,
+	"secret":           true,
+	"code":             true,
+	"code_verifier":    true,
+	"authorization":    true,
+	"cookie":           true,
+}
+
+// secretPatterns find secrets inside messages and other strings, like a token in a URL or an error
+var secretPatterns = []*regexp.Regexp{
+	// JSON Web Tokens, the access, refresh and ID tokens
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	// Personal access tokens
+	regexp.MustCompile(`jjrpat_[A-Za-z0-9_-]+`),
+	// Bearer credentials
+	regexp.MustCompile(`(?i)bearer\s+[^\s"]+`),
+}
+
+// secretParameter finds the values of sensitive query and form parameters, like the token of a verification link
+var secretParameter = regexp.MustCompile(`(?i)\b(password|token|refresh_token|client_secret|code|code_verifier)=[^&\s"]+`)
+
+// Redact returns s with the secrets it contains replaced
+func Redact(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, redacted)
+	}
+	return secretParameter.ReplaceAllString(s, "$1="+redacted)
+}
+
+// redactAttr is the ReplaceAttr of the handlers. It drops the values of sensitive keys and scans strings, the
+// message included, so secrets in lines from the standard log package or in error texts don't leak either.
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, Redact(err.Error()))
+		}
+	}
+	return attr
+}
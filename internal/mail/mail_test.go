@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn accepts one SMTP session on a local port and sends the DATA it received to the returned channel
+func smtpStandIn(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Err: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP stand-in")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.Fields(line)[0]); command {
+			case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				received <- string(data)
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 Bye")
+				return
+			default:
+				text.PrintfLine("502 Command not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := smtpStandIn(t)
+	mailer := SMTPMailer{Addr: addr, From: "JJR-Tec <noreply@example.com>"}
+
+	msg, err := Render("email_verification", "de-AT,de;q=0.9,en;q=0.5", map[string]string{"Username": "frank", "Link": "https://example.com/verify?token=a&b"})
+	if err != nil {
+		t.Fatalf("error rendering template. Err: %v", err)
+	}
+	msg.To = "frank@example.com"
+	if err := mailer.Send(context.Background(), msg); err != nil {
+		t.Fatalf("error sending mail. Err: %v", err)
+	}
+
+	data := <-received
+	for _, want := range []string{
+		"To: frank@example.com",
+		"Subject: =?utf-8?q?Best=C3=A4tige_deine_E-Mail-Adresse?=",
+		"Content-Type: multipart/alternative",
+		"Content-Type: text/html; charset=utf-8",
+		"https://example.com/verify?token=3Da&amp;b", // quoted-printable and HTML escaped
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("expected mail to contain %q; got:\n%s", want, data)
+		}
+	}
+}
+
+func TestSMTPMailerTimesOut(t *testing.T) {
+	// Connections complete in the listen backlog, but the server never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Err: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mailer := SMTPMailer{Addr: listener.Addr().String(), From: "noreply@example.com", Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	err = mailer.Send(context.Background(), Message{To: "frank@example.com", Subject: "hi", Text: "hi"})
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the delivery to fail after the timeout; got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestRenderFallsBackToDefaultLocale(t *testing.T) {
+	msg, err := Render("password_changed", "fr-FR", map[string]string{"Username": "frank"})
+	if err != nil {
+		t.Fatalf("error rendering template. Err: %v", err)
+	}
+	if msg.Subject != "Your password was changed" || !strings.HasPrefix(msg.Text, "Hi frank,") {
+		t.Errorf("expected the English template; got %+v", msg)
+	}
+	if msg.HTML != "" {
+		t.Errorf("expected no HTML body; got %q", msg.HTML)
+	}
+
+	if _, err := Render("no_such_template", "en", nil); err == nil {
+		t.Errorf("expected an error for an unknown template")
+	}
+}
+
+func TestComposeRejectsHeaderInjection(t *testing.T) {
+	msg := Message{To: "frank@example.com", Subject: "Hi\r\nBcc: mallory@example.com", Text: "hi"}
+	if _, err := msg.compose("noreply@example.com"); err == nil {
+		t.Errorf("expected a subject with a line break to be rejected")
+	}
+}
@@ -0,0 +1,137 @@
+package mail
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// OutboxStore is the part of database.Service the outbox uses
+type OutboxStore interface {
+	EnqueueMail(ctx context.Context, mail *modals.OutboxMail) error
+	ClaimOutboxMails(ctx context.Context, limit int, leaseUntil time.Time) ([]modals.OutboxMail, error)
+	MarkOutboxMailSent(ctx context.Context, id int) error
+	RetryOutboxMail(ctx context.Context, id int, lastError string, nextAttemptAt time.Time) error
+	DeadLetterOutboxMail(ctx context.Context, id int, lastError string) error
+	PurgeDeadOutboxMails(ctx context.Context, createdBefore time.Time) (int64, error)
+}
+
+// Outbox is the Mailer handlers use, it queues messages in the mail_outbox table for a Worker to deliver
+type Outbox struct {
+	Store OutboxStore
+}
+
+func (o Outbox) Send(ctx context.Context, msg Message) error {
+	return o.Store.EnqueueMail(ctx, &modals.OutboxMail{
+		Recipient: msg.To,
+		Subject:   msg.Subject,
+		TextBody:  msg.Text,
+		HTMLBody:  msg.HTML,
+	})
+}
+
+// Worker delivers queued mails through Mailer. Failed mails are retried with exponential backoff and
+// dead-lettered after MaxAttempts. Several workers may share one outbox.
+//
+// Mail bodies carry links with live tokens, so they don't outlive their use: sent mails lose their bodies right
+// away and dead mails are deleted once DeadRetention has passed.
+type Worker struct {
+	Store  OutboxStore
+	Mailer Mailer
+
+	Interval    time.Duration
+	BatchSize   int
+	MaxAttempts int
+	// Lease is how long a claimed mail is hidden from other workers, it must be longer than a delivery takes
+	Lease time.Duration
+	// DeadRetention is how long dead mails are kept for inspection, at least as long as the tokens in them live
+	DeadRetention time.Duration
+}
+
+func NewWorker(store OutboxStore, mailer Mailer) *Worker {
+	return &Worker{
+		Store:       store,
+		Mailer:      mailer,
+		Interval:    5 * time.Second,
+		BatchSize:   20,
+		MaxAttempts: 8,
+		Lease:       5 * time.Minute,
+		// Invitations, the longest lived links, expire after a week
+		DeadRetention: 7 * 24 * time.Hour,
+	}
+}
+
+// Run delivers due mails every Interval and purges dead mails every hour until ctx is done
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	purge := time.NewTicker(time.Hour)
+	defer purge.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-purge.C:
+			if _, err := w.PurgeDead(ctx); err != nil {
+				slog.ErrorContext(ctx, "purging dead mails failed", "error", err)
+			}
+		case <-ticker.C:
+			// Keep going while full batches come back, so a backlog doesn't wait for the next tick
+			for {
+				n, err := w.ProcessOnce(ctx)
+				if err != nil {
+					slog.ErrorContext(ctx, "processing mail outbox failed", "error", err)
+				}
+				if err != nil || n < w.BatchSize || ctx.Err() != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+// ProcessOnce claims one batch of due mails and tries to deliver each, it returns how many were claimed
+func (w *Worker) ProcessOnce(ctx context.Context) (int, error) {
+	mails, err := w.Store.ClaimOutboxMails(ctx, w.BatchSize, time.Now().Add(w.Lease))
+	if err != nil {
+		return 0, err
+	}
+	for _, mail := range mails {
+		err := w.Mailer.Send(ctx, Message{To: mail.Recipient, Subject: mail.Subject, Text: mail.TextBody, HTML: mail.HTMLBody})
+		if err == nil {
+			if err := w.Store.MarkOutboxMailSent(ctx, mail.ID); err != nil {
+				return len(mails), err
+			}
+			continue
+		}
+
+		attempt := mail.Attempts + 1
+		if attempt >= w.MaxAttempts {
+			slog.ErrorContext(ctx, "giving up on mail", "mail_id", mail.ID, "to", mail.Recipient, "attempts", attempt, "error", err)
+			if err := w.Store.DeadLetterOutboxMail(ctx, mail.ID, err.Error()); err != nil {
+				return len(mails), err
+			}
+			continue
+		}
+		if err := w.Store.RetryOutboxMail(ctx, mail.ID, err.Error(), time.Now().Add(retryDelay(attempt))); err != nil {
+			return len(mails), err
+		}
+	}
+	return len(mails), nil
+}
+
+// PurgeDead deletes the dead mails older than DeadRetention and returns how many were deleted
+func (w *Worker) PurgeDead(ctx context.Context) (int64, error) {
+	return w.Store.PurgeDeadOutboxMails(ctx, time.Now().Add(-w.DeadRetention))
+}
+
+// retryDelay doubles from 30 seconds after the first failed attempt up to one hour
+func retryDelay(attempt int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Hour)
+}
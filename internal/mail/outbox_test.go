@@ -0,0 +1,139 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// memoryOutbox keeps the outbox in memory, it ignores leases since tests use a single worker
+type memoryOutbox struct {
+	mails []modals.OutboxMail
+}
+
+func (o *memoryOutbox) EnqueueMail(ctx context.Context, mail *modals.OutboxMail) error {
+	mail.ID = len(o.mails) + 1
+	mail.Status = modals.OutboxMailPending
+	mail.CreatedAt = time.Now()
+	o.mails = append(o.mails, *mail)
+	return nil
+}
+
+func (o *memoryOutbox) ClaimOutboxMails(ctx context.Context, limit int, leaseUntil time.Time) ([]modals.OutboxMail, error) {
+	var claimed []modals.OutboxMail
+	for _, mail := range o.mails {
+		if mail.Status == modals.OutboxMailPending && !mail.NextAttemptAt.After(time.Now()) && len(claimed) < limit {
+			claimed = append(claimed, mail)
+		}
+	}
+	return claimed, nil
+}
+
+func (o *memoryOutbox) MarkOutboxMailSent(ctx context.Context, id int) error {
+	o.mails[id-1].Status = modals.OutboxMailSent
+	o.mails[id-1].Attempts++
+	o.mails[id-1].TextBody, o.mails[id-1].HTMLBody = "", ""
+	return nil
+}
+
+func (o *memoryOutbox) RetryOutboxMail(ctx context.Context, id int, lastError string, nextAttemptAt time.Time) error {
+	o.mails[id-1].Attempts++
+	o.mails[id-1].LastError = lastError
+	o.mails[id-1].NextAttemptAt = nextAttemptAt
+	return nil
+}
+
+func (o *memoryOutbox) DeadLetterOutboxMail(ctx context.Context, id int, lastError string) error {
+	o.mails[id-1].Status = modals.OutboxMailDead
+	o.mails[id-1].Attempts++
+	o.mails[id-1].LastError = lastError
+	return nil
+}
+
+// PurgeDeadOutboxMails blanks the purged mails, so IDs keep matching slice positions
+func (o *memoryOutbox) PurgeDeadOutboxMails(ctx context.Context, createdBefore time.Time) (int64, error) {
+	var purged int64
+	for i, mail := range o.mails {
+		if mail.Status == modals.OutboxMailDead && mail.CreatedAt.Before(createdBefore) {
+			o.mails[i] = modals.OutboxMail{}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// flakyMailer fails the first failures sends
+type flakyMailer struct {
+	failures int
+	sent     []Message
+}
+
+func (m *flakyMailer) Send(ctx context.Context, msg Message) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("connection refused")
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestWorkerRetriesAndDeadLetters(t *testing.T) {
+	store := &memoryOutbox{}
+	mailer := &flakyMailer{failures: 5}
+	worker := NewWorker(store, mailer)
+	worker.MaxAttempts = 3
+
+	Outbox{Store: store}.Send(context.Background(), Message{To: "frank@example.com", Subject: "first", Text: "1"})
+	Outbox{Store: store}.Send(context.Background(), Message{To: "erin@example.com", Subject: "second", Text: "2"})
+
+	// Both fail, and are retried only once they are due again
+	if n, err := worker.ProcessOnce(context.Background()); n != 2 || err != nil {
+		t.Fatalf("expected 2 mails to be claimed; got %d, %v", n, err)
+	}
+	if n, _ := worker.ProcessOnce(context.Background()); n != 0 {
+		t.Fatalf("expected no mails to be due right after a failure; got %d", n)
+	}
+	if store.mails[0].Attempts != 1 || store.mails[0].LastError != "connection refused" {
+		t.Errorf("expected the failed attempt to be recorded; got %+v", store.mails[0])
+	}
+
+	for attempt := 2; attempt <= 3; attempt++ {
+		for i := range store.mails {
+			store.mails[i].NextAttemptAt = time.Time{}
+		}
+		worker.ProcessOnce(context.Background())
+	}
+
+	if store.mails[0].Status != modals.OutboxMailDead || store.mails[0].Attempts != 3 {
+		t.Errorf("expected the first mail to be dead-lettered after 3 attempts; got %+v", store.mails[0])
+	}
+	if store.mails[1].Status != modals.OutboxMailSent || len(mailer.sent) != 1 || mailer.sent[0].To != "erin@example.com" {
+		t.Errorf("expected the second mail to be sent on its third attempt; got %+v", store.mails[1])
+	}
+	if store.mails[1].TextBody != "" {
+		t.Errorf("expected the body of the sent mail to be cleared; got %q", store.mails[1].TextBody)
+	}
+
+	// Dead mails stay for inspection until DeadRetention has passed
+	if n, _ := worker.PurgeDead(context.Background()); n != 0 {
+		t.Errorf("expected a fresh dead mail to be kept; %d purged", n)
+	}
+	store.mails[0].CreatedAt = time.Now().Add(-worker.DeadRetention - time.Minute)
+	if n, _ := worker.PurgeDead(context.Background()); n != 1 || store.mails[0].Status != "" {
+		t.Errorf("expected the old dead mail to be purged; %d purged", n)
+	}
+	if store.mails[1].Status != modals.OutboxMailSent {
+		t.Errorf("expected the sent mail to stay; got %+v", store.mails[1])
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 20: time.Hour} {
+		if got := retryDelay(attempt); got != want {
+			t.Errorf("retryDelay(%d) = %v; want %v", attempt, got, want)
+		}
+	}
+}
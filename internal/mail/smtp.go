@@ -0,0 +1,96 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"time"
+)
+
+// defaultSMTPTimeout bounds a delivery when SMTPMailer.Timeout is not set
+const defaultSMTPTimeout = 30 * time.Second
+
+// SMTPMailer delivers messages through an SMTP server. STARTTLS is used when the server offers it, PLAIN auth
+// when Username is set.
+type SMTPMailer struct {
+	// Addr is host:port of the server
+	Addr     string
+	Username string
+	Password string
+	// From is the sender, with or without display name
+	From string
+	// Timeout bounds one delivery, connecting included, so an unresponsive server can't stall the outbox worker
+	Timeout time.Duration
+}
+
+func (m SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := msg.compose(m.From)
+	if err != nil {
+		return err
+	}
+	sender, err := netmail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	recipient, err := netmail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = defaultSMTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	// net/smtp knows no context, the deadline and closing the connection on cancellation stand in for it
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(recipient.Address); err != nil {
+		return err
+	}
+	body, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := body.Write(data); err != nil {
+		return err
+	}
+	if err := body.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
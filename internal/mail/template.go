@@ -0,0 +1,105 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+
+	"golang.org/x/text/language"
+)
+
+// Templates live in templates/<locale>/. <name>.txt is the text body and defines "<name>.subject",
+// <name>.html is the optional HTML body. Locales may translate only some templates, the rest falls back to
+// DefaultLocale.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+const DefaultLocale = "en"
+
+type localeTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var (
+	templates, locales = mustParseTemplates()
+	localeMatcher      = language.NewMatcher(locales)
+)
+
+// mustParseTemplates parses the templates of every locale, DefaultLocale comes first so the matcher falls back to it
+func mustParseTemplates() (map[string]localeTemplates, []language.Tag) {
+	dirs, err := fs.ReadDir(templateFiles, "templates")
+	if err != nil {
+		panic(err)
+	}
+	parsed := map[string]localeTemplates{}
+	tags := []language.Tag{language.MustParse(DefaultLocale)}
+	for _, dir := range dirs {
+		locale := dir.Name()
+		var t localeTemplates
+		t.text = texttemplate.Must(texttemplate.New(locale).ParseFS(templateFiles, "templates/"+locale+"/*.txt"))
+		if htmlFiles, _ := fs.Glob(templateFiles, "templates/"+locale+"/*.html"); len(htmlFiles) > 0 {
+			t.html = htmltemplate.Must(htmltemplate.New(locale).ParseFS(templateFiles, htmlFiles...))
+		}
+		parsed[locale] = t
+		if locale != DefaultLocale {
+			tags = append(tags, language.MustParse(locale))
+		}
+	}
+	return parsed, tags
+}
+
+// Locales lists the locales templates are translated to
+func Locales() []string {
+	names := make([]string, len(locales))
+	for i, tag := range locales {
+		names[i] = tag.String()
+	}
+	slices.Sort(names)
+	return names
+}
+
+// MatchLocale returns the translated locale closest to the given one, which may be a single tag like "de-AT"
+// or an Accept-Language header. It returns DefaultLocale if nothing matches.
+func MatchLocale(locale string) string {
+	tags, _, _ := language.ParseAcceptLanguage(locale)
+	_, index, _ := localeMatcher.Match(tags...)
+	return locales[index].String()
+}
+
+// Render executes the named template in the locale closest to locale and returns the message without recipient
+func Render(name string, locale string, data interface{}) (Message, error) {
+	var msg Message
+	t, ok := templates[MatchLocale(locale)]
+	if !ok || t.text.Lookup(name+".txt") == nil {
+		t = templates[DefaultLocale]
+	}
+	if t.text.Lookup(name+".txt") == nil {
+		return msg, fmt.Errorf("mail template %q does not exist", name)
+	}
+
+	var subject, text bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, name+".subject", data); err != nil {
+		return msg, err
+	}
+	if err := t.text.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return msg, err
+	}
+	msg.Subject = strings.TrimSpace(subject.String())
+	msg.Text = strings.TrimSpace(text.String()) + "\n"
+
+	if t.html != nil && t.html.Lookup(name+".html") != nil {
+		var html bytes.Buffer
+		if err := t.html.ExecuteTemplate(&html, name+".html", data); err != nil {
+			return msg, err
+		}
+		msg.HTML = html.String()
+	}
+	return msg, nil
+}
@@ -0,0 +1,11 @@
+package modals
+
+// ExternalIdentity represents an entry in Postgres Table external_identities
+type ExternalIdentity struct {
+	ID        int
+	UserID    int
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt string
+}
@@ -0,0 +1,21 @@
+package modals
+
+import "time"
+
+// Invitation represents an entry in Postgres Table invitations
+type Invitation struct {
+	ID        int      `json:"id"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+	TokenHash string   `json:"-"`
+	// InvitedBy is the id of the admin who sent the invitation, InvitedByUsername is joined from users
+	InvitedBy         int        `json:"-"`
+	InvitedByUsername string     `json:"invited_by"`
+	CreatedAt         time.Time  `json:"created_at"`
+	SentAt            time.Time  `json:"sent_at"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	AcceptedAt        *time.Time `json:"accepted_at,omitempty"`
+	// UserID is the user created on acceptance
+	UserID    *int       `json:"user_id,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
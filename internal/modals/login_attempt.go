@@ -0,0 +1,38 @@
+package modals
+
+import "time"
+
+// LoginAttempt represents an entry in Postgres Table login_attempts, one per authentication attempt
+type LoginAttempt struct {
+	ID int `json:"id"`
+	// UserID is 0 if the username didn't match a user
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username"`
+	// Method is "password", "federated:<provider>" or "step_up"
+	Method  string `json:"method"`
+	Success bool   `json:"success"`
+	// Reason says why an attempt failed, like "invalid_credentials" or "step_up_required"
+	Reason    string `json:"reason,omitempty"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Device    string `json:"device"`
+	// Country and City come from the GeoIP database, coordinates are nil if the IP wasn't found
+	Country   string    `json:"country,omitempty"`
+	City      string    `json:"city,omitempty"`
+	Latitude  *float64  `json:"latitude,omitempty"`
+	Longitude *float64  `json:"longitude,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SecurityEvent represents an entry in Postgres Table security_events, raised for suspicious logins
+type SecurityEvent struct {
+	ID             int `json:"id"`
+	UserID         int `json:"user_id"`
+	LoginAttemptID int `json:"login_attempt_id"`
+	// Kind is "new_device", "unusual_ip_range" or "impossible_travel"
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	// Action is what was done about it: "none", "notify" or "step_up"
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+}
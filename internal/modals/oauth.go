@@ -0,0 +1,28 @@
+package modals
+
+import "time"
+
+// OAuthClient represents an entry in Postgres Table oauth_clients
+type OAuthClient struct {
+	ID           int
+	ClientID     string
+	SecretHash   string
+	Name         string
+	Type         string
+	RedirectURIs []string
+	CreatedAt    string
+}
+
+// AuthorizationCode represents an entry in Postgres Table oauth_authorization_codes
+type AuthorizationCode struct {
+	CodeHash            string
+	ClientID            string
+	UserID              int
+	RedirectURI         string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	AuthTime            time.Time
+	ExpiresAt           time.Time
+}
@@ -0,0 +1,26 @@
+package modals
+
+import "time"
+
+// Outbox mail statuses
+const (
+	OutboxMailPending = "pending"
+	OutboxMailSent    = "sent"
+	// OutboxMailDead marks mails that failed too often and won't be retried
+	OutboxMailDead = "dead"
+)
+
+// OutboxMail represents an entry in Postgres Table mail_outbox
+type OutboxMail struct {
+	ID            int
+	Recipient     string
+	Subject       string
+	TextBody      string
+	HTMLBody      string
+	Status        string
+	Attempts      int
+	LastError     string
+	CreatedAt     time.Time
+	NextAttemptAt time.Time
+	SentAt        *time.Time
+}
@@ -0,0 +1,18 @@
+package modals
+
+import "time"
+
+// PersonalAccessToken represents an entry in Postgres Table personal_access_tokens
+type PersonalAccessToken struct {
+	ID         int
+	UserID     int
+	Username   string
+	Name       string
+	Prefix     string
+	TokenHash  string
+	Scopes     []string
+	CreatedAt  string
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+}
@@ -0,0 +1,11 @@
+package modals
+
+// ServiceAccount represents an entry in Postgres Table service_accounts together with its roles
+type ServiceAccount struct {
+	ID         int
+	Name       string
+	ClientID   string
+	SecretHash string
+	Roles      []string
+	CreatedAt  string
+}
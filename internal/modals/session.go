@@ -0,0 +1,18 @@
+package modals
+
+import "time"
+
+// Session represents an entry in Postgres Table sessions, created on every login
+type Session struct {
+	ID     int `json:"id"`
+	UserID int `json:"user_id"`
+	// Username is joined from users for the admin view
+	Username   string     `json:"username"`
+	Device     string     `json:"device"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
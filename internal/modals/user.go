@@ -1,9 +1,41 @@
 package modals
 
-// User represents an entry in Postgres Table Users
+import "time"
+
+// User statuses, only active users can log in
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+	UserStatusLocked   = "locked"
+	UserStatusPending  = "pending"
+)
+
+// User represents an entry in Postgres Table Users, handlers encode it as is
 type User struct {
-	ID        int
-	Username  string
-	Email     string
-	CreatedAt string
-}
\ No newline at end of file
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	DisplayName   string `json:"display_name"`
+	// Locale is a BCP 47 language tag used for mails, empty if the user didn't choose one
+	Locale string `json:"locale"`
+	// Timezone is an IANA time zone name like "Europe/Berlin", empty if the user didn't choose one
+	Timezone    string     `json:"timezone"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+	// Attributes holds the custom metadata validated against the AttributeSchema
+	Attributes map[string]interface{} `json:"attributes"`
+	// TokensValidAfter rejects refresh tokens issued earlier, nil if all are accepted
+	TokensValidAfter *time.Time `json:"-"`
+}
+
+// ValidUserStatus reports whether status is one of the UserStatus constants
+func ValidUserStatus(status string) bool {
+	switch status {
+	case UserStatusActive, UserStatusDisabled, UserStatusLocked, UserStatusPending:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package modals
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AttributeSchema represents the single entry in Postgres Table user_attribute_schema
+type AttributeSchema struct {
+	// Schema is the JSON Schema user attributes are validated against
+	Schema json.RawMessage `json:"schema"`
+	// ClaimAttributes names the attributes copied into access tokens
+	ClaimAttributes []string `json:"claim_attributes"`
+	// UserEditableAttributes names the attributes users may change themselves, all others only admins change
+	UserEditableAttributes []string  `json:"user_editable_attributes"`
+	UpdatedAt              time.Time `json:"updated_at"`
+}
+
+// UserFilter narrows ListUsers, zero values don't filter
+type UserFilter struct {
+	Status string
+	// Attributes matches users whose attributes contain these, like {"department": "sales"}
+	Attributes map[string]interface{}
+	Limit      int
+	Offset     int
+}
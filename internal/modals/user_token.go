@@ -0,0 +1,14 @@
+package modals
+
+import "time"
+
+// UserToken represents an entry in Postgres Table user_tokens
+type UserToken struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
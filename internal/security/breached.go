@@ -0,0 +1,68 @@
+package security
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedPasswords looks passwords up in a local copy of the Have I Been Pwned k-anonymity ranges: a directory
+// with one file per 5 character SHA-1 prefix (e.g. "21BD1" or "21BD1.txt") whose lines are "SUFFIX:COUNT", as the
+// range API and its downloaders produce them. Only the file of the password's prefix is read.
+type BreachedPasswords struct {
+	Dir string
+}
+
+// LoadBreachedPasswords checks that dir exists, nil if dir is empty so that lookups find nothing
+func LoadBreachedPasswords(dir string) (*BreachedPasswords, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &BreachedPasswords{Dir: dir}, nil
+}
+
+// Contains reports whether the password appears in a known breach. A nil BreachedPasswords contains nothing,
+// a missing prefix file means no breached password has that prefix.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(b.Dir, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		file, err = os.Open(filepath.Join(b.Dir, prefix+".txt"))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Padded ranges list made-up suffixes with a count of 0
+		if strings.EqualFold(line, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,122 @@
+package security
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"time"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// Kinds of findings
+const (
+	NewDevice        = "new_device"
+	UnusualIPRange   = "unusual_ip_range"
+	ImpossibleTravel = "impossible_travel"
+)
+
+// Finding is one reason a login looks suspicious
+type Finding struct {
+	Kind   string
+	Detail string
+}
+
+// Detector compares a login with the user's earlier successful logins
+type Detector struct {
+	GeoIP *GeoIP
+	// MaxSpeedKmh is the fastest travel between two logins that is still believed, about an airliner by default
+	MaxSpeedKmh float64
+	// MinTravelKm ignores jumps shorter than this, GeoIP locations are only accurate to a region
+	MinTravelKm float64
+}
+
+func NewDetector(geoIP *GeoIP) *Detector {
+	return &Detector{GeoIP: geoIP, MaxSpeedKmh: 1000, MinTravelKm: 500}
+}
+
+// Locate fills in country, city and coordinates of the attempt from its IP
+func (d *Detector) Locate(attempt *modals.LoginAttempt) {
+	location := d.GeoIP.Lookup(attempt.IP)
+	if location == nil {
+		return
+	}
+	attempt.Country = location.Country
+	attempt.City = location.City
+	attempt.Latitude = &location.Latitude
+	attempt.Longitude = &location.Longitude
+}
+
+// Check returns the findings for a located login given the user's earlier successful logins, newest first.
+// A user's first login has nothing to compare with and is never suspicious.
+func (d *Detector) Check(attempt modals.LoginAttempt, history []modals.LoginAttempt) []Finding {
+	if len(history) == 0 {
+		return nil
+	}
+	var findings []Finding
+
+	knownDevice, knownRange, knownCountry := false, false, false
+	for _, earlier := range history {
+		knownDevice = knownDevice || earlier.Device == attempt.Device
+		knownRange = knownRange || ipRangeOf(earlier.IP) == ipRangeOf(attempt.IP)
+		knownCountry = knownCountry || (earlier.Country != "" && earlier.Country == attempt.Country)
+	}
+	if !knownDevice {
+		findings = append(findings, Finding{NewDevice, "first login from " + attempt.Device})
+	}
+	// A new network in a country the user logged in from before is everyday roaming, without GeoIP the range decides
+	if !knownRange && (attempt.Country == "" || !knownCountry) {
+		findings = append(findings, Finding{UnusualIPRange, "first login from " + ipRangeOf(attempt.IP) + describeLocation(attempt)})
+	}
+
+	if attempt.Latitude != nil {
+		for _, earlier := range history {
+			if earlier.Latitude == nil {
+				continue
+			}
+			km := distanceKm(*earlier.Latitude, *earlier.Longitude, *attempt.Latitude, *attempt.Longitude)
+			hours := attempt.CreatedAt.Sub(earlier.CreatedAt).Hours()
+			if km >= d.MinTravelKm && (hours <= 0 || km/hours > d.MaxSpeedKmh) {
+				findings = append(findings, Finding{ImpossibleTravel, fmt.Sprintf("%.0f km from the login%s %s earlier",
+					km, describeLocation(earlier), attempt.CreatedAt.Sub(earlier.CreatedAt).Round(time.Second))})
+			}
+			break // Only the latest located login matters
+		}
+	}
+	return findings
+}
+
+// ipRangeOf returns the /16 of an IPv4 and the /32 of an IPv6 address, roughly the network of one provider
+func ipRangeOf(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := 32
+	if addr.Is4() {
+		bits = 16
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+func describeLocation(attempt modals.LoginAttempt) string {
+	switch {
+	case attempt.City != "":
+		return " in " + attempt.City + ", " + attempt.Country
+	case attempt.Country != "":
+		return " in " + attempt.Country
+	}
+	return ""
+}
+
+// distanceKm is the great-circle distance between two coordinates
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
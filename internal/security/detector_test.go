@@ -0,0 +1,83 @@
+package security
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+const testGeoIP = `1.0.0.0,1.0.0.255,OC,AU,Queensland,Brisbane,-27.4679,153.028
+81.0.0.0,81.0.255.255,EU,DE,Berlin,Berlin,52.5244,13.4105
+82.0.0.0,82.0.255.255,EU,DE,Bavaria,Munich,48.1371,11.5754
+2001:db8::,2001:db8::ffff,EU,DE,Hamburg,Hamburg,53.5511,9.9937
+`
+
+func kinds(findings []Finding) string {
+	var names []string
+	for _, finding := range findings {
+		names = append(names, finding.Kind)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	geoIP, err := ReadGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatalf("error reading GeoIP CSV. Err: %v", err)
+	}
+	for ip, want := range map[string]string{
+		"81.0.12.1":          "Berlin",
+		"::ffff:82.0.0.1":    "Munich",
+		"2001:db8::1":        "Hamburg",
+		"1.0.1.0":            "",
+		"not an ip":          "",
+		"2001:db8:0:1::1":    "",
+		"0.0.0.1":            "",
+		"255.255.255.255":    "",
+		"2001:db8::ffff:ff0": "",
+	} {
+		location := geoIP.Lookup(ip)
+		if (location == nil && want != "") || (location != nil && location.City != want) {
+			t.Errorf("Lookup(%q) = %+v; want %q", ip, location, want)
+		}
+	}
+	if (*GeoIP)(nil).Lookup("81.0.12.1") != nil {
+		t.Errorf("expected a nil GeoIP to know no locations")
+	}
+}
+
+func TestDetector(t *testing.T) {
+	geoIP, err := ReadGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatalf("error reading GeoIP CSV. Err: %v", err)
+	}
+	detector := NewDetector(geoIP)
+	now := time.Now()
+	attempt := func(ip string, device string, at time.Time) modals.LoginAttempt {
+		login := modals.LoginAttempt{IP: ip, Device: device, CreatedAt: at, Success: true}
+		detector.Locate(&login)
+		return login
+	}
+	history := []modals.LoginAttempt{attempt("81.0.12.1", "Firefox on Linux", now.Add(-2*time.Hour))}
+
+	if findings := detector.Check(attempt("81.0.12.1", "Firefox on Linux", now), nil); findings != nil {
+		t.Errorf("expected the first login not to be suspicious; got %v", findings)
+	}
+	if got := kinds(detector.Check(attempt("81.0.99.7", "Firefox on Linux", now), history)); got != "" {
+		t.Errorf("expected a known device and network not to be suspicious; got %s", got)
+	}
+	// Munich is a new network but in a known country, and 500 km in two hours is possible
+	if got := kinds(detector.Check(attempt("82.0.0.1", "Chrome on Android", now), history)); got != NewDevice {
+		t.Errorf("expected only a new device; got %s", got)
+	}
+	// Brisbane two hours after Berlin is not
+	if got := kinds(detector.Check(attempt("1.0.0.1", "Firefox on Linux", now), history)); got != UnusualIPRange+","+ImpossibleTravel {
+		t.Errorf("expected an unusual range and impossible travel; got %s", got)
+	}
+	// Without GeoIP data only the network counts
+	if got := kinds(detector.Check(attempt("203.0.113.9", "Firefox on Linux", now), history)); got != UnusualIPRange {
+		t.Errorf("expected an unusual range; got %s", got)
+	}
+}
@@ -0,0 +1,102 @@
+// Package security detects suspicious logins from the login history of a user.
+package security
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Location is where an IP address is, as far as the GeoIP database knows
+type Location struct {
+	Country   string
+	City      string
+	Latitude  float64
+	Longitude float64
+}
+
+type ipRange struct {
+	start, end netip.Addr
+	location   *Location
+}
+
+// GeoIP looks up locations in an offline database loaded into memory. A nil *GeoIP knows no locations.
+type GeoIP struct {
+	ranges []ipRange
+}
+
+// LoadGeoIP reads a CSV file in the layout of the DB-IP "IP to City Lite" download, without header:
+// ip_start,ip_end,continent,country,stateprov,city,latitude,longitude
+func LoadGeoIP(path string) (*GeoIP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadGeoIP(file)
+}
+
+func ReadGeoIP(r io.Reader) (*GeoIP, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 8
+	reader.ReuseRecord = true
+
+	var ranges []ipRange
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, err := netip.ParseAddr(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		end, err := netip.ParseAddr(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		latitude, err := strconv.ParseFloat(record[6], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		longitude, err := strconv.ParseFloat(record[7], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ranges = append(ranges, ipRange{start: start, end: end, location: &Location{
+			Country:   record[3],
+			City:      record[5],
+			Latitude:  latitude,
+			Longitude: longitude,
+		}})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	return &GeoIP{ranges: ranges}, nil
+}
+
+// Lookup returns the location of ip, or nil if it is unknown or not an IP address
+func (g *GeoIP) Lookup(ip string) *Location {
+	if g == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	// The last range starting at or before addr is the only one that can contain it
+	i := sort.Search(len(g.ranges), func(i int) bool { return addr.Less(g.ranges[i].start) }) - 1
+	if i < 0 || g.ranges[i].end.Less(addr) || g.ranges[i].start.BitLen() != addr.BitLen() {
+		return nil
+	}
+	return g.ranges[i].location
+}
@@ -0,0 +1,117 @@
+package security
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPasswordBytes is the most bcrypt looks at, longer passwords would be silently truncated
+const maxPasswordBytes = 72
+
+// PasswordPolicy are the rules new passwords have to follow. The zero value only enforces what bcrypt needs.
+type PasswordPolicy struct {
+	// MinLength counts characters, not bytes
+	MinLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits and symbols a password must mix
+	MinClasses int
+	// DisallowPersonal rejects passwords containing the username or the local part of the email address
+	DisallowPersonal bool
+	// History is how many of the user's previous passwords, the current one included, may not be reused
+	History int
+}
+
+// PasswordPolicyFromEnv reads PASSWORD_MIN_LENGTH (default 8), PASSWORD_MIN_CLASSES (default 1),
+// PASSWORD_DISALLOW_PERSONAL (default true) and PASSWORD_HISTORY (default 5)
+func PasswordPolicyFromEnv() (PasswordPolicy, error) {
+	policy := PasswordPolicy{MinLength: 8, MinClasses: 1, DisallowPersonal: true, History: 5}
+	for key, target := range map[string]*int{
+		"PASSWORD_MIN_LENGTH":  &policy.MinLength,
+		"PASSWORD_MIN_CLASSES": &policy.MinClasses,
+		"PASSWORD_HISTORY":     &policy.History,
+	} {
+		if value := os.Getenv(key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return policy, fmt.Errorf("%s must be a non-negative number", key)
+			}
+			*target = n
+		}
+	}
+	if policy.MinClasses > 4 {
+		return policy, fmt.Errorf("PASSWORD_MIN_CLASSES can be at most 4")
+	}
+	if value := os.Getenv("PASSWORD_DISALLOW_PERSONAL"); value != "" {
+		disallow, err := strconv.ParseBool(value)
+		if err != nil {
+			return policy, fmt.Errorf("PASSWORD_DISALLOW_PERSONAL: %w", err)
+		}
+		policy.DisallowPersonal = disallow
+	}
+	return policy, nil
+}
+
+// PasswordPolicyError lists every rule a password broke, so users can fix them all at once
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password " + strings.Join(e.Violations, ", ")
+}
+
+// Check returns a *PasswordPolicyError if the password of the user with the given username and email breaks the policy.
+// Reuse is checked separately since it needs the stored hashes, see History.
+func (p PasswordPolicy) Check(password string, username string, email string) error {
+	var violations []string
+	if password == "" {
+		violations = append(violations, "must not be empty")
+	} else if n := utf8.RuneCountInString(password); n < p.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, fmt.Sprintf("must be at most %d bytes long", maxPasswordBytes))
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+	}
+	if p.DisallowPersonal {
+		lower := strings.ToLower(password)
+		local, _, _ := strings.Cut(email, "@")
+		if containsPersonal(lower, username) {
+			violations = append(violations, "must not contain the username")
+		}
+		if containsPersonal(lower, local) {
+			violations = append(violations, "must not contain the email address")
+		}
+	}
+	if violations != nil {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// containsPersonal ignores very short names, which would forbid too many passwords by accident
+func containsPersonal(password string, value string) bool {
+	return utf8.RuneCountInString(value) >= 3 && strings.Contains(password, strings.ToLower(value))
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
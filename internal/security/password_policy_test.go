@@ -0,0 +1,61 @@
+package security
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, MinClasses: 3, DisallowPersonal: true}
+	cases := []struct {
+		password   string
+		violations []string
+	}{
+		{"correct Horse 9", nil},
+		{"", []string{"must not be empty", "must mix at least 3 of lowercase letters, uppercase letters, digits and symbols"}},
+		{"short1A", []string{"must be at least 10 characters long"}},
+		{"alllowercaseletters", []string{"must mix at least 3 of lowercase letters, uppercase letters, digits and symbols"}},
+		{"Hi-Alice-2024", []string{"must not contain the username"}},
+		{"Mail4Alice.Smith", []string{"must not contain the username", "must not contain the email address"}},
+		{"Aa1" + string(make([]byte, 70)), []string{"must be at most 72 bytes long"}},
+	}
+	for _, c := range cases {
+		err := policy.Check(c.password, "alice", "alice.smith@example.com")
+		var policyErr *PasswordPolicyError
+		if c.violations == nil {
+			if err != nil {
+				t.Errorf("expected %q to pass; got %v", c.password, err)
+			}
+			continue
+		}
+		if !errors.As(err, &policyErr) || !reflect.DeepEqual(policyErr.Violations, c.violations) {
+			t.Errorf("expected %q to break %v; got %v", c.password, c.violations, err)
+		}
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	err := os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte("003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breached, err := LoadBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := breached.Contains("password"); err != nil || !found {
+		t.Errorf("expected \"password\" to be breached; got %v, %v", found, err)
+	}
+	if found, err := breached.Contains("correct horse battery staple 9"); err != nil || found {
+		t.Errorf("expected a prefix without file to be clean; got %v, %v", found, err)
+	}
+	if found, _ := (*BreachedPasswords)(nil).Contains("password"); found {
+		t.Errorf("expected no breached passwords without a directory")
+	}
+}
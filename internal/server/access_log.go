@@ -0,0 +1,88 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// statusRecorder remembers the status and size of a response for the access log
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+    if w.status == 0 {
+        w.status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(b)
+    w.bytes += n
+    return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// accessLogMiddleware serves the router, logs one line per request with method, route template, status, latency
+// and response size, records the request in the HTTP metrics and names the span of the request after its route. It uses the route template instead of the path,
+// so IDs and tokens in paths and query strings never reach the log and the metrics keep a bounded set of labels.
+func accessLogMiddleware(router *mux.Router) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        recorder := &statusRecorder{ResponseWriter: w}
+        router.ServeHTTP(recorder, r)
+
+        status := recorder.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        route := routeTemplate(router, r)
+        latency := time.Since(start)
+        span := trace.SpanFromContext(r.Context())
+        span.SetName(r.Method + " " + route)
+        span.SetAttributes(attribute.String("http.route", route))
+        observeRequest(r.Method, route, status, latency)
+
+        level := slog.LevelInfo
+        if status >= http.StatusInternalServerError {
+            level = slog.LevelError
+        }
+        slog.LogAttrs(r.Context(), level, "request",
+            slog.String("method", r.Method),
+            slog.String("route", route),
+            slog.Int("status", status),
+            slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+            slog.Int("bytes", recorder.bytes),
+            slog.String("client_ip", clientIP(r)),
+        )
+    })
+}
+
+// routeTemplate returns the template of the route the request matches, like "/v1/users/{username}",
+// or "unmatched" for requests no route answers
+func routeTemplate(router *mux.Router, r *http.Request) string {
+    var match mux.RouteMatch
+    if !router.Match(r, &match) || match.Route == nil {
+        return "unmatched"
+    }
+    template, err := match.Route.GetPathTemplate()
+    if err != nil {
+        return "unmatched"
+    }
+    return pathTemplate(template)
+}
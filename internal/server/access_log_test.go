@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"jjr-tec-backend/internal/logging"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(logging.New(&out, true, slog.LevelInfo))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	_, server := newTestServer(t, db)
+	admin := testAccessToken(t, db, "admin", "admin")
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/v1/users/alice/status", strings.NewReader(`{"status":"disabled"}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	req.Header.Set("X-Request-ID", "req-42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v %v", resp, err)
+	}
+	resp.Body.Close()
+	doJSON(t, http.MethodGet, server.URL+"/v1/verify-email?token=secret-token", "", nil, nil)
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected JSON log lines; got %q", line)
+		}
+		lines = append(lines, entry)
+	}
+
+	var audit, access map[string]interface{}
+	for _, entry := range lines {
+		switch entry["msg"] {
+		case "set user status":
+			audit = entry
+		case "request":
+			if access == nil {
+				access = entry
+			}
+		}
+	}
+	if audit == nil || audit["request_id"] != "req-42" || audit["username"] != "alice" {
+		t.Errorf("expected the audit line to carry the request ID; got %v", audit)
+	}
+	if access == nil || access["request_id"] != "req-42" || access["route"] != "/v1/users/{username}/status" ||
+		access["method"] != http.MethodPut || access["status"] != float64(http.StatusOK) || access["bytes"].(float64) == 0 {
+		t.Errorf("expected an access log line for the request; got %v", access)
+	}
+	if strings.Contains(out.String(), "secret-token") || strings.Contains(out.String(), admin) {
+		t.Errorf("expected no tokens in the log; got %s", out.String())
+	}
+}
@@ -1,65 +1,176 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/auth"
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
 )
 
 type UsernameStruct struct {
     Username string `json:"username"`
 }
 
+func (req *UsernameStruct) Normalize() {
+    req.Username = normalizeUsername(req.Username)
+}
+
+func (req *UsernameStruct) Validate() []FieldError {
+    var fields fieldErrors
+    fields.required("username", req.Username)
+    return fields
+}
+
+// AccountLookupRequest is the body of the legacy lookups GET /account and GET /protected/roles. They were
+// documented as taking the username and password, so old clients send both. The password is accepted and ignored.
+type AccountLookupRequest struct {
+    Username string `json:"username"`
+    Password string `json:"password,omitempty"`
+}
+
+func (req *AccountLookupRequest) Normalize() {
+    req.Username = normalizeUsername(req.Username)
+}
+
+func (req *AccountLookupRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.required("username", req.Username)
+    return fields
+}
+
 type TokenResponse struct {
     AccessToken  string `json:"access_token"`
     RefreshToken string `json:"refresh_token"`
 }
 
-// HandleAccountJwt generates both an access token and a refresh token for the user
+type LoginRequest struct {
+    Username string `json:"username"`
+    Password string `json:"password"`
+}
+
+func (req *LoginRequest) Normalize() {
+    req.Username = normalizeUsername(req.Username)
+}
+
+// HandleAccountJwt checks the username and password with the configured authenticators and generates both an access token and a refresh token for the user
 func (s *Server) HandleAccountJwt(w http.ResponseWriter, r *http.Request) {
-    var usernameStruct UsernameStruct
-    if err := json.NewDecoder(r.Body).Decode(&usernameStruct); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    var req LoginRequest
+    if !decodeJSON(w, r, &req) {
         return
     }
 
-    // Check if the user exists in the database
-    roles, err := s.db.GetRolesByUsername(usernameStruct.Username)
+    user, err := s.authenticator.Authenticate(r.Context(), req.Username, req.Password)
+    if errors.Is(err, auth.ErrInvalidCredentials) {
+        // The attempt is tied to the user even if the username only exists locally, so targeted guessing shows up in their history
+        known, _ := s.db.GetUserByUsername(r.Context(), req.Username)
+        s.recordFailedLogin(r, req.Username, known, methodPassword, "invalid_credentials")
+        writeProblem(w, r, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password")
+        return
+    }
+    if errors.Is(err, auth.ErrUnlinkedAccount) {
+        known, _ := s.db.GetUserByUsername(r.Context(), req.Username)
+        s.recordFailedLogin(r, req.Username, known, methodPassword, "unlinked_account")
+        writeProblem(w, r, http.StatusConflict, "unlinked_account", "A local account already uses this username, an administrator has to resolve the conflict")
+        return
+    }
     if err != nil {
-        http.Error(w, "Error querying database", http.StatusInternalServerError)
+        slog.ErrorContext(r.Context(), "authenticating user failed", "username", req.Username, "error", err)
+        writeProblem(w, r, http.StatusInternalServerError, codeInternalError, "Error authenticating user")
+        return
+    }
+    if !s.checkLoginAllowed(w, r, user, methodPassword) {
+        return
+    }
+
+    // Check if the user has any roles
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
         return
     }
     if roles == nil {
-        http.Error(w, "Invalid username", http.StatusUnauthorized)
+        writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid username")
         return
     }
 
-    // Generate Access Token (short-lived)
-    accessClaims := jwt.MapClaims{
-        "username":  usernameStruct.Username,
-        "role":      roles, 
-        "exp":       time.Now().Add(1 * time.Minute).Unix(), // Access token expires in 1 min
-        "iat":       time.Now().Unix(),
+    s.completeLogin(w, r, user, roles, methodPassword)
+}
+
+// checkLoginAllowed responds with 403 and returns false if the user may not log in: accounts that aren't active
+// and, with REQUIRE_VERIFIED_EMAIL, accounts with an unverified address. Refused logins go into the login history.
+func (s *Server) checkLoginAllowed(w http.ResponseWriter, r *http.Request, user *modals.User, method string) bool {
+    if user.Status != modals.UserStatusActive {
+        s.recordFailedLogin(r, user.Username, user, method, "account_"+user.Status)
+        writeProblem(w, r, http.StatusForbidden, "account_"+user.Status, "Account is "+user.Status)
+        return false
+    }
+    if requireVerifiedEmail && !user.EmailVerified {
+        s.recordFailedLogin(r, user.Username, user, method, "email_not_verified")
+        writeProblem(w, r, http.StatusForbidden, "email_not_verified", "Email address not verified")
+        return false
+    }
+    return true
+}
+
+// accessTokenClaims are the claims of the short-lived access tokens issued for a session, by logins and refreshes
+func (s *Server) accessTokenClaims(ctx context.Context, user *modals.User, roles []string, session *modals.Session) jwt.MapClaims {
+    claims := jwt.MapClaims{
+        "typ":      tokenTypeAccess,
+        "username": user.Username,
+        "role":     roles,
+        "sub_type": subjectTypeUser,
+        "sid":      session.ID,
+        "exp":      time.Now().Add(1 * time.Minute).Unix(), // Access token expires in 1 min
+        "iat":      time.Now().Unix(),
+    }
+    if attributes := s.attributeClaims(ctx, user); attributes != nil {
+        claims["attributes"] = attributes
+    }
+    return claims
+}
+
+// writeTokenPair starts a session for the user and responds with a new access token and refresh token for it
+func (s *Server) writeTokenPair(w http.ResponseWriter, r *http.Request, user *modals.User, roles []string) {
+    username := user.Username
+    session, err := s.startSession(r, user)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error starting session"))
+        return
     }
-    accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
+
+    // Generate Access Token (short-lived)
+    accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, s.accessTokenClaims(r.Context(), user, roles, session))
     accessTokenString, err := accessToken.SignedString([]byte(jwtKey))
     if err != nil {
-        http.Error(w, "Error generating access token", http.StatusInternalServerError)
+        writeProblem(w, r, http.StatusInternalServerError, codeInternalError, "Error generating access token")
         return
     }
 
     // Generate Refresh Token (long-lived)
     refreshClaims := jwt.MapClaims{
-        "username": usernameStruct.Username,
-        "exp":      time.Now().Add(7 * 24 * time.Hour).Unix(), // Refresh token expires in 7 days
+        "typ":      tokenTypeRefresh,
+        "username": username,
+        "sub_type": subjectTypeUser,
+        "sid":      session.ID,
+        "exp":      session.ExpiresAt.Unix(), // Refresh token expires with the session after 7 days
         "iat":      time.Now().Unix(),
     }
     refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
     refreshTokenString, err := refreshToken.SignedString([]byte(jwtKey))
     if err != nil {
-        http.Error(w, "Error generating refresh token", http.StatusInternalServerError)
+        writeProblem(w, r, http.StatusInternalServerError, codeInternalError, "Error generating refresh token")
         return
     }
 
@@ -67,6 +178,8 @@ func (s *Server) HandleAccountJwt(w http.ResponseWriter, r *http.Request) {
         AccessToken:  accessTokenString,
         RefreshToken: refreshTokenString,
     }
+    tokensIssued.WithLabelValues("access", grantSession).Inc()
+    tokensIssued.WithLabelValues("refresh", grantSession).Inc()
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(response)
@@ -79,59 +192,80 @@ func (s *Server) RefreshHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     // Decode the incoming request to get the refresh token
-    if err := json.NewDecoder(r.Body).Decode(&tokenReq); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &tokenReq) {
         return
     }
 
     // Parse the JWT token
     token, err := jwt.Parse(tokenReq.RefreshToken, func(token *jwt.Token) (interface{}, error) {
         return []byte(jwtKey), nil
-    })
+    }, jwt.WithValidMethods([]string{"HS256"}))
     if err != nil || !token.Valid {
-        http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+        writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid refresh token")
         return
     }
 
     // Extract claims from the token and ensure they are in the correct format
     claims, ok := token.Claims.(jwt.MapClaims)
-    if !ok || claims["username"] == nil {
-        http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+    username, _ := claims["username"].(string)
+    if !ok || username == "" || claims["typ"] != tokenTypeRefresh {
+        writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid token claims")
         return
     }
 
-    // Extract the username from claims
-    username := claims["username"].(string)
+    // Refresh tokens issued before the last password change or reset are no longer accepted
+    user, err := s.db.GetUserByUsername(r.Context(), username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    iat, _ := claims["iat"].(float64)
+    if user == nil || (user.TokensValidAfter != nil && int64(iat) < user.TokensValidAfter.Unix()) {
+        writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid refresh token")
+        return
+    }
+    if user.Status != modals.UserStatusActive {
+        writeProblem(w, r, http.StatusForbidden, "account_"+user.Status, "Account is "+user.Status)
+        return
+    }
+
+    // The session must still be active, users and admins end sessions to sign devices out
+    session, err := s.db.GetSession(r.Context(), sessionFromClaims(claims))
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if session == nil || session.UserID != user.ID || session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+        writeProblem(w, r, http.StatusUnauthorized, "session_ended", "Session has ended")
+        return
+    }
+    if err := s.db.TouchSession(r.Context(), session.ID, clientIP(r), r.UserAgent()); err != nil {
+        slog.ErrorContext(r.Context(), "touching session failed", "session_id", session.ID, "error", err)
+    }
 
     // Check if the user exists in the database
-    roles, err := s.db.GetRolesByUsername(username)
+    roles, err := s.db.GetRolesByUsername(r.Context(), username)
     if err != nil {
-        http.Error(w, "Error querying database", http.StatusInternalServerError)
+        writeError(w, r, dbError(err, "Error querying database"))
         return
     }
     if roles == nil {
-        http.Error(w, "Invalid username", http.StatusUnauthorized)
+        writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid username")
         return
     }
 
     // Generate Access Token (short-lived)
-    accessClaims := jwt.MapClaims{
-        "username":  username,
-        "role":      roles, 
-        "exp":       time.Now().Add(1 * time.Minute).Unix(), // Access token expires in 1 min
-        "iat":       time.Now().Unix(),
-    }
-
-    accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
+    accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, s.accessTokenClaims(r.Context(), user, roles, session))
     accessTokenString, err := accessToken.SignedString([]byte(jwtKey))
     if err != nil {
-        http.Error(w, "Error generating access token", http.StatusInternalServerError)
+        writeProblem(w, r, http.StatusInternalServerError, codeInternalError, "Error generating access token")
         return
     }
 
     response := map[string]string{
         "token": accessTokenString,
     }
+    tokensIssued.WithLabelValues("access", grantRefresh).Inc()
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(response)
@@ -139,24 +273,23 @@ func (s *Server) RefreshHandler(w http.ResponseWriter, r *http.Request) {
 
 
 func (s *Server) HandleAccountDB(w http.ResponseWriter, r *http.Request) {
-    var usernameStruct UsernameStruct
-    if err := json.NewDecoder(r.Body).Decode(&usernameStruct); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    var usernameStruct AccountLookupRequest
+    if !decodeJSON(w, r, &usernameStruct) {
         return
     }
 
     // Check if the user exists in the database
-    user, err := s.db.GetUserByUsername(usernameStruct.Username)
+    user, err := s.db.GetUserByUsername(r.Context(), usernameStruct.Username)
     if err != nil {
-        http.Error(w, "Error querying database", http.StatusInternalServerError)
+        writeError(w, r, dbError(err, "Error querying database"))
         return
     }
     if user == nil {
-        http.Error(w, "Invalid username", http.StatusUnauthorized)
+        writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid username")
         return
     }
 
-    // Respond with the user's information (excluding password)
+    // Respond with the user's information. The route needs no login, so it shows only what it always did.
     response := map[string]interface{}{
         "id":         user.ID,
         "username":   user.Username,
@@ -174,92 +307,221 @@ type AccountRegisterRequest struct {
     Password string `json:"password"`
 }
 
+func (req *AccountRegisterRequest) Normalize() {
+    req.Username = normalizeUsername(req.Username)
+    req.Email = normalizeEmail(req.Email)
+}
+
+// Validate checks the fields on their own, the password policy is checked by the handler
+func (req *AccountRegisterRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.username("username", req.Username)
+    fields.email("email", req.Email, false)
+    fields.required("password", req.Password)
+    return fields
+}
+
 //Takes the AccountRegisterRequest struct params and writes them in the Users Table to register an new User, ID and created_at get filled automaticaly
 func (s *Server) AccountRegisterHandlerDB(w http.ResponseWriter, r *http.Request) {
+    if s.registerUser(w, r) == nil {
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    w.Write([]byte("User registered successfully"))
+}
+
+// registerUser creates the user described by the AccountRegisterRequest in the body and mails a link to verify
+// the email address. It returns nil after responding with an error.
+func (s *Server) registerUser(w http.ResponseWriter, r *http.Request) *modals.User {
     var req AccountRegisterRequest
 
     // Parse the JSON request
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
-        return
+    if !decodeJSON(w, r, &req) {
+        return nil
+    }
+    if !s.checkNewPassword(w, r, req.Password, req.Username, req.Email, 0) {
+        return nil
     }
 
     // Insert the user into the database
-    err := s.db.CreateUser(req.Username, req.Email, req.Password)
-    if err != nil {
-        http.Error(w, "Failed to register user", http.StatusInternalServerError)
-        return
+    err := s.db.CreateUser(r.Context(), req.Username, req.Email, req.Password)
+    if errors.Is(err, database.ErrConflict) {
+        writeProblem(w, r, http.StatusConflict, codeConflict, "Username or email address is already taken")
+        return nil
+    } else if err != nil {
+        writeError(w, r, dbError(err, "Failed to register user"))
+        return nil
     }
+    slog.InfoContext(r.Context(), "registered user", "actor", subjectFromContext(r.Context()), "username", req.Username)
 
-    w.WriteHeader(http.StatusCreated)
-    w.Write([]byte("User registered successfully"))
+    user, err := s.db.GetUserByUsername(r.Context(), req.Username)
+    if err != nil || user == nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return nil
+    }
+    // The account is usable without a verified address unless REQUIRE_VERIFIED_EMAIL is set, so a failed mail doesn't fail the registration
+    if user.Email == "" {
+        slog.InfoContext(r.Context(), "not sending verification email, user has no address", "username", req.Username)
+    } else if err := s.sendVerificationEmail(r, user); err != nil {
+        slog.ErrorContext(r.Context(), "sending verification email failed", "username", req.Username, "error", err)
+    }
+    return user
 }
 
 type RolesRegisterRequest struct {
     Role_Name string `json:"role_name"`
 }
 
+func (req *RolesRegisterRequest) Normalize() {
+    req.Role_Name = strings.TrimSpace(req.Role_Name)
+}
+
+func (req *RolesRegisterRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.roleName("role_name", req.Role_Name)
+    return fields
+}
+
 //Takes the RolesRegisterRequest struct params and writes them in the Roles Table to register an new Role, ID get's filled automaticaly
 func (s *Server) RolesRegisterHandlerDB(w http.ResponseWriter, r *http.Request) {
+    if _, ok := s.registerRole(w, r); !ok {
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    w.Write([]byte("Role registered successfully"))
+}
+
+// RoleCreateHandler creates the role in the body and responds with it, Location points to the new role
+func (s *Server) RoleCreateHandler(w http.ResponseWriter, r *http.Request) {
+    role, ok := s.registerRole(w, r)
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/v1/roles/"+url.PathEscape(role))
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(RolesRegisterRequest{Role_Name: role})
+}
+
+// registerRole creates the role described by the RolesRegisterRequest in the body and returns its name.
+// It returns false after responding with an error.
+func (s *Server) registerRole(w http.ResponseWriter, r *http.Request) (string, bool) {
     var req RolesRegisterRequest
 
     // Parse the JSON request
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &req) {
+        return "", false
+    }
+
+    // Insert the role into the database
+    err := s.db.CreateRole(r.Context(), req.Role_Name)
+    if errors.Is(err, database.ErrConflict) {
+        writeProblem(w, r, http.StatusConflict, "role_exists", "Role "+req.Role_Name+" already exists")
+        return "", false
+    } else if err != nil {
+        writeError(w, r, dbError(err, "Failed to register role"))
+        return "", false
+    }
+    slog.InfoContext(r.Context(), "registered role", "actor", subjectFromContext(r.Context()), "role", req.Role_Name)
+    return req.Role_Name, true
+}
+
+// RoleListHandler responds with the names of all roles
+func (s *Server) RoleListHandler(w http.ResponseWriter, r *http.Request) {
+    roles, err := s.db.ListRoles(r.Context())
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
         return
     }
 
-    // Insert the user into the database
-    err := s.db.CreateRole(req.Role_Name)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(roles)
+}
+
+// RoleHandler responds with the role named in the path, roles have no other fields yet
+func (s *Server) RoleHandler(w http.ResponseWriter, r *http.Request) {
+    roles, err := s.db.ListRoles(r.Context())
     if err != nil {
-        http.Error(w, "Failed to register role", http.StatusInternalServerError)
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    role := mux.Vars(r)["role_name"]
+    if !slices.Contains(roles, role) {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Role not found")
         return
     }
 
-    w.WriteHeader(http.StatusCreated)
-    w.Write([]byte("Role registered successfully"))
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(RolesRegisterRequest{Role_Name: role})
 }
 
 type RolesAssignment struct {
     Username string `json:"username"`
     Role_Name string `json:"role_name"`
+    // Password is accepted from old clients, which were told to send it, and ignored
+    Password string `json:"password,omitempty"`
+}
+
+func (req *RolesAssignment) Normalize() {
+    req.Username = normalizeUsername(req.Username)
+    req.Role_Name = strings.TrimSpace(req.Role_Name)
+}
+
+// Validate only asks for the names, whether user and role exist is up to the database
+func (req *RolesAssignment) Validate() []FieldError {
+    var fields fieldErrors
+    if fields.required("username", req.Username) {
+        fields.maxLength("username", req.Username, maxUsernameLength)
+    }
+    if fields.required("role_name", req.Role_Name) {
+        fields.maxLength("role_name", req.Role_Name, maxRoleNameLength)
+    }
+    return fields
 }
 
 func (s *Server) HandleRoleAddedToUserDB(w http.ResponseWriter, r *http.Request) {
     var req RolesAssignment
 
     // Parse the JSON request
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &req) {
         return
     }
 
     // Insert the user into the database
-    err := s.db.AssignRoleToUser(req.Username, req.Role_Name)
-    if err != nil {
-        http.Error(w, "Failed to assign role", http.StatusInternalServerError)
+    err := s.db.AssignRoleToUser(r.Context(), req.Username, req.Role_Name)
+    if errors.Is(err, database.ErrNotFound) {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "User or role not found")
+        return
+    } else if errors.Is(err, database.ErrConflict) {
+        writeProblem(w, r, http.StatusConflict, codeConflict, "User already has role "+req.Role_Name)
+        return
+    } else if err != nil {
+        writeError(w, r, dbError(err, "Failed to assign role"))
         return
     }
+    slog.InfoContext(r.Context(), "assigned role", "actor", subjectFromContext(r.Context()), "role", req.Role_Name, "username", req.Username)
 
     w.WriteHeader(http.StatusCreated)
     w.Write([]byte("Role assigned successfully"))
 }
 
 func (s *Server) HandleGetUserRole(w http.ResponseWriter, r *http.Request) {
-    var usernameStruct UsernameStruct
-    if err := json.NewDecoder(r.Body).Decode(&usernameStruct); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    var usernameStruct AccountLookupRequest
+    if !decodeJSON(w, r, &usernameStruct) {
         return
     }
 
     // Check if the user exists in the database
-    roles, err := s.db.GetRolesByUsername(usernameStruct.Username)
+    roles, err := s.db.GetRolesByUsername(r.Context(), usernameStruct.Username)
     if err != nil {
-        http.Error(w, "Error querying database", http.StatusInternalServerError)
+        writeError(w, r, dbError(err, "Error querying database"))
         return
     }
     if roles == nil {
-        http.Error(w, "Invalid username", http.StatusUnauthorized)
+        writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid username")
         return
     }
 
@@ -1,56 +1,206 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// Values of the sub_type claim, they tell tokens issued to humans apart from tokens issued to machines
+const (
+    subjectTypeUser           = "user"
+    subjectTypeServiceAccount = "service_account"
+)
+
+// Values of the typ claim. Every JWT signed with jwtKey says what it is for, so a refresh token or the federation
+// state can't stand in for an access token. tokenTypePAT marks the claims AuthMiddleware builds from a personal
+// access token.
+const (
+    tokenTypeAccess          = "access"
+    tokenTypeRefresh         = "refresh"
+    tokenTypePAT             = "pat"
+    tokenTypeFederationState = "federation_state"
 )
 
-// AuthMiddleware checks the Authorization header for a valid JWT token.
+// claimsFromContext returns the JWT claims AuthMiddleware stored for the request, or nil
+func claimsFromContext(ctx context.Context) jwt.MapClaims {
+    claims, _ := ctx.Value(claimsContextKey).(jwt.MapClaims)
+    return claims
+}
+
+// subjectFromContext describes who the request was authenticated as, for example "user:alice" or
+// "service_account:sa_abc", so log lines show whether a human or a machine acted
+func subjectFromContext(ctx context.Context) string {
+    claims := claimsFromContext(ctx)
+    if claims == nil {
+        return "anonymous"
+    }
+    if claims["sub_type"] == subjectTypeServiceAccount {
+        clientID, _ := claims["client_id"].(string)
+        return subjectTypeServiceAccount + ":" + clientID
+    }
+    username, _ := claims["username"].(string)
+    return subjectTypeUser + ":" + username
+}
+
+// AuthMiddleware checks the Authorization header for a valid JWT token or personal access token.
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         tokenString := r.Header.Get("Authorization")
 
         if tokenString == "" {
-            http.Error(w, "Missing token", http.StatusUnauthorized)
+            writeProblem(w, r, http.StatusUnauthorized, "missing_token", "Missing token")
             return
         }
 
         // Remove "Bearer " prefix if it exists
         tokenString = strings.TrimPrefix(tokenString, "Bearer ")
 
+        // Personal access tokens are looked up in the database instead of being parsed
+        if strings.HasPrefix(tokenString, patPrefix) {
+            claims, err := s.authenticatePAT(r.Context(), tokenString)
+            if err != nil {
+                writeError(w, r, dbError(err, "Error querying database"))
+                return
+            }
+            if claims == nil {
+                writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid token")
+                return
+            }
+            ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+            next.ServeHTTP(w, r.WithContext(ctx))
+            return
+        }
+
         // Parse the JWT token
         token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
             return []byte(jwtKey), nil
-        })
+        }, jwt.WithValidMethods([]string{"HS256"}))
 
         if err != nil || !token.Valid {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
+            writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid token")
             return
         }
 
         // Extract claims from the token
         claims, ok := token.Claims.(jwt.MapClaims)
         if !ok {
-            http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+            writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid token claims")
+            return
+        }
+
+        // Tokens for an audience or scope are meant for someone else than this API, like an OAuth client
+        if claims["aud"] != nil || claims["scope"] != nil {
+            writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Token is not valid for this API")
             return
         }
 
         // Check if the token has expired
         exp, expOk := claims["exp"].(float64)
         if !expOk {
-            http.Error(w, "Invalid expiration claim", http.StatusUnauthorized)
+            writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid expiration claim")
             return
         }
 
         if time.Now().Unix() > int64(exp) {
-            http.Error(w, "Token has expired", http.StatusUnauthorized)
+            writeProblem(w, r, http.StatusUnauthorized, "token_expired", "Token has expired")
+            return
+        }
+
+        if claims["typ"] != tokenTypeAccess {
+            writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid token type")
             return
         }
+        if claims["sub_type"] == subjectTypeServiceAccount {
+            valid, err := s.serviceAccountTokenValid(r.Context(), claims)
+            if err != nil {
+                writeError(w, r, dbError(err, "Error querying database"))
+                return
+            }
+            if !valid {
+                writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Service account no longer exists")
+                return
+            }
+        } else {
+            valid, err := s.sessionTokenValid(r.Context(), claims)
+            if err != nil {
+                writeError(w, r, dbError(err, "Error querying database"))
+                return
+            }
+            if !valid {
+                writeProblem(w, r, http.StatusUnauthorized, "session_ended", "Session has ended")
+                return
+            }
+        }
 
-        // Token is valid and not expired; proceed with the request
-        next.ServeHTTP(w, r)
+        // Token is valid and not expired; proceed with the request and make the claims available to handlers
+        ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+        next.ServeHTTP(w, r.WithContext(ctx))
     })
 }
+
+// sessionTokenValid reports whether the user of an access token is still active and its session still running.
+// Ending a session, resetting the password or disabling the user thereby revokes access tokens at once.
+func (s *Server) sessionTokenValid(ctx context.Context, claims jwt.MapClaims) (bool, error) {
+    username, _ := claims["username"].(string)
+    user, err := s.db.GetUserByUsername(ctx, username)
+    if err != nil || user == nil {
+        return false, err
+    }
+    iat, _ := claims["iat"].(float64)
+    if user.Status != modals.UserStatusActive || (user.TokensValidAfter != nil && int64(iat) < user.TokensValidAfter.Unix()) {
+        return false, nil
+    }
+    session, err := s.db.GetSession(ctx, sessionFromClaims(claims))
+    if err != nil || session == nil {
+        return false, err
+    }
+    return session.UserID == user.ID && session.RevokedAt == nil && time.Now().Before(session.ExpiresAt), nil
+}
+
+// serviceAccountTokenValid reports whether the service account of an access token still exists, so deleting it
+// revokes its tokens at once. The roles of the token are cut down to the ones the account still has.
+func (s *Server) serviceAccountTokenValid(ctx context.Context, claims jwt.MapClaims) (bool, error) {
+    clientID, _ := claims["client_id"].(string)
+    account, err := s.db.GetServiceAccountByClientID(ctx, clientID)
+    if err != nil || account == nil {
+        return false, err
+    }
+    roles, _ := claims["role"].([]interface{})
+    granted := []interface{}{}
+    for _, role := range roles {
+        if name, ok := role.(string); ok && slices.Contains(account.Roles, name) {
+            granted = append(granted, name)
+        }
+    }
+    claims["role"] = granted
+    return true, nil
+}
+
+// RequireRole only lets requests through whose token carries the given role. It must run after AuthMiddleware.
+func (s *Server) RequireRole(role string) mux.MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            claims := claimsFromContext(r.Context())
+            roles, _ := claims["role"].([]interface{})
+            for _, v := range roles {
+                if name, ok := v.(string); ok && name == role {
+                    next.ServeHTTP(w, r)
+                    return
+                }
+            }
+            writeProblem(w, r, http.StatusForbidden, codeForbidden, "Requires the "+role+" role")
+        })
+    }
+}
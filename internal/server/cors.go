@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy says which browser origins may call the API, see corsFromEnv
+type corsPolicy struct {
+    // origins are scheme://host[:port] values, "*" allows every origin
+    origins     []string
+    methods     []string
+    headers     []string
+    credentials bool
+    // maxAge is how long browsers may cache a preflight response
+    maxAge time.Duration
+}
+
+// corsExposedHeaders are the response headers scripts on allowed origins may read besides the safelisted ones
+var corsExposedHeaders = []string{"X-Request-ID", "Location", "Deprecation", "Sunset", "Link", "WWW-Authenticate"}
+
+// corsFromEnv reads the CORS policy. CORS_ALLOWED_ORIGINS lists the allowed origins separated by commas,
+// "*" allows any origin but can't be combined with CORS_ALLOW_CREDENTIALS=true. CORS_ALLOWED_METHODS and
+// CORS_ALLOWED_HEADERS override what preflights allow, CORS_MAX_AGE is the preflight cache time in seconds.
+// Without allowed origins it returns nil, which disables CORS so browsers only call the API from its own origin.
+func corsFromEnv() (*corsPolicy, error) {
+    origins := splitList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+    if len(origins) == 0 {
+        return nil, nil
+    }
+    policy := &corsPolicy{
+        origins:     origins,
+        methods:     []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+        headers:     []string{"Authorization", "Content-Type", "X-Request-ID"},
+        credentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+        maxAge:      10 * time.Minute,
+    }
+    for _, origin := range origins {
+        if origin == "*" {
+            if policy.credentials {
+                return nil, errors.New("CORS_ALLOW_CREDENTIALS can't be combined with CORS_ALLOWED_ORIGINS=*")
+            }
+            continue
+        }
+        if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" ||
+            u.RawQuery != "" || u.User != nil {
+            return nil, fmt.Errorf("CORS_ALLOWED_ORIGINS: %q is no origin like https://app.example.com", origin)
+        }
+    }
+    if methods := splitList(os.Getenv("CORS_ALLOWED_METHODS")); len(methods) > 0 {
+        policy.methods = methods
+    }
+    if headers := splitList(os.Getenv("CORS_ALLOWED_HEADERS")); len(headers) > 0 {
+        policy.headers = headers
+    }
+    if value := os.Getenv("CORS_MAX_AGE"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds < 0 {
+            return nil, fmt.Errorf("CORS_MAX_AGE must be a number of seconds, not %q", value)
+        }
+        policy.maxAge = time.Duration(seconds) * time.Second
+    }
+    return policy, nil
+}
+
+// splitList splits a comma separated setting, dropping blanks
+func splitList(value string) []string {
+    var items []string
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// allowsOrigin reports whether the policy allows the origin, a nil policy allows none
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+    if p == nil || origin == "" {
+        return false
+    }
+    return slices.Contains(p.origins, "*") || slices.Contains(p.origins, strings.TrimSuffix(origin, "/"))
+}
+
+// corsMiddleware adds the CORS headers to responses for allowed origins and answers their preflight requests.
+// Preflights are answered here because the routes don't accept OPTIONS. Requests from other origins pass
+// without CORS headers, so browsers keep their scripts from reading the responses.
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if s.cors == nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+        header := w.Header()
+        // The response depends on the origin, caches must not hand one origin's answer to another
+        header.Add("Vary", "Origin")
+        origin := r.Header.Get("Origin")
+        if !s.cors.allowsOrigin(origin) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        header.Set("Access-Control-Allow-Origin", origin)
+        if s.cors.credentials {
+            header.Set("Access-Control-Allow-Credentials", "true")
+        }
+        if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+            header.Add("Vary", "Access-Control-Request-Method")
+            header.Add("Vary", "Access-Control-Request-Headers")
+            header.Set("Access-Control-Allow-Methods", strings.Join(s.cors.methods, ", "))
+            header.Set("Access-Control-Allow-Headers", strings.Join(s.cors.headers, ", "))
+            header.Set("Access-Control-Max-Age", strconv.Itoa(int(s.cors.maxAge.Seconds())))
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+        next.ServeHTTP(w, r)
+    })
+}
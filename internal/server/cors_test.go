@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("alice", "alice@example.com", "standard")
+	s, server := newTestServer(t, db)
+	s.cors = &corsPolicy{
+		origins:     []string{"https://app.example.com"},
+		methods:     []string{http.MethodGet, http.MethodPost},
+		headers:     []string{"Authorization", "Content-Type"},
+		credentials: true,
+		maxAge:      time.Hour,
+	}
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, server.URL+"/v1/me", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://app.example.com")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		resp.Header.Get("Access-Control-Allow-Methods") != "GET, POST" || resp.Header.Get("Access-Control-Allow-Headers") != "Authorization, Content-Type" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "true" || resp.Header.Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("expected the preflight of an allowed origin to be answered; got %v %v", resp.Status, resp.Header)
+	}
+	if resp := preflight("https://evil.example.com"); resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers for other origins; got %v", resp.Header)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/me", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Authorization", "Bearer "+testAccessToken(t, db, "alice", "standard"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		resp.Header.Get("Vary") != "Origin" || resp.Header.Get("Access-Control-Expose-Headers") == "" {
+		t.Errorf("expected CORS headers on the response; got %v %v", resp.Status, resp.Header)
+	}
+}
+
+func TestCORSFromEnv(t *testing.T) {
+	if policy, err := corsFromEnv(); policy != nil || err != nil {
+		t.Errorf("expected CORS to be disabled without allowed origins; got %v %v", policy, err)
+	}
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com, http://localhost:5173")
+	t.Setenv("CORS_MAX_AGE", "60")
+	policy, err := corsFromEnv()
+	if err != nil || len(policy.origins) != 2 || policy.maxAge != time.Minute || !policy.allowsOrigin("http://localhost:5173") {
+		t.Errorf("expected the configured policy; got %+v %v", policy, err)
+	}
+
+	for origins, credentials := range map[string]string{"*": "true", "https://app.example.com/path": "", "app.example.com": ""} {
+		t.Setenv("CORS_ALLOWED_ORIGINS", origins)
+		t.Setenv("CORS_ALLOW_CREDENTIALS", credentials)
+		if _, err := corsFromEnv(); err == nil {
+			t.Errorf("expected origins %q with credentials %q to be rejected", origins, credentials)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// csrfMiddleware rejects cross-site requests that change state and carry cookies but no Authorization header,
+// the requests another site can make a browser send with the user's cookies. Bearer tokens and client credentials
+// are never added by browsers on their own, so requests using them pass, as do safe methods.
+//
+// Browsers mark their requests with Sec-Fetch-Site, same-origin and user initiated ("none") requests pass. Older
+// browsers only send Origin, which has to match the host or an origin the CORS policy allows. Requests with
+// neither header don't come from a browser and pass.
+func (s *Server) csrfMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+            next.ServeHTTP(w, r)
+            return
+        }
+        if r.Header.Get("Authorization") != "" || len(r.Cookies()) == 0 || s.sameOriginOrTrusted(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        writeProblem(w, r, http.StatusForbidden, "cross_site_request", "Cross-site request rejected")
+    })
+}
+
+// sameOriginOrTrusted reports whether the request comes from the API's own origin, an origin the CORS policy
+// allows or no browser
+func (s *Server) sameOriginOrTrusted(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if s.cors.allowsOrigin(origin) {
+        return true
+    }
+    switch r.Header.Get("Sec-Fetch-Site") {
+    case "same-origin", "none":
+        return true
+    case "":
+        if origin == "" {
+            return true
+        }
+        u, err := url.Parse(origin)
+        return err == nil && u.Host == r.Host
+    }
+    return false
+}
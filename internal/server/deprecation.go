@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The routes predating /v1 stay as aliases until legacySunsetAt, responses announce their removal with the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers and link the /v1 route replacing them
+var (
+    legacyDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+    legacySunsetAt     = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// legacySuccessors maps the path template of a deprecated route to the /v1 route replacing it.
+// Keys with a method win over the plain path, routes taking the username from the body point to the collection.
+var legacySuccessors = map[string]string{
+    "POST /account":               "/v1/tokens",
+    "GET /account":                "/v1/users",
+    "/refresh":                    "/v1/tokens/refresh",
+    "/protected/account_register": "/v1/users",
+    "/protected/roles":            "/v1/users",
+    "/protected/roles_register":   "/v1/roles",
+}
+
+// legacySuccessor returns the successor template of a route, empty if the route isn't deprecated
+func legacySuccessor(method string, path string) string {
+    if successor, ok := legacySuccessors[method+" "+path]; ok {
+        return successor
+    }
+    return legacySuccessors[path]
+}
+
+// deprecationMiddleware adds the Deprecation, Sunset and successor Link headers to responses of legacy routes
+func deprecationMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if route := mux.CurrentRoute(r); route != nil {
+            if template, err := route.GetPathTemplate(); err == nil {
+                if successor := legacySuccessor(r.Method, pathTemplate(template)); successor != "" {
+                    w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecatedAt.Unix(), 10))
+                    w.Header().Set("Sunset", legacySunsetAt.Format(http.TimeFormat))
+                    w.Header().Add("Link", "<"+successor+">; rel=\"successor-version\"")
+                }
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
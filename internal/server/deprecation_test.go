@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("alice", "alice@example.com", "standard")
+	_, server := newTestServer(t, db)
+	alice := testAccessToken(t, db, "alice", "standard")
+
+	resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", map[string]string{"refresh_token": "x"}, nil)
+	if resp.Header.Get("Link") != `</v1/tokens/refresh>; rel="successor-version"` {
+		t.Errorf("expected the successor to be linked; got %q", resp.Header.Get("Link"))
+	}
+	if sunset, err := http.ParseTime(resp.Header.Get("Sunset")); err != nil || !sunset.Equal(legacySunsetAt) {
+		t.Errorf("expected the Sunset header; got %q", resp.Header.Get("Sunset"))
+	}
+	if resp.Header.Get("Deprecation") == "" {
+		t.Errorf("expected the Deprecation header")
+	}
+
+	resp = doJSON(t, http.MethodGet, server.URL+"/v1/me", alice, nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Deprecation") != "" || resp.Header.Get("Sunset") != "" {
+		t.Errorf("expected /v1/me not to be deprecated; got %v %v", resp.Status, resp.Header)
+	}
+
+	// Routes added along with /v1 only exist there
+	for _, path := range []string{"/protected/me", "/protected/tokens", "/password/forgot", "/account/step-up"} {
+		if resp := doJSON(t, http.MethodGet, server.URL+path, alice, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected %s not to be mounted; got %v", path, resp.Status)
+		}
+	}
+
+	// Every route outside /v1 has a successor there, except the ones that stay like the OpenID Connect endpoints
+	unversioned := []string{"/v1/", "/oauth/", "/auth/", "/.well-known/", "/health", "/metrics", "/openapi.json", "/docs"}
+	registered := map[string]bool{}
+	(&Server{}).router().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		path := pathTemplate(template)
+		registered[path] = true
+		if path == "/" || slices.ContainsFunc(unversioned, func(prefix string) bool { return strings.HasPrefix(path, prefix) }) {
+			return nil
+		}
+		if legacySuccessor(http.MethodGet, path) == "" && legacySuccessor(http.MethodPost, path) == "" {
+			t.Errorf("route %s has no successor under /v1", path)
+		}
+		return nil
+	})
+	for legacy, successor := range legacySuccessors {
+		if !registered[successor] {
+			t.Errorf("successor %s of %s is not a route", successor, legacy)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+const (
+    purposeEmailVerification = "email_verification"
+
+    emailVerificationTTL       = 24 * time.Hour
+    emailVerificationResendGap = 2 * time.Minute
+)
+
+var (
+    // requireVerifiedEmail blocks logins of users whose address isn't verified yet
+    requireVerifiedEmail = os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
+
+    // emailVerificationURL is the page the link in the mail points to, the token is appended as ?token=.
+    // It defaults to GET /v1/verify-email on PUBLIC_URL.
+    emailVerificationURL = os.Getenv("EMAIL_VERIFICATION_URL")
+)
+
+// sendVerificationEmail invalidates earlier verification links of the user and mails a new one
+func (s *Server) sendVerificationEmail(r *http.Request, user *modals.User) error {
+    token, hash := newSignedToken(purposeEmailVerification)
+    link, err := mailLink(emailVerificationURL, "/v1/verify-email", token)
+    if err != nil {
+        return err
+    }
+    if err := s.db.RevokeUserTokens(r.Context(), user.ID, purposeEmailVerification); err != nil {
+        return err
+    }
+
+    now := time.Now()
+    err = s.db.CreateUserToken(r.Context(), &modals.UserToken{
+        UserID:    user.ID,
+        Purpose:   purposeEmailVerification,
+        TokenHash: hash,
+        CreatedAt: now,
+        ExpiresAt: now.Add(emailVerificationTTL),
+    })
+    if err != nil {
+        return err
+    }
+
+    return s.sendMail(r, user, "email_verification", map[string]string{"Username": user.Username, "Link": link})
+}
+
+// VerifyEmailHandler takes the token from the verification mail, as query parameter (GET) or JSON body (POST),
+// and marks the user's email address as verified. Each token works once.
+func (s *Server) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Token string `json:"token"`
+    }
+    if r.Method == http.MethodPost {
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+    } else {
+        req.Token = r.URL.Query().Get("token")
+    }
+
+    hash, ok := verifySignedToken(purposeEmailVerification, req.Token)
+    if !ok {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token")
+        return
+    }
+    token, err := s.db.ConsumeUserToken(r.Context(), purposeEmailVerification, hash)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if token == nil {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token")
+        return
+    }
+
+    if err := s.db.SetEmailVerified(r.Context(), token.UserID, true); err != nil {
+        writeError(w, r, dbError(err, "Failed to verify email"))
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Email verified successfully"))
+}
+
+// EmailRequest is the body of the endpoints that mail a link to an address
+type EmailRequest struct {
+    Email string `json:"email"`
+}
+
+func (req *EmailRequest) Normalize() {
+    req.Email = normalizeEmail(req.Email)
+}
+
+func (req *EmailRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.email("email", req.Email, true)
+    return fields
+}
+
+// ResendVerificationEmailHandler mails a new verification link to the given address. It answers 202 whether or
+// not an unverified account uses the address, and sends at most one mail per account every emailVerificationResendGap.
+func (s *Server) ResendVerificationEmailHandler(w http.ResponseWriter, r *http.Request) {
+    var req EmailRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    user, err := s.db.GetUserByEmail(r.Context(), req.Email)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    if user != nil && !user.EmailVerified {
+        latest, err := s.db.LatestUserToken(r.Context(), user.ID, purposeEmailVerification)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return
+        }
+        if latest == nil || time.Since(latest.CreatedAt) >= emailVerificationResendGap {
+            if err := s.sendVerificationEmail(r, user); err != nil {
+                slog.ErrorContext(r.Context(), "sending verification email failed", "username", user.Username, "error", err)
+            }
+        }
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("If the address belongs to an unverified account, a new verification email was sent"))
+}
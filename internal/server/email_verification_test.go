@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestEmailVerification(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+
+	resp := doJSON(t, http.MethodPost, server.URL+"/protected/account_register", testAccessToken(t, db, "admin", "admin"),
+		AccountRegisterRequest{Username: "frank", Email: "frank@example.com", Password: "pw"}, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status Created; got %v", resp.Status)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "frank@example.com" {
+		t.Fatalf("expected one verification mail to frank; got %+v", mailer.sent)
+	}
+	link := regexp.MustCompile(`http\S+`).FindString(mailer.sent[0].Text)
+	token, _ := url.Parse(link)
+
+	tampered := server.URL + "/v1/verify-email?token=" + url.QueryEscape(token.Query().Get("token")+"x")
+	if resp := doJSON(t, http.MethodGet, tampered, "", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a tampered token to be rejected; got %v", resp.Status)
+	}
+
+	if resp := doJSON(t, http.MethodGet, link, "", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if user, _ := db.GetUserByUsername(context.Background(), "frank"); !user.EmailVerified {
+		t.Errorf("expected frank's email to be verified")
+	}
+	if resp := doJSON(t, http.MethodGet, link, "", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a used token to be rejected; got %v", resp.Status)
+	}
+
+	// Verified accounts don't get more mails, and neither do unknown addresses
+	doJSON(t, http.MethodPost, server.URL+"/v1/verify-email/resend", "", map[string]string{"email": "frank@example.com"}, nil)
+	doJSON(t, http.MethodPost, server.URL+"/v1/verify-email/resend", "", map[string]string{"email": "nobody@example.com"}, nil)
+	if len(mailer.sent) != 1 {
+		t.Errorf("expected no further mails; got %d", len(mailer.sent))
+	}
+}
@@ -0,0 +1,582 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/mail"
+	"jjr-tec-backend/internal/modals"
+)
+
+// fakeDB keeps just enough state in memory to exercise handlers without Postgres.
+// Methods a test needs but fakeDB doesn't implement panic through the nil embedded Service.
+type fakeDB struct {
+	database.Service
+
+	users    []modals.User
+	roles    map[string][]string
+	clients  map[string]*modals.OAuthClient
+	consents map[string]string
+	codes    map[string]*modals.AuthorizationCode
+
+	serviceAccounts []modals.ServiceAccount
+	pats            []modals.PersonalAccessToken
+	identities      []modals.ExternalIdentity
+	userTokens      []modals.UserToken
+	passwords       map[int]string
+	oldPasswords    map[int][]string
+	attributeSchema *modals.AttributeSchema
+	sessions        []modals.Session
+	loginAttempts   []modals.LoginAttempt
+	securityEvents  []modals.SecurityEvent
+	invitations     []modals.Invitation
+	roleNames       []string
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		roles:     map[string][]string{},
+		clients:   map[string]*modals.OAuthClient{},
+		consents:  map[string]string{},
+		codes:     map[string]*modals.AuthorizationCode{},
+		passwords: map[int]string{},
+
+		oldPasswords: map[int][]string{},
+	}
+}
+
+func (f *fakeDB) addUser(username string, email string, roles ...string) *modals.User {
+	f.users = append(f.users, modals.User{ID: len(f.users) + 1, Username: username, Email: email, Status: modals.UserStatusActive})
+	f.roles[username] = roles
+	return &f.users[len(f.users)-1]
+}
+
+func (f *fakeDB) CreateUser(ctx context.Context, username string, email string, password string) error {
+	for _, user := range f.users {
+		if user.Username == username || (email != "" && strings.EqualFold(user.Email, email)) {
+			return fmt.Errorf("user %q %w", username, database.ErrConflict)
+		}
+	}
+	f.addUser(username, email)
+	return nil
+}
+
+func (f *fakeDB) AssignRoleToUser(ctx context.Context, username string, role_name string) error {
+	if user, _ := f.GetUserByUsername(ctx, username); user == nil {
+		return fmt.Errorf("user %q or role %q %w", username, role_name, database.ErrNotFound)
+	}
+	if slices.Contains(f.roles[username], role_name) {
+		return fmt.Errorf("role %q of user %q %w", role_name, username, database.ErrConflict)
+	}
+	f.roles[username] = append(f.roles[username], role_name)
+	return nil
+}
+
+func (f *fakeDB) RemoveRoleFromUser(ctx context.Context, username string, role_name string) error {
+	if !slices.Contains(f.roles[username], role_name) {
+		return fmt.Errorf("role %q of user %q %w", role_name, username, database.ErrNotFound)
+	}
+	f.roles[username] = slices.DeleteFunc(f.roles[username], func(role string) bool { return role == role_name })
+	return nil
+}
+
+func (f *fakeDB) CreateRole(ctx context.Context, role_name string) error {
+	if roles, _ := f.ListRoles(ctx); slices.Contains(roles, role_name) {
+		return fmt.Errorf("role %q %w", role_name, database.ErrConflict)
+	}
+	f.roleNames = append(f.roleNames, role_name)
+	return nil
+}
+
+// ListRoles returns the created roles and every role a user has, so tests don't need to create roles first
+func (f *fakeDB) ListRoles(ctx context.Context) ([]string, error) {
+	roles := slices.Clone(f.roleNames)
+	for _, userRoles := range f.roles {
+		roles = append(roles, userRoles...)
+	}
+	slices.Sort(roles)
+	return slices.Compact(roles), nil
+}
+
+func (f *fakeDB) GetUserByEmail(ctx context.Context, email string) (*modals.User, error) {
+	for i := range f.users {
+		if email != "" && strings.EqualFold(f.users[i].Email, email) {
+			user := f.users[i]
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) GetUserByUsername(ctx context.Context, username string) (*modals.User, error) {
+	for i := range f.users {
+		if f.users[i].Username == username {
+			user := f.users[i]
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) GetUserByID(ctx context.Context, id int) (*modals.User, error) {
+	for i := range f.users {
+		if f.users[i].ID == id {
+			user := f.users[i]
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) GetRolesByUsername(ctx context.Context, username string) ([]string, error) {
+	return f.roles[username], nil
+}
+
+func (f *fakeDB) CreateOAuthClient(ctx context.Context, client *modals.OAuthClient) error {
+	client.ID = len(f.clients) + 1
+	stored := *client
+	f.clients[client.ClientID] = &stored
+	return nil
+}
+
+func (f *fakeDB) GetOAuthClient(ctx context.Context, clientID string) (*modals.OAuthClient, error) {
+	return f.clients[clientID], nil
+}
+
+func (f *fakeDB) GetOAuthConsent(ctx context.Context, userID int, clientID string) (string, error) {
+	return f.consents[fmt.Sprintf("%d/%s", userID, clientID)], nil
+}
+
+func (f *fakeDB) SaveOAuthConsent(ctx context.Context, userID int, clientID string, scope string) error {
+	f.consents[fmt.Sprintf("%d/%s", userID, clientID)] = scope
+	return nil
+}
+
+func (f *fakeDB) CreateAuthorizationCode(ctx context.Context, code *modals.AuthorizationCode) error {
+	f.codes[code.CodeHash] = code
+	return nil
+}
+
+func (f *fakeDB) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*modals.AuthorizationCode, error) {
+	code := f.codes[codeHash]
+	delete(f.codes, codeHash)
+	return code, nil
+}
+
+func (f *fakeDB) GetServiceAccountByClientID(ctx context.Context, clientID string) (*modals.ServiceAccount, error) {
+	for i := range f.serviceAccounts {
+		if f.serviceAccounts[i].ClientID == clientID {
+			account := f.serviceAccounts[i]
+			return &account, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) CreatePersonalAccessToken(ctx context.Context, token *modals.PersonalAccessToken) error {
+	token.ID = len(f.pats) + 1
+	f.pats = append(f.pats, *token)
+	return nil
+}
+
+func (f *fakeDB) GetPersonalAccessTokenByHash(ctx context.Context, tokenHash string) (*modals.PersonalAccessToken, error) {
+	for i := range f.pats {
+		if f.pats[i].TokenHash == tokenHash {
+			token := f.pats[i]
+			user, _ := f.GetUserByID(ctx, token.UserID)
+			token.Username = user.Username
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) RevokePersonalAccessToken(ctx context.Context, userID int, id int) (bool, error) {
+	for i := range f.pats {
+		if f.pats[i].ID == id && f.pats[i].UserID == userID && f.pats[i].RevokedAt == nil {
+			now := time.Now()
+			f.pats[i].RevokedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeDB) TouchPersonalAccessToken(ctx context.Context, id int) error {
+	now := time.Now()
+	f.pats[id-1].LastUsedAt = &now
+	return nil
+}
+
+func (f *fakeDB) ListPersonalAccessTokens(ctx context.Context, userID int) ([]modals.PersonalAccessToken, error) {
+	var tokens []modals.PersonalAccessToken
+	for _, token := range f.pats {
+		if token.UserID == userID && token.RevokedAt == nil {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (f *fakeDB) GetUserByExternalIdentity(ctx context.Context, provider string, subject string) (*modals.User, error) {
+	for _, identity := range f.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return f.GetUserByID(ctx, identity.UserID)
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) LinkExternalIdentity(ctx context.Context, userID int, provider string, subject string, email string) error {
+	f.identities = append(f.identities, modals.ExternalIdentity{UserID: userID, Provider: provider, Subject: subject, Email: email})
+	return nil
+}
+
+func (f *fakeDB) ProvisionExternalUser(ctx context.Context, username string, email string, emailVerified bool, roles []string, provider string, subject string) (*modals.User, error) {
+	for _, user := range f.users {
+		if user.Username == username || (email != "" && strings.EqualFold(user.Email, email)) {
+			return nil, fmt.Errorf("user %q %w", username, database.ErrConflict)
+		}
+	}
+	user := f.addUser(username, email, roles...)
+	user.EmailVerified = emailVerified && email != ""
+	f.passwords[user.ID] = ""
+	f.identities = append(f.identities, modals.ExternalIdentity{UserID: user.ID, Provider: provider, Subject: subject, Email: email})
+	provisioned := *user
+	return &provisioned, nil
+}
+
+func (f *fakeDB) SetEmailVerified(ctx context.Context, userID int, verified bool) error {
+	f.users[userID-1].EmailVerified = verified
+	return nil
+}
+
+// GetPasswordHash hashes the password of the user, "password" unless it was changed. Users without a local
+// password have an empty one.
+func (f *fakeDB) GetPasswordHash(ctx context.Context, username string) (string, error) {
+	user, _ := f.GetUserByUsername(ctx, username)
+	if user == nil {
+		return "", nil
+	}
+	password, ok := f.passwords[user.ID]
+	if !ok {
+		password = "password"
+	}
+	if password == "" {
+		return "", nil
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	return string(hash), nil
+}
+
+func (f *fakeDB) UpdatePassword(ctx context.Context, userID int, password string) error {
+	now := time.Now().Truncate(time.Second)
+	if old, ok := f.passwords[userID]; ok {
+		f.oldPasswords[userID] = append([]string{old}, f.oldPasswords[userID]...)
+	}
+	f.passwords[userID] = password
+	f.users[userID-1].TokensValidAfter = &now
+	return nil
+}
+
+func (f *fakeDB) PasswordHistory(ctx context.Context, userID int, limit int) ([]string, error) {
+	passwords := f.oldPasswords[userID]
+	if current, ok := f.passwords[userID]; ok {
+		passwords = append([]string{current}, passwords...)
+	}
+	var hashes []string
+	for _, password := range passwords[:min(limit, len(passwords))] {
+		hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		hashes = append(hashes, string(hash))
+	}
+	return hashes, nil
+}
+
+func (f *fakeDB) UpdateUserProfile(ctx context.Context, user *modals.User) error {
+	for _, other := range f.users {
+		if other.ID != user.ID && user.Email != "" && strings.EqualFold(other.Email, user.Email) {
+			return fmt.Errorf("email %q %w", user.Email, database.ErrConflict)
+		}
+	}
+	f.users[user.ID-1] = *user
+	return nil
+}
+
+// DeleteUser blanks the user, so IDs keep matching slice positions
+func (f *fakeDB) DeleteUser(ctx context.Context, userID int) (bool, error) {
+	delete(f.roles, f.users[userID-1].Username)
+	f.users[userID-1] = modals.User{}
+	return true, nil
+}
+
+func (f *fakeDB) SetUserStatus(ctx context.Context, userID int, status string) (bool, error) {
+	f.users[userID-1].Status = status
+	return true, nil
+}
+
+func (f *fakeDB) RecordLogin(ctx context.Context, userID int) error {
+	now := time.Now()
+	f.users[userID-1].LastLoginAt = &now
+	return nil
+}
+
+func (f *fakeDB) UpdateUserAttributes(ctx context.Context, userID int, attributes map[string]interface{}) error {
+	f.users[userID-1].Attributes = attributes
+	return nil
+}
+
+// ListUsers supports containment of top-level scalar attributes only
+func (f *fakeDB) ListUsers(ctx context.Context, filter modals.UserFilter) ([]modals.User, error) {
+	var users []modals.User
+	for _, user := range f.users {
+		matches := user.Username != "" && (filter.Status == "" || user.Status == filter.Status)
+		for name, value := range filter.Attributes {
+			matches = matches && user.Attributes[name] == value
+		}
+		if matches {
+			users = append(users, user)
+		}
+	}
+	users = users[min(filter.Offset, len(users)):]
+	return users[:min(filter.Limit, len(users))], nil
+}
+
+func (f *fakeDB) GetAttributeSchema(ctx context.Context) (*modals.AttributeSchema, error) {
+	return f.attributeSchema, nil
+}
+
+func (f *fakeDB) SaveAttributeSchema(ctx context.Context, schema *modals.AttributeSchema) error {
+	f.attributeSchema = schema
+	return nil
+}
+
+func (f *fakeDB) CreateSession(ctx context.Context, session *modals.Session) error {
+	session.ID = len(f.sessions) + 1
+	f.sessions = append(f.sessions, *session)
+	return nil
+}
+
+func (f *fakeDB) GetSession(ctx context.Context, id int) (*modals.Session, error) {
+	if id < 1 || id > len(f.sessions) {
+		return nil, nil
+	}
+	session := f.sessions[id-1]
+	return &session, nil
+}
+
+func (f *fakeDB) ListSessions(ctx context.Context, userID int) ([]modals.Session, error) {
+	var sessions []modals.Session
+	for _, session := range slices.Backward(f.sessions) {
+		if (userID == 0 || session.UserID == userID) && session.RevokedAt == nil && time.Now().Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (f *fakeDB) TouchSession(ctx context.Context, id int, ip string, userAgent string) error {
+	f.sessions[id-1].LastSeenAt = time.Now()
+	f.sessions[id-1].IP = ip
+	f.sessions[id-1].UserAgent = userAgent
+	return nil
+}
+
+func (f *fakeDB) RevokeSession(ctx context.Context, userID int, id int) (bool, error) {
+	if id < 1 || id > len(f.sessions) || f.sessions[id-1].UserID != userID || f.sessions[id-1].RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	f.sessions[id-1].RevokedAt = &now
+	return true, nil
+}
+
+func (f *fakeDB) RevokeUserSessions(ctx context.Context, userID int, exceptID int) error {
+	for i := range f.sessions {
+		if f.sessions[i].UserID == userID && f.sessions[i].ID != exceptID && f.sessions[i].RevokedAt == nil {
+			now := time.Now()
+			f.sessions[i].RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (f *fakeDB) CreateUserToken(ctx context.Context, token *modals.UserToken) error {
+	token.ID = len(f.userTokens) + 1
+	f.userTokens = append(f.userTokens, *token)
+	return nil
+}
+
+func (f *fakeDB) GetUserToken(ctx context.Context, purpose string, tokenHash string) (*modals.UserToken, error) {
+	for _, token := range f.userTokens {
+		if token.Purpose == purpose && token.TokenHash == tokenHash && token.UsedAt == nil && time.Now().Before(token.ExpiresAt) {
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) ConsumeUserToken(ctx context.Context, purpose string, tokenHash string) (*modals.UserToken, error) {
+	for i := range f.userTokens {
+		token := &f.userTokens[i]
+		if token.Purpose == purpose && token.TokenHash == tokenHash && token.UsedAt == nil && time.Now().Before(token.ExpiresAt) {
+			now := time.Now()
+			token.UsedAt = &now
+			consumed := *token
+			return &consumed, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) LatestUserToken(ctx context.Context, userID int, purpose string) (*modals.UserToken, error) {
+	for i := len(f.userTokens) - 1; i >= 0; i-- {
+		if f.userTokens[i].UserID == userID && f.userTokens[i].Purpose == purpose {
+			token := f.userTokens[i]
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) RevokeUserTokens(ctx context.Context, userID int, purpose string) error {
+	for i := range f.userTokens {
+		if f.userTokens[i].UserID == userID && f.userTokens[i].Purpose == purpose && f.userTokens[i].UsedAt == nil {
+			now := time.Now()
+			f.userTokens[i].UsedAt = &now
+		}
+	}
+	return nil
+}
+
+func (f *fakeDB) RecordLoginAttempt(ctx context.Context, attempt *modals.LoginAttempt) error {
+	attempt.ID = len(f.loginAttempts) + 1
+	f.loginAttempts = append(f.loginAttempts, *attempt)
+	return nil
+}
+
+func (f *fakeDB) ListLoginAttempts(ctx context.Context, userID int, onlySuccessful bool, limit int) ([]modals.LoginAttempt, error) {
+	var attempts []modals.LoginAttempt
+	for _, attempt := range slices.Backward(f.loginAttempts) {
+		if attempt.UserID == userID && (attempt.Success || !onlySuccessful) && len(attempts) < limit {
+			attempts = append(attempts, attempt)
+		}
+	}
+	return attempts, nil
+}
+
+func (f *fakeDB) CreateSecurityEvent(ctx context.Context, event *modals.SecurityEvent) error {
+	event.ID = len(f.securityEvents) + 1
+	f.securityEvents = append(f.securityEvents, *event)
+	return nil
+}
+
+func (f *fakeDB) ListSecurityEvents(ctx context.Context, userID int, limit int) ([]modals.SecurityEvent, error) {
+	var events []modals.SecurityEvent
+	for _, event := range slices.Backward(f.securityEvents) {
+		if event.UserID == userID && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (f *fakeDB) CreateInvitation(ctx context.Context, invitation *modals.Invitation) error {
+	known, _ := f.ListRoles(ctx)
+	for _, role := range invitation.Roles {
+		if !slices.Contains(known, role) {
+			return fmt.Errorf("role %q %w", role, database.ErrNotFound)
+		}
+	}
+	invitation.ID = len(f.invitations) + 1
+	f.invitations = append(f.invitations, *invitation)
+	return nil
+}
+
+func (f *fakeDB) GetInvitation(ctx context.Context, id int) (*modals.Invitation, error) {
+	if id < 1 || id > len(f.invitations) {
+		return nil, nil
+	}
+	invitation := f.invitations[id-1]
+	return &invitation, nil
+}
+
+func (f *fakeDB) GetInvitationByTokenHash(ctx context.Context, tokenHash string) (*modals.Invitation, error) {
+	for _, invitation := range f.invitations {
+		if invitation.TokenHash == tokenHash {
+			return &invitation, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) ListInvitations(ctx context.Context) ([]modals.Invitation, error) {
+	var invitations []modals.Invitation
+	for _, invitation := range slices.Backward(f.invitations) {
+		invitations = append(invitations, invitation)
+	}
+	return invitations, nil
+}
+
+func (f *fakeDB) RenewInvitation(ctx context.Context, id int, tokenHash string, sentAt time.Time, expiresAt time.Time) (bool, error) {
+	invitation := &f.invitations[id-1]
+	if invitation.AcceptedAt != nil || invitation.RevokedAt != nil {
+		return false, nil
+	}
+	invitation.TokenHash, invitation.SentAt, invitation.ExpiresAt = tokenHash, sentAt, expiresAt
+	return true, nil
+}
+
+func (f *fakeDB) RevokeInvitation(ctx context.Context, id int) (bool, error) {
+	if id < 1 || id > len(f.invitations) || f.invitations[id-1].AcceptedAt != nil || f.invitations[id-1].RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	f.invitations[id-1].RevokedAt = &now
+	return true, nil
+}
+
+func (f *fakeDB) AcceptInvitation(ctx context.Context, id int, username string, password string) (*modals.User, error) {
+	invitation := &f.invitations[id-1]
+	if invitation.AcceptedAt != nil || invitation.RevokedAt != nil || time.Now().After(invitation.ExpiresAt) {
+		return nil, nil
+	}
+	for _, user := range f.users {
+		if user.Username == username || strings.EqualFold(user.Email, invitation.Email) {
+			return nil, fmt.Errorf("user %q %w", username, database.ErrConflict)
+		}
+	}
+	known, _ := f.ListRoles(ctx)
+	for _, role := range invitation.Roles {
+		if !slices.Contains(known, role) {
+			return nil, fmt.Errorf("role %q %w", role, database.ErrNotFound)
+		}
+	}
+	user := f.addUser(username, invitation.Email, invitation.Roles...)
+	user.EmailVerified = true
+	f.passwords[user.ID] = password
+	now := time.Now()
+	invitation.AcceptedAt, invitation.UserID = &now, &user.ID
+	accepted := *user
+	return &accepted, nil
+}
+
+func (f *fakeDB) Stats() sql.DBStats {
+	return sql.DBStats{OpenConnections: 3, InUse: 1, Idle: 2}
+}
+
+// fakeMailer records sent messages instead of delivering them
+type fakeMailer struct {
+	sent []mail.Message
+}
+
+func (m *fakeMailer) Send(ctx context.Context, msg mail.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
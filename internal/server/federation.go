@@ -0,0 +1,360 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/auth"
+	"jjr-tec-backend/internal/federation"
+	"jjr-tec-backend/internal/modals"
+)
+
+var oidcProvidersFile = os.Getenv("OIDC_PROVIDERS_FILE")
+
+const (
+    federationCookieName = "jjr_federation"
+    federationStateTTL   = 10 * time.Minute
+
+    // defaultRole is assigned to users provisioned on their first federated login
+    defaultRole = "standard"
+)
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// loadProviders builds the upstream identity providers configured in OIDC_PROVIDERS_FILE
+func loadProviders() (map[string]*federation.Provider, error) {
+    configs, err := federation.LoadConfigs(oidcProvidersFile)
+    if err != nil {
+        return nil, err
+    }
+    providers := map[string]*federation.Provider{}
+    for _, config := range configs {
+        providers[config.Name] = federation.NewProvider(config, nil)
+    }
+    return providers, nil
+}
+
+// FederatedProvidersHandler lists the names of the configured upstream identity providers for login pages
+func (s *Server) FederatedProvidersHandler(w http.ResponseWriter, r *http.Request) {
+    names := []string{}
+    for name := range s.providers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(names)
+}
+
+// FederatedLoginHandler sends the user agent to the upstream provider's authorization endpoint
+func (s *Server) FederatedLoginHandler(w http.ResponseWriter, r *http.Request) {
+    provider, ok := s.providers[mux.Vars(r)["provider"]]
+    if !ok {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Unknown identity provider")
+        return
+    }
+
+    authURL, err := s.startFederatedLogin(w, r, provider, 0)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "starting federated login failed", "provider", provider.Name, "error", err)
+        writeProblem(w, r, http.StatusBadGateway, "provider_unavailable", "Identity provider unavailable")
+        return
+    }
+
+    http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// FederatedLinkHandler starts a login at the upstream provider whose identity gets linked to the calling user.
+// It responds with the URL to send the user agent to.
+func (s *Server) FederatedLinkHandler(w http.ResponseWriter, r *http.Request) {
+    provider, ok := s.providers[mux.Vars(r)["provider"]]
+    if !ok {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Unknown identity provider")
+        return
+    }
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+
+    authURL, err := s.startFederatedLogin(w, r, provider, user.ID)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "starting identity link failed", "provider", provider.Name, "error", err)
+        writeProblem(w, r, http.StatusBadGateway, "provider_unavailable", "Identity provider unavailable")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"redirect_to": authURL})
+}
+
+// startFederatedLogin keeps state, nonce and PKCE verifier in a short-lived signed cookie scoped to the
+// provider's routes and returns the upstream authorization URL. The cookie binds the callback to this user agent.
+func (s *Server) startFederatedLogin(w http.ResponseWriter, r *http.Request, provider *federation.Provider, linkUserID int) (string, error) {
+    state := randomToken(16)
+    nonce := randomToken(16)
+    verifier := randomToken(32)
+    sum := sha256.Sum256([]byte(verifier))
+
+    authURL, err := provider.AuthCodeURL(r.Context(), federationRedirectURI(r, provider), state, nonce,
+        base64.RawURLEncoding.EncodeToString(sum[:]))
+    if err != nil {
+        return "", err
+    }
+
+    cookieClaims := jwt.MapClaims{
+        "typ":          tokenTypeFederationState,
+        "provider":     provider.Name,
+        "state":        state,
+        "nonce":        nonce,
+        "verifier":     verifier,
+        "link_user_id": linkUserID,
+        "exp":          time.Now().Add(federationStateTTL).Unix(),
+    }
+    cookieValue, err := jwt.NewWithClaims(jwt.SigningMethodHS256, cookieClaims).SignedString([]byte(jwtKey))
+    if err != nil {
+        return "", err
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name:     federationCookieName,
+        Value:    cookieValue,
+        Path:     "/auth/" + provider.Name,
+        MaxAge:   int(federationStateTTL.Seconds()),
+        HttpOnly: true,
+        Secure:   strings.HasPrefix(issuer(), "https://"),
+        SameSite: http.SameSiteLaxMode,
+    })
+
+    return authURL, nil
+}
+
+func federationRedirectURI(r *http.Request, provider *federation.Provider) string {
+    if provider.RedirectURI != "" {
+        return provider.RedirectURI
+    }
+    return issuer() + "/auth/" + provider.Name + "/callback"
+}
+
+// FederatedCallbackHandler completes the upstream login: it validates the ID token, finds, links or provisions
+// the local user, syncs the roles mapped from upstream groups and responds like POST /account
+func (s *Server) FederatedCallbackHandler(w http.ResponseWriter, r *http.Request) {
+    provider, ok := s.providers[mux.Vars(r)["provider"]]
+    if !ok {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Unknown identity provider")
+        return
+    }
+
+    cookie, err := r.Cookie(federationCookieName)
+    if err != nil {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_login_state", "Login session expired")
+        return
+    }
+    // The state cookie is single-use
+    http.SetCookie(w, &http.Cookie{Name: federationCookieName, Path: "/auth/" + provider.Name, MaxAge: -1})
+
+    stateClaims := jwt.MapClaims{}
+    _, err = jwt.ParseWithClaims(cookie.Value, stateClaims, func(token *jwt.Token) (interface{}, error) {
+        return []byte(jwtKey), nil
+    }, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+    if err != nil || stateClaims["typ"] != tokenTypeFederationState || stateClaims["provider"] != provider.Name || stateClaims["state"] != r.URL.Query().Get("state") {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_login_state", "Invalid login state")
+        return
+    }
+    if upstreamErr := r.URL.Query().Get("error"); upstreamErr != "" {
+        writeProblem(w, r, http.StatusUnauthorized, "federated_login_denied", "Identity provider denied login: "+upstreamErr)
+        return
+    }
+
+    nonce, _ := stateClaims["nonce"].(string)
+    verifier, _ := stateClaims["verifier"].(string)
+    idClaims, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), federationRedirectURI(r, provider), verifier, nonce)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "completing federated login failed", "provider", provider.Name, "error", err)
+        writeProblem(w, r, http.StatusUnauthorized, "federated_login_failed", "Login with identity provider failed")
+        return
+    }
+    subject, _ := idClaims["sub"].(string)
+    if subject == "" {
+        writeProblem(w, r, http.StatusUnauthorized, "federated_login_failed", "Login with identity provider failed")
+        return
+    }
+
+    linkUserID := 0
+    if id, ok := stateClaims["link_user_id"].(float64); ok {
+        linkUserID = int(id)
+    }
+    user, err := s.resolveFederatedUser(r.Context(), provider, subject, idClaims, linkUserID)
+    if err != nil {
+        writeError(w, r, err)
+        return
+    }
+
+    if err := auth.SyncRoles(r.Context(), s.db, user.Username, provider.GroupRoles, provider.Groups(idClaims)); err != nil {
+        writeError(w, r, dbError(err, "Failed to sync roles"))
+        return
+    }
+    method := "federated:" + provider.Name
+    if !s.checkLoginAllowed(w, r, user, method) {
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if roles == nil {
+        writeProblem(w, r, http.StatusForbidden, "no_roles", "User has no roles")
+        return
+    }
+
+    s.completeLogin(w, r, user, roles, method)
+}
+
+// resolveFederatedUser returns the local user for the upstream identity. In order it uses an existing link,
+// links the identity to the user that started a link flow, links to a user with the same email if the provider
+// allows it and both sides verified the address, or provisions a new user. Errors are ready to respond with.
+func (s *Server) resolveFederatedUser(ctx context.Context, provider *federation.Provider, subject string, claims jwt.MapClaims, linkUserID int) (*modals.User, error) {
+    email, _ := claims["email"].(string)
+
+    user, err := s.db.GetUserByExternalIdentity(ctx, provider.Name, subject)
+    if err != nil {
+        return nil, dbError(err, "Error querying database")
+    }
+    if user != nil {
+        if linkUserID != 0 && user.ID != linkUserID {
+            return nil, &APIError{Status: http.StatusConflict, Code: "identity_linked", Detail: "The identity is linked to another account"}
+        }
+        return user, nil
+    }
+
+    if linkUserID != 0 {
+        user, err = s.db.GetUserByID(ctx, linkUserID)
+    } else if provider.LinkByEmail && email != "" && claims["email_verified"] == true {
+        user, err = s.db.GetUserByEmail(ctx, email)
+        // Anyone can register an address they don't own, linking to it would hand them the upstream identity
+        if user != nil && !user.EmailVerified {
+            user = nil
+        }
+    }
+    if err != nil {
+        return nil, dbError(err, "Error querying database")
+    }
+    if user == nil {
+        return s.provisionFederatedUser(ctx, provider, subject, claims)
+    }
+
+    if err := s.db.LinkExternalIdentity(ctx, user.ID, provider.Name, subject, email); err != nil {
+        return nil, dbError(err, "Failed to link identity")
+    }
+    slog.InfoContext(ctx, "linked identity", "provider", provider.Name, "subject", subject, "username", user.Username)
+    return user, nil
+}
+
+// provisionFederatedUser creates a local user linked to the upstream identity on its first login. The user has no
+// password, so they can only sign in through the provider.
+func (s *Server) provisionFederatedUser(ctx context.Context, provider *federation.Provider, subject string, claims jwt.MapClaims) (*modals.User, error) {
+    email, _ := claims["email"].(string)
+    base, _ := claims["preferred_username"].(string)
+    if base == "" && email != "" {
+        base = strings.SplitN(email, "@", 2)[0]
+    }
+    base = usernameInvalidChars.ReplaceAllString(base, "")
+    if base == "" {
+        base = provider.Name + "-" + usernameInvalidChars.ReplaceAllString(subject, "")
+    }
+    if len(base) > 45 {
+        base = base[:45]
+    }
+
+    if email != "" {
+        other, err := s.db.GetUserByEmail(ctx, email)
+        if err != nil {
+            return nil, dbError(err, "Error querying database")
+        }
+        if other != nil {
+            return nil, &APIError{Status: http.StatusConflict, Code: "email_taken", Detail: "The email address of the identity is used by another account"}
+        }
+    }
+
+    for i := 1; i <= 20; i++ {
+        username := base
+        if i > 1 {
+            username = fmt.Sprintf("%s-%d", base, i)
+        }
+        existing, err := s.db.GetUserByUsername(ctx, username)
+        if err != nil {
+            return nil, dbError(err, "Error querying database")
+        }
+        if existing != nil {
+            continue
+        }
+
+        // The check above gives the usual answer, the unique indexes catch names and addresses taken since
+        user, err := s.db.ProvisionExternalUser(ctx, username, email, claims["email_verified"] == true, []string{defaultRole}, provider.Name, subject)
+        if err != nil {
+            return nil, dbError(err, "Failed to provision user")
+        }
+        slog.InfoContext(ctx, "provisioned federated user", "username", username, "provider", provider.Name, "subject", subject)
+        return user, nil
+    }
+    return nil, &APIError{Status: http.StatusConflict, Code: codeConflict, Detail: "No free username for the identity",
+        Err: fmt.Errorf("no free username for %q", base)}
+}
+
+func (s *Server) ExternalIdentityListHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+
+    identities, err := s.db.ListExternalIdentities(r.Context(), user.ID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    response := []map[string]interface{}{}
+    for _, identity := range identities {
+        response = append(response, map[string]interface{}{
+            "provider":   identity.Provider,
+            "subject":    identity.Subject,
+            "email":      identity.Email,
+            "created_at": identity.CreatedAt,
+        })
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) ExternalIdentityUnlinkHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+
+    unlinked, err := s.db.UnlinkExternalIdentity(r.Context(), user.ID, mux.Vars(r)["provider"])
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to unlink identity"))
+        return
+    }
+    if !unlinked {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Identity not found")
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
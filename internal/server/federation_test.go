@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"jjr-tec-backend/internal/federation"
+)
+
+// mockOIDCServer is an upstream identity provider that accepts a single authorization code for one identity
+type mockOIDCServer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+
+	// taken from the authorization request the backend redirected to
+	nonce     string
+	challenge string
+}
+
+func newMockOIDCServer(t *testing.T, claims jwt.MapClaims) *mockOIDCServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key. Err: %v", err)
+	}
+	m := &mockOIDCServer{key: key, claims: claims}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "upstream",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "upstream-code" || clientID != "backend" || secret != "backend-secret" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idClaims := jwt.MapClaims{"iss": m.URL, "aud": "backend", "exp": time.Now().Add(time.Minute).Unix(), "nonce": m.nonce}
+		for k, v := range m.claims {
+			idClaims[k] = v
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, idClaims)
+		idToken.Header["kid"] = "upstream"
+		signed, _ := idToken.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "id_token": signed})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestFederatedLoginProvisionsUserAndMapsGroups(t *testing.T) {
+	upstream := newMockOIDCServer(t, jwt.MapClaims{
+		"sub":                "corp-42",
+		"preferred_username": "bob",
+		"email":              "bob@corp.example",
+		"groups":             []string{"it-admins", "everyone"},
+	})
+	db := newFakeDB()
+	s, server := newTestServer(t, db)
+	s.providers = map[string]*federation.Provider{
+		"corp": federation.NewProvider(federation.Config{
+			Name:         "corp",
+			Issuer:       upstream.URL,
+			ClientID:     "backend",
+			ClientSecret: "backend-secret",
+			GroupRoles:   map[string]string{"it-admins": "admin", "auditors": "auditor"},
+		}, nil),
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(server.URL + "/auth/corp/login")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected status Found; got %v", resp.Status)
+	}
+	authURL, _ := url.Parse(resp.Header.Get("Location"))
+	upstream.nonce = authURL.Query().Get("nonce")
+	upstream.challenge = authURL.Query().Get("code_challenge")
+	if authURL.Query().Get("redirect_uri") != server.URL+"/auth/corp/callback" {
+		t.Errorf("unexpected redirect_uri %q", authURL.Query().Get("redirect_uri"))
+	}
+
+	loginPath, _ := url.Parse(server.URL + "/auth/corp/callback")
+	for _, cookie := range jar.Cookies(loginPath) {
+		if cookie.Name == federationCookieName {
+			if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", cookie.Value, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected the state cookie to be refused as a bearer token; got %v", resp.Status)
+			}
+		}
+	}
+
+	callback := server.URL + "/auth/corp/callback?" + url.Values{
+		"code":  {"upstream-code"},
+		"state": {"forged"},
+	}.Encode()
+	resp, _ = client.Get(callback)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a wrong state to be rejected; got %v", resp.Status)
+	}
+
+	// The state cookie was consumed by the rejected attempt, so start over
+	resp, _ = client.Get(server.URL + "/auth/corp/login")
+	resp.Body.Close()
+	authURL, _ = url.Parse(resp.Header.Get("Location"))
+	upstream.nonce = authURL.Query().Get("nonce")
+	upstream.challenge = authURL.Query().Get("code_challenge")
+
+	callback = server.URL + "/auth/corp/callback?" + url.Values{
+		"code":  {"upstream-code"},
+		"state": {authURL.Query().Get("state")},
+	}.Encode()
+	resp, err = client.Get(callback)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	defer resp.Body.Close()
+	var tokens TokenResponse
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	if resp.StatusCode != http.StatusOK || tokens.AccessToken == "" {
+		t.Fatalf("expected tokens; got %v", resp.Status)
+	}
+
+	user, _ := db.GetUserByUsername(context.Background(), "bob")
+	if user == nil || user.Email != "bob@corp.example" {
+		t.Fatalf("expected user bob to be provisioned; got %+v", user)
+	}
+	if roles := db.roles["bob"]; !slices.Contains(roles, "standard") || !slices.Contains(roles, "admin") || slices.Contains(roles, "auditor") {
+		t.Errorf("expected default and group mapped roles; got %v", roles)
+	}
+	if linked, _ := db.GetUserByExternalIdentity(context.Background(), "corp", "corp-42"); linked == nil || linked.ID != user.ID {
+		t.Errorf("expected identity to be linked to bob")
+	}
+}
+
+// federatedLogin runs a login at the corp provider through to the callback and returns its response
+func federatedLogin(t *testing.T, serverURL string, upstream *mockOIDCServer) *http.Response {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(serverURL + "/auth/corp/login")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	authURL, _ := url.Parse(resp.Header.Get("Location"))
+	upstream.nonce = authURL.Query().Get("nonce")
+	upstream.challenge = authURL.Query().Get("code_challenge")
+
+	resp, err = client.Get(serverURL + "/auth/corp/callback?" + url.Values{
+		"code":  {"upstream-code"},
+		"state": {authURL.Query().Get("state")},
+	}.Encode())
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestFederatedLoginLinksOnlyVerifiedAddresses(t *testing.T) {
+	upstream := newMockOIDCServer(t, jwt.MapClaims{"sub": "corp-7", "email": "carol@corp.example", "email_verified": true})
+	db := newFakeDB()
+	db.addUser("squatter", "carol@corp.example", "standard")
+	s, server := newTestServer(t, db)
+	s.providers = map[string]*federation.Provider{
+		"corp": federation.NewProvider(federation.Config{
+			Name: "corp", Issuer: upstream.URL, ClientID: "backend", ClientSecret: "backend-secret", LinkByEmail: true,
+		}, nil),
+	}
+
+	// The local account never proved it owns the address, so it isn't linked and the address can't be provisioned
+	var problem Problem
+	resp := federatedLogin(t, server.URL, upstream)
+	json.NewDecoder(resp.Body).Decode(&problem)
+	if resp.StatusCode != http.StatusConflict || problem.Code != "email_taken" {
+		t.Errorf("expected the taken address to conflict; got %v %+v", resp.Status, problem)
+	}
+	if linked, _ := db.GetUserByExternalIdentity(context.Background(), "corp", "corp-7"); linked != nil {
+		t.Fatalf("expected no link to the unverified account; got %+v", linked)
+	}
+
+	db.users[0].EmailVerified = true
+	if resp := federatedLogin(t, server.URL, upstream); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a login linking the verified account; got %v", resp.Status)
+	}
+	if linked, _ := db.GetUserByExternalIdentity(context.Background(), "corp", "corp-7"); linked == nil || linked.Username != "squatter" {
+		t.Errorf("expected the identity to be linked to the verified account; got %+v", linked)
+	}
+}
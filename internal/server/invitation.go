@@ -0,0 +1,353 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
+)
+
+const (
+    purposeInvitation = "invitation"
+
+    invitationTTL = 7 * 24 * time.Hour
+
+    methodInvitation = "invitation"
+)
+
+// invitationURL is the page the link in the invitation mail points to, the token is appended as ?token=.
+// It defaults to GET /v1/invitations/accept on PUBLIC_URL, which describes the invitation.
+var invitationURL = os.Getenv("INVITATION_URL")
+
+// Invitation states in responses, derived from the timestamps
+const (
+    invitationPending  = "pending"
+    invitationAccepted = "accepted"
+    invitationRevoked  = "revoked"
+    invitationExpired  = "expired"
+)
+
+type invitationView struct {
+    modals.Invitation
+    Status string `json:"status"`
+}
+
+func newInvitationView(invitation modals.Invitation) invitationView {
+    status := invitationPending
+    switch {
+    case invitation.AcceptedAt != nil:
+        status = invitationAccepted
+    case invitation.RevokedAt != nil:
+        status = invitationRevoked
+    case time.Now().After(invitation.ExpiresAt):
+        status = invitationExpired
+    }
+    return invitationView{invitation, status}
+}
+
+type InvitationCreateRequest struct {
+    Email string   `json:"email"`
+    Roles []string `json:"roles"`
+    // Locale of the invitation mail, the admin's request language if empty
+    Locale string `json:"locale"`
+}
+
+func (req *InvitationCreateRequest) Normalize() {
+    req.Email = normalizeEmail(req.Email)
+    for i := range req.Roles {
+        req.Roles[i] = strings.TrimSpace(req.Roles[i])
+    }
+}
+
+func (req *InvitationCreateRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.email("email", req.Email, true)
+    for i, role := range req.Roles {
+        fields.roleName(fmt.Sprintf("roles[%d]", i), role)
+    }
+    fields.locale("locale", req.Locale)
+    return fields
+}
+
+// InvitationCreateHandler invites an email address with preassigned roles and mails the invite link
+func (s *Server) InvitationCreateHandler(w http.ResponseWriter, r *http.Request) {
+    var req InvitationCreateRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    // Only a courtesy to the admin, the address can still be taken before the invitation is accepted.
+    // AcceptInvitation is what keeps addresses unique.
+    if existing, err := s.db.GetUserByEmail(r.Context(), req.Email); err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    } else if existing != nil {
+        writeProblem(w, r, http.StatusConflict, "email_taken", "A user with this email address already exists")
+        return
+    }
+    token, hash := newSignedToken(purposeInvitation)
+    now := time.Now()
+    invitation := modals.Invitation{
+        Email:     req.Email,
+        Roles:     req.Roles,
+        TokenHash: hash,
+        CreatedAt: now,
+        SentAt:    now,
+        ExpiresAt: now.Add(invitationTTL),
+    }
+    if invitation.Roles == nil {
+        invitation.Roles = []string{}
+    }
+    if username, _ := claimsFromContext(r.Context())["username"].(string); username != "" {
+        if admin, err := s.db.GetUserByUsername(r.Context(), username); err == nil && admin != nil {
+            invitation.InvitedBy = admin.ID
+            invitation.InvitedByUsername = admin.Username
+        }
+    }
+    err := s.db.CreateInvitation(r.Context(), &invitation)
+    if errors.Is(err, database.ErrNotFound) {
+        // The roles are only assigned once the invitation is accepted, so a misspelled one is caught here
+        writeValidationProblem(w, r, FieldError{Field: "roles", Code: "unknown_role", Message: err.Error()})
+        return
+    }
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to create invitation"))
+        return
+    }
+    slog.InfoContext(r.Context(), "invited user", "actor", subjectFromContext(r.Context()), "invitation_id", invitation.ID, "email", invitation.Email, "roles", invitation.Roles)
+
+    if err := s.sendInvitationEmail(r, invitation, token, req.Locale); err != nil {
+        slog.ErrorContext(r.Context(), "sending invitation failed", "invitation_id", invitation.ID, "error", err)
+        writeProblem(w, r, http.StatusInternalServerError, "mail_failed", "Invitation created, but the mail could not be sent")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/v1/invitations/"+strconv.Itoa(invitation.ID))
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(newInvitationView(invitation))
+}
+
+func (s *Server) sendInvitationEmail(r *http.Request, invitation modals.Invitation, token string, locale string) error {
+    link, err := mailLink(invitationURL, "/v1/invitations/accept", token)
+    if err != nil {
+        return err
+    }
+
+    // The invitee has no account yet, so the mail goes to a user that only carries the address and locale
+    recipient := &modals.User{Email: invitation.Email, Locale: locale}
+    return s.sendMail(r, recipient, "invitation", map[string]interface{}{
+        "InvitedBy": invitation.InvitedByUsername,
+        "Link":      link,
+        "ExpiresAt": invitation.ExpiresAt.Format("2006-01-02 15:04 MST"),
+    })
+}
+
+// InvitationListHandler lists all invitations with their status
+func (s *Server) InvitationListHandler(w http.ResponseWriter, r *http.Request) {
+    invitations, err := s.db.ListInvitations(r.Context())
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    views := []invitationView{}
+    for _, invitation := range invitations {
+        views = append(views, newInvitationView(invitation))
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(views)
+}
+
+// InvitationGetHandler responds with one invitation and its status
+func (s *Server) InvitationGetHandler(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    invitation, err := s.db.GetInvitation(r.Context(), id)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if invitation == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Invitation not found")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(newInvitationView(*invitation))
+}
+
+// InvitationResendHandler mails a new link for an open or expired invitation and restarts its expiry.
+// The link mailed before stops working.
+func (s *Server) InvitationResendHandler(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    invitation, err := s.db.GetInvitation(r.Context(), id)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if invitation == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Invitation not found")
+        return
+    }
+
+    token, hash := newSignedToken(purposeInvitation)
+    now := time.Now()
+    renewed, err := s.db.RenewInvitation(r.Context(), invitation.ID, hash, now, now.Add(invitationTTL))
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to renew invitation"))
+        return
+    }
+    if !renewed {
+        writeProblem(w, r, http.StatusConflict, codeConflict, "Invitation was already accepted or revoked")
+        return
+    }
+    invitation.TokenHash, invitation.SentAt, invitation.ExpiresAt = hash, now, now.Add(invitationTTL)
+    slog.InfoContext(r.Context(), "resent invitation", "actor", subjectFromContext(r.Context()), "invitation_id", invitation.ID, "email", invitation.Email)
+
+    if err := s.sendInvitationEmail(r, *invitation, token, ""); err != nil {
+        slog.ErrorContext(r.Context(), "sending invitation failed", "invitation_id", invitation.ID, "error", err)
+        writeProblem(w, r, http.StatusInternalServerError, "mail_failed", "Failed to send invitation")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(newInvitationView(*invitation))
+}
+
+// InvitationRevokeHandler makes the link of an invitation stop working
+func (s *Server) InvitationRevokeHandler(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    revoked, err := s.db.RevokeInvitation(r.Context(), id)
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to revoke invitation"))
+        return
+    }
+    if !revoked {
+        invitation, err := s.db.GetInvitation(r.Context(), id)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return
+        }
+        if invitation == nil {
+            writeProblem(w, r, http.StatusNotFound, codeNotFound, "Invitation not found")
+            return
+        }
+        writeProblem(w, r, http.StatusConflict, codeConflict, "Invitation was already accepted or revoked")
+        return
+    }
+    slog.InfoContext(r.Context(), "revoked invitation", "actor", subjectFromContext(r.Context()), "invitation_id", id)
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// openInvitation returns the invitation the token from the mail belongs to if it can still be accepted.
+// On failure it has already written the response.
+func (s *Server) openInvitation(w http.ResponseWriter, r *http.Request, token string) (*modals.Invitation, bool) {
+    hash, ok := verifySignedToken(purposeInvitation, token)
+    if !ok {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_invitation", "Invalid or expired invitation")
+        return nil, false
+    }
+    invitation, err := s.db.GetInvitationByTokenHash(r.Context(), hash)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return nil, false
+    }
+    if invitation == nil || newInvitationView(*invitation).Status != invitationPending {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_invitation", "Invalid or expired invitation")
+        return nil, false
+    }
+    return invitation, true
+}
+
+// InvitationHandler describes the invitation the token belongs to, so the signup page can show the address and roles
+func (s *Server) InvitationHandler(w http.ResponseWriter, r *http.Request) {
+    invitation, ok := s.openInvitation(w, r, r.URL.Query().Get("token"))
+    if !ok {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "email":      invitation.Email,
+        "roles":      invitation.Roles,
+        "invited_by": invitation.InvitedByUsername,
+        "expires_at": invitation.ExpiresAt,
+    })
+}
+
+type InvitationAcceptRequest struct {
+    Token    string `json:"token"`
+    Username string `json:"username"`
+    Password string `json:"password"`
+}
+
+func (req *InvitationAcceptRequest) Normalize() {
+    req.Username = normalizeUsername(req.Username)
+}
+
+func (req *InvitationAcceptRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.required("token", req.Token)
+    fields.username("username", req.Username)
+    fields.required("password", req.Password)
+    return fields
+}
+
+// InvitationAcceptHandler creates the invited user with the chosen username and password and the preassigned
+// roles, then responds like POST /account. The invited address counts as verified since the token was mailed to it.
+func (s *Server) InvitationAcceptHandler(w http.ResponseWriter, r *http.Request) {
+    var req InvitationAcceptRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    invitation, ok := s.openInvitation(w, r, req.Token)
+    if !ok {
+        return
+    }
+    if !s.checkNewPassword(w, r, req.Password, req.Username, invitation.Email, 0) {
+        return
+    }
+    if existing, err := s.db.GetUserByUsername(r.Context(), req.Username); err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    } else if existing != nil {
+        writeProblem(w, r, http.StatusConflict, "username_taken", "Username is already taken")
+        return
+    }
+
+    user, err := s.db.AcceptInvitation(r.Context(), invitation.ID, req.Username, req.Password)
+    if errors.Is(err, database.ErrConflict) {
+        writeProblem(w, r, http.StatusConflict, codeConflict, "Username or email address is already taken")
+        return
+    }
+    if errors.Is(err, database.ErrNotFound) {
+        writeProblem(w, r, http.StatusConflict, codeConflict, "A role of the invitation no longer exists")
+        return
+    }
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to create user"))
+        return
+    }
+    if user == nil {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_invitation", "Invalid or expired invitation")
+        return
+    }
+    slog.InfoContext(r.Context(), "accepted invitation", "invitation_id", invitation.ID, "email", invitation.Email, "username", user.Username)
+
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    s.completeLogin(w, r, user, roles, methodInvitation)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestInvitationFlow(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.roleNames = []string{"standard"}
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+	adminToken := testAccessToken(t, db, "admin", "admin")
+
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations", adminToken,
+		InvitationCreateRequest{Email: "admin@example.com"}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected inviting an existing user's address to conflict; got %v", resp.Status)
+	}
+
+	var problem Problem
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations", adminToken,
+		InvitationCreateRequest{Email: "grace@example.com", Roles: []string{"standard", "admni"}}, &problem)
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(problem.Errors) != 1 || problem.Errors[0].Code != "unknown_role" {
+		t.Errorf("expected the unknown role to be rejected; got %v %+v", resp.Status, problem)
+	}
+
+	var created invitationView
+	resp = doJSON(t, http.MethodPost, server.URL+"/v1/invitations", adminToken,
+		InvitationCreateRequest{Email: "grace@example.com", Roles: []string{"standard"}}, &created)
+	if resp.StatusCode != http.StatusCreated || created.Status != invitationPending || created.InvitedByUsername != "admin" {
+		t.Fatalf("expected a pending invitation by admin; got %v %+v", resp.Status, created)
+	}
+	tokenFromMail := func() string {
+		t.Helper()
+		link, err := url.Parse(regexp.MustCompile(`http\S+`).FindString(mailer.sent[len(mailer.sent)-1].Text))
+		if err != nil || mailer.sent[len(mailer.sent)-1].To != "grace@example.com" {
+			t.Fatalf("expected an invitation mail to grace; got %+v", mailer.sent)
+		}
+		return link.Query().Get("token")
+	}
+	first := tokenFromMail()
+
+	// Resending replaces the link
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations/1/resend", adminToken, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	token := tokenFromMail()
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/invitations/accept?token="+url.QueryEscape(first), "", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the replaced link to stop working; got %v", resp.Status)
+	}
+	var described map[string]interface{}
+	doJSON(t, http.MethodGet, server.URL+"/v1/invitations/accept?token="+url.QueryEscape(token), "", nil, &described)
+	if described["email"] != "grace@example.com" {
+		t.Errorf("expected the invitation to describe grace's address; got %v", described)
+	}
+
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations/accept", "",
+		InvitationAcceptRequest{Token: token, Username: "admin", Password: "pw"}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected a taken username to conflict; got %v", resp.Status)
+	}
+	var tokens TokenResponse
+	resp = doJSON(t, http.MethodPost, server.URL+"/v1/invitations/accept", "", InvitationAcceptRequest{Token: token, Username: "grace", Password: "pw"}, &tokens)
+	if resp.StatusCode != http.StatusOK || tokens.AccessToken == "" {
+		t.Fatalf("expected the invitee to be logged in; got %v", resp.Status)
+	}
+	if grace, _ := db.GetUserByUsername(context.Background(), "grace"); grace == nil || !grace.EmailVerified || db.roles["grace"][0] != "standard" {
+		t.Errorf("expected grace with a verified address and the standard role; got %+v %v", grace, db.roles["grace"])
+	}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations/accept", "",
+		InvitationAcceptRequest{Token: token, Username: "grace2", Password: "pw"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an accepted invitation to be single-use; got %v", resp.Status)
+	}
+
+	var listed []invitationView
+	doJSON(t, http.MethodGet, server.URL+"/v1/invitations", adminToken, nil, &listed)
+	if len(listed) != 1 || listed[0].Status != invitationAccepted {
+		t.Errorf("expected the invitation listed as accepted; got %+v", listed)
+	}
+	if resp := doJSON(t, http.MethodDelete, server.URL+"/v1/invitations/1", adminToken, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected an accepted invitation not to be revocable; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodDelete, server.URL+"/v1/invitations/2", adminToken, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status Not Found for an unknown invitation; got %v", resp.Status)
+	}
+}
+
+func TestInvitationAcceptWhenAddressTakenMeanwhile(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+	adminToken := testAccessToken(t, db, "admin", "admin")
+
+	doJSON(t, http.MethodPost, server.URL+"/v1/invitations", adminToken, InvitationCreateRequest{Email: "grace@example.com"}, nil)
+	link, _ := url.Parse(regexp.MustCompile(`http\S+`).FindString(mailer.sent[0].Text))
+	// Someone registers the address between invitation and acceptance, in another case than the invitation
+	db.addUser("gracie", "Grace@Example.com", "standard")
+
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations/accept", "",
+		InvitationAcceptRequest{Token: link.Query().Get("token"), Username: "grace", Password: "pw"}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected the taken address to conflict; got %v", resp.Status)
+	}
+}
+
+func TestInvitationAcceptWhenRoleDeletedMeanwhile(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.roleNames = append(db.roleNames, "auditor")
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+	adminToken := testAccessToken(t, db, "admin", "admin")
+
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations", adminToken, InvitationCreateRequest{Email: "grace@example.com", Roles: []string{"auditor"}}, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status Created; got %v", resp.Status)
+	}
+	link, _ := url.Parse(regexp.MustCompile(`http\S+`).FindString(mailer.sent[0].Text))
+	db.roleNames = nil
+
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/invitations/accept", "",
+		InvitationAcceptRequest{Token: link.Query().Get("token"), Username: "grace", Password: "pw"}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected the deleted role to fail the acceptance; got %v", resp.Status)
+	}
+	if grace, _ := db.GetUserByUsername(context.Background(), "grace"); grace != nil {
+		t.Errorf("expected no user without the invited roles; got %+v", grace)
+	}
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/modals"
+	"jjr-tec-backend/internal/security"
+)
+
+const (
+    methodPassword = "password"
+    methodStepUp   = "step_up"
+
+    purposeLoginStepUp = "login_step_up"
+    loginStepUpTTL     = 10 * time.Minute
+
+    // loginHistoryDepth is how many earlier successful logins the detector compares with
+    loginHistoryDepth = 100
+    // loginHistoryLimit is how many entries the history endpoints respond with
+    loginHistoryLimit = 50
+)
+
+// Actions for suspicious logins
+const (
+    suspiciousLoginNone   = "none"
+    suspiciousLoginNotify = "notify"
+    suspiciousLoginStepUp = "step_up"
+)
+
+var (
+    // geoIPFile is the offline GeoIP database, see security.LoadGeoIP. Without it only devices and IP ranges are compared.
+    geoIPFile = os.Getenv("GEOIP_DB_FILE")
+
+    // suspiciousLoginAction is what happens when the detector flags a login: "notify" (the default) mails the user,
+    // "step_up" additionally holds the login back until the user enters a code mailed to them, "none" only records it
+    suspiciousLoginAction = os.Getenv("SUSPICIOUS_LOGIN_ACTION")
+)
+
+// newDetector loads the GeoIP database from GEOIP_DB_FILE and checks SUSPICIOUS_LOGIN_ACTION
+func newDetector() (*security.Detector, error) {
+    switch suspiciousLoginAction {
+    case "", suspiciousLoginNone, suspiciousLoginNotify, suspiciousLoginStepUp:
+    default:
+        return nil, fmt.Errorf("SUSPICIOUS_LOGIN_ACTION must be none, notify or step_up, not %q", suspiciousLoginAction)
+    }
+    var geoIP *security.GeoIP
+    if geoIPFile != "" {
+        var err error
+        if geoIP, err = security.LoadGeoIP(geoIPFile); err != nil {
+            return nil, err
+        }
+    }
+    return security.NewDetector(geoIP), nil
+}
+
+// newLoginAttempt describes an attempt to log in as username from the client making the request
+func (s *Server) newLoginAttempt(r *http.Request, username string, user *modals.User, method string) *modals.LoginAttempt {
+    attempt := &modals.LoginAttempt{
+        Username:  username,
+        Method:    method,
+        IP:        clientIP(r),
+        UserAgent: r.UserAgent(),
+        Device:    describeDevice(r.UserAgent()),
+        CreatedAt: time.Now(),
+    }
+    if user != nil {
+        attempt.UserID = user.ID
+        attempt.Username = user.Username
+    }
+    if s.detector != nil {
+        s.detector.Locate(attempt)
+    }
+    return attempt
+}
+
+// recordFailedLogin adds a failed attempt to the login history, user is nil if the username matched no user
+func (s *Server) recordFailedLogin(r *http.Request, username string, user *modals.User, method string, reason string) {
+    attempt := s.newLoginAttempt(r, username, user, method)
+    attempt.Reason = reason
+    observeLogin(method, reason)
+    if err := s.db.RecordLoginAttempt(r.Context(), attempt); err != nil {
+        slog.ErrorContext(r.Context(), "recording login attempt failed", "username", username, "error", err)
+    }
+}
+
+// completeLogin records the successful login, checks it for anomalies and responds with a token pair. If the
+// login is suspicious and SUSPICIOUS_LOGIN_ACTION is step_up, it responds with a step-up challenge instead,
+// unless the user has no verified email address to mail the code to.
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, user *modals.User, roles []string, method string) {
+    attempt := s.newLoginAttempt(r, user.Username, user, method)
+    attempt.Success = true
+
+    var findings []security.Finding
+    if s.detector != nil && method != methodStepUp {
+        history, err := s.db.ListLoginAttempts(r.Context(), user.ID, true, loginHistoryDepth)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return
+        }
+        findings = s.detector.Check(*attempt, history)
+    }
+    action := suspiciousLoginNone
+    if len(findings) > 0 {
+        action = suspiciousLoginAction
+        if action == "" {
+            action = suspiciousLoginNotify
+        }
+    }
+    if action == suspiciousLoginStepUp && (user.Email == "" || !user.EmailVerified) {
+        // The code could never reach the user, holding the login back would lock them out for good
+        slog.WarnContext(r.Context(), "no verified email address for a login code, notifying instead", "username", user.Username)
+        action = suspiciousLoginNotify
+    }
+    if action == suspiciousLoginStepUp {
+        attempt.Success = false
+        attempt.Reason = "step_up_required"
+    }
+
+    if err := s.db.RecordLoginAttempt(r.Context(), attempt); err != nil {
+        writeError(w, r, dbError(err, "Error recording login"))
+        return
+    }
+    observeLogin(method, attempt.Reason)
+    for _, finding := range findings {
+        err := s.db.CreateSecurityEvent(r.Context(), &modals.SecurityEvent{
+            UserID:         user.ID,
+            LoginAttemptID: attempt.ID,
+            Kind:           finding.Kind,
+            Detail:         finding.Detail,
+            Action:         action,
+            CreatedAt:      attempt.CreatedAt,
+        })
+        if err != nil {
+            writeError(w, r, dbError(err, "Error recording security event"))
+            return
+        }
+        slog.WarnContext(r.Context(), "suspicious login", "username", user.Username, "kind", finding.Kind, "detail", finding.Detail)
+    }
+
+    switch action {
+    case suspiciousLoginNotify:
+        s.sendSecurityAlert(r, user, attempt, findings)
+    case suspiciousLoginStepUp:
+        s.startStepUp(w, r, user)
+        return
+    }
+
+    if err := s.db.RecordLogin(r.Context(), user.ID); err != nil {
+        slog.ErrorContext(r.Context(), "recording login failed", "username", user.Username, "error", err)
+    }
+    s.writeTokenPair(w, r, user, roles)
+}
+
+func (s *Server) sendSecurityAlert(r *http.Request, user *modals.User, attempt *modals.LoginAttempt, findings []security.Finding) {
+    if user.Email == "" {
+        return
+    }
+    when := attempt.CreatedAt
+    if location, err := time.LoadLocation(user.Timezone); err == nil && user.Timezone != "" {
+        when = when.In(location)
+    }
+    var reasons []string
+    for _, finding := range findings {
+        reasons = append(reasons, finding.Detail)
+    }
+    err := s.sendMail(r, user, "security_alert", map[string]interface{}{
+        "Username": user.Username,
+        "Device":   attempt.Device,
+        "IP":       attempt.IP,
+        "City":     attempt.City,
+        "Country":  attempt.Country,
+        "Time":     when.Format("2006-01-02 15:04 MST"),
+        "Reasons":  reasons,
+    })
+    if err != nil {
+        slog.ErrorContext(r.Context(), "sending security alert failed", "username", user.Username, "error", err)
+    }
+}
+
+// stepUpCodeAlphabet leaves out characters that are easily confused, like 0 and O
+const stepUpCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// startStepUp mails the user a code and responds with the challenge the code has to be posted with to
+// /v1/tokens/step-up. The code alone is worthless, so 8 characters are plenty against guessing within the TTL.
+func (s *Server) startStepUp(w http.ResponseWriter, r *http.Request, user *modals.User) {
+    challenge, challengeHash := newSignedToken(purposeLoginStepUp)
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        panic(err) // crypto/rand never fails on supported platforms
+    }
+    for i := range b {
+        b[i] = stepUpCodeAlphabet[int(b[i])%len(stepUpCodeAlphabet)]
+    }
+    code := string(b)
+
+    now := time.Now()
+    err := s.db.CreateUserToken(r.Context(), &modals.UserToken{
+        UserID:    user.ID,
+        Purpose:   purposeLoginStepUp,
+        TokenHash: hashSecret(challengeHash + ":" + code),
+        CreatedAt: now,
+        ExpiresAt: now.Add(loginStepUpTTL),
+    })
+    if err != nil {
+        writeError(w, r, dbError(err, "Error starting step-up"))
+        return
+    }
+    if err := s.sendMail(r, user, "login_code", map[string]string{"Username": user.Username, "Code": code}); err != nil {
+        slog.ErrorContext(r.Context(), "sending login code failed", "username", user.Username, "error", err)
+        writeProblem(w, r, http.StatusInternalServerError, "mail_failed", "Error sending login code")
+        return
+    }
+
+    writeError(w, r, &APIError{
+        Status: http.StatusUnauthorized,
+        Code:   "step_up_required",
+        Detail: "Enter the code mailed to you to finish logging in",
+        Extensions: map[string]interface{}{
+            "challenge":  challenge,
+            "expires_in": int(loginStepUpTTL.Seconds()),
+        },
+    })
+}
+
+type StepUpRequest struct {
+    Challenge string `json:"challenge"`
+    Code      string `json:"code"`
+}
+
+func (req *StepUpRequest) Normalize() {
+    req.Code = strings.ToUpper(strings.TrimSpace(req.Code))
+}
+
+func (req *StepUpRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.required("challenge", req.Challenge)
+    fields.required("code", req.Code)
+    return fields
+}
+
+// StepUpHandler completes a login that was held back as suspicious, it responds like POST /account
+func (s *Server) StepUpHandler(w http.ResponseWriter, r *http.Request) {
+    var req StepUpRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    challengeHash, ok := verifySignedToken(purposeLoginStepUp, req.Challenge)
+    if !ok {
+        writeProblem(w, r, http.StatusUnauthorized, "invalid_code", "Invalid or expired code")
+        return
+    }
+    code := strings.ToUpper(strings.TrimSpace(req.Code))
+    token, err := s.db.ConsumeUserToken(r.Context(), purposeLoginStepUp, hashSecret(challengeHash+":"+code))
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if token == nil {
+        writeProblem(w, r, http.StatusUnauthorized, "invalid_code", "Invalid or expired code")
+        return
+    }
+
+    user, err := s.db.GetUserByID(r.Context(), token.UserID)
+    if err != nil || user == nil {
+        writeProblem(w, r, http.StatusInternalServerError, codeDatabaseError, "Error querying database")
+        return
+    }
+    if !s.checkLoginAllowed(w, r, user, methodStepUp) {
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    s.completeLogin(w, r, user, roles, methodStepUp)
+}
+
+// MeLoginHistoryHandler responds with the newest login attempts of the calling user
+func (s *Server) MeLoginHistoryHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    s.writeLoginHistory(w, r, user)
+}
+
+// MeSecurityEventsHandler responds with the suspicious logins flagged for the calling user
+func (s *Server) MeSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    s.writeSecurityEvents(w, r, user)
+}
+
+// UserLoginHistoryHandler lets admins see the newest login attempts of a user
+func (s *Server) UserLoginHistoryHandler(w http.ResponseWriter, r *http.Request) {
+    if user := s.userFromPath(w, r); user != nil {
+        s.writeLoginHistory(w, r, user)
+    }
+}
+
+// UserSecurityEventsHandler lets admins see the suspicious logins flagged for a user
+func (s *Server) UserSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+    if user := s.userFromPath(w, r); user != nil {
+        s.writeSecurityEvents(w, r, user)
+    }
+}
+
+// userFromPath returns the user named by the {username} route variable, or responds with an error and returns nil
+func (s *Server) userFromPath(w http.ResponseWriter, r *http.Request) *modals.User {
+    user, err := s.db.GetUserByUsername(r.Context(), mux.Vars(r)["username"])
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return nil
+    }
+    if user == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "User not found")
+        return nil
+    }
+    return user
+}
+
+func (s *Server) writeLoginHistory(w http.ResponseWriter, r *http.Request, user *modals.User) {
+    attempts, err := s.db.ListLoginAttempts(r.Context(), user.ID, false, loginHistoryLimit)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if attempts == nil {
+        attempts = []modals.LoginAttempt{}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(attempts)
+}
+
+func (s *Server) writeSecurityEvents(w http.ResponseWriter, r *http.Request, user *modals.User) {
+    events, err := s.db.ListSecurityEvents(r.Context(), user.ID, loginHistoryLimit)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if events == nil {
+        events = []modals.SecurityEvent{}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(events)
+}
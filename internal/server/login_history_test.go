@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"jjr-tec-backend/internal/security"
+)
+
+const (
+	firefoxOnLinux  = "Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0"
+	chromeOnAndroid = "Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 Chrome/129.0 Mobile Safari/537.36"
+)
+
+func TestLoginHistoryAndSuspiciousLogins(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard").EmailVerified = true
+	db.addUser("bob", "", "standard")
+	s, server := newTestServer(t, db)
+	s.authenticator = passwordAuthenticator{db}
+	s.detector = security.NewDetector(nil)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+
+	// The first login has nothing to compare with, the second one comes from a new device
+	login(t, server.URL, "alice", firefoxOnLinux)
+	if len(mailer.sent) != 0 {
+		t.Fatalf("expected no alert for the first login; got %+v", mailer.sent)
+	}
+	tokens := login(t, server.URL, "alice", chromeOnAndroid)
+	if tokens.AccessToken == "" {
+		t.Fatalf("expected the login to go through with the notify action")
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "alice@example.com" || !bytes.Contains([]byte(mailer.sent[0].Text), []byte("Chrome on Android")) {
+		t.Fatalf("expected a security alert about the new device; got %+v", mailer.sent)
+	}
+	doJSON(t, http.MethodPost, server.URL+"/account", "", LoginRequest{Username: "alice", Password: "wrong"}, nil)
+
+	var history []map[string]interface{}
+	doJSON(t, http.MethodGet, server.URL+"/v1/me/logins", tokens.AccessToken, nil, &history)
+	if len(history) != 3 || history[0]["success"] != false || history[0]["reason"] != "invalid_credentials" || history[1]["device"] != "Chrome on Android" {
+		t.Fatalf("expected the failed and both successful logins, newest first; got %v", history)
+	}
+	var events []map[string]interface{}
+	doJSON(t, http.MethodGet, server.URL+"/v1/users/alice/security_events", testAccessToken(t, db, "admin", "admin"), nil, &events)
+	if len(events) != 1 || events[0]["kind"] != security.NewDevice || events[0]["action"] != suspiciousLoginNotify {
+		t.Fatalf("expected one new device event; got %v", events)
+	}
+
+	// With step_up a suspicious login needs the code mailed to the user
+	suspiciousLoginAction = suspiciousLoginStepUp
+	t.Cleanup(func() { suspiciousLoginAction = "" })
+	body, _ := json.Marshal(LoginRequest{Username: "alice", Password: "password"})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/account", bytes.NewReader(body))
+	req.Header.Set("User-Agent", "curl/8.5.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	var challenge map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&challenge)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || challenge["code"] != "step_up_required" {
+		t.Fatalf("expected a step-up challenge; got %v %v", resp.Status, challenge)
+	}
+	code := regexp.MustCompile(`(?m)^[A-Z2-9]{8}$`).FindString(mailer.sent[len(mailer.sent)-1].Text)
+	if code == "" {
+		t.Fatalf("expected a login code mail; got %+v", mailer.sent[len(mailer.sent)-1])
+	}
+
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/tokens/step-up", "", StepUpRequest{Challenge: challenge["challenge"].(string), Code: "AAAAAAAA"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be rejected; got %v", resp.Status)
+	}
+	var stepped TokenResponse
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/tokens/step-up", "", StepUpRequest{Challenge: challenge["challenge"].(string), Code: code}, &stepped); resp.StatusCode != http.StatusOK || stepped.AccessToken == "" {
+		t.Fatalf("expected tokens for the right code; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/tokens/step-up", "", StepUpRequest{Challenge: challenge["challenge"].(string), Code: code}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the code to be single-use; got %v", resp.Status)
+	}
+
+	// A user without a verified email address couldn't get the code, their suspicious logins go through
+	login(t, server.URL, "bob", firefoxOnLinux)
+	if tokens := login(t, server.URL, "bob", chromeOnAndroid); tokens.AccessToken == "" {
+		t.Fatalf("expected bob to be let in without a step-up")
+	}
+	events = nil
+	doJSON(t, http.MethodGet, server.URL+"/v1/users/bob/security_events", testAccessToken(t, db, "admin", "admin"), nil, &events)
+	if len(events) != 1 || events[0]["action"] != suspiciousLoginNotify {
+		t.Errorf("expected the new device to be recorded with the notify action; got %v", events)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/language"
+
+	"jjr-tec-backend/internal/auth"
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
+)
+
+// maxDisplayNameLength matches the display_name column
+const maxDisplayNameLength = 100
+
+// MeHandler responds with the profile of the calling user
+func (s *Server) MeHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(profileResponse(user, roles))
+}
+
+// ProfileUpdateRequest holds the fields to change, fields left out keep their value and "" clears them.
+// Changing the email address takes the current password.
+type ProfileUpdateRequest struct {
+    Email           *string `json:"email"`
+    DisplayName     *string `json:"display_name"`
+    Locale          *string `json:"locale"`
+    Timezone        *string `json:"timezone"`
+    CurrentPassword string  `json:"current_password,omitempty"`
+}
+
+func (req *ProfileUpdateRequest) Normalize() {
+    if req.Email != nil {
+        *req.Email = normalizeEmail(*req.Email)
+    }
+    if req.DisplayName != nil {
+        *req.DisplayName = strings.TrimSpace(*req.DisplayName)
+    }
+}
+
+// Validate checks the fields that are given, whether the email address is free is up to the handler
+func (req *ProfileUpdateRequest) Validate() []FieldError {
+    var fields fieldErrors
+    if req.Email != nil {
+        fields.email("email", *req.Email, false)
+    }
+    if req.DisplayName != nil {
+        fields.maxLength("display_name", *req.DisplayName, maxDisplayNameLength)
+    }
+    if req.Locale != nil {
+        fields.locale("locale", *req.Locale)
+    }
+    if req.Timezone != nil {
+        fields.timezone("timezone", *req.Timezone)
+    }
+    return fields
+}
+
+// MeUpdateHandler changes the profile of the calling user. A new email address has to be verified again,
+// a verification link is mailed to it. Password reset links mailed to the old address stop working, the address
+// controls the account, so changing it takes the current password and a user session rather than a personal access token.
+func (s *Server) MeUpdateHandler(w http.ResponseWriter, r *http.Request) {
+    var req ProfileUpdateRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    emailChanged := false
+
+    if req.Email != nil && *req.Email != user.Email {
+        if claimsFromContext(r.Context())["typ"] == tokenTypePAT {
+            writeProblem(w, r, http.StatusForbidden, "user_session_required", "The email address can only be changed with a user session")
+            return
+        }
+        if req.CurrentPassword == "" {
+            writeValidationProblem(w, r, FieldError{Field: "current_password", Code: "required", Message: "current_password is required to change the email address"})
+            return
+        }
+        if _, err := (auth.Local{DB: s.db}).Authenticate(r.Context(), user.Username, req.CurrentPassword); errors.Is(err, auth.ErrInvalidCredentials) {
+            writeProblem(w, r, http.StatusUnauthorized, "wrong_password", "Current password is wrong")
+            return
+        } else if err != nil {
+            writeError(w, r, dbError(err, "Error authenticating user"))
+            return
+        }
+
+        other, err := s.db.GetUserByEmail(r.Context(), *req.Email)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return
+        }
+        if other != nil {
+            writeProblem(w, r, http.StatusConflict, "email_taken", "email is used by another account")
+            return
+        }
+        user.Email = *req.Email
+        user.EmailVerified = false
+        emailChanged = true
+    }
+    if req.DisplayName != nil {
+        user.DisplayName = *req.DisplayName
+    }
+    if req.Locale != nil {
+        user.Locale = ""
+        if *req.Locale != "" {
+            user.Locale = language.Make(*req.Locale).String()
+        }
+    }
+    if req.Timezone != nil {
+        user.Timezone = *req.Timezone
+    }
+
+    // The check above gives the usual answer, the unique index catches addresses taken since
+    if err := s.db.UpdateUserProfile(r.Context(), user); errors.Is(err, database.ErrConflict) {
+        writeProblem(w, r, http.StatusConflict, "email_taken", "email is used by another account")
+        return
+    } else if err != nil {
+        writeError(w, r, dbError(err, "Failed to update profile"))
+        return
+    }
+    if emailChanged {
+        // Reset links went to the old address, using one would mark the new address verified
+        if err := s.db.RevokeUserTokens(r.Context(), user.ID, purposePasswordReset); err != nil {
+            slog.ErrorContext(r.Context(), "revoking password reset tokens failed", "username", user.Username, "error", err)
+        }
+        if err := s.sendVerificationEmail(r, user); err != nil {
+            slog.ErrorContext(r.Context(), "sending verification email failed", "username", user.Username, "error", err)
+        }
+    }
+
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(profileResponse(user, roles))
+}
+
+// MeRolesHandler responds with the role names of the calling user
+func (s *Server) MeRolesHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if roles == nil {
+        roles = []string{}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(roles)
+}
+
+// MeDeleteHandler deletes the calling user's account with everything attached to it. The body has to repeat the
+// username as confirmation, and personal access tokens can't delete the account they belong to.
+func (s *Server) MeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+    if claimsFromContext(r.Context())["typ"] == tokenTypePAT {
+        writeProblem(w, r, http.StatusForbidden, "user_session_required", "Accounts can only be deleted with a user session")
+        return
+    }
+    var req UsernameStruct
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    if req.Username != user.Username {
+        writeValidationProblem(w, r, FieldError{Field: "username", Code: "mismatch", Message: "username must match the account to delete"})
+        return
+    }
+
+    if _, err := s.db.DeleteUser(r.Context(), user.ID); err != nil {
+        writeError(w, r, dbError(err, "Failed to delete account"))
+        return
+    }
+    slog.InfoContext(r.Context(), "deleted own account", "actor", subjectFromContext(r.Context()))
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// profile is the user as /me shows it, with their role names
+type profile struct {
+    *modals.User
+    Roles []string `json:"roles"`
+}
+
+func profileResponse(user *modals.User, roles []string) profile {
+    if roles == nil {
+        roles = []string{}
+    }
+    return profile{User: user, Roles: roles}
+}
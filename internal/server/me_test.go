@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMeProfile(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("alice", "alice@example.com", "standard").EmailVerified = true
+	db.addUser("bob", "bob@example.com", "standard")
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+	token := testAccessToken(t, db, "alice", "standard")
+
+	var profile map[string]interface{}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", token, nil, &profile); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if profile["username"] != "alice" || profile["email_verified"] != true {
+		t.Errorf("expected alice's profile; got %v", profile)
+	}
+
+	for _, invalid := range []ProfileUpdateRequest{
+		{Locale: ptr("not a locale")},
+		{Timezone: ptr("Mars/Olympus_Mons")},
+		{Email: ptr("alice")},
+	} {
+		if resp := doJSON(t, http.MethodPatch, server.URL+"/v1/me", token, invalid, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("expected %+v to be rejected; got %v", invalid, resp.Status)
+		}
+	}
+	if resp := doJSON(t, http.MethodPatch, server.URL+"/v1/me", token, ProfileUpdateRequest{Email: ptr("bob@example.com"), CurrentPassword: "password"}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected bob's address to be rejected; got %v", resp.Status)
+	}
+
+	// The address controls the account, changing it takes the current password
+	update := ProfileUpdateRequest{Email: ptr("alice@example.org"), DisplayName: ptr("Alice"), Locale: ptr("de-at"), Timezone: ptr("Europe/Vienna")}
+	if resp := doJSON(t, http.MethodPatch, server.URL+"/v1/me", token, update, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected the current password to be required; got %v", resp.Status)
+	}
+	update.CurrentPassword = "wrong"
+	if resp := doJSON(t, http.MethodPatch, server.URL+"/v1/me", token, update, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be rejected; got %v", resp.Status)
+	}
+	update.CurrentPassword = "password"
+	if resp := doJSON(t, http.MethodPatch, server.URL+"/v1/me", token, update, &profile); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if profile["locale"] != "de-AT" || profile["timezone"] != "Europe/Vienna" || profile["email_verified"] != false {
+		t.Errorf("expected the updated profile with an unverified address; got %v", profile)
+	}
+	// The verification mail goes to the new address in the user's language
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "alice@example.org" || !strings.HasPrefix(mailer.sent[0].Text, "Hallo alice") {
+		t.Errorf("expected a German verification mail to the new address; got %+v", mailer.sent)
+	}
+
+	resp := doJSON(t, http.MethodDelete, server.URL+"/v1/me", token, UsernameStruct{Username: "bob"}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a mismatching confirmation to be rejected; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodDelete, server.URL+"/v1/me", token, UsernameStruct{Username: "alice"}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status No Content; got %v", resp.Status)
+	}
+	if user, _ := db.GetUserByUsername(context.Background(), "alice"); user != nil {
+		t.Errorf("expected alice to be deleted")
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the deleted user's token to be rejected; got %v", resp.Status)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestEmailChangeNeedsUserSession(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("alice", "alice@example.com", "standard").EmailVerified = true
+	s, server := newTestServer(t, db)
+	s.mailer = &fakeMailer{}
+	token := testAccessToken(t, db, "alice", "standard")
+
+	var created map[string]interface{}
+	doJSON(t, http.MethodPost, server.URL+"/v1/me/tokens", token, PersonalAccessTokenRequest{Name: "ci", Scopes: []string{"standard"}}, &created)
+	update := ProfileUpdateRequest{Email: ptr("mallory@example.org"), CurrentPassword: "password"}
+	if resp := doJSON(t, http.MethodPatch, server.URL+"/v1/me", created["token"].(string), update, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected personal access tokens not to change the address; got %v", resp.Status)
+	}
+
+	// A reset link mailed to the old address must not verify the new one
+	doJSON(t, http.MethodPost, server.URL+"/v1/password/forgot", "", EmailRequest{Email: "alice@example.com"}, nil)
+	update.Email = ptr("alice@example.org")
+	if resp := doJSON(t, http.MethodPatch, server.URL+"/v1/me", token, update, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	resets := 0
+	for _, userToken := range db.userTokens {
+		if userToken.Purpose == purposePasswordReset {
+			resets++
+			if userToken.UsedAt == nil {
+				t.Errorf("expected the reset token to be revoked; got %+v", userToken)
+			}
+		}
+	}
+	if resets != 1 {
+		t.Errorf("expected one reset token; got %d", resets)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"jjr-tec-backend/internal/database"
+)
+
+var (
+    // metricsToken is the bearer token scrapers have to send to GET /metrics. Without it /metrics is closed.
+    metricsToken = os.Getenv("METRICS_TOKEN")
+
+    // metricsPublic opens /metrics to everyone when no token is set, for deployments where only the internal
+    // network reaches the API
+    metricsPublic = os.Getenv("METRICS_PUBLIC") == "true"
+)
+
+// metricsRegistry holds the metrics of the process, /metrics adds the connection pool of the Server's database
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+    httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "http_requests_total",
+        Help: "HTTP requests by method, route template and status.",
+    }, []string{"method", "route", "status"})
+
+    httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "http_request_duration_seconds",
+        Help:    "Time to answer HTTP requests by method, route template and status.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"method", "route", "status"})
+
+    panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "http_panics_total",
+        Help: "Handler panics recovered into 500 responses, by route template.",
+    }, []string{"route"})
+
+    // logins counts what login attempts record, result is success or failure and reason the failure reason
+    logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "auth_logins_total",
+        Help: "Login attempts by method (password, step_up, invitation, federated provider), result and failure reason.",
+    }, []string{"method", "result", "reason"})
+
+    tokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "auth_tokens_issued_total",
+        Help: "Tokens issued by type (access, refresh, id, personal_access) and grant.",
+    }, []string{"type", "grant"})
+)
+
+// Grants tokensIssued distinguishes, grantSession are the token pairs of new sessions from logins and password changes
+const (
+    grantSession           = "session"
+    grantRefresh           = "refresh_token"
+    grantAuthorizationCode = "authorization_code"
+    grantClientCredentials = "client_credentials"
+    grantPersonal          = "personal"
+)
+
+func init() {
+    metricsRegistry.MustRegister(
+        httpRequests, httpRequestDuration, panics, logins, tokensIssued,
+        collectors.NewGoCollector(),
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+    )
+}
+
+// observeRequest records a finished request in the HTTP metrics
+func observeRequest(method string, route string, status int, latency time.Duration) {
+    code := strconv.Itoa(status)
+    httpRequests.WithLabelValues(method, route, code).Inc()
+    httpRequestDuration.WithLabelValues(method, route, code).Observe(latency.Seconds())
+}
+
+// observeLogin records a login attempt, an empty reason means it succeeded
+func observeLogin(method string, reason string) {
+    result := "success"
+    if reason != "" {
+        result = "failure"
+    }
+    logins.WithLabelValues(method, result, reason).Inc()
+}
+
+// MetricsHandler responds with the metrics in the Prometheus text format
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+    switch {
+    case metricsToken != "":
+        if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+metricsToken)) != 1 {
+            writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid metrics token")
+            return
+        }
+    case !metricsPublic:
+        writeProblem(w, r, http.StatusForbidden, "metrics_disabled", "Metrics are disabled, set METRICS_TOKEN or METRICS_PUBLIC=true")
+        return
+    }
+
+    pool := prometheus.NewRegistry()
+    pool.MustRegister(dbStatsCollector{s.db})
+    promhttp.HandlerFor(prometheus.Gatherers{metricsRegistry, pool}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// dbStatsCollector exposes the connection pool statistics GET /health reports
+type dbStatsCollector struct {
+    db database.Service
+}
+
+var (
+    dbOpenConnections   = prometheus.NewDesc("db_pool_open_connections", "Established connections, in use and idle.", nil, nil)
+    dbInUse             = prometheus.NewDesc("db_pool_in_use_connections", "Connections currently in use.", nil, nil)
+    dbIdle              = prometheus.NewDesc("db_pool_idle_connections", "Idle connections.", nil, nil)
+    dbMaxOpen           = prometheus.NewDesc("db_pool_max_open_connections", "Maximum number of open connections.", nil, nil)
+    dbWaitCount         = prometheus.NewDesc("db_pool_wait_count_total", "Connections waited for.", nil, nil)
+    dbWaitDuration      = prometheus.NewDesc("db_pool_wait_duration_seconds_total", "Time spent waiting for connections.", nil, nil)
+    dbMaxIdleClosed     = prometheus.NewDesc("db_pool_max_idle_closed_total", "Connections closed because of the idle limit.", nil, nil)
+    dbMaxLifetimeClosed = prometheus.NewDesc("db_pool_max_lifetime_closed_total", "Connections closed because of their maximum lifetime.", nil, nil)
+)
+
+func (c dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+    for _, desc := range []*prometheus.Desc{dbOpenConnections, dbInUse, dbIdle, dbMaxOpen, dbWaitCount, dbWaitDuration, dbMaxIdleClosed, dbMaxLifetimeClosed} {
+        ch <- desc
+    }
+}
+
+func (c dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+    stats := c.db.Stats()
+    ch <- prometheus.MustNewConstMetric(dbOpenConnections, prometheus.GaugeValue, float64(stats.OpenConnections))
+    ch <- prometheus.MustNewConstMetric(dbInUse, prometheus.GaugeValue, float64(stats.InUse))
+    ch <- prometheus.MustNewConstMetric(dbIdle, prometheus.GaugeValue, float64(stats.Idle))
+    ch <- prometheus.MustNewConstMetric(dbMaxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+    ch <- prometheus.MustNewConstMetric(dbWaitCount, prometheus.CounterValue, float64(stats.WaitCount))
+    ch <- prometheus.MustNewConstMetric(dbWaitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+    ch <- prometheus.MustNewConstMetric(dbMaxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+    ch <- prometheus.MustNewConstMetric(dbMaxLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("alice", "alice@example.com", "standard")
+	s, server := newTestServer(t, db)
+	s.authenticator = passwordAuthenticator{db}
+
+	doJSON(t, http.MethodPost, server.URL+"/v1/tokens", "", LoginRequest{Username: "alice", Password: "password"}, nil)
+	doJSON(t, http.MethodPost, server.URL+"/v1/tokens", "", LoginRequest{Username: "alice", Password: "wrong"}, nil)
+	doJSON(t, http.MethodGet, server.URL+"/v1/users/alice", "", nil, nil)
+
+	// Closed unless a token is configured or it is opened explicitly
+	if resp := doJSON(t, http.MethodGet, server.URL+"/metrics", "", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected metrics to be closed by default; got %v", resp.Status)
+	}
+	metricsPublic = true
+	t.Cleanup(func() { metricsPublic = false })
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v %v", resp, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, metric := range []string{
+		`http_requests_total{method="POST",route="/v1/tokens",status="200"}`,
+		`http_requests_total{method="GET",route="/v1/users/{username}",status="401"}`,
+		`http_request_duration_seconds_bucket{method="POST",route="/v1/tokens",status="200",le="+Inf"}`,
+		`auth_logins_total{method="password",reason="",result="success"}`,
+		`auth_logins_total{method="password",reason="invalid_credentials",result="failure"}`,
+		`auth_tokens_issued_total{grant="session",type="refresh"}`,
+		`db_pool_open_connections 3`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("expected %s in the metrics", metric)
+		}
+	}
+
+	metricsToken = "scrape"
+	t.Cleanup(func() { metricsToken = "" })
+	if resp := doJSON(t, http.MethodGet, server.URL+"/metrics", "", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected scrapers without the token to be unauthorized, even with METRICS_PUBLIC; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/metrics", "scrape", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected scrapers with the token to be let in; got %v", resp.Status)
+	}
+}
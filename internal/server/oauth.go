@@ -0,0 +1,630 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+const (
+    authorizationCodeTTL = 2 * time.Minute
+    oauthAccessTokenTTL  = 15 * time.Minute
+    idTokenTTL           = time.Hour
+)
+
+// oauthAccessTokenType is the typ header of the access tokens issued to OAuth clients, see RFC 9068. ID tokens
+// are signed with the same key but keep the default typ, so one can't be used as the other.
+const oauthAccessTokenType = "at+jwt"
+
+// scopeDescriptions lists the scopes clients may request, the descriptions are shown on the consent screen
+var scopeDescriptions = map[string]string{
+    "openid":  "Sign you in with your account",
+    "profile": "Read your username",
+    "email":   "Read your email address",
+    "roles":   "Read the roles assigned to you",
+}
+
+var supportedScopes = []string{"openid", "profile", "email", "roles"}
+
+// issuer returns OIDC_ISSUER, or PUBLIC_URL if it is not configured. It is never taken from the request's Host
+// header, whoever sends the request could choose the issuer of the discovery document and ID tokens that way.
+func issuer() string {
+    if oidcIssuer != "" {
+        return strings.TrimSuffix(oidcIssuer, "/")
+    }
+    return strings.TrimSuffix(publicURL, "/")
+}
+
+// checkIssuer makes sure issuer has an absolute URL to return
+func checkIssuer() error {
+    iss := issuer()
+    if iss == "" {
+        return errors.New("OIDC_ISSUER or PUBLIC_URL must be set to the address clients reach the API at")
+    }
+    if u, err := url.Parse(iss); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return fmt.Errorf("OIDC_ISSUER: %q is no absolute URL like https://api.example.com", iss)
+    }
+    return nil
+}
+
+func (s *Server) OpenIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+    iss := issuer()
+    response := map[string]interface{}{
+        "issuer":                                iss,
+        "authorization_endpoint":                iss + "/oauth/authorize",
+        "token_endpoint":                        iss + "/oauth/token",
+        "userinfo_endpoint":                     iss + "/oauth/userinfo",
+        "jwks_uri":                              iss + "/oauth/jwks",
+        "scopes_supported":                      supportedScopes,
+        "response_types_supported":              []string{"code"},
+        "grant_types_supported":                 []string{"authorization_code", "client_credentials"},
+        "subject_types_supported":               []string{"public"},
+        "id_token_signing_alg_values_supported": []string{"RS256"},
+        "token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+        "code_challenge_methods_supported":      []string{"S256"},
+        "claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "email", "roles"},
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+    response := map[string]interface{}{
+        "keys": []map[string]string{s.idTokenKey.jwk()},
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+type AuthorizeRequest struct {
+    ResponseType        string `json:"response_type"`
+    ClientID            string `json:"client_id"`
+    RedirectURI         string `json:"redirect_uri"`
+    Scope               string `json:"scope"`
+    State               string `json:"state"`
+    Nonce               string `json:"nonce"`
+    CodeChallenge       string `json:"code_challenge"`
+    CodeChallengeMethod string `json:"code_challenge_method"`
+    Approve             bool   `json:"approve"`
+}
+
+// AuthorizeResponse either tells the caller where to send the user agent or describes the consent screen to show
+type AuthorizeResponse struct {
+    RedirectTo      string            `json:"redirect_to,omitempty"`
+    ConsentRequired bool              `json:"consent_required,omitempty"`
+    Client          map[string]string `json:"client,omitempty"`
+    Scopes          []ScopeConsent    `json:"scopes,omitempty"`
+}
+
+type ScopeConsent struct {
+    Name        string `json:"name"`
+    Description string `json:"description"`
+}
+
+// AuthorizeHandler is the OAuth 2.0 authorization endpoint. The user is identified by the access token
+// AuthMiddleware validated. GET checks the request parameters and either returns the consent screen as JSON
+// or, when the user already consented, a redirect carrying the authorization code. POST records the user's
+// decision for the same parameters and answers with the redirect.
+func (s *Server) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+    var req AuthorizeRequest
+    switch r.Method {
+    case http.MethodGet:
+        q := r.URL.Query()
+        req = AuthorizeRequest{
+            ResponseType:        q.Get("response_type"),
+            ClientID:            q.Get("client_id"),
+            RedirectURI:         q.Get("redirect_uri"),
+            Scope:               q.Get("scope"),
+            State:               q.Get("state"),
+            Nonce:               q.Get("nonce"),
+            CodeChallenge:       q.Get("code_challenge"),
+            CodeChallengeMethod: q.Get("code_challenge_method"),
+        }
+    case http.MethodPost:
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+    default:
+        writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method Not Allowed")
+        return
+    }
+
+    client, err := s.db.GetOAuthClient(r.Context(), req.ClientID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if client == nil {
+        writeProblem(w, r, http.StatusBadRequest, "unknown_client", "Unknown client_id")
+        return
+    }
+
+    // Without a registered redirect_uri errors can't be sent back to the client
+    if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+        req.RedirectURI = client.RedirectURIs[0]
+    }
+    if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_redirect_uri", "Invalid redirect_uri")
+        return
+    }
+
+    if req.ResponseType != "code" {
+        s.authorizeRedirect(w, req, url.Values{"error": {"unsupported_response_type"}})
+        return
+    }
+    scopes, ok := parseScope(req.Scope)
+    if !ok {
+        s.authorizeRedirect(w, req, url.Values{"error": {"invalid_scope"}})
+        return
+    }
+    if req.CodeChallenge == "" && client.Type == "public" {
+        s.authorizeRedirect(w, req, url.Values{"error": {"invalid_request"}, "error_description": {"code_challenge required for public clients"}})
+        return
+    }
+    if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+        s.authorizeRedirect(w, req, url.Values{"error": {"invalid_request"}, "error_description": {"code_challenge_method must be S256"}})
+        return
+    }
+
+    claims := claimsFromContext(r.Context())
+    username, _ := claims["username"].(string)
+    user, err := s.db.GetUserByUsername(r.Context(), username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if user == nil {
+        writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid username")
+        return
+    }
+
+    if r.Method == http.MethodPost {
+        if !req.Approve {
+            s.authorizeRedirect(w, req, url.Values{"error": {"access_denied"}})
+            return
+        }
+        if err := s.db.SaveOAuthConsent(r.Context(), user.ID, client.ClientID, strings.Join(scopes, " ")); err != nil {
+            writeError(w, r, dbError(err, "Failed to save consent"))
+            return
+        }
+    } else {
+        granted, err := s.db.GetOAuthConsent(r.Context(), user.ID, client.ClientID)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return
+        }
+        if !scopesCovered(scopes, strings.Fields(granted)) {
+            response := AuthorizeResponse{
+                ConsentRequired: true,
+                Client:          map[string]string{"client_id": client.ClientID, "name": client.Name},
+            }
+            for _, scope := range scopes {
+                response.Scopes = append(response.Scopes, ScopeConsent{Name: scope, Description: scopeDescriptions[scope]})
+            }
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(response)
+            return
+        }
+    }
+
+    authTime := time.Now()
+    if iat, ok := claims["iat"].(float64); ok {
+        authTime = time.Unix(int64(iat), 0)
+    }
+    code := randomToken(32)
+    err = s.db.CreateAuthorizationCode(r.Context(), &modals.AuthorizationCode{
+        CodeHash:            hashSecret(code),
+        ClientID:            client.ClientID,
+        UserID:              user.ID,
+        RedirectURI:         req.RedirectURI,
+        Scope:               strings.Join(scopes, " "),
+        Nonce:               req.Nonce,
+        CodeChallenge:       req.CodeChallenge,
+        CodeChallengeMethod: req.CodeChallengeMethod,
+        AuthTime:            authTime,
+        ExpiresAt:           time.Now().Add(authorizationCodeTTL),
+    })
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to issue authorization code"))
+        return
+    }
+
+    s.authorizeRedirect(w, req, url.Values{"code": {code}})
+}
+
+// authorizeRedirect answers with the redirect_uri extended by params and the client's state
+func (s *Server) authorizeRedirect(w http.ResponseWriter, req AuthorizeRequest, params url.Values) {
+    if req.State != "" {
+        params.Set("state", req.State)
+    }
+    redirect, _ := url.Parse(req.RedirectURI) // validated when the client was registered
+    query := redirect.Query()
+    for key, values := range params {
+        query[key] = values
+    }
+    redirect.RawQuery = query.Encode()
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(AuthorizeResponse{RedirectTo: redirect.String()})
+}
+
+// parseScope splits a space separated scope, defaulting to openid, and rejects unsupported scopes
+func parseScope(scope string) ([]string, bool) {
+    scopes := strings.Fields(scope)
+    if len(scopes) == 0 {
+        scopes = []string{"openid"}
+    }
+    for _, s := range scopes {
+        if _, ok := scopeDescriptions[s]; !ok {
+            return nil, false
+        }
+    }
+    slices.Sort(scopes)
+    return slices.Compact(scopes), true
+}
+
+func scopesCovered(requested []string, granted []string) bool {
+    for _, scope := range requested {
+        if !slices.Contains(granted, scope) {
+            return false
+        }
+    }
+    return true
+}
+
+// oauthError writes an error response as defined in RFC 6749 section 5.2
+func oauthError(w http.ResponseWriter, status int, code string, description string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]string{
+        "error":             code,
+        "error_description": description,
+    })
+}
+
+// TokenHandler is the OAuth 2.0 token endpoint, it exchanges authorization codes for access and ID tokens
+// and issues access tokens to service accounts
+func (s *Server) TokenHandler(w http.ResponseWriter, r *http.Request) {
+    if err := r.ParseForm(); err != nil {
+        oauthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body")
+        return
+    }
+
+    switch r.PostForm.Get("grant_type") {
+    case "authorization_code":
+        s.authorizationCodeGrant(w, r)
+    case "client_credentials":
+        s.clientCredentialsGrant(w, r)
+    default:
+        oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type")
+    }
+}
+
+// clientCredentials reads the client_id and client_secret from HTTP Basic auth or the form fields of the same name
+func clientCredentials(r *http.Request) (string, string) {
+    clientID, secret, basic := r.BasicAuth()
+    if basic {
+        // RFC 6749 section 2.3.1 form-encodes the credentials before they are put in the header
+        clientID, _ = url.QueryUnescape(clientID)
+        secret, _ = url.QueryUnescape(secret)
+        return clientID, secret
+    }
+    return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+// authenticateClient identifies the OAuth client calling the token endpoint. Public clients only present their client_id.
+func (s *Server) authenticateClient(r *http.Request) (*modals.OAuthClient, bool) {
+    clientID, secret := clientCredentials(r)
+
+    client, err := s.db.GetOAuthClient(r.Context(), clientID)
+    if err != nil || client == nil {
+        return nil, false
+    }
+    if client.Type == "public" {
+        return client, secret == ""
+    }
+    return client, secret != "" && secretMatches(secret, client.SecretHash)
+}
+
+func (s *Server) authorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
+    client, ok := s.authenticateClient(r)
+    if !ok {
+        oauthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+        return
+    }
+
+    code, err := s.db.ConsumeAuthorizationCode(r.Context(), hashSecret(r.PostForm.Get("code")))
+    if err != nil {
+        oauthError(w, http.StatusInternalServerError, "server_error", "Error querying database")
+        return
+    }
+    if code == nil || code.ClientID != client.ClientID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+        oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+        return
+    }
+    if code.CodeChallenge != "" && !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+        oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+        return
+    }
+
+    user, err := s.db.GetUserByID(r.Context(), code.UserID)
+    if err != nil {
+        oauthError(w, http.StatusInternalServerError, "server_error", "Error querying database")
+        return
+    }
+    if user == nil {
+        oauthError(w, http.StatusBadRequest, "invalid_grant", "User no longer exists")
+        return
+    }
+    if user.Status != modals.UserStatusActive {
+        oauthError(w, http.StatusBadRequest, "invalid_grant", "Account is "+user.Status)
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        oauthError(w, http.StatusInternalServerError, "server_error", "Error querying database")
+        return
+    }
+
+    // The access token is for the client to call /oauth/userinfo, not the API. It is signed with the OIDC key
+    // instead of jwtKey and carries no username or roles, so AuthMiddleware never takes it for a user's token.
+    now := time.Now()
+    accessClaims := jwt.MapClaims{
+        "iss":       issuer(),
+        "sub":       strconv.Itoa(user.ID),
+        "aud":       client.ClientID,
+        "client_id": client.ClientID,
+        "scope":     code.Scope,
+        "exp":       now.Add(oauthAccessTokenTTL).Unix(),
+        "iat":       now.Unix(),
+    }
+    accessToken := jwt.NewWithClaims(jwt.SigningMethodRS256, accessClaims)
+    accessToken.Header["typ"] = oauthAccessTokenType
+    accessToken.Header["kid"] = s.idTokenKey.kid
+    accessTokenString, err := accessToken.SignedString(s.idTokenKey.key)
+    if err != nil {
+        oauthError(w, http.StatusInternalServerError, "server_error", "Error generating access token")
+        return
+    }
+
+    response := map[string]interface{}{
+        "access_token": accessTokenString,
+        "token_type":   "Bearer",
+        "expires_in":   int(oauthAccessTokenTTL.Seconds()),
+        "scope":        code.Scope,
+    }
+
+    scopes := strings.Fields(code.Scope)
+    if slices.Contains(scopes, "openid") {
+        idClaims := userClaims(user, roles, scopes)
+        idClaims["iss"] = issuer()
+        idClaims["aud"] = client.ClientID
+        idClaims["exp"] = now.Add(idTokenTTL).Unix()
+        idClaims["iat"] = now.Unix()
+        idClaims["auth_time"] = code.AuthTime.Unix()
+        if code.Nonce != "" {
+            idClaims["nonce"] = code.Nonce
+        }
+        idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, idClaims)
+        idToken.Header["kid"] = s.idTokenKey.kid
+        idTokenString, err := idToken.SignedString(s.idTokenKey.key)
+        if err != nil {
+            oauthError(w, http.StatusInternalServerError, "server_error", "Error generating ID token")
+            return
+        }
+        response["id_token"] = idTokenString
+        tokensIssued.WithLabelValues("id", grantAuthorizationCode).Inc()
+    }
+    tokensIssued.WithLabelValues("access", grantAuthorizationCode).Inc()
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(response)
+}
+
+// verifyCodeChallenge checks a PKCE code_verifier against the S256 code_challenge from the authorization request
+func verifyCodeChallenge(verifier string, challenge string) bool {
+    if verifier == "" {
+        return false
+    }
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+// userClaims returns the standard claims about the user that the granted scopes allow to be shared
+func userClaims(user *modals.User, roles []string, scopes []string) jwt.MapClaims {
+    claims := jwt.MapClaims{
+        "sub": strconv.Itoa(user.ID),
+    }
+    if slices.Contains(scopes, "profile") {
+        claims["preferred_username"] = user.Username
+    }
+    if slices.Contains(scopes, "email") {
+        claims["email"] = user.Email
+    }
+    if slices.Contains(scopes, "roles") {
+        claims["roles"] = roles
+    }
+    return claims
+}
+
+// OAuthAccessMiddleware authenticates the one route OAuth clients call with their access tokens, /oauth/userinfo.
+// Other tokens are left to AuthMiddleware, which rejects the tokens of OAuth clients.
+func (s *Server) OAuthAccessMiddleware(next http.Handler) http.Handler {
+    fallback := s.AuthMiddleware(next)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+        claims := jwt.MapClaims{}
+        token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+            return &s.idTokenKey.key.PublicKey, nil
+        }, jwt.WithValidMethods([]string{"RS256"}), jwt.WithExpirationRequired())
+        if err != nil || token.Header["typ"] != oauthAccessTokenType {
+            fallback.ServeHTTP(w, r)
+            return
+        }
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+    })
+}
+
+// UserInfoHandler returns the claims about the user the access token was issued for
+func (s *Server) UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+    claims := claimsFromContext(r.Context())
+
+    // OAuth access tokens name the user by ID, the tokens of POST /account by username
+    var user *modals.User
+    var err error
+    if username, ok := claims["username"].(string); ok {
+        user, err = s.db.GetUserByUsername(r.Context(), username)
+    } else {
+        id, _ := strconv.Atoi(fmt.Sprint(claims["sub"]))
+        user, err = s.db.GetUserByID(r.Context(), id)
+    }
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if user == nil || user.Status != modals.UserStatusActive {
+        writeProblem(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid token")
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    // Tokens from POST /account carry no scope and may read everything about their own user
+    scopes := supportedScopes
+    if scope, ok := claims["scope"].(string); ok {
+        scopes = strings.Fields(scope)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(userClaims(user, roles, scopes))
+}
+
+type OAuthClientRegisterRequest struct {
+    Name         string   `json:"name"`
+    ClientType   string   `json:"client_type"`
+    RedirectURIs []string `json:"redirect_uris"`
+}
+
+func (req *OAuthClientRegisterRequest) Normalize() {
+    req.Name = strings.TrimSpace(req.Name)
+}
+
+func (req *OAuthClientRegisterRequest) Validate() []FieldError {
+    var fields fieldErrors
+    if fields.required("name", req.Name) {
+        fields.maxLength("name", req.Name, maxClientNameLength)
+    }
+    if req.ClientType != "confidential" && req.ClientType != "public" {
+        fields.add("client_type", "invalid", "client_type must be confidential or public")
+    }
+    if len(req.RedirectURIs) == 0 {
+        fields.add("redirect_uris", "required", "redirect_uris are required")
+    }
+    for i, uri := range req.RedirectURIs {
+        parsed, err := url.Parse(uri)
+        if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || strings.ContainsAny(uri, " \t\n") {
+            fields.add(fmt.Sprintf("redirect_uris[%d]", i), "invalid", "Invalid redirect_uri "+uri)
+        }
+    }
+    return fields
+}
+
+// OAuthClientRegisterHandler registers a client application. The client_secret of confidential clients
+// is only part of this response, the database keeps its hash.
+func (s *Server) OAuthClientRegisterHandler(w http.ResponseWriter, r *http.Request) {
+    var req OAuthClientRegisterRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    client := modals.OAuthClient{
+        ClientID:     randomToken(16),
+        Name:         req.Name,
+        Type:         req.ClientType,
+        RedirectURIs: req.RedirectURIs,
+    }
+    var secret string
+    if client.Type == "confidential" {
+        secret = randomToken(32)
+        client.SecretHash = hashSecret(secret)
+    }
+
+    if err := s.db.CreateOAuthClient(r.Context(), &client); err != nil {
+        writeError(w, r, dbError(err, "Failed to register client"))
+        return
+    }
+
+    response := oauthClientResponse(client)
+    if secret != "" {
+        response["client_secret"] = secret
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/v1/oauth/clients/"+url.PathEscape(client.ClientID))
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) OAuthClientListHandler(w http.ResponseWriter, r *http.Request) {
+    clients, err := s.db.ListOAuthClients(r.Context())
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    response := []map[string]interface{}{}
+    for _, client := range clients {
+        response = append(response, oauthClientResponse(client))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// OAuthClientHandler responds with one registered client
+func (s *Server) OAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+    client, err := s.db.GetOAuthClient(r.Context(), mux.Vars(r)["client_id"])
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if client == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Client not found")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(oauthClientResponse(*client))
+}
+
+func oauthClientResponse(client modals.OAuthClient) map[string]interface{} {
+    return map[string]interface{}{
+        "id":            client.ID,
+        "client_id":     client.ClientID,
+        "name":          client.Name,
+        "client_type":   client.Type,
+        "redirect_uris": client.RedirectURIs,
+        "created_at":    client.CreatedAt,
+    }
+}
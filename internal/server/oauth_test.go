@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+func newTestServer(t *testing.T, db *fakeDB) (*Server, *httptest.Server) {
+	t.Helper()
+	jwtKey = "test-key"
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key. Err: %v", err)
+	}
+	s := &Server{db: db, idTokenKey: &signingKey{kid: "test", key: key}}
+	server := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(server.Close)
+	publicURL = server.URL
+	return s, server
+}
+
+// testAccessToken starts a session for the user in db and signs an access token for it carrying roles
+func testAccessToken(t *testing.T, db *fakeDB, username string, roles ...string) string {
+	t.Helper()
+	user, _ := db.GetUserByUsername(context.Background(), username)
+	if user == nil {
+		t.Fatalf("no user %q to issue an access token for", username)
+	}
+	session := &modals.Session{UserID: user.ID, Username: username, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	db.CreateSession(context.Background(), session)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":      tokenTypeAccess,
+		"username": username,
+		"role":     roles,
+		"sub_type": subjectTypeUser,
+		"sid":      session.ID,
+		"exp":      time.Now().Add(time.Minute).Unix(),
+		"iat":      time.Now().Unix(),
+	}).SignedString([]byte(jwtKey))
+	if err != nil {
+		t.Fatalf("error signing token. Err: %v", err)
+	}
+	return token
+}
+
+func doJSON(t *testing.T, method string, target string, token string, body interface{}, out interface{}) *http.Response {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("error encoding body. Err: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, target, &payload)
+	if err != nil {
+		t.Fatalf("error creating request. Err: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("error decoding response. Err: %v", err)
+		}
+	}
+	return resp
+}
+
+func TestAuthorizationCodeFlowWithPKCE(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	alice := db.addUser("alice", "alice@example.com", "standard")
+	s, server := newTestServer(t, db)
+
+	var client map[string]interface{}
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/oauth/clients", testAccessToken(t, db, "admin", "admin"),
+		OAuthClientRegisterRequest{Name: "SPA", ClientType: "public", RedirectURIs: []string{"https://app.example.com/cb"}}, &client)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status Created; got %v", resp.Status)
+	}
+	if _, ok := client["client_secret"]; ok {
+		t.Errorf("public clients must not get a client_secret")
+	}
+	clientID := client["client_id"].(string)
+
+	verifier := randomToken(32)
+	sum := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {"https://app.example.com/cb"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	userToken := testAccessToken(t, db, "alice", "standard")
+
+	var consent AuthorizeResponse
+	doJSON(t, http.MethodGet, server.URL+"/oauth/authorize?"+params.Encode(), userToken, nil, &consent)
+	if !consent.ConsentRequired || len(consent.Scopes) != 2 {
+		t.Fatalf("expected consent screen for two scopes; got %+v", consent)
+	}
+
+	var approved AuthorizeResponse
+	doJSON(t, http.MethodPost, server.URL+"/oauth/authorize", userToken, AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            clientID,
+		RedirectURI:         "https://app.example.com/cb",
+		Scope:               "openid email",
+		State:               "xyz",
+		Nonce:               "n-0S6",
+		CodeChallenge:       params.Get("code_challenge"),
+		CodeChallengeMethod: "S256",
+		Approve:             true,
+	}, &approved)
+	redirect, err := url.Parse(approved.RedirectTo)
+	if err != nil || redirect.Query().Get("code") == "" || redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("expected redirect with code and state; got %q", approved.RedirectTo)
+	}
+
+	exchange := func(verifier string) (*http.Response, map[string]interface{}) {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {redirect.Query().Get("code")},
+			"redirect_uri":  {"https://app.example.com/cb"},
+			"client_id":     {clientID},
+			"code_verifier": {verifier},
+		}
+		resp, err := http.Post(server.URL+"/oauth/token", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	resp, tokens := exchange(verifier)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v %v", resp.Status, tokens)
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokens["id_token"].(string), claims, func(token *jwt.Token) (interface{}, error) {
+		return &s.idTokenKey.key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		t.Fatalf("error verifying id_token. Err: %v", err)
+	}
+	if claims["sub"] != "2" || claims["nonce"] != "n-0S6" || claims["email"] != alice.Email || claims["aud"] != clientID {
+		t.Errorf("unexpected id_token claims %v", claims)
+	}
+
+	if resp, _ := exchange(verifier); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a used code to be rejected; got %v", resp.Status)
+	}
+
+	var userinfo map[string]interface{}
+	doJSON(t, http.MethodGet, server.URL+"/oauth/userinfo", tokens["access_token"].(string), nil, &userinfo)
+	if userinfo["email"] != alice.Email || userinfo["preferred_username"] != nil {
+		t.Errorf("expected userinfo limited to the email scope; got %v", userinfo)
+	}
+	for _, target := range []string{"/v1/me", "/v1/me", "/v1/users"} {
+		if resp := doJSON(t, http.MethodGet, server.URL+target, tokens["access_token"].(string), nil, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected the client's access token to be rejected by %s; got %v", target, resp.Status)
+		}
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/oauth/userinfo", tokens["id_token"].(string), nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the ID token to be rejected as access token; got %v", resp.Status)
+	}
+}
+
+func TestDiscoveryIgnoresHostHeader(t *testing.T) {
+	_, server := newTestServer(t, newFakeDB())
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/.well-known/openid-configuration", nil)
+	req.Host = "evil.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	defer resp.Body.Close()
+	var discovery map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&discovery)
+	if discovery["issuer"] != server.URL || discovery["jwks_uri"] != server.URL+"/oauth/jwks" {
+		t.Errorf("expected the configured issuer; got %v", discovery)
+	}
+
+	publicURL = ""
+	if err := checkIssuer(); err == nil {
+		t.Errorf("expected the server to need OIDC_ISSUER or PUBLIC_URL")
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+)
+
+var (
+    oidcIssuer         = os.Getenv("OIDC_ISSUER")
+    oidcSigningKeyFile = os.Getenv("OIDC_SIGNING_KEY_FILE")
+)
+
+// signingKey is the RSA key ID tokens are signed with, kid identifies it in the JWKS
+type signingKey struct {
+    kid string
+    key *rsa.PrivateKey
+}
+
+// loadSigningKey reads the PEM encoded RSA key from OIDC_SIGNING_KEY_FILE. Without a configured file
+// a key is generated on startup, which invalidates all issued ID tokens on every restart.
+func loadSigningKey() (*signingKey, error) {
+    var key *rsa.PrivateKey
+    if oidcSigningKeyFile == "" {
+        slog.Warn("OIDC_SIGNING_KEY_FILE not set, generating an ephemeral ID token signing key")
+        generated, err := rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil {
+            return nil, err
+        }
+        key = generated
+    } else {
+        data, err := os.ReadFile(oidcSigningKeyFile)
+        if err != nil {
+            return nil, err
+        }
+        key, err = parseRSAPrivateKey(data)
+        if err != nil {
+            return nil, fmt.Errorf("parse %s: %w", oidcSigningKeyFile, err)
+        }
+    }
+
+    sum := sha256.Sum256(key.PublicKey.N.Bytes())
+    return &signingKey{
+        kid: base64.RawURLEncoding.EncodeToString(sum[:12]),
+        key: key,
+    }, nil
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, errors.New("no PEM block found")
+    }
+    if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+        return key, nil
+    }
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, err
+    }
+    key, ok := parsed.(*rsa.PrivateKey)
+    if !ok {
+        return nil, errors.New("key is not an RSA private key")
+    }
+    return key, nil
+}
+
+// jwk returns the public part of the key in JSON Web Key format
+func (k *signingKey) jwk() map[string]string {
+    return map[string]string{
+        "kty": "RSA",
+        "use": "sig",
+        "alg": "RS256",
+        "kid": k.kid,
+        "n":   base64.RawURLEncoding.EncodeToString(k.key.PublicKey.N.Bytes()),
+        "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.PublicKey.E)).Bytes()),
+    }
+}
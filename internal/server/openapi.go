@@ -0,0 +1,639 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// apiVersion is the version of the API the OpenAPI document describes
+const apiVersion = "1.1.0"
+
+//go:embed static/docs.html
+var apiDocsPage []byte
+
+// Who may call an operation, see apiOperation
+const (
+    authNone  = ""
+    authUser  = "user"
+    authAdmin = "admin"
+)
+
+// apiOperation documents one method of a route for /openapi.json. Request and Response are example values, the
+// schemas are generated from their types, so the document follows the Go types the handlers decode and encode.
+// TestOpenAPICoversRoutes fails when a registered route has no apiOperation.
+type apiOperation struct {
+    Method  string
+    // Path is the route as registered, with path variables but without their patterns
+    Path    string
+    Tag     string
+    Summary string
+    Auth    string
+    Query   []apiParameter
+    Request interface{}
+    // Form sends Request as application/x-www-form-urlencoded instead of JSON
+    Form     bool
+    Status   int
+    Response interface{}
+    // Location marks created responses whose Location header points to the new resource
+    Location bool
+    // Also are further success statuses without a body, like the 204 of a repeated idempotent request
+    Also []int
+    // Errors are the statuses of the problem responses besides those implied by Auth and Request
+    Errors []int
+    // OAuthErrors marks endpoints that answer errors in the RFC 6749 format instead of problems
+    OAuthErrors bool
+}
+
+type apiParameter struct {
+    Name        string
+    Description string
+    Required    bool
+}
+
+// properties describes a JSON object by example, each value stands for the type of its member
+type properties map[string]interface{}
+
+// jsonSchema is used as it is where no Go type describes a value, like the free-form attributes object
+type jsonSchema map[string]interface{}
+
+// plainText and htmlPage describe responses that aren't JSON, the value is the example
+type plainText string
+type htmlPage string
+
+// withMember returns a copy of response extended by one member, for responses that add a secret to a shared shape
+func withMember(response map[string]interface{}, name string, value interface{}) map[string]interface{} {
+    extended := map[string]interface{}{name: value}
+    for key, v := range response {
+        extended[key] = v
+    }
+    return extended
+}
+
+var (
+    tokenQuery = apiParameter{Name: "token", Description: "The token from the mail", Required: true}
+
+    authorizeQuery = []apiParameter{
+        {Name: "response_type", Description: "Must be code", Required: true},
+        {Name: "client_id", Required: true},
+        {Name: "redirect_uri", Description: "One of the client's registered redirect URIs", Required: true},
+        {Name: "scope", Description: "Space separated, openid, profile, email and roles are supported"},
+        {Name: "state"},
+        {Name: "nonce", Description: "Copied into the ID token"},
+        {Name: "code_challenge", Description: "PKCE challenge, required for public clients"},
+        {Name: "code_challenge_method", Description: "Must be S256"},
+    }
+
+    tokenEndpointForm = properties{
+        "grant_type":    "authorization_code or client_credentials",
+        "code":          "",
+        "redirect_uri":  "",
+        "code_verifier": "",
+        "client_id":     "",
+        "client_secret": "",
+        "scope":         "",
+    }
+)
+
+// apiOperations documents every route RegisterRoutes sets up, grouped like there
+var apiOperations = []apiOperation{
+    {Method: http.MethodGet, Path: "/", Tag: "general", Summary: "Welcome message", Response: properties{"message": ""}},
+    {Method: http.MethodGet, Path: "/health", Tag: "general", Summary: "Database health and connection pool statistics, 503 while the database is down", Response: map[string]string{}},
+    {Method: http.MethodGet, Path: "/metrics", Tag: "general", Summary: "Metrics in the Prometheus text format, for scrapers sending METRICS_TOKEN",
+        Response: plainText("# HELP http_requests_total HTTP requests by method, route template and status."),
+        Errors: []int{http.StatusUnauthorized, http.StatusForbidden}},
+    {Method: http.MethodGet, Path: "/openapi.json", Tag: "general", Summary: "This OpenAPI document", Response: jsonSchema{"type": "object"}},
+    {Method: http.MethodGet, Path: "/docs", Tag: "general", Summary: "Interactive API documentation", Response: htmlPage("<!DOCTYPE html>")},
+
+    {Method: http.MethodPost, Path: "/account", Tag: "login", Summary: "Log in with username and password",
+        Request: LoginRequest{}, Response: TokenResponse{}, Errors: []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict}},
+    {Method: http.MethodGet, Path: "/account", Tag: "login", Summary: "Look up a user by username",
+        Request: AccountLookupRequest{}, Response: properties{"id": 0, "username": "", "email": "", "created_at": time.Time{}},
+        Errors: []int{http.StatusUnauthorized}},
+    {Method: http.MethodPost, Path: "/refresh", Tag: "login", Summary: "Get a new access token for a refresh token",
+        Request: properties{"refresh_token": ""}, Response: properties{"token": ""}, Errors: []int{http.StatusUnauthorized}},
+
+    {Method: http.MethodGet, Path: "/auth/providers", Tag: "federation", Summary: "Names of the upstream identity providers", Response: []string{}},
+    {Method: http.MethodGet, Path: "/auth/{provider}/login", Tag: "federation", Summary: "Redirect to the provider's login",
+        Status: http.StatusFound, Errors: []int{http.StatusNotFound, http.StatusBadGateway}},
+    {Method: http.MethodGet, Path: "/auth/{provider}/callback", Tag: "federation", Summary: "Complete a login at the provider",
+        Query: []apiParameter{{Name: "code", Required: true}, {Name: "state", Required: true}, {Name: "error"}},
+        Response: TokenResponse{}, Errors: []int{http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden, http.StatusBadGateway}},
+
+    {Method: http.MethodGet, Path: "/.well-known/openid-configuration", Tag: "oauth", Summary: "OpenID Connect discovery document",
+        Response: properties{
+            "issuer": "", "authorization_endpoint": "", "token_endpoint": "", "userinfo_endpoint": "", "jwks_uri": "",
+            "scopes_supported": []string{}, "response_types_supported": []string{}, "grant_types_supported": []string{},
+            "subject_types_supported": []string{}, "id_token_signing_alg_values_supported": []string{},
+            "token_endpoint_auth_methods_supported": []string{}, "code_challenge_methods_supported": []string{},
+            "claims_supported": []string{},
+        }},
+    {Method: http.MethodGet, Path: "/oauth/jwks", Tag: "oauth", Summary: "Keys ID tokens are signed with", Response: properties{"keys": []map[string]string{}}},
+    {Method: http.MethodGet, Path: "/oauth/authorize", Tag: "oauth", Summary: "Check an authorization request, responds with the consent screen or the redirect",
+        Auth: authUser, Query: authorizeQuery, Response: AuthorizeResponse{}},
+    {Method: http.MethodPost, Path: "/oauth/authorize", Tag: "oauth", Summary: "Approve or deny an authorization request",
+        Auth: authUser, Request: AuthorizeRequest{}, Response: AuthorizeResponse{}},
+    {Method: http.MethodPost, Path: "/oauth/token", Tag: "oauth", Summary: "Exchange an authorization code or client credentials for tokens",
+        Request: tokenEndpointForm, Form: true, OAuthErrors: true,
+        Response: properties{"access_token": "", "token_type": "", "expires_in": 0, "scope": "", "id_token": ""}},
+    {Method: http.MethodGet, Path: "/oauth/userinfo", Tag: "oauth", Summary: "Claims about the user the granted scopes allow",
+        Auth: authUser, Response: jsonSchema{"type": "object"}},
+    {Method: http.MethodPost, Path: "/oauth/userinfo", Tag: "oauth", Summary: "Claims about the user the granted scopes allow",
+        Auth: authUser, Response: jsonSchema{"type": "object"}},
+
+    {Method: http.MethodPost, Path: "/protected/account_register", Tag: "users", Summary: "Register a user and mail a verification link",
+        Auth: authUser, Request: AccountRegisterRequest{}, Status: http.StatusCreated, Response: plainText("User registered successfully"),
+        Errors: []int{http.StatusConflict}},
+    {Method: http.MethodGet, Path: "/protected/roles", Tag: "users", Summary: "Roles of a user",
+        Auth: authUser, Request: AccountLookupRequest{}, Response: []string{}},
+    {Method: http.MethodPost, Path: "/protected/roles", Tag: "users", Summary: "Assign a role to a user",
+        Auth: authUser, Request: RolesAssignment{}, Status: http.StatusCreated, Response: plainText("Role assigned successfully"),
+        Errors: []int{http.StatusNotFound, http.StatusConflict}},
+    {Method: http.MethodPost, Path: "/protected/roles_register", Tag: "users", Summary: "Create a role",
+        Auth: authUser, Request: RolesRegisterRequest{}, Status: http.StatusCreated, Response: plainText("Role registered successfully"),
+        Errors: []int{http.StatusConflict}},
+
+    // The versioned API, see registerV1Routes. /account, /refresh and the /protected routes above are deprecated aliases of these.
+    {Method: http.MethodPost, Path: "/v1/tokens", Tag: "login", Summary: "Log in with username and password",
+        Request: LoginRequest{}, Response: TokenResponse{}, Errors: []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict}},
+    {Method: http.MethodPost, Path: "/v1/tokens/refresh", Tag: "login", Summary: "Get a new access token for a refresh token",
+        Request: properties{"refresh_token": ""}, Response: properties{"token": ""}, Errors: []int{http.StatusUnauthorized}},
+    {Method: http.MethodPost, Path: "/v1/tokens/step-up", Tag: "login", Summary: "Complete a suspicious login with the mailed code",
+        Request: StepUpRequest{}, Response: TokenResponse{}, Errors: []int{http.StatusUnauthorized}},
+    {Method: http.MethodGet, Path: "/v1/verify-email", Tag: "login", Summary: "Verify an email address, the link in the verification mail",
+        Query: []apiParameter{tokenQuery}, Response: plainText("Email verified successfully")},
+    {Method: http.MethodPost, Path: "/v1/verify-email", Tag: "login", Summary: "Verify an email address",
+        Request: properties{"token": ""}, Response: plainText("Email verified successfully")},
+    {Method: http.MethodPost, Path: "/v1/verify-email/resend", Tag: "login", Summary: "Mail a new verification link",
+        Request: EmailRequest{}, Status: http.StatusAccepted, Response: plainText("If the address belongs to an unverified account, a new verification email was sent")},
+    {Method: http.MethodPost, Path: "/v1/password/forgot", Tag: "login", Summary: "Mail a password reset link",
+        Request: EmailRequest{}, Status: http.StatusAccepted, Response: plainText("If the address belongs to an account, a password reset email was sent")},
+    {Method: http.MethodGet, Path: "/v1/password/reset", Tag: "login", Summary: "Show whose password a reset token sets, the link in the reset mail",
+        Query: []apiParameter{tokenQuery}, Response: properties{"username": "", "expires_at": time.Time{}}},
+    {Method: http.MethodPost, Path: "/v1/password/reset", Tag: "login", Summary: "Set a new password with the token from the reset mail",
+        Request: ResetPasswordRequest{}, Response: plainText("Password reset successfully"), Errors: []int{http.StatusConflict}},
+    {Method: http.MethodGet, Path: "/v1/invitations/accept", Tag: "login", Summary: "Show an open invitation, the link in the invitation mail",
+        Query: []apiParameter{tokenQuery}, Response: properties{"email": "", "roles": []string{}, "invited_by": "", "expires_at": time.Time{}}},
+    {Method: http.MethodPost, Path: "/v1/invitations/accept", Tag: "login", Summary: "Accept an invitation, creating the user",
+        Request: InvitationAcceptRequest{}, Response: TokenResponse{}, Errors: []int{http.StatusConflict}},
+
+    {Method: http.MethodGet, Path: "/v1/me", Tag: "me", Summary: "Profile of the calling user", Auth: authUser, Response: profile{}},
+    {Method: http.MethodPatch, Path: "/v1/me", Tag: "me", Summary: "Change the profile, a new email address takes current_password and is mailed a verification link",
+        Auth: authUser, Request: ProfileUpdateRequest{}, Response: profile{}, Errors: []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict}},
+    {Method: http.MethodDelete, Path: "/v1/me", Tag: "me", Summary: "Delete the calling user's account",
+        Auth: authUser, Request: UsernameStruct{}, Status: http.StatusNoContent},
+    {Method: http.MethodGet, Path: "/v1/me/roles", Tag: "me", Summary: "Roles of the calling user", Auth: authUser, Response: []string{}},
+    {Method: http.MethodPut, Path: "/v1/me/attributes", Tag: "me", Summary: "Replace the calling user's attributes",
+        Auth: authUser, Request: jsonSchema{"type": "object", "description": "Validated against the attribute schema"}, Response: modals.User{}},
+    {Method: http.MethodPost, Path: "/v1/me/password", Tag: "me", Summary: "Change the password, other sessions end",
+        Auth: authUser, Request: ChangePasswordRequest{}, Response: TokenResponse{}},
+    {Method: http.MethodGet, Path: "/v1/me/sessions", Tag: "me", Summary: "Active sessions and personal access tokens",
+        Auth: authUser, Response: properties{
+            "sessions":               []sessionView{},
+            "personal_access_tokens": []map[string]interface{}{personalAccessTokenResponse(modals.PersonalAccessToken{})},
+        }},
+    {Method: http.MethodDelete, Path: "/v1/me/sessions", Tag: "me", Summary: "End every session but the current one",
+        Auth: authUser, Status: http.StatusNoContent},
+    {Method: http.MethodDelete, Path: "/v1/me/sessions/{id}", Tag: "me", Summary: "End a session",
+        Auth: authUser, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodGet, Path: "/v1/me/logins", Tag: "me", Summary: "Latest login attempts", Auth: authUser, Response: []modals.LoginAttempt{}},
+    {Method: http.MethodGet, Path: "/v1/me/security_events", Tag: "me", Summary: "Logins flagged as suspicious", Auth: authUser, Response: []modals.SecurityEvent{}},
+    {Method: http.MethodPost, Path: "/v1/me/tokens", Tag: "me", Summary: "Create a personal access token, the token is only part of this response",
+        Auth: authUser, Request: PersonalAccessTokenRequest{}, Status: http.StatusCreated, Location: true,
+        Response: withMember(personalAccessTokenResponse(modals.PersonalAccessToken{}), "token", "")},
+    {Method: http.MethodGet, Path: "/v1/me/tokens", Tag: "me", Summary: "Personal access tokens",
+        Auth: authUser, Response: []map[string]interface{}{personalAccessTokenResponse(modals.PersonalAccessToken{})}},
+    {Method: http.MethodGet, Path: "/v1/me/tokens/{id}", Tag: "me", Summary: "A personal access token",
+        Auth: authUser, Response: personalAccessTokenResponse(modals.PersonalAccessToken{}), Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodDelete, Path: "/v1/me/tokens/{id}", Tag: "me", Summary: "Revoke a personal access token",
+        Auth: authUser, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodGet, Path: "/v1/me/identities", Tag: "me", Summary: "Linked upstream identities",
+        Auth: authUser, Response: []properties{{"provider": "", "subject": "", "email": "", "created_at": ""}}},
+    {Method: http.MethodPost, Path: "/v1/me/identities/{provider}", Tag: "me", Summary: "Start linking an identity at the provider",
+        Auth: authUser, Response: properties{"redirect_to": ""}, Errors: []int{http.StatusNotFound, http.StatusBadGateway}},
+    {Method: http.MethodDelete, Path: "/v1/me/identities/{provider}", Tag: "me", Summary: "Unlink the identity at the provider",
+        Auth: authUser, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+
+    {Method: http.MethodGet, Path: "/v1/users", Tag: "admin", Summary: "List users",
+        Auth: authAdmin, Response: []modals.User{}, Query: []apiParameter{
+            {Name: "status", Description: "active, disabled, locked or pending"},
+            {Name: "attributes", Description: `JSON object the attributes must contain, like {"department":"sales"}`},
+            {Name: "limit", Description: "1 to 200, 50 if left out"},
+            {Name: "offset"},
+        }},
+    {Method: http.MethodPost, Path: "/v1/users", Tag: "admin", Summary: "Create a user and mail a verification link",
+        Auth: authAdmin, Request: AccountRegisterRequest{}, Status: http.StatusCreated, Location: true, Response: modals.User{},
+        Errors: []int{http.StatusConflict}},
+    {Method: http.MethodGet, Path: "/v1/users/attribute_schema", Tag: "admin", Summary: "The JSON Schema user attributes are validated against",
+        Auth: authAdmin, Response: modals.AttributeSchema{}},
+    {Method: http.MethodPut, Path: "/v1/users/attribute_schema", Tag: "admin", Summary: "Replace the attribute schema",
+        Auth: authAdmin, Request: modals.AttributeSchema{}, Response: modals.AttributeSchema{}},
+    {Method: http.MethodGet, Path: "/v1/users/{username}", Tag: "admin", Summary: "A user",
+        Auth: authAdmin, Response: modals.User{}, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodPut, Path: "/v1/users/{username}/status", Tag: "admin", Summary: "Set the status of a user",
+        Auth: authAdmin, Request: properties{"status": "active, disabled, locked or pending"}, Response: modals.User{}, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodPut, Path: "/v1/users/{username}/attributes", Tag: "admin", Summary: "Replace the attributes of a user",
+        Auth: authAdmin, Request: jsonSchema{"type": "object", "description": "Validated against the attribute schema"}, Response: modals.User{},
+        Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodGet, Path: "/v1/users/{username}/logins", Tag: "admin", Summary: "Login history of a user",
+        Auth: authAdmin, Response: []modals.LoginAttempt{}, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodGet, Path: "/v1/users/{username}/security_events", Tag: "admin", Summary: "Suspicious logins of a user",
+        Auth: authAdmin, Response: []modals.SecurityEvent{}, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodGet, Path: "/v1/users/{username}/roles", Tag: "admin", Summary: "Roles of a user",
+        Auth: authAdmin, Response: []string{}, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodPut, Path: "/v1/users/{username}/roles/{role_name}", Tag: "admin", Summary: "Assign a role, 204 if the user already has it",
+        Auth: authAdmin, Status: http.StatusCreated, Location: true, Also: []int{http.StatusNoContent}, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodDelete, Path: "/v1/users/{username}/roles/{role_name}", Tag: "admin", Summary: "Remove a role from a user",
+        Auth: authAdmin, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+
+    {Method: http.MethodGet, Path: "/v1/roles", Tag: "admin", Summary: "List roles", Auth: authAdmin, Response: []string{}},
+    {Method: http.MethodPost, Path: "/v1/roles", Tag: "admin", Summary: "Create a role",
+        Auth: authAdmin, Request: RolesRegisterRequest{}, Status: http.StatusCreated, Location: true, Response: RolesRegisterRequest{},
+        Errors: []int{http.StatusConflict}},
+    {Method: http.MethodGet, Path: "/v1/roles/{role_name}", Tag: "admin", Summary: "A role",
+        Auth: authAdmin, Response: RolesRegisterRequest{}, Errors: []int{http.StatusNotFound}},
+
+    {Method: http.MethodPost, Path: "/v1/invitations", Tag: "admin", Summary: "Invite an email address with preassigned roles",
+        Auth: authAdmin, Request: InvitationCreateRequest{}, Status: http.StatusCreated, Location: true, Response: invitationView{},
+        Errors: []int{http.StatusNotFound, http.StatusConflict}},
+    {Method: http.MethodGet, Path: "/v1/invitations", Tag: "admin", Summary: "List invitations", Auth: authAdmin, Response: []invitationView{}},
+    {Method: http.MethodGet, Path: "/v1/invitations/{id}", Tag: "admin", Summary: "An invitation",
+        Auth: authAdmin, Response: invitationView{}, Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodDelete, Path: "/v1/invitations/{id}", Tag: "admin", Summary: "Revoke an invitation",
+        Auth: authAdmin, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound, http.StatusConflict}},
+    {Method: http.MethodPost, Path: "/v1/invitations/{id}/resend", Tag: "admin", Summary: "Mail a new invite link",
+        Auth: authAdmin, Response: invitationView{}, Errors: []int{http.StatusNotFound, http.StatusConflict}},
+
+    {Method: http.MethodGet, Path: "/v1/sessions", Tag: "admin", Summary: "Active sessions of all users",
+        Auth: authAdmin, Query: []apiParameter{{Name: "username", Description: "Only this user's sessions"}}, Response: []modals.Session{},
+        Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodDelete, Path: "/v1/sessions/{id}", Tag: "admin", Summary: "End a session",
+        Auth: authAdmin, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+
+    {Method: http.MethodPost, Path: "/v1/oauth/clients", Tag: "admin", Summary: "Register a client app, the client_secret is only part of this response",
+        Auth: authAdmin, Request: OAuthClientRegisterRequest{}, Status: http.StatusCreated, Location: true,
+        Response: withMember(oauthClientResponse(modals.OAuthClient{}), "client_secret", "")},
+    {Method: http.MethodGet, Path: "/v1/oauth/clients", Tag: "admin", Summary: "List client apps",
+        Auth: authAdmin, Response: []map[string]interface{}{oauthClientResponse(modals.OAuthClient{})}},
+    {Method: http.MethodGet, Path: "/v1/oauth/clients/{client_id}", Tag: "admin", Summary: "A client app",
+        Auth: authAdmin, Response: oauthClientResponse(modals.OAuthClient{}), Errors: []int{http.StatusNotFound}},
+
+    {Method: http.MethodPost, Path: "/v1/service_accounts", Tag: "admin", Summary: "Create a service account, the client_secret is only part of this response",
+        Auth: authAdmin, Request: ServiceAccountRegisterRequest{}, Status: http.StatusCreated, Location: true,
+        Response: withMember(serviceAccountResponse(modals.ServiceAccount{}), "client_secret", ""), Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodGet, Path: "/v1/service_accounts", Tag: "admin", Summary: "List service accounts",
+        Auth: authAdmin, Response: []map[string]interface{}{serviceAccountResponse(modals.ServiceAccount{})}},
+    {Method: http.MethodGet, Path: "/v1/service_accounts/{client_id}", Tag: "admin", Summary: "A service account",
+        Auth: authAdmin, Response: serviceAccountResponse(modals.ServiceAccount{}), Errors: []int{http.StatusNotFound}},
+    {Method: http.MethodDelete, Path: "/v1/service_accounts/{client_id}", Tag: "admin", Summary: "Delete a service account",
+        Auth: authAdmin, Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+}
+
+var (
+    openAPIOnce     sync.Once
+    openAPIDocument []byte
+)
+
+// OpenAPIHandler responds with the OpenAPI 3.1 document generated from apiOperations
+func (s *Server) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+    openAPIOnce.Do(func() {
+        var err error
+        openAPIDocument, err = json.Marshal(buildOpenAPI(apiOperations))
+        if err != nil {
+            slog.ErrorContext(r.Context(), "generating OpenAPI document failed", "error", err)
+        }
+    })
+    if openAPIDocument == nil {
+        writeProblem(w, r, http.StatusInternalServerError, codeInternalError, "Error generating OpenAPI document")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(openAPIDocument)
+}
+
+// APIDocsHandler serves a page rendering /openapi.json with Swagger UI
+func (s *Server) APIDocsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Header().Set("Content-Security-Policy", docsContentSecurityPolicy)
+    w.Write(apiDocsPage)
+}
+
+// buildOpenAPI generates the OpenAPI document, named Go types become component schemas
+func buildOpenAPI(operations []apiOperation) map[string]interface{} {
+    b := &openAPIBuilder{schemas: map[string]interface{}{}, types: map[string]reflect.Type{}}
+    problem := b.schemaOf(Problem{})
+
+    paths := map[string]map[string]interface{}{}
+    for _, op := range operations {
+        if paths[op.Path] == nil {
+            paths[op.Path] = map[string]interface{}{}
+        }
+        paths[op.Path][strings.ToLower(op.Method)] = b.operation(op, problem)
+    }
+
+    return map[string]interface{}{
+        "openapi": "3.1.0",
+        "info": map[string]interface{}{
+            "title":       "JJR Backend API",
+            "version":     apiVersion,
+            "description": "Accounts, roles and logins, and an OpenID Connect provider for other apps. Errors are RFC 7807 problems.",
+        },
+        "paths": paths,
+        "components": map[string]interface{}{
+            "schemas": b.schemas,
+            "securitySchemes": map[string]interface{}{
+                "bearerAuth": map[string]interface{}{
+                    "type":        "http",
+                    "scheme":      "bearer",
+                    "description": "An access token from POST /v1/tokens or a personal access token",
+                },
+            },
+        },
+    }
+}
+
+type openAPIBuilder struct {
+    schemas map[string]interface{}
+    // types remembers which Go type got a component name, so two types can't share one
+    types map[string]reflect.Type
+}
+
+var pathVariable = regexp.MustCompile(`\{([^}:]+)\}`)
+
+func (b *openAPIBuilder) operation(op apiOperation, problem map[string]interface{}) map[string]interface{} {
+    operation := map[string]interface{}{
+        "tags":    []string{op.Tag},
+        "summary": op.Summary,
+    }
+
+    parameters := []interface{}{}
+    for _, match := range pathVariable.FindAllStringSubmatch(op.Path, -1) {
+        schema := map[string]interface{}{"type": "string"}
+        if match[1] == "id" {
+            schema["type"] = "integer"
+        }
+        parameters = append(parameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": schema})
+    }
+    for _, param := range op.Query {
+        parameter := map[string]interface{}{"name": param.Name, "in": "query", "required": param.Required, "schema": map[string]interface{}{"type": "string"}}
+        if param.Description != "" {
+            parameter["description"] = param.Description
+        }
+        parameters = append(parameters, parameter)
+    }
+    if len(parameters) > 0 {
+        operation["parameters"] = parameters
+    }
+
+    statuses := append([]int{}, op.Errors...)
+    if op.Request != nil {
+        contentType := "application/json"
+        if op.Form {
+            contentType = "application/x-www-form-urlencoded"
+        }
+        operation["requestBody"] = map[string]interface{}{
+            "required": true,
+            "content":  map[string]interface{}{contentType: map[string]interface{}{"schema": b.schemaOf(op.Request)}},
+        }
+        statuses = append(statuses, http.StatusBadRequest)
+        if !op.Form {
+            statuses = append(statuses, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity)
+        }
+    }
+    switch op.Auth {
+    case authUser:
+        operation["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+        statuses = append(statuses, http.StatusUnauthorized)
+    case authAdmin:
+        operation["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+        operation["description"] = "Requires the admin role."
+        statuses = append(statuses, http.StatusUnauthorized, http.StatusForbidden)
+    }
+    if successor := legacySuccessor(op.Method, op.Path); successor != "" {
+        operation["deprecated"] = true
+        description := fmt.Sprintf("Deprecated, use %s instead. This route is removed after %s.", successor, legacySunsetAt.Format(time.DateOnly))
+        if operation["description"] != nil {
+            description += " " + operation["description"].(string)
+        }
+        operation["description"] = description
+    }
+
+    status := op.Status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    responses := map[string]interface{}{fmt.Sprint(status): b.response(status, op.Response)}
+    if op.Location {
+        responses[fmt.Sprint(status)].(map[string]interface{})["headers"] = map[string]interface{}{
+            "Location": map[string]interface{}{"description": "URL of the new resource", "schema": map[string]interface{}{"type": "string"}},
+        }
+    }
+    for _, code := range op.Also {
+        responses[fmt.Sprint(code)] = b.response(code, nil)
+    }
+
+    errorContent := map[string]interface{}{"application/problem+json": map[string]interface{}{"schema": problem}}
+    if op.OAuthErrors {
+        errorContent = map[string]interface{}{"application/json": map[string]interface{}{
+            "schema": b.schemaOf(properties{"error": "", "error_description": ""}),
+        }}
+    }
+    statuses = append(statuses, http.StatusInternalServerError)
+    sort.Ints(statuses)
+    for _, code := range statuses {
+        responses[fmt.Sprint(code)] = map[string]interface{}{"description": http.StatusText(code), "content": errorContent}
+    }
+    operation["responses"] = responses
+    return operation
+}
+
+func (b *openAPIBuilder) response(status int, body interface{}) map[string]interface{} {
+    response := map[string]interface{}{"description": http.StatusText(status)}
+    switch body := body.(type) {
+    case nil:
+    case plainText:
+        response["content"] = map[string]interface{}{"text/plain": map[string]interface{}{
+            "schema": map[string]interface{}{"type": "string"}, "example": string(body),
+        }}
+    case htmlPage:
+        response["content"] = map[string]interface{}{"text/html": map[string]interface{}{
+            "schema": map[string]interface{}{"type": "string"},
+        }}
+    default:
+        response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schemaOf(body)}}
+    }
+    return response
+}
+
+// schemaOf describes an example value. Objects built as maps, like properties or the responses of
+// oauthClientResponse, are described member by member, a non-empty slice by its first element.
+func (b *openAPIBuilder) schemaOf(value interface{}) map[string]interface{} {
+    switch value := value.(type) {
+    case nil:
+        return map[string]interface{}{}
+    case jsonSchema:
+        return value
+    case properties:
+        return b.objectSchema(value)
+    case map[string]interface{}:
+        return b.objectSchema(value)
+    }
+    v := reflect.ValueOf(value)
+    if v.Kind() == reflect.Slice && v.Len() > 0 {
+        return map[string]interface{}{"type": "array", "items": b.schemaOf(v.Index(0).Interface())}
+    }
+    return b.schemaFor(v.Type())
+}
+
+func (b *openAPIBuilder) objectSchema(members map[string]interface{}) map[string]interface{} {
+    props := map[string]interface{}{}
+    for name, value := range members {
+        schema := b.schemaOf(value)
+        // A nil slice or map in a response map is sent as null, pointers are nullable already
+        if v := reflect.ValueOf(value); (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+            schema = nullable(schema)
+        }
+        props[name] = schema
+    }
+    return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+}
+
+var (
+    timeType      = reflect.TypeOf(time.Time{})
+    rawJSONType   = reflect.TypeOf(json.RawMessage{})
+    marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schemaFor describes a Go type the way encoding/json encodes it
+func (b *openAPIBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+    switch {
+    case t == timeType:
+        return map[string]interface{}{"type": "string", "format": "date-time"}
+    case t == rawJSONType:
+        return map[string]interface{}{}
+    }
+    switch t.Kind() {
+    case reflect.Pointer:
+        return nullable(b.schemaFor(t.Elem()))
+    case reflect.Interface:
+        return map[string]interface{}{}
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]interface{}{"type": "integer"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    case reflect.String:
+        return map[string]interface{}{"type": "string"}
+    case reflect.Slice, reflect.Array:
+        return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+    case reflect.Map:
+        if t.Elem().Kind() == reflect.Interface {
+            return map[string]interface{}{"type": "object"}
+        }
+        return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+    case reflect.Struct:
+        if t.Name() == "" {
+            return b.structSchema(t)
+        }
+        return b.component(t)
+    }
+    panic(fmt.Sprintf("openapi: no schema for type %s", t))
+}
+
+// component adds the schema of a named struct to the components once and refers to it
+func (b *openAPIBuilder) component(t reflect.Type) map[string]interface{} {
+    name := []rune(t.Name())
+    name[0] = unicode.ToUpper(name[0])
+    ref := map[string]interface{}{"$ref": "#/components/schemas/" + string(name)}
+
+    if known, ok := b.types[string(name)]; ok {
+        if known != t {
+            panic(fmt.Sprintf("openapi: types %s and %s both become schema %s", known, t, string(name)))
+        }
+        return ref
+    }
+    b.types[string(name)] = t
+    b.schemas[string(name)] = map[string]interface{}{} // placeholder for recursive types
+    b.schemas[string(name)] = b.structSchema(t)
+    return ref
+}
+
+// structSchema lists the members encoding/json writes for the struct, embedded structs are inlined like it does.
+// Slices, maps and pointers may be nil and encode as null.
+func (b *openAPIBuilder) structSchema(t reflect.Type) map[string]interface{} {
+    props := map[string]interface{}{}
+    b.addFields(t, props)
+    schema := map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+    // Types with their own MarshalJSON, like Problem, may add members
+    if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+        delete(schema, "additionalProperties")
+    }
+    return schema
+}
+
+func (b *openAPIBuilder) addFields(t reflect.Type, props map[string]interface{}) {
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        tag := field.Tag.Get("json")
+        name, _, _ := strings.Cut(tag, ",")
+        if name == "-" {
+            continue
+        }
+        if field.Anonymous && name == "" {
+            embedded := field.Type
+            if embedded.Kind() == reflect.Pointer {
+                embedded = embedded.Elem()
+            }
+            if embedded.Kind() == reflect.Struct {
+                b.addFields(embedded, props)
+                continue
+            }
+        }
+        if !field.IsExported() {
+            continue
+        }
+        if name == "" {
+            name = field.Name
+        }
+        schema := b.schemaFor(field.Type)
+        switch field.Type.Kind() {
+        case reflect.Slice, reflect.Map:
+            if field.Type != rawJSONType {
+                schema = nullable(schema)
+            }
+        }
+        props[name] = schema
+    }
+}
+
+// nullable allows null next to what schema allows, pointers are already nullable
+func nullable(schema map[string]interface{}) map[string]interface{} {
+    switch t := schema["type"].(type) {
+    case string:
+        widened := map[string]interface{}{}
+        for key, value := range schema {
+            widened[key] = value
+        }
+        widened["type"] = []string{t, "null"}
+        return widened
+    case nil:
+        if _, ok := schema["$ref"]; ok {
+            return map[string]interface{}{"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+        }
+    }
+    return schema
+}
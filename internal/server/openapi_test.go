@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	spec := buildOpenAPI(apiOperations)
+	paths := spec["paths"].(map[string]map[string]interface{})
+
+	registered := map[string]bool{}
+	err := (&Server{}).router().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		path := pathTemplate(template)
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes without methods dispatch themselves and document each method they answer
+			if len(paths[path]) == 0 {
+				t.Errorf("route %s is missing from the OpenAPI document", path)
+			}
+			for method := range paths[path] {
+				registered[strings.ToUpper(method)+" "+path] = true
+			}
+			return nil
+		}
+		for _, method := range methods {
+			registered[method+" "+path] = true
+			if paths[path][strings.ToLower(method)] == nil {
+				t.Errorf("route %s %s is missing from the OpenAPI document", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error walking routes. Err: %v", err)
+	}
+
+	for _, op := range apiOperations {
+		if !registered[op.Method+" "+op.Path] {
+			t.Errorf("OpenAPI document describes %s %s, which is not a route", op.Method, op.Path)
+		}
+	}
+}
+
+func TestOpenAPIResponsesMatchSchemas(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	_, server := newTestServer(t, db)
+	alice := testAccessToken(t, db, "alice", "standard")
+	admin := testAccessToken(t, db, "admin", "admin")
+
+	resp, err := http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	document, err := jsonschema.UnmarshalJSON(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the OpenAPI document; got %v %v", resp.Status, err)
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("openapi.json", document); err != nil {
+		t.Fatalf("error adding document. Err: %v", err)
+	}
+
+	check := func(method string, path string, target string, token string, body interface{}) {
+		t.Helper()
+		var payload bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&payload).Encode(body)
+		}
+		req, _ := http.NewRequest(method, server.URL+target, &payload)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		mediaType := strings.TrimSuffix(resp.Header.Get("Content-Type"), "; charset=utf-8")
+		pointer := strings.Join([]string{"paths", escapePointer(path), strings.ToLower(method), "responses",
+			resp.Status[:3], "content", escapePointer(mediaType), "schema"}, "/")
+		schema, err := compiler.Compile("openapi.json#/" + pointer)
+		if err != nil {
+			t.Errorf("%s %s answered %s %s, which the document doesn't describe: %v", method, path, resp.Status, mediaType, err)
+			return
+		}
+		instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error decoding response of %s %s. Err: %v", method, path, err)
+		}
+		if err := schema.Validate(instance); err != nil {
+			t.Errorf("response of %s %s doesn't match its schema: %v", method, path, err)
+		}
+	}
+
+	check(http.MethodGet, "/v1/me", "/v1/me", alice, nil)
+	check(http.MethodPost, "/v1/me/tokens", "/v1/me/tokens", alice, PersonalAccessTokenRequest{Name: "ci"})
+	check(http.MethodGet, "/v1/me/tokens", "/v1/me/tokens", alice, nil)
+	check(http.MethodGet, "/v1/users", "/v1/users", admin, nil)
+	check(http.MethodPost, "/v1/oauth/clients", "/v1/oauth/clients", admin,
+		OAuthClientRegisterRequest{Name: "App", ClientType: "confidential", RedirectURIs: []string{"https://app.example.com/cb"}})
+	check(http.MethodGet, "/.well-known/openid-configuration", "/.well-known/openid-configuration", "", nil)
+	check(http.MethodGet, "/oauth/jwks", "/oauth/jwks", "", nil)
+	check(http.MethodPatch, "/v1/me", "/v1/me", alice, map[string]string{"timezone": "Mars/Olympus_Mons"})
+	check(http.MethodGet, "/v1/users", "/v1/users", alice, nil)
+}
+
+// escapePointer escapes a JSON pointer token, see RFC 6901
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"jjr-tec-backend/internal/auth"
+	"jjr-tec-backend/internal/modals"
+	"jjr-tec-backend/internal/security"
+)
+
+const (
+    purposePasswordReset = "password_reset"
+
+    passwordResetTTL       = time.Hour
+    passwordResetResendGap = 2 * time.Minute
+)
+
+var (
+    // passwordResetURL is the page the link in the reset mail points to, the token is appended as ?token=.
+    // It defaults to GET /v1/password/reset on PUBLIC_URL, which describes the token.
+    passwordResetURL = os.Getenv("PASSWORD_RESET_URL")
+
+    // breachedPasswordsDir holds the Have I Been Pwned range files new passwords are checked against, see security.BreachedPasswords
+    breachedPasswordsDir = os.Getenv("BREACHED_PASSWORDS_DIR")
+)
+
+// checkNewPassword responds with 400 and returns false if the password breaks the password policy, appears in a
+// known breach or, for an existing user (userID not 0), is one of their last passwords. All policy violations are
+// listed at once.
+func (s *Server) checkNewPassword(w http.ResponseWriter, r *http.Request, password string, username string, email string, userID int) bool {
+    var policyErr *security.PasswordPolicyError
+    if err := s.passwordPolicy.Check(password, username, email); errors.As(err, &policyErr) {
+        var fields []FieldError
+        for _, violation := range policyErr.Violations {
+            fields = append(fields, FieldError{Field: "password", Code: "password_policy", Message: "Password " + violation})
+        }
+        writeValidationProblem(w, r, fields...)
+        return false
+    }
+
+    breached, err := s.breachedPasswords.Contains(password)
+    if err != nil {
+        // A broken breach list shouldn't lock everyone out of changing passwords
+        slog.ErrorContext(r.Context(), "checking password against breached passwords failed", "error", err)
+    }
+    if breached {
+        writeValidationProblem(w, r, FieldError{Field: "password", Code: "breached", Message: "Password appears in a known data breach, choose another one"})
+        return false
+    }
+
+    if userID != 0 && s.passwordPolicy.History > 0 {
+        hashes, err := s.db.PasswordHistory(r.Context(), userID, s.passwordPolicy.History)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return false
+        }
+        for _, hash := range hashes {
+            if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+                message := fmt.Sprintf("Password must differ from your last %d passwords", s.passwordPolicy.History)
+                writeValidationProblem(w, r, FieldError{Field: "password", Code: "reused", Message: message})
+                return false
+            }
+        }
+    }
+    return true
+}
+
+type ChangePasswordRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+func (req *ChangePasswordRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.required("current_password", req.CurrentPassword)
+    fields.required("new_password", req.NewPassword)
+    return fields
+}
+
+// ChangePasswordHandler sets a new password for the calling user after checking the current one. Refresh tokens
+// issued before are rejected from now on, the response carries a new token pair for the calling client.
+func (s *Server) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+    var req ChangePasswordRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    // Only the local password store can change passwords, directory users change theirs in the directory
+    if _, err := (auth.Local{DB: s.db}).Authenticate(r.Context(), user.Username, req.CurrentPassword); err != nil {
+        if errors.Is(err, auth.ErrInvalidCredentials) {
+            writeProblem(w, r, http.StatusUnauthorized, "wrong_password", "Current password is wrong")
+            return
+        }
+        writeProblem(w, r, http.StatusInternalServerError, codeInternalError, "Error authenticating user")
+        return
+    }
+    if !s.checkNewPassword(w, r, req.NewPassword, user.Username, user.Email, user.ID) {
+        return
+    }
+
+    if err := s.db.UpdatePassword(r.Context(), user.ID, req.NewPassword); err != nil {
+        writeError(w, r, dbError(err, "Failed to change password"))
+        return
+    }
+    // The response starts a new session for the caller, every existing one ends
+    if err := s.db.RevokeUserSessions(r.Context(), user.ID, 0); err != nil {
+        writeError(w, r, dbError(err, "Failed to end sessions"))
+        return
+    }
+    s.sendPasswordChangedEmail(r, user)
+
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    s.writeTokenPair(w, r, user, roles)
+}
+
+// ForgotPasswordHandler mails a password reset link to the given address. It answers 202 whether or not an
+// account uses the address, and sends at most one mail per account every passwordResetResendGap. Accounts without
+// a local password get no mail, they sign in at their directory or identity provider only.
+func (s *Server) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+    var req EmailRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    user, err := s.db.GetUserByEmail(r.Context(), req.Email)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if user != nil {
+        local, err := s.hasLocalPassword(r, user)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return
+        }
+        if !local {
+            slog.InfoContext(r.Context(), "refused password reset for user without local password", "username", user.Username)
+        } else if err := s.sendPasswordResetEmail(r, user); err != nil {
+            slog.ErrorContext(r.Context(), "sending password reset email failed", "username", user.Username, "error", err)
+        }
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("If the address belongs to an account, a password reset email was sent"))
+}
+
+// hasLocalPassword reports whether the user has a local password. Users provisioned from the directory or an
+// upstream identity provider have none, so nothing may set one for them.
+func (s *Server) hasLocalPassword(r *http.Request, user *modals.User) (bool, error) {
+    hash, err := s.db.GetPasswordHash(r.Context(), user.Username)
+    return hash != "", err
+}
+
+func (s *Server) sendPasswordResetEmail(r *http.Request, user *modals.User) error {
+    latest, err := s.db.LatestUserToken(r.Context(), user.ID, purposePasswordReset)
+    if err != nil {
+        return err
+    }
+    if latest != nil && time.Since(latest.CreatedAt) < passwordResetResendGap {
+        return nil
+    }
+    token, hash := newSignedToken(purposePasswordReset)
+    link, err := mailLink(passwordResetURL, "/v1/password/reset", token)
+    if err != nil {
+        return err
+    }
+    if err := s.db.RevokeUserTokens(r.Context(), user.ID, purposePasswordReset); err != nil {
+        return err
+    }
+
+    now := time.Now()
+    err = s.db.CreateUserToken(r.Context(), &modals.UserToken{
+        UserID:    user.ID,
+        Purpose:   purposePasswordReset,
+        TokenHash: hash,
+        CreatedAt: now,
+        ExpiresAt: now.Add(passwordResetTTL),
+    })
+    if err != nil {
+        return err
+    }
+
+    return s.sendMail(r, user, "password_reset", map[string]string{"Username": user.Username, "Link": link})
+}
+
+type ResetPasswordRequest struct {
+    Token       string `json:"token"`
+    NewPassword string `json:"new_password"`
+}
+
+func (req *ResetPasswordRequest) Validate() []FieldError {
+    var fields fieldErrors
+    fields.required("token", req.Token)
+    fields.required("new_password", req.NewPassword)
+    return fields
+}
+
+// PasswordResetTokenHandler describes the reset token from the mail, so the reset page can tell whose password
+// is set before asking for the new one. The token stays usable.
+func (s *Server) PasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+    hash, ok := verifySignedToken(purposePasswordReset, r.URL.Query().Get("token"))
+    if !ok {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token")
+        return
+    }
+    token, err := s.db.GetUserToken(r.Context(), purposePasswordReset, hash)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if token == nil {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token")
+        return
+    }
+    user, err := s.db.GetUserByID(r.Context(), token.UserID)
+    if err != nil || user == nil {
+        writeProblem(w, r, http.StatusInternalServerError, codeDatabaseError, "Error querying database")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "username":   user.Username,
+        "expires_at": token.ExpiresAt,
+    })
+}
+
+// ResetPasswordHandler sets a new password using the token from the reset mail. All refresh tokens of the user
+// are rejected afterwards, so every session has to log in again.
+func (s *Server) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+    var req ResetPasswordRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    hash, ok := verifySignedToken(purposePasswordReset, req.Token)
+    if !ok {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token")
+        return
+    }
+    // The token is only used up once the new password passes the checks, so users can retry with the same link
+    token, err := s.db.GetUserToken(r.Context(), purposePasswordReset, hash)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if token == nil {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token")
+        return
+    }
+    user, err := s.db.GetUserByID(r.Context(), token.UserID)
+    if err != nil || user == nil {
+        writeProblem(w, r, http.StatusInternalServerError, codeDatabaseError, "Error querying database")
+        return
+    }
+    if local, err := s.hasLocalPassword(r, user); err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    } else if !local {
+        writeProblem(w, r, http.StatusConflict, "no_local_password", "The account signs in through its identity provider and has no password to reset")
+        return
+    }
+    if !s.checkNewPassword(w, r, req.NewPassword, user.Username, user.Email, user.ID) {
+        return
+    }
+    if token, err = s.db.ConsumeUserToken(r.Context(), purposePasswordReset, hash); err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    } else if token == nil {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token")
+        return
+    }
+
+    if err := s.db.UpdatePassword(r.Context(), token.UserID, req.NewPassword); err != nil {
+        writeError(w, r, dbError(err, "Failed to reset password"))
+        return
+    }
+    if err := s.db.RevokeUserSessions(r.Context(), token.UserID, 0); err != nil {
+        writeError(w, r, dbError(err, "Failed to end sessions"))
+        return
+    }
+    // Receiving the mail proves the address belongs to the user
+    if err := s.db.SetEmailVerified(r.Context(), token.UserID, true); err != nil {
+        slog.ErrorContext(r.Context(), "marking email verified after password reset failed", "username", user.Username, "error", err)
+    }
+
+    slog.InfoContext(r.Context(), "password was reset", "username", user.Username)
+    s.sendPasswordChangedEmail(r, user)
+
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Password reset successfully"))
+}
+
+// sendPasswordChangedEmail tells the user their password changed, so they notice if it wasn't them
+func (s *Server) sendPasswordChangedEmail(r *http.Request, user *modals.User) {
+    if user.Email == "" {
+        return
+    }
+    err := s.sendMail(r, user, "password_changed", map[string]string{"Username": user.Username})
+    if err != nil {
+        slog.ErrorContext(r.Context(), "sending password changed email failed", "username", user.Username, "error", err)
+    }
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"jjr-tec-backend/internal/security"
+)
+
+func TestPasswordReset(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("frank", "frank@example.com", "standard")
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+
+	s.authenticator = passwordAuthenticator{db}
+
+	var tokens TokenResponse
+	doJSON(t, http.MethodPost, server.URL+"/account", "", LoginRequest{Username: "frank", Password: "password"}, &tokens)
+	refresh := map[string]string{"refresh_token": tokens.RefreshToken}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", refresh, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the refresh token to work before the reset; got %v", resp.Status)
+	}
+
+	// Unknown addresses get the same answer and no mail
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/password/forgot", "", map[string]string{"email": "nobody@example.com"}, nil)
+	if resp.StatusCode != http.StatusAccepted || len(mailer.sent) != 0 {
+		t.Fatalf("expected 202 and no mail for an unknown address; got %v and %d mails", resp.Status, len(mailer.sent))
+	}
+
+	// The link must not follow a Host header the requester chose
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/password/forgot", strings.NewReader(`{"email": "frank@example.com"}`))
+	req.Host = "evil.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || len(mailer.sent) != 1 {
+		t.Fatalf("expected 202 and one reset mail; got %v and %d mails", resp.Status, len(mailer.sent))
+	}
+	link, _ := url.Parse(regexp.MustCompile(`http\S+`).FindString(mailer.sent[0].Text))
+	token := link.Query().Get("token")
+	if !strings.HasPrefix(link.String(), server.URL+"/v1/password/reset?") {
+		t.Fatalf("expected the link to point to the configured public URL; got %v", link)
+	}
+
+	// The link itself answers GET, describing the token without using it up
+	var described map[string]interface{}
+	if resp := doJSON(t, http.MethodGet, link.String(), "", nil, &described); resp.StatusCode != http.StatusOK || described["username"] != "frank" {
+		t.Fatalf("expected the link to describe frank's reset; got %v %v", resp.Status, described)
+	}
+
+	resp = doJSON(t, http.MethodPost, server.URL+"/v1/password/reset", "", ResetPasswordRequest{Token: token + "x", NewPassword: "new"}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a tampered token to be rejected; got %v", resp.Status)
+	}
+	resp = doJSON(t, http.MethodPost, server.URL+"/v1/password/reset", "", ResetPasswordRequest{Token: token, NewPassword: "new"}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if db.passwords[1] != "new" {
+		t.Errorf("expected frank's password to be changed")
+	}
+	resp = doJSON(t, http.MethodPost, server.URL+"/v1/password/reset", "", ResetPasswordRequest{Token: token, NewPassword: "again"}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a used token to be rejected; got %v", resp.Status)
+	}
+
+	if resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", refresh, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token to be rejected after the reset; got %v", resp.Status)
+	}
+}
+
+func TestPasswordPolicyOnRegistrationAndReset(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	frank := db.addUser("frank", "frank@example.com", "standard")
+	db.passwords[frank.ID] = "Old password 1"
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+	s.passwordPolicy = security.PasswordPolicy{MinLength: 10, MinClasses: 2, DisallowPersonal: true, History: 2}
+
+	body, _ := json.Marshal(AccountRegisterRequest{Username: "grace", Email: "grace@example.com", Password: "grace"})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/protected/account_register", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAccessToken(t, db, "admin", "admin"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	message, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(message), "at least 10 characters") ||
+		!strings.Contains(string(message), "must not contain the username") {
+		t.Errorf("expected all policy violations to be listed; got %v %q", resp.Status, message)
+	}
+
+	doJSON(t, http.MethodPost, server.URL+"/v1/password/forgot", "", map[string]string{"email": "frank@example.com"}, nil)
+	link, _ := url.Parse(regexp.MustCompile(`http\S+`).FindString(mailer.sent[0].Text))
+	token := link.Query().Get("token")
+
+	// A rejected password leaves the link usable
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/password/reset", "", ResetPasswordRequest{Token: token, NewPassword: "Old password 1"}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected reusing the current password to be rejected; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/password/reset", "", ResetPasswordRequest{Token: token, NewPassword: "New password 2"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if db.passwords[frank.ID] != "New password 2" {
+		t.Errorf("expected frank's password to be changed")
+	}
+}
+
+func TestPasswordResetWithoutPublicURL(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("frank", "frank@example.com", "standard")
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+	publicURL = ""
+
+	// Without an address for the link no mail is sent, the answer still doesn't tell whether the account exists
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/password/forgot", "", map[string]string{"email": "frank@example.com"}, nil)
+	if resp.StatusCode != http.StatusAccepted || len(mailer.sent) != 0 {
+		t.Errorf("expected 202 and no mail; got %v and %d mails", resp.Status, len(mailer.sent))
+	}
+}
+
+func TestPasswordResetWithoutLocalPassword(t *testing.T) {
+	db := newFakeDB()
+	db.ProvisionExternalUser(context.Background(), "dave", "dave@corp.example", true, []string{"standard"}, "corp", "corp-1")
+	erin := db.addUser("erin", "erin@example.com", "standard")
+	s, server := newTestServer(t, db)
+	mailer := &fakeMailer{}
+	s.mailer = mailer
+
+	// A federated user gets no reset link, so they can't set a password the local login would accept
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/password/forgot", "", map[string]string{"email": "dave@corp.example"}, nil)
+	if resp.StatusCode != http.StatusAccepted || len(mailer.sent) != 0 {
+		t.Fatalf("expected 202 and no mail; got %v and %d mails", resp.Status, len(mailer.sent))
+	}
+
+	// A link sent before the account lost its local password doesn't set one either
+	doJSON(t, http.MethodPost, server.URL+"/v1/password/forgot", "", map[string]string{"email": "erin@example.com"}, nil)
+	link, _ := url.Parse(regexp.MustCompile(`http\S+`).FindString(mailer.sent[0].Text))
+	db.passwords[erin.ID] = ""
+	resp = doJSON(t, http.MethodPost, server.URL+"/v1/password/reset", "", ResetPasswordRequest{Token: link.Query().Get("token"), NewPassword: "new"}, nil)
+	if resp.StatusCode != http.StatusConflict || db.passwords[erin.ID] != "" {
+		t.Errorf("expected the reset to be refused; got %v", resp.Status)
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// patPrefix starts every personal access token, AuthMiddleware uses it to tell them apart from JWTs
+const patPrefix = "jjrpat_"
+
+// patTouchInterval is how stale last_used_at gets before a request with the token updates it, so busy tokens
+// don't cost a write per request
+const patTouchInterval = time.Minute
+
+type PersonalAccessTokenRequest struct {
+    Name          string   `json:"name"`
+    Scopes        []string `json:"scopes"`
+    ExpiresInDays int      `json:"expires_in_days"`
+}
+
+func (req *PersonalAccessTokenRequest) Normalize() {
+    req.Name = strings.TrimSpace(req.Name)
+}
+
+func (req *PersonalAccessTokenRequest) Validate() []FieldError {
+    var fields fieldErrors
+    if fields.required("name", req.Name) {
+        fields.maxLength("name", req.Name, maxTokenNameLength)
+    }
+    if req.ExpiresInDays < 0 {
+        fields.add("expires_in_days", "out_of_range", "expires_in_days must not be negative")
+    }
+    return fields
+}
+
+// PersonalAccessTokenCreateHandler creates a token for the calling user. Scopes are role names and must be
+// roles the user has, no scopes means all of them. The token itself is only part of this response.
+func (s *Server) PersonalAccessTokenCreateHandler(w http.ResponseWriter, r *http.Request) {
+    claims := claimsFromContext(r.Context())
+    if claims["sub_type"] == subjectTypeServiceAccount || claims["typ"] == tokenTypePAT {
+        writeProblem(w, r, http.StatusForbidden, "user_session_required", "Personal access tokens can only be created with a user session")
+        return
+    }
+
+    var req PersonalAccessTokenRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if len(req.Scopes) == 0 {
+        req.Scopes = roles
+    }
+    for _, scope := range req.Scopes {
+        if !slices.Contains(roles, scope) {
+            writeValidationProblem(w, r, FieldError{Field: "scopes", Code: "invalid", Message: "Scope " + scope + " is not a role of this user"})
+            return
+        }
+    }
+
+    secret := patPrefix + randomToken(32)
+    token := modals.PersonalAccessToken{
+        UserID:    user.ID,
+        Name:      req.Name,
+        Prefix:    secret[:len(patPrefix)+6],
+        TokenHash: hashSecret(secret),
+        Scopes:    req.Scopes,
+    }
+    if req.ExpiresInDays > 0 {
+        expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+        token.ExpiresAt = &expiresAt
+    }
+    if err := s.db.CreatePersonalAccessToken(r.Context(), &token); err != nil {
+        writeError(w, r, dbError(err, "Failed to create token"))
+        return
+    }
+
+    tokensIssued.WithLabelValues("personal_access", grantPersonal).Inc()
+    response := personalAccessTokenResponse(token)
+    response["token"] = secret
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/v1/me/tokens/"+strconv.Itoa(token.ID))
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) PersonalAccessTokenListHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+
+    tokens, err := s.db.ListPersonalAccessTokens(r.Context(), user.ID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    response := []map[string]interface{}{}
+    for _, token := range tokens {
+        response = append(response, personalAccessTokenResponse(token))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// PersonalAccessTokenHandler responds with one token of the calling user
+func (s *Server) PersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_id", "Invalid token id")
+        return
+    }
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+
+    tokens, err := s.db.ListPersonalAccessTokens(r.Context(), user.ID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    for _, token := range tokens {
+        if token.ID == id {
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(personalAccessTokenResponse(token))
+            return
+        }
+    }
+    writeProblem(w, r, http.StatusNotFound, codeNotFound, "Token not found")
+}
+
+func (s *Server) PersonalAccessTokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeProblem(w, r, http.StatusBadRequest, "invalid_id", "Invalid token id")
+        return
+    }
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+
+    revoked, err := s.db.RevokePersonalAccessToken(r.Context(), user.ID, id)
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to revoke token"))
+        return
+    }
+    if !revoked {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Token not found")
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// currentUser loads the user the request was authenticated as. On failure it has already written the response.
+func (s *Server) currentUser(w http.ResponseWriter, r *http.Request) (*modals.User, bool) {
+    username, _ := claimsFromContext(r.Context())["username"].(string)
+    if username == "" {
+        writeProblem(w, r, http.StatusForbidden, "user_session_required", "Only available to users")
+        return nil, false
+    }
+    user, err := s.db.GetUserByUsername(r.Context(), username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return nil, false
+    }
+    if user == nil {
+        writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid username")
+        return nil, false
+    }
+    return user, true
+}
+
+func personalAccessTokenResponse(token modals.PersonalAccessToken) map[string]interface{} {
+    return map[string]interface{}{
+        "id":           token.ID,
+        "name":         token.Name,
+        "prefix":       token.Prefix,
+        "scopes":       token.Scopes,
+        "created_at":   token.CreatedAt,
+        "last_used_at": token.LastUsedAt,
+        "expires_at":   token.ExpiresAt,
+    }
+}
+
+// authenticatePAT validates a personal access token and returns claims shaped like those of an access token.
+// The roles are the token's scopes the user still has, so removing a role from a user also takes it from their tokens.
+func (s *Server) authenticatePAT(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+    token, err := s.db.GetPersonalAccessTokenByHash(ctx, hashSecret(tokenString))
+    if err != nil {
+        return nil, err
+    }
+    if token == nil || token.RevokedAt != nil || (token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt)) {
+        return nil, nil
+    }
+
+    // Tokens stop working while their user isn't active
+    user, err := s.db.GetUserByUsername(ctx, token.Username)
+    if err != nil {
+        return nil, err
+    }
+    if user == nil || user.Status != modals.UserStatusActive {
+        return nil, nil
+    }
+
+    roles, err := s.db.GetRolesByUsername(ctx, token.Username)
+    if err != nil {
+        return nil, err
+    }
+    granted := []interface{}{}
+    for _, role := range roles {
+        if slices.Contains(token.Scopes, role) {
+            granted = append(granted, role)
+        }
+    }
+
+    if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) >= patTouchInterval {
+        if err := s.db.TouchPersonalAccessToken(ctx, token.ID); err != nil {
+            return nil, err
+        }
+    }
+
+    return jwt.MapClaims{
+        "username":   token.Username,
+        "role":       granted,
+        "sub_type":   subjectTypeUser,
+        "typ":        tokenTypePAT,
+        "scope":      strings.Join(token.Scopes, " "),
+    }, nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersonalAccessTokenLifecycle(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("alice", "alice@example.com", "standard", "admin")
+	_, server := newTestServer(t, db)
+
+	var created map[string]interface{}
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/me/tokens", testAccessToken(t, db, "alice", "standard", "admin"),
+		PersonalAccessTokenRequest{Name: "ci", Scopes: []string{"standard"}}, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status Created; got %v", resp.Status)
+	}
+	pat := created["token"].(string)
+	if !strings.HasPrefix(pat, patPrefix) || !strings.HasPrefix(pat, created["prefix"].(string)) {
+		t.Fatalf("expected token starting with its prefix; got %q and %q", pat, created["prefix"])
+	}
+	if db.pats[0].TokenHash != hashSecret(pat) {
+		t.Errorf("expected only the hash of the token to be stored")
+	}
+
+	// The token works on protected routes but only carries the scoped role
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me/tokens", pat, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected personal access token to be accepted; got %v", resp.Status)
+	}
+	if db.pats[0].LastUsedAt == nil {
+		t.Fatalf("expected last_used_at to be recorded")
+	}
+	// Within patTouchInterval further requests don't write it again
+	lastUsed := *db.pats[0].LastUsedAt
+	doJSON(t, http.MethodGet, server.URL+"/v1/me/tokens", pat, nil, nil)
+	if !db.pats[0].LastUsedAt.Equal(lastUsed) {
+		t.Errorf("expected last_used_at to be kept within the touch interval")
+	}
+	stale := time.Now().Add(-patTouchInterval)
+	db.pats[0].LastUsedAt = &stale
+	doJSON(t, http.MethodGet, server.URL+"/v1/me/tokens", pat, nil, nil)
+	if !db.pats[0].LastUsedAt.After(stale) {
+		t.Errorf("expected a stale last_used_at to be updated")
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/service_accounts", pat, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected admin route to be forbidden for a standard scoped token; got %v", resp.Status)
+	}
+
+	target := fmt.Sprintf("%s/v1/me/tokens/%v", server.URL, created["id"])
+	if resp := doJSON(t, http.MethodDelete, target, pat, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status No Content; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me/tokens", pat, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected revoked token to be rejected; got %v", resp.Status)
+	}
+}
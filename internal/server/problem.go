@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/logging"
+)
+
+// Error codes of problem responses. Clients branch on these, so they must not change once released.
+// Handlers may use more specific codes next to these.
+const (
+    codeInvalidPayload   = "invalid_payload"
+    codeValidationFailed = "validation_failed"
+    codeDatabaseError    = "database_error"
+    codeInternalError    = "internal_error"
+    codeUnauthorized     = "unauthorized"
+    codeInvalidToken     = "invalid_token"
+    codeForbidden        = "forbidden"
+    codeNotFound         = "not_found"
+    codeMethodNotAllowed = "method_not_allowed"
+    codeConflict         = "conflict"
+    codeInvalidReference = "invalid_reference"
+)
+
+// Problem is the RFC 7807 body of every error response, extended with a stable code, the request ID and,
+// for validation errors, the offending fields
+type Problem struct {
+    Type      string       `json:"type"`
+    Title     string       `json:"title"`
+    Status    int          `json:"status"`
+    Detail    string       `json:"detail,omitempty"`
+    Instance  string       `json:"instance,omitempty"`
+    Code      string       `json:"code"`
+    RequestID string       `json:"request_id,omitempty"`
+    Errors    []FieldError `json:"errors,omitempty"`
+    // Extensions are further members for problems that carry data, like the challenge of a step-up login
+    Extensions map[string]interface{} `json:"-"`
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+    type members Problem
+    b, err := json.Marshal(members(p))
+    if err != nil || len(p.Extensions) == 0 {
+        return b, err
+    }
+    merged := map[string]interface{}{}
+    if err := json.Unmarshal(b, &merged); err != nil {
+        return nil, err
+    }
+    for key, value := range p.Extensions {
+        if _, taken := merged[key]; !taken {
+            merged[key] = value
+        }
+    }
+    return json.Marshal(merged)
+}
+
+// FieldError describes what is wrong with one field of the request
+type FieldError struct {
+    Field   string `json:"field"`
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+// APIError is an error that knows how it is shown to clients, see writeError
+type APIError struct {
+    Status     int
+    Code       string
+    Detail     string
+    Fields     []FieldError
+    Extensions map[string]interface{}
+    // Err is the cause, it is logged but never sent to clients
+    Err error
+}
+
+func (e *APIError) Error() string {
+    if e.Err != nil {
+        return e.Detail + ": " + e.Err.Error()
+    }
+    return e.Detail
+}
+
+func (e *APIError) Unwrap() error { return e.Err }
+
+// validationError returns a 422 APIError listing the fields, its detail repeats their messages
+func validationError(fields ...FieldError) *APIError {
+    messages := make([]string, len(fields))
+    for i, field := range fields {
+        messages[i] = field.Message
+    }
+    return &APIError{Status: http.StatusUnprocessableEntity, Code: codeValidationFailed, Detail: strings.Join(messages, "; "), Fields: fields}
+}
+
+// writeProblem responds with a problem+json body
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+    writeError(w, r, &APIError{Status: status, Code: code, Detail: detail})
+}
+
+// writeValidationProblem responds with 422 and the field-level details
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, fields ...FieldError) {
+    writeError(w, r, validationError(fields...))
+}
+
+// writeError responds with the problem for err. An *APIError is shown as it is, anything else is logged and
+// hidden behind a 500.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+    var apiErr *APIError
+    if !errors.As(err, &apiErr) {
+        apiErr = &APIError{Status: http.StatusInternalServerError, Code: codeInternalError, Detail: "Internal server error", Err: err}
+    }
+    problem := Problem{
+        Type:      "about:blank",
+        Title:     http.StatusText(apiErr.Status),
+        Status:    apiErr.Status,
+        Detail:    apiErr.Detail,
+        Instance:  r.URL.Path,
+        Code:      apiErr.Code,
+        RequestID: requestIDFromContext(r.Context()),
+        Errors:    apiErr.Fields,
+
+        Extensions: apiErr.Extensions,
+    }
+    if problem.Status >= http.StatusInternalServerError && apiErr.Err != nil {
+        slog.ErrorContext(r.Context(), "request failed", "method", r.Method, "path", r.URL.Path, "error", apiErr.Err)
+    }
+
+    w.Header().Set("Content-Type", "application/problem+json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(problem.Status)
+    json.NewEncoder(w).Encode(problem)
+}
+
+// dbError wraps a failed database call. The typed errors of the database package become 404, 409 or 422 with a
+// generic detail, handlers that can say more check for them first. Anything else is a 500 showing detail.
+func dbError(err error, detail string) *APIError {
+    switch {
+    case errors.Is(err, database.ErrNotFound):
+        return &APIError{Status: http.StatusNotFound, Code: codeNotFound, Detail: "The request refers to something that does not exist", Err: err}
+    case errors.Is(err, database.ErrConflict):
+        return &APIError{Status: http.StatusConflict, Code: codeConflict, Detail: "A resource with these values already exists", Err: err}
+    case errors.Is(err, database.ErrMissingReference):
+        return &APIError{Status: http.StatusUnprocessableEntity, Code: codeInvalidReference, Detail: "The request refers to something that does not exist", Err: err}
+    case errors.Is(err, database.ErrReferenced):
+        return &APIError{Status: http.StatusConflict, Code: codeInvalidReference, Detail: "The request refers to something that does not exist or is still in use", Err: err}
+    }
+    return &APIError{Status: http.StatusInternalServerError, Code: codeDatabaseError, Detail: detail, Err: err}
+}
+
+// validRequestID limits the request IDs taken from clients to what is safe to log and echo
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware gives every request an ID, taken from a sane X-Request-ID header or generated. It is sent
+// back in X-Request-ID, included in problem responses and attached to every line logged for the request, so reports
+// from clients can be matched with the logs.
+func requestIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID.MatchString(id) {
+            id = randomToken(12)
+        }
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+    })
+}
+
+func requestIDFromContext(ctx context.Context) string {
+    return logging.RequestID(ctx)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"jjr-tec-backend/internal/database"
+)
+
+func TestProblemResponses(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("alice", "alice@example.com", "standard")
+	_, server := newTestServer(t, db)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/nowhere", nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	var problem Problem
+	json.NewDecoder(resp.Body).Decode(&problem)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "application/problem+json" ||
+		problem.Code != codeNotFound || problem.RequestID != "req-42" || resp.Header.Get("X-Request-ID") != "req-42" {
+		t.Errorf("expected a not found problem carrying the request ID; got %v %+v", resp.Status, problem)
+	}
+
+	problem = Problem{}
+	resp = doJSON(t, http.MethodPatch, server.URL+"/v1/me", testAccessToken(t, db, "alice", "standard"),
+		map[string]string{"timezone": "Mars/Olympus_Mons", "locale": "not a locale"}, &problem)
+	if resp.StatusCode != http.StatusUnprocessableEntity || problem.Code != codeValidationFailed || len(problem.Errors) == 0 ||
+		problem.Errors[0].Field == "" || problem.RequestID == "" || problem.RequestID != resp.Header.Get("X-Request-ID") {
+		t.Errorf("expected a validation problem naming the field; got %v %+v", resp.Status, problem)
+	}
+}
+
+func TestDBErrorMapsDatabaseErrors(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{dbError(fmt.Errorf("%w: %w", database.ErrConflict, &pgconn.PgError{Code: "23505"}), "Failed to register user"), http.StatusConflict, codeConflict},
+		{dbError(fmt.Errorf("%w: %w", database.ErrReferenced, &pgconn.PgError{Code: "23503"}), "Failed to delete role"), http.StatusConflict, codeInvalidReference},
+		{dbError(fmt.Errorf("%w: %w: %w", database.ErrMissingReference, database.ErrReferenced, &pgconn.PgError{Code: "23503"}), "Failed to create session"), http.StatusUnprocessableEntity, codeInvalidReference},
+		{dbError(fmt.Errorf("role %q %w", "ghost", database.ErrNotFound), "Failed to assign role"), http.StatusNotFound, codeNotFound},
+		{dbError(&pgconn.PgError{Code: "57014"}, "Error querying database"), http.StatusInternalServerError, codeDatabaseError},
+		{errors.New("boom"), http.StatusInternalServerError, codeInternalError},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		writeError(recorder, httptest.NewRequest(http.MethodPost, "/protected/account_register", nil), c.err)
+		var problem Problem
+		json.NewDecoder(recorder.Body).Decode(&problem)
+		if recorder.Code != c.status || problem.Status != c.status || problem.Code != c.code || problem.Instance != "/protected/account_register" {
+			t.Errorf("expected %d %s for %v; got %d %+v", c.status, c.code, c.err, recorder.Code, problem)
+		}
+		if problem.Detail == "boom" {
+			t.Errorf("expected the cause of internal errors to stay hidden")
+		}
+	}
+}
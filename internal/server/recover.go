@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gorilla/mux"
+)
+
+// recoverMiddleware turns a panicking handler into a 500 problem response instead of a dropped connection.
+// The panic is logged with its stack trace and counted in http_panics_total. If the handler already started
+// the response, only the log line and the metric are left, the client sees a truncated body.
+func recoverMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        recorder := &statusRecorder{ResponseWriter: w}
+        defer func() {
+            recovered := recover()
+            if recovered == nil {
+                return
+            }
+            // net/http aborts responses on purpose with this panic, it must reach the server
+            if recovered == http.ErrAbortHandler {
+                panic(recovered)
+            }
+
+            route := "unmatched"
+            if current := mux.CurrentRoute(r); current != nil {
+                if template, err := current.GetPathTemplate(); err == nil {
+                    route = pathTemplate(template)
+                }
+            }
+            panics.WithLabelValues(route).Inc()
+            slog.ErrorContext(r.Context(), "panic serving request",
+                "method", r.Method,
+                "route", route,
+                "panic", fmt.Sprint(recovered),
+                "stack", string(debug.Stack()),
+            )
+            if recorder.status == 0 {
+                writeProblem(recorder, r, http.StatusInternalServerError, codeInternalError, "Internal server error")
+            }
+        }()
+        next.ServeHTTP(recorder, r)
+    })
+}
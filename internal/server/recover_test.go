@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/logging"
+)
+
+func TestPanicsBecomeProblems(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(logging.New(&out, true, slog.LevelInfo))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	r := mux.NewRouter()
+	r.Use(recoverMiddleware)
+	r.HandleFunc("/boom/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var claims map[string]interface{}
+		_ = claims["username"].(string)
+	})
+	server := httptest.NewServer(requestIDMiddleware(accessLogMiddleware(r)))
+	t.Cleanup(server.Close)
+	before := panicCount(t, "/boom/{id}")
+
+	var problem Problem
+	resp := doJSON(t, http.MethodGet, server.URL+"/boom/1", "", nil, &problem)
+	if resp.StatusCode != http.StatusInternalServerError || problem.Code != codeInternalError || problem.RequestID == "" {
+		t.Errorf("expected a 500 problem; got %v %+v", resp.Status, problem)
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/boom/2", "", nil, nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the server to keep serving; got %v", resp.Status)
+	}
+	if got := panicCount(t, "/boom/{id}"); got != before+2 {
+		t.Errorf("expected both panics to be counted; got %v", got-before)
+	}
+	if !strings.Contains(out.String(), `"msg":"panic serving request"`) || !strings.Contains(out.String(), "recover_test.go") {
+		t.Errorf("expected the panic to be logged with its stack trace; got %s", out.String())
+	}
+}
+
+// panicCount reads http_panics_total of route from the metrics registry
+func panicCount(t *testing.T, route string) float64 {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics. Err: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "http_panics_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == route {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestRefreshRejectsMalformedClaims(t *testing.T) {
+	_, server := newTestServer(t, newFakeDB())
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": 42,
+		"exp":      time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte(jwtKey))
+	if err != nil {
+		t.Fatalf("error signing token. Err: %v", err)
+	}
+
+	var problem Problem
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/tokens/refresh", "", map[string]string{"refresh_token": token}, &problem)
+	if resp.StatusCode != http.StatusUnauthorized || problem.Code != codeInvalidToken {
+		t.Errorf("expected a non-string username to be rejected; got %v %+v", resp.Status, problem)
+	}
+}
@@ -2,31 +2,78 @@ package server
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
+	"regexp"
 
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 func (s *Server) RegisterRoutes() http.Handler {
+    // Every response carries an X-Request-ID, error responses and the log lines of the request repeat it.
+    // otelhttp starts the span of the request, continuing the trace of a traceparent header, and the access log
+    // names it after the route template. Security and CORS headers go on every response, CORS preflights are
+    // answered before the router.
+    return requestIDMiddleware(otelhttp.NewHandler(
+        securityHeadersMiddleware(s.corsMiddleware(accessLogMiddleware(s.router()))), "http.server"))
+}
+
+// router sets up every route, each one needs an entry in apiOperations for the OpenAPI document
+func (s *Server) router() *mux.Router {
     r := mux.NewRouter()
 
+    // A panicking handler answers 500 instead of taking the connection down with it
+    r.Use(recoverMiddleware)
+
+    // Requests changing state with cookies as their only credentials have to come from a trusted origin
+    r.Use(s.csrfMiddleware)
+
+    // /account, /refresh and the /protected routes are deprecated aliases of /v1 routes, their responses carry
+    // Deprecation and Sunset headers
+    r.Use(deprecationMiddleware)
+
     // Just a default route with a welcome message (Get only)
     r.HandleFunc("/", s.defaultRouteHandler)
 
     // Responds with some data about the application like open connections and such (Get only)
     r.HandleFunc("/health", s.healthHandler)
 
-    // Post takes Username and Password -> validates password -> responds with a JWT token that holds basic jwt values + role of user and username
+    // Metrics in the Prometheus text format for scrapers sending METRICS_TOKEN, closed without it unless METRICS_PUBLIC=true
+    r.HandleFunc("/metrics", s.MetricsHandler).Methods(http.MethodGet)
+
+    // The OpenAPI document generated from apiOperations, and Swagger UI rendering it
+    r.HandleFunc("/openapi.json", s.OpenAPIHandler).Methods(http.MethodGet)
+    r.HandleFunc("/docs", s.APIDocsHandler).Methods(http.MethodGet)
+
+    // Post takes Username and Password -> validates password with the AUTH_BACKENDS (local password store, LDAP) -> responds with a JWT token that holds basic jwt values + role of user and username
     // Get takes Username and Password -> validates password -> responds with the corresponding row in in Users Table without the password
     r.HandleFunc("/account", s.accountHandler)
 
     // For JWT Refresh Tokens
     r.HandleFunc("/refresh", s.RefreshHandler)
 
+    // OpenID Connect provider for other apps, see registerOAuthRoutes
+    s.registerOAuthRoutes(r)
+
+    // Login through upstream identity providers configured in OIDC_PROVIDERS_FILE
+    // Get /auth/providers lists their names, /auth/{provider}/login redirects to the provider,
+    // and the provider redirects back to /auth/{provider}/callback which responds like POST /account
+    r.HandleFunc("/auth/providers", s.FederatedProvidersHandler).Methods(http.MethodGet)
+    r.HandleFunc("/auth/{provider}/login", s.FederatedLoginHandler).Methods(http.MethodGet)
+    r.HandleFunc("/auth/{provider}/callback", s.FederatedCallbackHandler).Methods(http.MethodGet)
+
     // Define protected routes with middleware
     s.registerProtectedRoutes(r)
 
+    // The versioned API, see registerV1Routes
+    s.registerV1Routes(r)
+
+    r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "No such endpoint")
+    })
+    r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method Not Allowed")
+    })
     return r
 }
 
@@ -35,7 +82,7 @@ func (s *Server) registerProtectedRoutes(r *mux.Router) {
     protected := r.PathPrefix("/protected").Subrouter()
     protected.Use(s.AuthMiddleware) // Apply authentication middleware to all /protected routes
 
-    // POST takes username, email and password and registers a User with that data
+    // POST takes username, email and password and registers a User with that data, then mails a link to verify the email address
     protected.HandleFunc("/account_register", s.AccountRegisterHandlerDB).Methods(http.MethodPost)
 
     // Post takes Username, Role_Name and Password -> validates password -> responds with Status -> Assigns Role to User
@@ -46,6 +93,123 @@ func (s *Server) registerProtectedRoutes(r *mux.Router) {
     protected.HandleFunc("/roles_register", s.RolesRegisterHandlerDB).Methods(http.MethodPost)
 }
 
+// registerV1Routes sets up the versioned API under "/v1". It offers what the legacy routes do as resources,
+// identified by the path rather than the body, and answers with Location headers for everything it creates.
+func (s *Server) registerV1Routes(r *mux.Router) {
+    v1 := r.PathPrefix("/v1").Subrouter()
+
+    // Post takes username and password -> responds with a token pair, or with a step-up challenge for suspicious logins
+    // Post /tokens/refresh exchanges a refresh token, Post /tokens/step-up takes the challenge and the mailed code
+    v1.HandleFunc("/tokens", s.HandleAccountJwt).Methods(http.MethodPost)
+    v1.HandleFunc("/tokens/refresh", s.RefreshHandler).Methods(http.MethodPost)
+    v1.HandleFunc("/tokens/step-up", s.StepUpHandler).Methods(http.MethodPost)
+
+    // Get (link from the mail) or Post takes the verification token -> marks the user's email address as verified
+    // Post /verify-email/resend mails a new verification link if the address belongs to an unverified account (throttled)
+    // Post /password/forgot mails a reset link if the address belongs to an account (throttled, never tells which)
+    v1.HandleFunc("/verify-email", s.VerifyEmailHandler).Methods(http.MethodGet, http.MethodPost)
+    v1.HandleFunc("/verify-email/resend", s.ResendVerificationEmailHandler).Methods(http.MethodPost)
+    v1.HandleFunc("/password/forgot", s.ForgotPasswordHandler).Methods(http.MethodPost)
+    // Get ?token= describes the reset token from the mail, Post takes the token and the new password
+    v1.HandleFunc("/password/reset", s.PasswordResetTokenHandler).Methods(http.MethodGet)
+    v1.HandleFunc("/password/reset", s.ResetPasswordHandler).Methods(http.MethodPost)
+
+    // Get ?token= describes the invitation from the mail, Post takes the token, username and password -> creates the user
+    v1.HandleFunc("/invitations/accept", s.InvitationHandler).Methods(http.MethodGet)
+    v1.HandleFunc("/invitations/accept", s.InvitationAcceptHandler).Methods(http.MethodPost)
+
+    authed := v1.NewRoute().Subrouter()
+    authed.Use(s.AuthMiddleware)
+
+    // The calling user's own account, its sessions, login history, personal access tokens and linked identities
+    authed.HandleFunc("/me", s.MeHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me", s.MeUpdateHandler).Methods(http.MethodPatch)
+    authed.HandleFunc("/me", s.MeDeleteHandler).Methods(http.MethodDelete)
+    authed.HandleFunc("/me/roles", s.MeRolesHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me/attributes", s.MeAttributesUpdateHandler).Methods(http.MethodPut)
+    authed.HandleFunc("/me/password", s.ChangePasswordHandler).Methods(http.MethodPost)
+    authed.HandleFunc("/me/sessions", s.MeSessionsHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me/sessions", s.MeSessionsRevokeOthersHandler).Methods(http.MethodDelete)
+    authed.HandleFunc("/me/sessions/{id:[0-9]+}", s.MeSessionRevokeHandler).Methods(http.MethodDelete)
+    authed.HandleFunc("/me/logins", s.MeLoginHistoryHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me/security_events", s.MeSecurityEventsHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me/tokens", s.PersonalAccessTokenCreateHandler).Methods(http.MethodPost)
+    authed.HandleFunc("/me/tokens", s.PersonalAccessTokenListHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me/tokens/{id:[0-9]+}", s.PersonalAccessTokenHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me/tokens/{id:[0-9]+}", s.PersonalAccessTokenRevokeHandler).Methods(http.MethodDelete)
+    authed.HandleFunc("/me/identities", s.ExternalIdentityListHandler).Methods(http.MethodGet)
+    authed.HandleFunc("/me/identities/{provider}", s.FederatedLinkHandler).Methods(http.MethodPost)
+    authed.HandleFunc("/me/identities/{provider}", s.ExternalIdentityUnlinkHandler).Methods(http.MethodDelete)
+
+    admin := authed.NewRoute().Subrouter()
+    admin.Use(s.RequireRole("admin"))
+
+    // Users and their role assignments. Put /users/{username}/roles/{role_name} answers 201 when it assigned
+    // the role and 204 when the user already had it, Delete answers 404 when the user doesn't have it.
+    // Get /users filters by status and attributes, Put /users/attribute_schema replaces the JSON Schema attributes are
+    // validated against along with the attributes copied into access tokens and those users may change themselves.
+    admin.HandleFunc("/users", s.UserListHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/users", s.UserCreateHandler).Methods(http.MethodPost)
+    admin.HandleFunc("/users/attribute_schema", s.AttributeSchemaHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/users/attribute_schema", s.AttributeSchemaUpdateHandler).Methods(http.MethodPut)
+    admin.HandleFunc("/users/{username}", s.UserHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/users/{username}/status", s.UserStatusHandler).Methods(http.MethodPut)
+    admin.HandleFunc("/users/{username}/attributes", s.UserAttributesUpdateHandler).Methods(http.MethodPut)
+    admin.HandleFunc("/users/{username}/logins", s.UserLoginHistoryHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/users/{username}/security_events", s.UserSecurityEventsHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/users/{username}/roles", s.UserRolesHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/users/{username}/roles/{role_name}", s.UserRoleAssignHandler).Methods(http.MethodPut)
+    admin.HandleFunc("/users/{username}/roles/{role_name}", s.UserRoleRemoveHandler).Methods(http.MethodDelete)
+
+    // Roles, Post takes role_name
+    admin.HandleFunc("/roles", s.RoleListHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/roles", s.RoleCreateHandler).Methods(http.MethodPost)
+    admin.HandleFunc("/roles/{role_name}", s.RoleHandler).Methods(http.MethodGet)
+
+    // Invitations, Post takes email, roles and an optional locale -> mails the invite link, Post /invitations/{id}/resend mails a new link
+    // Sessions of all users (or ?username=), the client apps that may log in through this backend, and service accounts,
+    // which get tokens through the client_credentials grant on /oauth/token
+    admin.HandleFunc("/invitations", s.InvitationCreateHandler).Methods(http.MethodPost)
+    admin.HandleFunc("/invitations", s.InvitationListHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/invitations/{id:[0-9]+}", s.InvitationGetHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/invitations/{id:[0-9]+}", s.InvitationRevokeHandler).Methods(http.MethodDelete)
+    admin.HandleFunc("/invitations/{id:[0-9]+}/resend", s.InvitationResendHandler).Methods(http.MethodPost)
+    admin.HandleFunc("/sessions", s.SessionListHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/sessions/{id:[0-9]+}", s.SessionRevokeHandler).Methods(http.MethodDelete)
+    admin.HandleFunc("/oauth/clients", s.OAuthClientRegisterHandler).Methods(http.MethodPost)
+    admin.HandleFunc("/oauth/clients", s.OAuthClientListHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/oauth/clients/{client_id}", s.OAuthClientHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/service_accounts", s.ServiceAccountRegisterHandler).Methods(http.MethodPost)
+    admin.HandleFunc("/service_accounts", s.ServiceAccountListHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/service_accounts/{client_id}", s.ServiceAccountHandler).Methods(http.MethodGet)
+    admin.HandleFunc("/service_accounts/{client_id}", s.ServiceAccountDeleteHandler).Methods(http.MethodDelete)
+}
+
+var routeVariablePattern = regexp.MustCompile(`\{([^}:]+):[^}]+\}`)
+
+// pathTemplate drops the patterns from the variables of a mux path template, "/tokens/{id:[0-9]+}" becomes "/tokens/{id}"
+func pathTemplate(template string) string {
+    return routeVariablePattern.ReplaceAllString(template, "{$1}")
+}
+
+// registerOAuthRoutes sets up the OAuth 2.0 authorization code flow (with PKCE) and the OpenID Connect endpoints
+func (s *Server) registerOAuthRoutes(r *mux.Router) {
+    // Discovery document and the public keys ID tokens are signed with
+    r.HandleFunc("/.well-known/openid-configuration", s.OpenIDConfigurationHandler).Methods(http.MethodGet)
+    r.HandleFunc("/oauth/jwks", s.JWKSHandler).Methods(http.MethodGet)
+
+    // Get validates the authorization request -> responds with the consent screen or the redirect carrying the code
+    // Post takes the same parameters plus approve -> records the consent -> responds with the redirect
+    r.Handle("/oauth/authorize", s.AuthMiddleware(http.HandlerFunc(s.AuthorizeHandler))).Methods(http.MethodGet, http.MethodPost)
+
+    // Post takes the form encoded grant -> responds with access token and ID token (authorization_code)
+    // or with an access token for a service account (client_credentials)
+    r.HandleFunc("/oauth/token", s.TokenHandler).Methods(http.MethodPost)
+
+    // Get or Post with the access token -> responds with the claims about the user the granted scopes allow
+    r.Handle("/oauth/userinfo", s.OAuthAccessMiddleware(http.HandlerFunc(s.UserInfoHandler))).Methods(http.MethodGet, http.MethodPost)
+}
+
 
 func (s *Server) defaultRouteHandler(w http.ResponseWriter, r *http.Request) {
     resp := make(map[string]string)
@@ -53,19 +217,27 @@ func (s *Server) defaultRouteHandler(w http.ResponseWriter, r *http.Request) {
 
     jsonResp, err := json.Marshal(resp)
     if err != nil {
-        log.Fatalf("error handling JSON marshal. Err: %v", err)
+        writeError(w, r, err)
+        return
     }
 
+    w.Header().Set("Content-Type", "application/json")
     _, _ = w.Write(jsonResp)
 }
 
+// healthHandler responds with the database health, with 503 while the database is down
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
-    jsonResp, err := json.Marshal(s.db.Health())
-
+    health := s.db.Health()
+    jsonResp, err := json.Marshal(health)
     if err != nil {
-        log.Fatalf("error handling JSON marshal. Err: %v", err)
+        writeError(w, r, err)
+        return
     }
 
+    w.Header().Set("Content-Type", "application/json")
+    if health["status"] == "down" {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
     _, _ = w.Write(jsonResp)
 }
 
@@ -76,7 +248,7 @@ func (s *Server) accountHandler(w http.ResponseWriter, r *http.Request) {
     case http.MethodGet:
         s.HandleAccountDB(w, r)
     default:
-        http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+        writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method Not Allowed")
     }
 }
 
@@ -87,6 +259,6 @@ func (s *Server) rolesHandler(w http.ResponseWriter, r *http.Request) {
     case http.MethodGet:
         s.HandleGetUserRole(w, r)
     default:
-        http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+        writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method Not Allowed")
     }
 }
\ No newline at end of file
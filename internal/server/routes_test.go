@@ -2,8 +2,10 @@ package server
 
 import (
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"testing"
 )
 
@@ -29,3 +31,43 @@ func TestHandler(t *testing.T) {
 		t.Errorf("expected response body to be %v; got %v", expected, string(body))
 	}
 }
+
+func TestLegacyAccountLookupShowsOnlyPublicFields(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("frank", "frank@example.com", "standard")
+	_, server := newTestServer(t, db)
+
+	var account map[string]interface{}
+	// Old clients send the password along, as the route was documented to take it
+	resp := doJSON(t, http.MethodGet, server.URL+"/account", "", map[string]string{"username": "frank", "password": "password"}, &account)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if keys := slices.Sorted(maps.Keys(account)); !slices.Equal(keys, []string{"created_at", "email", "id", "username"}) {
+		t.Errorf("expected only id, username, email and created_at; got %v", keys)
+	}
+}
+
+func TestLegacyRolesAcceptPassword(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("frank", "frank@example.com", "standard")
+	_, server := newTestServer(t, db)
+	token := testAccessToken(t, db, "admin", "admin")
+
+	var roles []string
+	resp := doJSON(t, http.MethodGet, server.URL+"/protected/roles", token, map[string]string{"username": "frank", "password": "password"}, &roles)
+	if resp.StatusCode != http.StatusOK || !slices.Equal(roles, []string{"standard"}) {
+		t.Errorf("expected frank's roles; got %v %v", resp.Status, roles)
+	}
+	resp = doJSON(t, http.MethodPost, server.URL+"/protected/roles", token,
+		map[string]string{"username": "frank", "role_name": "admin", "password": "password"}, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected the role to be assigned; got %v", resp.Status)
+	}
+	// Fields nobody ever sent are still refused
+	resp = doJSON(t, http.MethodGet, server.URL+"/account", "", map[string]string{"username": "frank", "pasword": "typo"}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected an unknown field to be rejected; got %v", resp.Status)
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// randomToken returns n random bytes encoded as unpadded base64url, suitable for codes, secrets and IDs
+func randomToken(n int) string {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        panic(err) // crypto/rand never fails on supported platforms
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashSecret returns the hex encoded SHA-256 of a high entropy secret, which is what gets stored in the database
+func hashSecret(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// secretMatches compares a presented secret against a stored hash in constant time
+func secretMatches(secret string, hash string) bool {
+    return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(hash)) == 1
+}
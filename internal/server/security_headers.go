@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// apiContentSecurityPolicy allows nothing, JSON responses load no resources and must not be framed
+const apiContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+// hstsMaxAge is two years, the value browsers' preload lists ask for
+const hstsMaxAge = "max-age=63072000; includeSubDomains"
+
+// securityHeadersMiddleware adds the standard security headers to every response. The strict Content-Security-Policy
+// suits the JSON responses, handlers serving HTML replace it with a policy for their page, like docsContentSecurityPolicy.
+// HSTS is only sent when the API is reached over HTTPS, browsers ignore it on plain HTTP anyway.
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        header := w.Header()
+        header.Set("X-Content-Type-Options", "nosniff")
+        header.Set("X-Frame-Options", "DENY")
+        header.Set("Referrer-Policy", "no-referrer")
+        header.Set("Content-Security-Policy", apiContentSecurityPolicy)
+        if strings.HasPrefix(issuer(), "https://") {
+            header.Set("Strict-Transport-Security", hstsMaxAge)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// docsContentSecurityPolicy lets the Swagger UI page load its bundle from unpkg, run its one inline script,
+// identified by its hash, and fetch /openapi.json. Swagger UI sets inline styles, so styles can't be restricted further.
+var docsContentSecurityPolicy = "default-src 'none'; script-src https://unpkg.com " + inlineScriptHashes(apiDocsPage) +
+    "; style-src https://unpkg.com 'unsafe-inline'; img-src 'self' data: https://unpkg.com; connect-src 'self'" +
+    "; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+var inlineScript = regexp.MustCompile(`(?s)<script>(.*?)</script>`)
+
+// inlineScriptHashes returns the CSP sources of the inline scripts of page, so the policy follows edits of the page
+func inlineScriptHashes(page []byte) string {
+    var sources []string
+    for _, match := range inlineScript.FindAllSubmatch(page, -1) {
+        sum := sha256.Sum256(match[1])
+        sources = append(sources, "'sha256-"+base64.StdEncoding.EncodeToString(sum[:])+"'")
+    }
+    return strings.Join(sources, " ")
+}
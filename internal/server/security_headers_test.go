@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	_, server := newTestServer(t, newFakeDB())
+
+	resp := doJSON(t, http.MethodGet, server.URL+"/openapi.json", "", nil, nil)
+	for name, want := range map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "no-referrer",
+		"Content-Security-Policy": apiContentSecurityPolicy,
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("expected %s %q; got %q", name, want, got)
+		}
+	}
+	if resp.Header.Get("Strict-Transport-Security") != "" {
+		t.Errorf("expected no HSTS over plain HTTP")
+	}
+
+	// HSTS follows the configured address, clients can't switch it on with X-Forwarded-Proto
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/docs", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if resp := doRequest(t, req); resp.Header.Get("Strict-Transport-Security") != "" {
+		t.Errorf("expected a forwarded scheme not to turn on HSTS")
+	}
+	publicURL = "https://api.example.com"
+	resp = doRequest(t, req)
+	if resp.Header.Get("Strict-Transport-Security") != hstsMaxAge {
+		t.Errorf("expected HSTS over HTTPS; got %v", resp.Header)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "script-src https://unpkg.com 'sha256-") {
+		t.Errorf("expected the docs page to allow Swagger UI and its inline script; got %q", csp)
+	}
+}
+
+func doRequest(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCrossSiteRequestsWithCookiesAreRejected(t *testing.T) {
+	s, server := newTestServer(t, newFakeDB())
+	s.cors = &corsPolicy{origins: []string{"https://app.example.com"}}
+
+	post := func(headers map[string]string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/password/forgot", strings.NewReader(`{"email":"nobody@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tc := range []struct {
+		headers map[string]string
+		allowed bool
+	}{
+		{map[string]string{"Cookie": "session=1", "Origin": "https://evil.example.com", "Sec-Fetch-Site": "cross-site"}, false},
+		{map[string]string{"Cookie": "session=1", "Origin": "https://evil.example.com"}, false},
+		{map[string]string{"Cookie": "session=1", "Origin": "https://app.example.com", "Sec-Fetch-Site": "cross-site"}, true},
+		{map[string]string{"Cookie": "session=1", "Sec-Fetch-Site": "same-origin"}, true},
+		{map[string]string{"Cookie": "session=1", "Origin": server.URL}, true},
+		{map[string]string{"Cookie": "session=1"}, true},
+		{map[string]string{"Origin": "https://evil.example.com", "Sec-Fetch-Site": "cross-site"}, true},
+		{map[string]string{"Cookie": "session=1", "Origin": "https://evil.example.com", "Authorization": "Bearer x"}, true},
+	} {
+		status := post(tc.headers)
+		if rejected := status == http.StatusForbidden; rejected == tc.allowed {
+			t.Errorf("expected a request with %v to be allowed: %v; got %v", tc.headers, tc.allowed, status)
+		}
+	}
+}
@@ -1,31 +1,134 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 
+	"jjr-tec-backend/internal/auth"
 	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/federation"
+	"jjr-tec-backend/internal/mail"
+	"jjr-tec-backend/internal/modals"
+	"jjr-tec-backend/internal/security"
 )
 
 type Server struct {
 	port int
 
 	db database.Service
+
+	idTokenKey *signingKey
+
+	providers map[string]*federation.Provider
+
+	// authenticator checks the passwords posted to /account
+	authenticator auth.Authenticator
+
+	// mailer queues mails in the outbox, see sendMail
+	mailer mail.Mailer
+
+	// detector flags suspicious logins, nil disables the checks
+	detector *security.Detector
+
+	// cors lets browser apps on other origins call the API, nil disables CORS
+	cors *corsPolicy
+
+	// passwordPolicy and breachedPasswords decide which new passwords are accepted, see checkNewPassword
+	passwordPolicy    security.PasswordPolicy
+	breachedPasswords *security.BreachedPasswords
 }
 
 var jwtKey = os.Getenv("JWT_KEY")
 
-func NewServer() *http.Server {
+// publicURL is the address clients reach the API at, like https://api.example.com. Links in mails point to it
+// unless PASSWORD_RESET_URL, EMAIL_VERIFICATION_URL or INVITATION_URL name a page. Links are never built from
+// the request's Host header, anyone asking for a reset mail could point it to their own site that way.
+var publicURL = os.Getenv("PUBLIC_URL")
+
+// authBackends lists the authenticators the login handler tries in order, "local" and "ldap" are supported
+var authBackends = os.Getenv("AUTH_BACKENDS")
+
+// fatal logs why the server can't start and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// NewServer configures the server from the environment. Background work, like the mail worker and the LDAP
+// group sync, runs until ctx is done.
+func NewServer(ctx context.Context) *http.Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
+	idTokenKey, err := loadSigningKey()
+	if err != nil {
+		fatal("could not load ID token signing key", err)
+	}
+	providers, err := loadProviders()
+	if err != nil {
+		fatal("could not load identity providers", err)
+	}
+	db := database.New()
+	authenticator, err := newAuthenticator(ctx, db)
+	if err != nil {
+		fatal("could not configure authentication", err)
+	}
+	// Mails are queued by the handlers and delivered in the background through the driver from MAIL_DRIVER
+	mailDriver, err := mail.FromEnv()
+	if err != nil {
+		fatal("could not configure mail", err)
+	}
+	go mail.NewWorker(db, mailDriver).Run(ctx)
+	if err := checkPublicURL(); err != nil {
+		fatal("could not configure mail links", err)
+	}
+	if err := checkIssuer(); err != nil {
+		fatal("could not configure the OpenID Connect issuer", err)
+	}
+	detector, err := newDetector()
+	if err != nil {
+		fatal("could not configure suspicious login detection", err)
+	}
+	passwordPolicy, err := security.PasswordPolicyFromEnv()
+	if err != nil {
+		fatal("could not configure password policy", err)
+	}
+	breachedPasswords, err := security.LoadBreachedPasswords(breachedPasswordsDir)
+	if err != nil {
+		fatal("could not load breached passwords", err)
+	}
+	cors, err := corsFromEnv()
+	if err != nil {
+		fatal("could not configure CORS", err)
+	}
+
 	NewServer := &Server{
 		port: port,
 
-		db: database.New(),
+		db: db,
+
+		idTokenKey: idTokenKey,
+
+		providers: providers,
+
+		authenticator: authenticator,
+
+		mailer: mail.Outbox{Store: db},
+
+		detector: detector,
+
+		cors: cors,
+
+		passwordPolicy:    passwordPolicy,
+		breachedPasswords: breachedPasswords,
 	}
 
 	// Declare Server config
@@ -35,7 +138,83 @@ func NewServer() *http.Server {
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		// Errors of net/http itself, like failed TLS handshakes, go to the structured log too
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
 	}
 
 	return server
 }
+
+// newAuthenticator chains the backends listed in AUTH_BACKENDS, "local" when unset. When LDAP is used and
+// LDAP_SYNC_INTERVAL is set, the group to role sync runs in the background until ctx is done.
+func newAuthenticator(ctx context.Context, db database.Service) (auth.Authenticator, error) {
+	backends := strings.Split(authBackends, ",")
+	if authBackends == "" {
+		backends = []string{"local"}
+	}
+
+	var chain auth.Chain
+	for _, backend := range backends {
+		switch strings.TrimSpace(backend) {
+		case "local":
+			chain = append(chain, auth.Local{DB: db})
+		case "ldap":
+			config, err := auth.LDAPConfigFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			if config == nil {
+				return nil, fmt.Errorf("AUTH_BACKENDS contains ldap but LDAP_URL is not set")
+			}
+			ldap := auth.NewLDAP(*config, db)
+			if config.SyncInterval > 0 {
+				go ldap.RunSync(ctx)
+			}
+			chain = append(chain, ldap)
+		default:
+			return nil, fmt.Errorf("unknown authentication backend %q", backend)
+		}
+	}
+	return chain, nil
+}
+
+// checkPublicURL makes sure every mail link has an address to point to: PUBLIC_URL, or a page for each mail
+func checkPublicURL() error {
+	if publicURL == "" {
+		if passwordResetURL == "" || emailVerificationURL == "" || invitationURL == "" {
+			return errors.New("PUBLIC_URL must be set to the address clients reach the API at")
+		}
+		return nil
+	}
+	if u, err := url.Parse(publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("PUBLIC_URL: %q is no absolute URL like https://api.example.com", publicURL)
+	}
+	return nil
+}
+
+// mailLink returns the link for a mail carrying token. It points to page if one is configured, to path on
+// publicURL otherwise.
+func mailLink(page string, path string, token string) (string, error) {
+	if page == "" {
+		if publicURL == "" {
+			return "", errors.New("PUBLIC_URL is not set, mail links can't be built")
+		}
+		page = strings.TrimSuffix(publicURL, "/") + path
+	}
+	return page + "?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// sendMail renders the named mail template in the user's locale, or the one the request prefers if they didn't
+// choose one, and sends it to the user's address
+func (s *Server) sendMail(r *http.Request, user *modals.User, template string, data interface{}) error {
+	locale := user.Locale
+	if locale == "" {
+		locale = r.Header.Get("Accept-Language")
+	}
+	msg, err := mail.Render(template, locale, data)
+	if err != nil {
+		return err
+	}
+	msg.To = user.Email
+	return s.mailer.Send(r.Context(), msg)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+const serviceAccountTokenTTL = 15 * time.Minute
+
+// clientCredentialsGrant issues an access token to a service account. The requested scope is a space separated
+// list of role names and must be a subset of the roles assigned to the account, no scope grants all of them.
+func (s *Server) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+    clientID, secret := clientCredentials(r)
+    account, err := s.db.GetServiceAccountByClientID(r.Context(), clientID)
+    if err != nil {
+        oauthError(w, http.StatusInternalServerError, "server_error", "Error querying database")
+        return
+    }
+    if account == nil || secret == "" || !secretMatches(secret, account.SecretHash) {
+        oauthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+        return
+    }
+
+    scopes := strings.Fields(r.PostForm.Get("scope"))
+    if len(scopes) == 0 {
+        scopes = account.Roles
+    }
+    for _, scope := range scopes {
+        if !slices.Contains(account.Roles, scope) {
+            oauthError(w, http.StatusBadRequest, "invalid_scope", "Scope "+scope+" is not granted to this service account")
+            return
+        }
+    }
+
+    now := time.Now()
+    accessClaims := jwt.MapClaims{
+        "typ":       tokenTypeAccess,
+        "sub":       account.ClientID,
+        "sub_type":  subjectTypeServiceAccount,
+        "client_id": account.ClientID,
+        "role":      scopes,
+        "exp":       now.Add(serviceAccountTokenTTL).Unix(),
+        "iat":       now.Unix(),
+    }
+    accessTokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims).SignedString([]byte(jwtKey))
+    if err != nil {
+        oauthError(w, http.StatusInternalServerError, "server_error", "Error generating access token")
+        return
+    }
+    tokensIssued.WithLabelValues("access", grantClientCredentials).Inc()
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "access_token": accessTokenString,
+        "token_type":   "Bearer",
+        "expires_in":   int(serviceAccountTokenTTL.Seconds()),
+        "scope":        strings.Join(scopes, " "),
+    })
+}
+
+type ServiceAccountRegisterRequest struct {
+    Name  string   `json:"name"`
+    Roles []string `json:"roles"`
+}
+
+func (req *ServiceAccountRegisterRequest) Normalize() {
+    req.Name = strings.TrimSpace(req.Name)
+}
+
+func (req *ServiceAccountRegisterRequest) Validate() []FieldError {
+    var fields fieldErrors
+    if fields.required("name", req.Name) {
+        fields.maxLength("name", req.Name, maxNameLength)
+    }
+    if len(req.Roles) == 0 {
+        fields.add("roles", "required", "roles are required")
+    }
+    for i, role := range req.Roles {
+        fields.roleName(fmt.Sprintf("roles[%d]", i), role)
+    }
+    return fields
+}
+
+// ServiceAccountRegisterHandler creates a service account with the given roles. The client_secret is only part of this response.
+func (s *Server) ServiceAccountRegisterHandler(w http.ResponseWriter, r *http.Request) {
+    var req ServiceAccountRegisterRequest
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+
+    secret := randomToken(32)
+    account := modals.ServiceAccount{
+        Name:       req.Name,
+        ClientID:   "sa_" + randomToken(16),
+        SecretHash: hashSecret(secret),
+        Roles:      req.Roles,
+    }
+    if err := s.db.CreateServiceAccount(r.Context(), &account); err != nil {
+        writeError(w, r, dbError(err, "Failed to register service account"))
+        return
+    }
+    slog.InfoContext(r.Context(), "registered service account", "actor", subjectFromContext(r.Context()), "client_id", account.ClientID)
+
+    response := serviceAccountResponse(account)
+    response["client_secret"] = secret
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/v1/service_accounts/"+url.PathEscape(account.ClientID))
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) ServiceAccountListHandler(w http.ResponseWriter, r *http.Request) {
+    accounts, err := s.db.ListServiceAccounts(r.Context())
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    response := []map[string]interface{}{}
+    for _, account := range accounts {
+        response = append(response, serviceAccountResponse(account))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// ServiceAccountHandler responds with one service account
+func (s *Server) ServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+    account, err := s.db.GetServiceAccountByClientID(r.Context(), mux.Vars(r)["client_id"])
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if account == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Service account not found")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(serviceAccountResponse(*account))
+}
+
+func (s *Server) ServiceAccountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+    clientID := mux.Vars(r)["client_id"]
+    deleted, err := s.db.DeleteServiceAccount(r.Context(), clientID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to delete service account"))
+        return
+    }
+    if !deleted {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Service account not found")
+        return
+    }
+    slog.InfoContext(r.Context(), "deleted service account", "actor", subjectFromContext(r.Context()), "client_id", clientID)
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func serviceAccountResponse(account modals.ServiceAccount) map[string]interface{} {
+    return map[string]interface{}{
+        "id":         account.ID,
+        "name":       account.Name,
+        "client_id":  account.ClientID,
+        "roles":      account.Roles,
+        "created_at": account.CreatedAt,
+    }
+}
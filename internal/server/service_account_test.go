@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+func TestClientCredentialsGrant(t *testing.T) {
+	db := newFakeDB()
+	db.serviceAccounts = append(db.serviceAccounts, modals.ServiceAccount{
+		ClientID:   "sa_ci",
+		SecretHash: hashSecret("s3cret"),
+		Roles:      []string{"standard", "reporting"},
+	})
+	_, server := newTestServer(t, db)
+
+	request := func(secret string, scope string) (*http.Response, map[string]interface{}) {
+		form := url.Values{"grant_type": {"client_credentials"}, "scope": {scope}}
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("sa_ci", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	if resp, _ := request("wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for a wrong secret; got %v", resp.Status)
+	}
+	if resp, _ := request("s3cret", "admin"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status Bad Request for a scope outside the account's roles; got %v", resp.Status)
+	}
+
+	resp, body := request("s3cret", "reporting")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v %v", resp.Status, body)
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(body["access_token"].(string), claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(jwtKey), nil
+	}); err != nil {
+		t.Fatalf("error parsing access token. Err: %v", err)
+	}
+	if claims["sub_type"] != subjectTypeServiceAccount || claims["sub"] != "sa_ci" {
+		t.Errorf("expected a service account subject; got %v", claims)
+	}
+	if roles := claims["role"].([]interface{}); len(roles) != 1 || roles[0] != "reporting" {
+		t.Errorf("expected only the requested role; got %v", roles)
+	}
+
+	// The token only works while the account exists, with the roles it still has
+	db.serviceAccounts[0].Roles = append(db.serviceAccounts[0].Roles, "admin")
+	_, body = request("s3cret", "admin")
+	accessToken := body["access_token"].(string)
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/service_accounts/sa_ci", accessToken, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the admin token to be accepted; got %v", resp.Status)
+	}
+	db.serviceAccounts[0].Roles = []string{"standard", "reporting"}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/service_accounts/sa_ci", accessToken, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the revoked role to stop working; got %v", resp.Status)
+	}
+	db.serviceAccounts = nil
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me/tokens", accessToken, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the token of a deleted account to be rejected; got %v", resp.Status)
+	}
+}
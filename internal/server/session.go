@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// sessionTTL is the lifetime of a session and of the refresh token issued with it
+const sessionTTL = 7 * 24 * time.Hour
+
+var (
+    // maxSessionsPerUser caps the active sessions of a user, a new login ends the least recently used ones.
+    // 0 or unset means no limit.
+    maxSessionsPerUser, _ = strconv.Atoi(os.Getenv("MAX_SESSIONS_PER_USER"))
+
+    // trustProxyHeaders takes the client IP from the last X-Forwarded-For entry, the one the proxy in front of the
+    // API appended. Only set it behind such a proxy, clients can send the header themselves.
+    trustProxyHeaders = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+)
+
+// startSession records a login of the user from the client making the request
+func (s *Server) startSession(r *http.Request, user *modals.User) (*modals.Session, error) {
+    if maxSessionsPerUser > 0 {
+        active, err := s.db.ListSessions(r.Context(), user.ID)
+        if err != nil {
+            return nil, err
+        }
+        // active is ordered most recently seen first, keep room for the new session
+        for i := maxSessionsPerUser - 1; i < len(active); i++ {
+            if _, err := s.db.RevokeSession(r.Context(), user.ID, active[i].ID); err != nil {
+                return nil, err
+            }
+            slog.InfoContext(r.Context(), "ended session over the limit", "session_id", active[i].ID, "username", user.Username, "max_sessions", maxSessionsPerUser)
+        }
+    }
+
+    now := time.Now()
+    session := &modals.Session{
+        UserID:     user.ID,
+        Username:   user.Username,
+        Device:     describeDevice(r.UserAgent()),
+        UserAgent:  r.UserAgent(),
+        IP:         clientIP(r),
+        CreatedAt:  now,
+        LastSeenAt: now,
+        ExpiresAt:  now.Add(sessionTTL),
+    }
+    if err := s.db.CreateSession(r.Context(), session); err != nil {
+        return nil, err
+    }
+    return session, nil
+}
+
+// sessionFromClaims returns the session id of an access or refresh token, 0 if it has none
+func sessionFromClaims(claims map[string]interface{}) int {
+    sid, _ := claims["sid"].(float64)
+    return int(sid)
+}
+
+// clientIP returns the address the request came from. Behind a trusted proxy that is the entry the proxy appended
+// to X-Forwarded-For, the entries before it come from the client and can say anything.
+func clientIP(r *http.Request) string {
+    if trustProxyHeaders {
+        if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+            entries := strings.Split(forwarded[len(forwarded)-1], ",")
+            if ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-1])); ip != nil {
+                return ip.String()
+            }
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// describeDevice names browser and operating system of a user agent for humans, like "Firefox on Linux"
+func describeDevice(userAgent string) string {
+    browser := ""
+    for _, candidate := range []struct{ token, name string }{
+        // Order matters, Edge and Opera also claim to be Chrome, and Chrome claims to be Safari
+        {"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+        {"curl/", "curl"},
+    } {
+        if strings.Contains(userAgent, candidate.token) {
+            browser = candidate.name
+            break
+        }
+    }
+    system := ""
+    for _, candidate := range []struct{ token, name string }{
+        {"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"},
+        {"Linux", "Linux"},
+    } {
+        if strings.Contains(userAgent, candidate.token) {
+            system = candidate.name
+            break
+        }
+    }
+
+    switch {
+    case browser != "" && system != "":
+        return browser + " on " + system
+    case browser != "":
+        return browser
+    case system != "":
+        return system
+    }
+    return "Unknown device"
+}
+
+// sessionView marks the session the request was made with
+type sessionView struct {
+    modals.Session
+    Current bool `json:"current"`
+}
+
+// MeSessionsHandler responds with the active sessions of the calling user and their personal access tokens,
+// the other credentials that can act for the user
+func (s *Server) MeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    sessions, err := s.db.ListSessions(r.Context(), user.ID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    tokens, err := s.db.ListPersonalAccessTokens(r.Context(), user.ID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+
+    current := sessionFromClaims(claimsFromContext(r.Context()))
+    views := []sessionView{}
+    for _, session := range sessions {
+        views = append(views, sessionView{Session: session, Current: session.ID == current})
+    }
+    personalAccessTokens := []map[string]interface{}{}
+    for _, token := range tokens {
+        personalAccessTokens = append(personalAccessTokens, personalAccessTokenResponse(token))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "sessions":               views,
+        "personal_access_tokens": personalAccessTokens,
+    })
+}
+
+// MeSessionRevokeHandler ends one session of the calling user, its refresh token stops working
+func (s *Server) MeSessionRevokeHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    revoked, err := s.db.RevokeSession(r.Context(), user.ID, id)
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to end session"))
+        return
+    }
+    if !revoked {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Session not found")
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// MeSessionsRevokeOthersHandler ends every session of the calling user except the one the request was made with
+func (s *Server) MeSessionsRevokeOthersHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    if err := s.db.RevokeUserSessions(r.Context(), user.ID, sessionFromClaims(claimsFromContext(r.Context()))); err != nil {
+        writeError(w, r, dbError(err, "Failed to end sessions"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionListHandler lets admins list the active sessions of all users, or of one with ?username=
+func (s *Server) SessionListHandler(w http.ResponseWriter, r *http.Request) {
+    userID := 0
+    if username := r.URL.Query().Get("username"); username != "" {
+        user, err := s.db.GetUserByUsername(r.Context(), username)
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return
+        }
+        if user == nil {
+            writeProblem(w, r, http.StatusNotFound, codeNotFound, "User not found")
+            return
+        }
+        userID = user.ID
+    }
+
+    sessions, err := s.db.ListSessions(r.Context(), userID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if sessions == nil {
+        sessions = []modals.Session{}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(sessions)
+}
+
+// SessionRevokeHandler lets admins end any session
+func (s *Server) SessionRevokeHandler(w http.ResponseWriter, r *http.Request) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    session, err := s.db.GetSession(r.Context(), id)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if session == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Session not found")
+        return
+    }
+
+    revoked, err := s.db.RevokeSession(r.Context(), session.UserID, session.ID)
+    if err != nil {
+        writeError(w, r, dbError(err, "Failed to end session"))
+        return
+    }
+    if !revoked {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "Session not found")
+        return
+    }
+    slog.InfoContext(r.Context(), "ended session", "actor", subjectFromContext(r.Context()), "session_id", session.ID, "username", session.Username)
+
+    w.WriteHeader(http.StatusNoContent)
+}
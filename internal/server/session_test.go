@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// login posts to /account with the given user agent
+func login(t *testing.T, serverURL string, username string, userAgent string) TokenResponse {
+	t.Helper()
+	body, _ := json.Marshal(LoginRequest{Username: username, Password: "password"})
+	req, _ := http.NewRequest(http.MethodPost, serverURL+"/account", bytes.NewReader(body))
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	defer resp.Body.Close()
+	var tokens TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatalf("error decoding response. Err: %v", err)
+	}
+	return tokens
+}
+
+func TestSessions(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	s, server := newTestServer(t, db)
+	s.authenticator = passwordAuthenticator{db}
+	maxSessionsPerUser = 2
+	t.Cleanup(func() { maxSessionsPerUser = 0 })
+
+	laptop := login(t, server.URL, "alice", "Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0")
+	phone := login(t, server.URL, "alice", "Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 Chrome/129.0 Mobile Safari/537.36")
+
+	var listed struct {
+		Sessions []sessionView `json:"sessions"`
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me/sessions", phone.AccessToken, nil, &listed); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if len(listed.Sessions) != 2 || listed.Sessions[0].Device != "Chrome on Android" || !listed.Sessions[0].Current ||
+		listed.Sessions[1].Device != "Firefox on Linux" || listed.Sessions[1].Current {
+		t.Fatalf("expected the phone (current) and laptop sessions; got %+v", listed.Sessions)
+	}
+
+	// Ending the laptop session stops its refresh token
+	target := fmt.Sprintf("%s/v1/me/sessions/%d", server.URL, listed.Sessions[1].ID)
+	if resp := doJSON(t, http.MethodDelete, target, phone.AccessToken, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status No Content; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", map[string]string{"refresh_token": laptop.RefreshToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the ended session's refresh token to be rejected; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", map[string]string{"refresh_token": phone.RefreshToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the phone's refresh token to work; got %v", resp.Status)
+	}
+
+	// With two sessions allowed, the third login ends the least recently used one
+	login(t, server.URL, "alice", "curl/8.5.0")
+	tablet := login(t, server.URL, "alice", "curl/8.5.0")
+	if resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", map[string]string{"refresh_token": phone.RefreshToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the oldest session to be ended by the session limit; got %v", resp.Status)
+	}
+
+	var all []modals.Session
+	admin := testAccessToken(t, db, "admin", "admin")
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/sessions?username=alice", admin, nil, &all); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if len(all) != 2 || all[0].Username != "alice" {
+		t.Fatalf("expected alice's two sessions; got %+v", all)
+	}
+	target = fmt.Sprintf("%s/v1/sessions/%d", server.URL, all[0].ID)
+	if resp := doJSON(t, http.MethodDelete, target, admin, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status No Content; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", map[string]string{"refresh_token": tablet.RefreshToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the session ended by the admin to be rejected; got %v", resp.Status)
+	}
+}
+
+func TestOnlyLiveAccessTokensAuthenticate(t *testing.T) {
+	db := newFakeDB()
+	alice := db.addUser("alice", "alice@example.com", "standard")
+	s, server := newTestServer(t, db)
+	s.authenticator = passwordAuthenticator{db}
+
+	tokens := login(t, server.URL, "alice", "curl/8.5.0")
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", tokens.AccessToken, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the access token to work; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", tokens.RefreshToken, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token to be rejected as bearer token; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/v1/tokens/refresh", "", map[string]string{"refresh_token": tokens.AccessToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be rejected as refresh token; got %v", resp.Status)
+	}
+
+	// A password reset moves tokens_valid_after past the token's issue time
+	now, later := time.Now(), time.Now().Add(time.Second)
+	db.users[alice.ID-1].TokensValidAfter = &later
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", tokens.AccessToken, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected access tokens issued before tokens_valid_after to be rejected; got %v", resp.Status)
+	}
+	db.users[alice.ID-1].TokensValidAfter = nil
+
+	db.sessions[len(db.sessions)-1].RevokedAt = &now
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", tokens.AccessToken, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the access token of an ended session to be rejected; got %v", resp.Status)
+	}
+
+	token := testAccessToken(t, db, "alice", "standard")
+	db.users[alice.ID-1].Status = modals.UserStatusDisabled
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/me", token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the access token of a disabled user to be rejected; got %v", resp.Status)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trustProxyHeaders = true
+	t.Cleanup(func() { trustProxyHeaders = false })
+
+	for _, tc := range []struct {
+		forwarded []string
+		want      string
+	}{
+		{nil, "192.0.2.1"},
+		{[]string{"203.0.113.7"}, "203.0.113.7"},
+		{[]string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{[]string{"198.51.100.1", "2001:db8::7"}, "2001:db8::7"},
+		{[]string{"203.0.113.7, " + strings.Repeat("x", 64)}, "192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:4711"
+		for _, value := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := clientIP(r); ip != tc.want {
+			t.Errorf("expected %s for %q; got %s", tc.want, tc.forwarded, ip)
+		}
+	}
+}
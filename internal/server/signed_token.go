@@ -0,0 +1,32 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// newSignedToken returns a token to mail to a user together with the hash to store. The token carries an HMAC
+// over its random part and purpose, so forged tokens or tokens meant for another flow are rejected before the
+// database is asked.
+func newSignedToken(purpose string) (string, string) {
+    random := randomToken(32)
+    token := random + "." + signTokenPart(purpose, random)
+    return token, hashSecret(token)
+}
+
+// verifySignedToken checks the signature of a token made by newSignedToken and returns the hash to look up
+func verifySignedToken(purpose string, token string) (string, bool) {
+    random, signature, ok := strings.Cut(token, ".")
+    if !ok || !hmac.Equal([]byte(signature), []byte(signTokenPart(purpose, random))) {
+        return "", false
+    }
+    return hashSecret(token), true
+}
+
+func signTokenPart(purpose string, random string) string {
+    mac := hmac.New(sha256.New, []byte(jwtKey))
+    mac.Write([]byte(purpose + ":" + random))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
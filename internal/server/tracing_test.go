@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"jjr-tec-backend/internal/logging"
+	"jjr-tec-backend/internal/tracing"
+)
+
+func TestRequestSpans(t *testing.T) {
+	spans, restore := tracing.InMemory()
+	t.Cleanup(restore)
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(logging.New(&out, true, slog.LevelInfo))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	_, server := newTestServer(t, db)
+	admin := testAccessToken(t, db, "admin", "admin")
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/v1/users/alice/status", strings.NewReader(`{"status":"disabled"}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	ended := spans.GetSpans()
+	if len(ended) != 1 {
+		t.Fatalf("expected one span for the request; got %d", len(ended))
+	}
+	span := ended[0]
+	if span.Name != "PUT /v1/users/{username}/status" {
+		t.Errorf("expected the span to be named after the route template; got %q", span.Name)
+	}
+	if span.SpanContext.TraceID().String() != traceID || span.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the span to continue the trace of the traceparent header; got trace %s parent %s",
+			span.SpanContext.TraceID(), span.Parent.SpanID())
+	}
+	var route string
+	for _, attr := range span.Attributes {
+		if attr.Key == attribute.Key("http.route") {
+			route = attr.Value.AsString()
+		}
+	}
+	if route != "/v1/users/{username}/status" {
+		t.Errorf("expected the http.route attribute; got %v", span.Attributes)
+	}
+
+	var logged bool
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected JSON log lines; got %q", line)
+		}
+		if entry["msg"] == "set user status" {
+			logged = entry["trace_id"] == traceID && entry["span_id"] == span.SpanContext.SpanID().String()
+		}
+	}
+	if !logged {
+		t.Errorf("expected the audit line to carry the trace and span ID; got %s", out.String())
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+// attributeSchemaURL names the admin-defined schema inside the compiler, it is never fetched
+const attributeSchemaURL = "urn:jjr-tec:user-attributes"
+
+// compileAttributeSchema compiles a JSON Schema (draft 2020-12 unless $schema says otherwise). Schemas can't
+// $ref anything outside themselves, so saving one can't make the backend read files or fetch URLs.
+func compileAttributeSchema(document json.RawMessage) (*jsonschema.Schema, error) {
+    doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(document))
+    if err != nil {
+        return nil, err
+    }
+    compiler := jsonschema.NewCompiler()
+    compiler.UseLoader(jsonschema.SchemeURLLoader{})
+    compiler.AssertFormat()
+    if err := compiler.AddResource(attributeSchemaURL, doc); err != nil {
+        return nil, err
+    }
+    return compiler.Compile(attributeSchemaURL)
+}
+
+// validateAttributes checks attributes against the admin-defined schema, any object is valid while there is none.
+// Errors of type *jsonschema.ValidationError describe what doesn't match, others are internal.
+func (s *Server) validateAttributes(ctx context.Context, attributes map[string]interface{}) error {
+    stored, err := s.db.GetAttributeSchema(ctx)
+    if err != nil || stored == nil {
+        return err
+    }
+    schema, err := compileAttributeSchema(stored.Schema)
+    if err != nil {
+        return err
+    }
+
+    // Round trip through the validator's own decoding, so numbers are compared exactly
+    data, err := json.Marshal(attributes)
+    if err != nil {
+        return err
+    }
+    instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+    if err != nil {
+        return err
+    }
+    return schema.Validate(instance)
+}
+
+// attributeClaims picks the attributes listed in the schema's claim_attributes for access tokens,
+// it returns nil if none are configured or the user has none of them
+func (s *Server) attributeClaims(ctx context.Context, user *modals.User) map[string]interface{} {
+    stored, err := s.db.GetAttributeSchema(ctx)
+    if err != nil {
+        slog.ErrorContext(ctx, "loading attribute schema failed", "error", err)
+        return nil
+    }
+    if stored == nil {
+        return nil
+    }
+    var claims map[string]interface{}
+    for _, name := range stored.ClaimAttributes {
+        if value, ok := user.Attributes[name]; ok {
+            if claims == nil {
+                claims = map[string]interface{}{}
+            }
+            claims[name] = value
+        }
+    }
+    return claims
+}
+
+// AttributeSchemaHandler responds with the attribute schema, 404 while admins haven't defined one
+func (s *Server) AttributeSchemaHandler(w http.ResponseWriter, r *http.Request) {
+    schema, err := s.db.GetAttributeSchema(r.Context())
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if schema == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "No attribute schema defined")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(schema)
+}
+
+// AttributeSchemaUpdateHandler replaces the attribute schema. Attributes users already have aren't revalidated,
+// the schema applies to the next write of each user.
+func (s *Server) AttributeSchemaUpdateHandler(w http.ResponseWriter, r *http.Request) {
+    var req modals.AttributeSchema
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    if len(req.Schema) == 0 {
+        writeValidationProblem(w, r, FieldError{Field: "schema", Code: "required", Message: "schema is required"})
+        return
+    }
+    if _, err := compileAttributeSchema(req.Schema); err != nil {
+        writeValidationProblem(w, r, FieldError{Field: "schema", Code: "invalid", Message: "Invalid schema: " + err.Error()})
+        return
+    }
+
+    req.UpdatedAt = time.Now()
+    if err := s.db.SaveAttributeSchema(r.Context(), &req); err != nil {
+        writeError(w, r, dbError(err, "Failed to save schema"))
+        return
+    }
+    slog.InfoContext(r.Context(), "updated the user attribute schema", "actor", subjectFromContext(r.Context()))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(req)
+}
+
+// UserAttributesUpdateHandler lets admins replace the attributes of a user
+func (s *Server) UserAttributesUpdateHandler(w http.ResponseWriter, r *http.Request) {
+    username := mux.Vars(r)["username"]
+    user, err := s.db.GetUserByUsername(r.Context(), username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if user == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "User not found")
+        return
+    }
+    if s.updateAttributes(w, r, user, false) {
+        slog.InfoContext(r.Context(), "updated user attributes", "actor", subjectFromContext(r.Context()), "username", username)
+    }
+}
+
+// MeAttributesUpdateHandler replaces the attributes of the calling user. Attributes can end up in access tokens,
+// so users only change those the schema lists in user_editable_attributes, the others have to stay as they are.
+func (s *Server) MeAttributesUpdateHandler(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.currentUser(w, r)
+    if !ok {
+        return
+    }
+    s.updateAttributes(w, r, user, true)
+}
+
+// updateAttributes validates the attributes object in the body, stores it for the user and responds with the user.
+// For selfService writes, attributes that aren't user-editable must keep their current values.
+func (s *Server) updateAttributes(w http.ResponseWriter, r *http.Request, user *modals.User, selfService bool) bool {
+    var attributes map[string]interface{}
+    if !decodeJSON(w, r, &attributes) {
+        return false
+    }
+    if attributes == nil {
+        writeProblem(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload, expected a JSON object")
+        return false
+    }
+    if selfService {
+        stored, err := s.db.GetAttributeSchema(r.Context())
+        if err != nil {
+            writeError(w, r, dbError(err, "Error querying database"))
+            return false
+        }
+        if fields := readOnlyAttributeChanges(stored, user.Attributes, attributes); len(fields) > 0 {
+            writeValidationProblem(w, r, fields...)
+            return false
+        }
+    }
+
+    var invalid *jsonschema.ValidationError
+    if err := s.validateAttributes(r.Context(), attributes); errors.As(err, &invalid) {
+        writeValidationProblem(w, r, attributeFieldErrors(invalid)...)
+        return false
+    } else if err != nil {
+        slog.ErrorContext(r.Context(), "validating attributes failed", "error", err)
+        writeProblem(w, r, http.StatusInternalServerError, codeInternalError, "Error validating attributes")
+        return false
+    }
+
+    if err := s.db.UpdateUserAttributes(r.Context(), user.ID, attributes); err != nil {
+        writeError(w, r, dbError(err, "Failed to update attributes"))
+        return false
+    }
+    user.Attributes = attributes
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+    return true
+}
+
+// readOnlyAttributeChanges lists the attributes requested adds, changes or removes compared to current although the
+// schema doesn't mark them user-editable. Without a schema no attribute is.
+func readOnlyAttributeChanges(schema *modals.AttributeSchema, current map[string]interface{}, requested map[string]interface{}) []FieldError {
+    var editable []string
+    if schema != nil {
+        editable = schema.UserEditableAttributes
+    }
+    var names []string
+    for name, value := range requested {
+        if old, ok := current[name]; !ok || !reflect.DeepEqual(old, value) {
+            names = append(names, name)
+        }
+    }
+    for name := range current {
+        if _, ok := requested[name]; !ok {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    var fields []FieldError
+    for _, name := range names {
+        if !slices.Contains(editable, name) {
+            fields = append(fields, FieldError{Field: "attributes/" + name, Code: "read_only", Message: name + " can only be changed by an administrator"})
+        }
+    }
+    return fields
+}
+
+// attributeFieldErrors turns the schema violations into one field error per offending attribute, the field is
+// "attributes" followed by the JSON pointer of the value, like "attributes/department"
+func attributeFieldErrors(invalid *jsonschema.ValidationError) []FieldError {
+    var fields []FieldError
+    for _, unit := range invalid.BasicOutput().Errors {
+        if unit.Error == nil || unit.KeywordLocation == "" {
+            continue
+        }
+        fields = append(fields, FieldError{Field: "attributes" + unit.InstanceLocation, Code: "schema", Message: unit.Error.String()})
+    }
+    if fields == nil {
+        fields = []FieldError{{Field: "attributes", Code: "schema", Message: "Attributes don't match the schema: " + invalid.Error()}}
+    }
+    return fields
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"jjr-tec-backend/internal/modals"
+)
+
+func TestUserAttributes(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	db.addUser("bob", "bob@example.com", "standard")
+	s, server := newTestServer(t, db)
+	s.authenticator = passwordAuthenticator{db}
+	admin := testAccessToken(t, db, "admin", "admin")
+
+	invalidSchema := modals.AttributeSchema{Schema: json.RawMessage(`{"type": "object", "properties": {"a": {"$ref": "file:///etc/passwd"}}}`)}
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/users/attribute_schema", admin, invalidSchema, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a schema referencing a file to be rejected; got %v", resp.Status)
+	}
+	schema := modals.AttributeSchema{
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"department": {"enum": ["sales", "engineering"]},
+				"cost_center": {"type": "integer"}
+			},
+			"additionalProperties": false
+		}`),
+		ClaimAttributes:        []string{"department"},
+		UserEditableAttributes: []string{"cost_center"},
+	}
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/users/attribute_schema", admin, schema, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/users/alice/attributes", admin, map[string]interface{}{"department": "marketing"}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected attributes not matching the schema to be rejected; got %v", resp.Status)
+	}
+	attributes := map[string]interface{}{"department": "sales", "cost_center": 4711}
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/users/alice/attributes", admin, attributes, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	bob := testAccessToken(t, db, "bob", "standard")
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/me/attributes", bob, map[string]interface{}{"cost_center": 12}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+
+	// The department goes into access tokens, users can't set it for themselves, nor drop the one an admin set
+	var problem Problem
+	resp := doJSON(t, http.MethodPut, server.URL+"/v1/me/attributes", bob, map[string]interface{}{"department": "sales", "cost_center": 12}, &problem)
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(problem.Errors) != 1 || problem.Errors[0].Field != "attributes/department" {
+		t.Errorf("expected the department to be read-only for bob; got %v %+v", resp.Status, problem)
+	}
+	alice := testAccessToken(t, db, "alice", "standard")
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/me/attributes", alice, map[string]interface{}{"cost_center": 1}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected alice not to be able to drop her department; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/me/attributes", alice, map[string]interface{}{"department": "sales", "cost_center": 1}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected alice to change her cost center, keeping the department; got %v", resp.Status)
+	}
+
+	var users []modals.User
+	target := server.URL + "/v1/users?" + url.Values{"attributes": {`{"department":"sales"}`}}.Encode()
+	if resp := doJSON(t, http.MethodGet, target, admin, nil, &users); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if len(users) != 1 || users[0].Username != "alice" {
+		t.Errorf("expected only alice to be in sales; got %+v", users)
+	}
+
+	// Only the configured attributes end up in access tokens
+	var tokens TokenResponse
+	doJSON(t, http.MethodPost, server.URL+"/account", "", LoginRequest{Username: "alice", Password: "password"}, &tokens)
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokens.AccessToken, claims, func(*jwt.Token) (interface{}, error) { return []byte(jwtKey), nil }); err != nil {
+		t.Fatalf("error parsing access token. Err: %v", err)
+	}
+	projected, _ := claims["attributes"].(map[string]interface{})
+	if len(projected) != 1 || projected["department"] != "sales" {
+		t.Errorf("expected only the department claim; got %v", claims["attributes"])
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"jjr-tec-backend/internal/database"
+	"jjr-tec-backend/internal/modals"
+)
+
+const (
+    defaultUserListLimit = 50
+    maxUserListLimit     = 200
+)
+
+// UserListHandler lists users ordered by username. Query parameters: status, attributes (a JSON object the
+// user's attributes must contain, like {"department":"sales"}), limit (default 50, at most 200) and offset.
+func (s *Server) UserListHandler(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    filter := modals.UserFilter{Status: query.Get("status"), Limit: defaultUserListLimit}
+
+    if filter.Status != "" && !modals.ValidUserStatus(filter.Status) {
+        writeValidationProblem(w, r, FieldError{Field: "status", Code: "invalid", Message: "status must be active, disabled, locked or pending"})
+        return
+    }
+    if attributes := query.Get("attributes"); attributes != "" {
+        if err := json.Unmarshal([]byte(attributes), &filter.Attributes); err != nil {
+            writeValidationProblem(w, r, FieldError{Field: "attributes", Code: "invalid", Message: "attributes must be a JSON object"})
+            return
+        }
+    }
+    if limit := query.Get("limit"); limit != "" {
+        n, err := strconv.Atoi(limit)
+        if err != nil || n < 1 || n > maxUserListLimit {
+            writeValidationProblem(w, r, FieldError{Field: "limit", Code: "out_of_range", Message: "limit must be between 1 and 200"})
+            return
+        }
+        filter.Limit = n
+    }
+    if offset := query.Get("offset"); offset != "" {
+        n, err := strconv.Atoi(offset)
+        if err != nil || n < 0 {
+            writeValidationProblem(w, r, FieldError{Field: "offset", Code: "out_of_range", Message: "offset must not be negative"})
+            return
+        }
+        filter.Offset = n
+    }
+
+    users, err := s.db.ListUsers(r.Context(), filter)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if users == nil {
+        users = []modals.User{}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(users)
+}
+
+// UserStatusHandler lets admins set the status of a user. Users that aren't active can't log in or use their
+// personal access tokens and their sessions end, access tokens they already hold run out within a minute.
+func (s *Server) UserStatusHandler(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Status string `json:"status"`
+    }
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    if !modals.ValidUserStatus(req.Status) {
+        writeValidationProblem(w, r, FieldError{Field: "status", Code: "invalid", Message: "status must be active, disabled, locked or pending"})
+        return
+    }
+
+    username := mux.Vars(r)["username"]
+    user, err := s.db.GetUserByUsername(r.Context(), username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if user == nil {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "User not found")
+        return
+    }
+
+    if _, err := s.db.SetUserStatus(r.Context(), user.ID, req.Status); err != nil {
+        writeError(w, r, dbError(err, "Failed to set status"))
+        return
+    }
+    if req.Status != modals.UserStatusActive {
+        if err := s.db.RevokeUserSessions(r.Context(), user.ID, 0); err != nil {
+            writeError(w, r, dbError(err, "Failed to end sessions"))
+            return
+        }
+    }
+    slog.InfoContext(r.Context(), "set user status", "actor", subjectFromContext(r.Context()), "username", username, "status", req.Status)
+
+    user.Status = req.Status
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+}
+
+// UserCreateHandler registers a user like POST /protected/account_register and responds with it, Location
+// points to the new user
+func (s *Server) UserCreateHandler(w http.ResponseWriter, r *http.Request) {
+    user := s.registerUser(w, r)
+    if user == nil {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/v1/users/"+url.PathEscape(user.Username))
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(user)
+}
+
+// UserHandler responds with the user named in the path
+func (s *Server) UserHandler(w http.ResponseWriter, r *http.Request) {
+    user := s.userFromPath(w, r)
+    if user == nil {
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+}
+
+// UserRolesHandler responds with the role names of the user named in the path
+func (s *Server) UserRolesHandler(w http.ResponseWriter, r *http.Request) {
+    user := s.userFromPath(w, r)
+    if user == nil {
+        return
+    }
+    roles, err := s.db.GetRolesByUsername(r.Context(), user.Username)
+    if err != nil {
+        writeError(w, r, dbError(err, "Error querying database"))
+        return
+    }
+    if roles == nil {
+        roles = []string{}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(roles)
+}
+
+// UserRoleAssignHandler gives the user in the path the role in the path. It answers 201 with the assignment as
+// Location if the user didn't have the role and 204 if they did, so repeating the request is harmless.
+func (s *Server) UserRoleAssignHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    err := s.db.AssignRoleToUser(r.Context(), vars["username"], vars["role_name"])
+    switch {
+    case errors.Is(err, database.ErrConflict):
+        w.WriteHeader(http.StatusNoContent)
+        return
+    case errors.Is(err, database.ErrNotFound):
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "User or role not found")
+        return
+    case err != nil:
+        writeError(w, r, dbError(err, "Failed to assign role"))
+        return
+    }
+    slog.InfoContext(r.Context(), "assigned role", "actor", subjectFromContext(r.Context()), "role", vars["role_name"], "username", vars["username"])
+
+    w.Header().Set("Location", "/v1/users/"+url.PathEscape(vars["username"])+"/roles/"+url.PathEscape(vars["role_name"]))
+    w.WriteHeader(http.StatusCreated)
+}
+
+// UserRoleRemoveHandler takes the role in the path from the user in the path
+func (s *Server) UserRoleRemoveHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    err := s.db.RemoveRoleFromUser(r.Context(), vars["username"], vars["role_name"])
+    if errors.Is(err, database.ErrNotFound) {
+        writeProblem(w, r, http.StatusNotFound, codeNotFound, "User doesn't have this role")
+        return
+    } else if err != nil {
+        writeError(w, r, dbError(err, "Failed to remove role"))
+        return
+    }
+    slog.InfoContext(r.Context(), "removed role", "actor", subjectFromContext(r.Context()), "role", vars["role_name"], "username", vars["username"])
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"jjr-tec-backend/internal/auth"
+	"jjr-tec-backend/internal/modals"
+)
+
+// passwordAuthenticator accepts "password" for every user of the fakeDB
+type passwordAuthenticator struct {
+	db *fakeDB
+}
+
+func (a passwordAuthenticator) Authenticate(ctx context.Context, username string, password string) (*modals.User, error) {
+	user, _ := a.db.GetUserByUsername(ctx, username)
+	if user == nil || password != "password" {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+func TestUserStatusBlocksLogin(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	s, server := newTestServer(t, db)
+	s.authenticator = passwordAuthenticator{db}
+
+	var tokens TokenResponse
+	login := LoginRequest{Username: "alice", Password: "password"}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/account", "", login, &tokens); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if db.users[1].LastLoginAt == nil {
+		t.Errorf("expected last_login_at to be recorded")
+	}
+
+	target := server.URL + "/v1/users/alice/status"
+	if resp := doJSON(t, http.MethodPut, target, testAccessToken(t, db, "alice", "standard"), map[string]string{"status": "active"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected non-admins to be forbidden; got %v", resp.Status)
+	}
+	admin := testAccessToken(t, db, "admin", "admin")
+	if resp := doJSON(t, http.MethodPut, target, admin, map[string]string{"status": "gone"}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected an unknown status to be rejected; got %v", resp.Status)
+	}
+	var user modals.User
+	if resp := doJSON(t, http.MethodPut, target, admin, map[string]string{"status": "disabled"}, &user); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if user.Status != modals.UserStatusDisabled || user.Username != "alice" {
+		t.Errorf("expected alice to be disabled; got %+v", user)
+	}
+
+	if resp := doJSON(t, http.MethodPost, server.URL+"/account", "", login, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a disabled user's login to be forbidden; got %v", resp.Status)
+	}
+	refresh := map[string]string{"refresh_token": tokens.RefreshToken}
+	if resp := doJSON(t, http.MethodPost, server.URL+"/refresh", "", refresh, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a disabled user's refresh token to be rejected; got %v", resp.Status)
+	}
+}
+
+func TestUserAndRoleConflicts(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	_, server := newTestServer(t, db)
+	admin := testAccessToken(t, db, "admin", "admin")
+
+	var problem Problem
+	resp := doJSON(t, http.MethodPost, server.URL+"/protected/account_register", admin,
+		AccountRegisterRequest{Username: "alice", Password: "pw"}, &problem)
+	if resp.StatusCode != http.StatusConflict || problem.Code != codeConflict {
+		t.Errorf("expected a taken username to conflict; got %v %+v", resp.Status, problem)
+	}
+
+	problem = Problem{}
+	resp = doJSON(t, http.MethodPost, server.URL+"/protected/roles", admin, RolesAssignment{Username: "nobody", Role_Name: "standard"}, &problem)
+	if resp.StatusCode != http.StatusNotFound || problem.Code != codeNotFound {
+		t.Errorf("expected assigning a role to an unknown user to be not found; got %v %+v", resp.Status, problem)
+	}
+
+	problem = Problem{}
+	resp = doJSON(t, http.MethodPost, server.URL+"/protected/roles", admin, RolesAssignment{Username: "alice", Role_Name: "standard"}, &problem)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected assigning a role twice to conflict; got %v %+v", resp.Status, problem)
+	}
+}
+
+func TestV1UsersAndRoleAssignments(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	db.addUser("alice", "alice@example.com", "standard")
+	s, server := newTestServer(t, db)
+	s.mailer = &fakeMailer{}
+	admin := testAccessToken(t, db, "admin", "admin")
+
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/users/alice", testAccessToken(t, db, "alice", "standard"), nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected non-admins to be forbidden; got %v", resp.Status)
+	}
+
+	resp := doJSON(t, http.MethodPost, server.URL+"/v1/users", admin,
+		AccountRegisterRequest{Username: "frank", Email: "frank@example.com", Password: "pw"}, nil)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/v1/users/frank" {
+		t.Fatalf("expected status Created with the user's location; got %v %q", resp.Status, resp.Header.Get("Location"))
+	}
+	var user modals.User
+	if resp := doJSON(t, http.MethodGet, server.URL+resp.Header.Get("Location"), admin, nil, &user); resp.StatusCode != http.StatusOK || user.Username != "frank" {
+		t.Errorf("expected the created user at its location; got %v %+v", resp.Status, user)
+	}
+	if resp.Header.Get("Deprecation") != "" {
+		t.Errorf("expected /v1 routes not to be deprecated")
+	}
+
+	resp = doJSON(t, http.MethodPost, server.URL+"/v1/roles", admin, RolesRegisterRequest{Role_Name: "editor"}, nil)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/v1/roles/editor" {
+		t.Fatalf("expected status Created with the role's location; got %v %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if resp := doJSON(t, http.MethodGet, server.URL+"/v1/roles/nobody", admin, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown role to be not found; got %v", resp.Status)
+	}
+
+	target := server.URL + "/v1/users/frank/roles/editor"
+	if resp := doJSON(t, http.MethodPut, target, admin, nil, nil); resp.StatusCode != http.StatusCreated ||
+		resp.Header.Get("Location") != "/v1/users/frank/roles/editor" {
+		t.Errorf("expected status Created pointing to the assignment; got %v %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if resp := doJSON(t, http.MethodPut, target, admin, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected assigning the role again to answer No Content; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodPut, server.URL+"/v1/users/nobody/roles/editor", admin, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown user to be not found; got %v", resp.Status)
+	}
+	var roles []string
+	if doJSON(t, http.MethodGet, server.URL+"/v1/users/frank/roles", admin, nil, &roles); len(roles) != 1 || roles[0] != "editor" {
+		t.Errorf("expected frank to have the editor role; got %v", roles)
+	}
+	if resp := doJSON(t, http.MethodDelete, target, admin, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status No Content; got %v", resp.Status)
+	}
+	if resp := doJSON(t, http.MethodDelete, target, admin, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected removing a role the user doesn't have to be not found; got %v", resp.Status)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxRequestBodyBytes caps JSON bodies, the largest legitimate ones are attribute schemas
+const maxRequestBodyBytes = 1 << 20
+
+// Column sizes the validation keeps requests within
+const (
+    maxUsernameLength = 50
+    maxEmailLength    = 255
+    maxRoleNameLength = 50
+    maxNameLength     = 50
+    // maxClientNameLength and maxTokenNameLength are for names only shown to people
+    maxClientNameLength = 100
+    maxTokenNameLength  = 100
+)
+
+var (
+    // usernamePattern keeps usernames usable in URLs, LDAP filters and log lines
+    usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+    // roleNamePattern leaves out whitespace since role names are joined with spaces into scopes
+    roleNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+)
+
+// validator is implemented by request types that check their own fields, see decodeJSON
+type validator interface {
+    Validate() []FieldError
+}
+
+// normalizer is implemented by request types that clean up their fields before they are validated
+type normalizer interface {
+    Normalize()
+}
+
+// decodeJSON reads the body into dst, rejecting bodies over maxRequestBodyBytes, unknown fields and trailing data.
+// It then normalizes and validates dst if it implements normalizer or validator and responds with 422 listing every
+// failing field. On failure it has already written the response.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+    decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+    decoder.DisallowUnknownFields()
+
+    err := decoder.Decode(dst)
+    if err == nil {
+        // Decode stops after the value, anything but whitespace behind it is an error
+        if _, extra := decoder.Token(); extra != io.EOF {
+            err = errors.New("trailing data after the JSON value")
+        }
+    }
+    if err != nil {
+        writeError(w, r, decodeError(err))
+        return false
+    }
+
+    if n, ok := dst.(normalizer); ok {
+        n.Normalize()
+    }
+    if v, ok := dst.(validator); ok {
+        if fields := v.Validate(); len(fields) > 0 {
+            writeValidationProblem(w, r, fields...)
+            return false
+        }
+    }
+    return true
+}
+
+// decodeError describes why a body couldn't be decoded, naming the field where the decoder knows it
+func decodeError(err error) *APIError {
+    var tooLarge *http.MaxBytesError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case errors.As(err, &tooLarge):
+        return &APIError{Status: http.StatusRequestEntityTooLarge, Code: "payload_too_large",
+            Detail: fmt.Sprintf("Request body must not exceed %d bytes", tooLarge.Limit)}
+    case errors.As(err, &typeErr) && typeErr.Field != "":
+        return validationError(FieldError{Field: typeErr.Field, Code: "invalid_type", Message: typeErr.Field + " must be a " + jsonTypeName(typeErr.Type.Kind().String())})
+    case strings.HasPrefix(err.Error(), "json: unknown field "):
+        field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+        return validationError(FieldError{Field: field, Code: "unknown_field", Message: field + " is not a known field"})
+    case errors.Is(err, io.EOF):
+        return &APIError{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Request body is empty"}
+    }
+    return &APIError{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: " + err.Error()}
+}
+
+func jsonTypeName(kind string) string {
+    switch kind {
+    case "string":
+        return "string"
+    case "bool":
+        return "boolean"
+    case "slice", "array":
+        return "list"
+    case "map", "struct":
+        return "object"
+    }
+    return "number"
+}
+
+// fieldErrors collects the failures of a Validate method, the checks return whether the field passed
+type fieldErrors []FieldError
+
+func (f *fieldErrors) add(field string, code string, message string) bool {
+    *f = append(*f, FieldError{Field: field, Code: code, Message: message})
+    return false
+}
+
+func (f *fieldErrors) required(field string, value string) bool {
+    if value == "" {
+        return f.add(field, "required", field+" is required")
+    }
+    return true
+}
+
+func (f *fieldErrors) maxLength(field string, value string, max int) bool {
+    if utf8.RuneCountInString(value) > max {
+        return f.add(field, "too_long", fmt.Sprintf("%s must be at most %d characters long", field, max))
+    }
+    return true
+}
+
+func (f *fieldErrors) username(field string, value string) bool {
+    if !f.required(field, value) || !f.maxLength(field, value, maxUsernameLength) {
+        return false
+    }
+    if !usernamePattern.MatchString(value) {
+        return f.add(field, "invalid", field+" may only contain letters, digits, '.', '_' and '-' and must start with a letter or digit")
+    }
+    return true
+}
+
+// email checks an address normalized by normalizeEmail, an empty one passes unless it is required
+func (f *fieldErrors) email(field string, value string, required bool) bool {
+    if value == "" {
+        return !required || f.required(field, value)
+    }
+    if !f.maxLength(field, value, maxEmailLength) {
+        return false
+    }
+    if address, err := netmail.ParseAddress(value); err != nil || address.Address != value {
+        return f.add(field, "invalid", field+" is not a valid address")
+    }
+    return true
+}
+
+func (f *fieldErrors) roleName(field string, value string) bool {
+    if !f.required(field, value) || !f.maxLength(field, value, maxRoleNameLength) {
+        return false
+    }
+    if !roleNamePattern.MatchString(value) {
+        return f.add(field, "invalid", field+" may only contain letters, digits, '.', '_', ':' and '-'")
+    }
+    return true
+}
+
+func (f *fieldErrors) locale(field string, value string) bool {
+    if _, err := language.Parse(value); value != "" && err != nil {
+        return f.add(field, "invalid", field+" is not a valid language tag")
+    }
+    return true
+}
+
+func (f *fieldErrors) timezone(field string, value string) bool {
+    // "Local" would be the server's zone, which means nothing to the user
+    if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+        return f.add(field, "invalid", field+" is not a valid IANA time zone")
+    }
+    return true
+}
+
+// normalizeUsername trims the username and brings it into Unicode NFC, so visually equal names compare equal.
+// Case is kept, usernames are matched exactly.
+func normalizeUsername(username string) string {
+    return norm.NFC.String(strings.TrimSpace(username))
+}
+
+// normalizeEmail trims the address and lowercases its domain, which is case-insensitive. The local part is left
+// alone since mail servers may treat it case-sensitively.
+func normalizeEmail(email string) string {
+    email = strings.TrimSpace(email)
+    if at := strings.LastIndex(email, "@"); at >= 0 {
+        email = email[:at] + strings.ToLower(email[at:])
+    }
+    return email
+}
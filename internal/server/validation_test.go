@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRequestValidation(t *testing.T) {
+	db := newFakeDB()
+	db.addUser("admin", "admin@example.com", "admin")
+	s, server := newTestServer(t, db)
+	s.mailer = &fakeMailer{}
+	admin := testAccessToken(t, db, "admin", "admin")
+	target := server.URL + "/protected/account_register"
+
+	var problem Problem
+	resp := doJSON(t, http.MethodPost, target, admin,
+		map[string]string{"username": "frank", "password": "pw", "is_admin": "yes"}, &problem)
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(problem.Errors) != 1 || problem.Errors[0].Field != "is_admin" {
+		t.Errorf("expected the unknown field to be rejected; got %v %+v", resp.Status, problem)
+	}
+
+	problem = Problem{}
+	resp = doJSON(t, http.MethodPost, target, admin,
+		AccountRegisterRequest{Username: "frank smith", Email: "frank@", Password: ""}, &problem)
+	fields := map[string]bool{}
+	for _, field := range problem.Errors {
+		fields[field.Field] = true
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity || !fields["username"] || !fields["email"] || !fields["password"] {
+		t.Errorf("expected username, email and password to be listed; got %v %+v", resp.Status, problem)
+	}
+
+	problem = Problem{}
+	resp = doJSON(t, http.MethodPost, target, admin, map[string]interface{}{"username": 42}, &problem)
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(problem.Errors) != 1 || problem.Errors[0].Code != "invalid_type" {
+		t.Errorf("expected a wrongly typed field to be rejected; got %v %+v", resp.Status, problem)
+	}
+
+	body := bytes.Repeat([]byte(" "), maxRequestBodyBytes+1)
+	req, _ := http.NewRequest(http.MethodPost, target, bytes.NewReader(append(body, "{}"...)))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected an oversized body to be rejected; got %v %v", resp, err)
+	}
+
+	resp = doJSON(t, http.MethodPost, target, admin,
+		AccountRegisterRequest{Username: " frank ", Email: " Frank@Example.COM", Password: "pw"}, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status Created; got %v", resp.Status)
+	}
+	if user, _ := db.GetUserByUsername(context.Background(), "frank"); user == nil || user.Email != "Frank@example.com" {
+		t.Errorf("expected the username trimmed and the email domain lowercased; got %+v", user)
+	}
+}
@@ -0,0 +1,80 @@
+// Package tracing sets up OpenTelemetry tracing. The server starts a span for every request and the database
+// one for every call, both through the global tracer provider this package installs, and W3C trace context
+// headers continue the traces of callers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// defaultServiceName names the service in exported spans unless OTEL_SERVICE_NAME is set
+const defaultServiceName = "jjr-tec-backend"
+
+// FromEnv installs the tracer provider selected by OTEL_TRACES_EXPORTER: "none" (the default) records nothing,
+// "otlp" exports spans over OTLP/HTTP. The exporter reads its endpoint, headers and timeout from the standard
+// OTEL_EXPORTER_OTLP_* variables and OTEL_SERVICE_NAME names the service. The returned function flushes the
+// spans still buffered and stops the exporter, it has to be called before the process exits.
+func FromEnv(ctx context.Context) (func(context.Context) error, error) {
+	setPropagator()
+	switch exporter := envOr("OTEL_TRACES_EXPORTER", "none"); exporter {
+	case "none":
+		// The global provider is a no-op until one is set
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		client, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("OTLP exporter: %w", err)
+		}
+		provider := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(client),
+			sdktrace.WithResource(serviceResource(envOr("OTEL_SERVICE_NAME", defaultServiceName))),
+		)
+		otel.SetTracerProvider(provider)
+		return provider.Shutdown, nil
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", exporter)
+	}
+}
+
+// InMemory installs a tracer provider that records finished spans in the returned exporter, for tests.
+// The returned function restores the previous provider.
+func InMemory() (*tracetest.InMemoryExporter, func()) {
+	setPropagator()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithResource(serviceResource(defaultServiceName)),
+	)
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	return exporter, func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	}
+}
+
+// setPropagator makes the server read and the HTTP clients send W3C traceparent, tracestate and baggage headers
+func setPropagator() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+func serviceResource(name string) *resource.Resource {
+	return resource.NewSchemaless(semconv.ServiceName(name))
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := FromEnv(context.Background()); err == nil {
+		t.Errorf("expected an unknown exporter to fail")
+	}
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	shutdown, err := FromEnv(context.Background())
+	if err != nil {
+		t.Fatalf("expected the no-op default; got %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("expected the no-op shutdown to succeed; got %v", err)
+	}
+}
+
+func TestInMemoryRecordsAndPropagates(t *testing.T) {
+	spans, restore := InMemory()
+	defer restore()
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "outer")
+	header := http.Header{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	span.End()
+
+	ended := spans.GetSpans()
+	if len(ended) != 1 || ended[0].Name != "outer" {
+		t.Fatalf("expected the span to be recorded; got %v", ended)
+	}
+	want := "00-" + ended[0].SpanContext.TraceID().String() + "-" + ended[0].SpanContext.SpanID().String() + "-01"
+	if got := header.Get("traceparent"); got != want {
+		t.Errorf("expected W3C trace context %q; got %q", want, got)
+	}
+}
@@ -0,0 +1,17 @@
+-- Machine-to-machine callers that authenticate with the client_credentials grant
+CREATE TABLE IF NOT EXISTS service_accounts (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    client_id VARCHAR(64) NOT NULL UNIQUE,
+    client_secret_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Roles a service account may request as scopes
+CREATE TABLE IF NOT EXISTS service_account_roles (
+    service_account_id INT NOT NULL REFERENCES service_accounts(id) ON DELETE CASCADE,
+    role_id INT NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (service_account_id, role_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_service_account_roles_service_account_id ON service_account_roles (service_account_id);
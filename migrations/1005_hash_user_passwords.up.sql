@@ -0,0 +1,6 @@
+-- Passwords used to be stored in plain text. Hash them with bcrypt, which is what the application
+-- compares against from now on. Hashes produced by pgcrypto's crypt() are compatible with Go's bcrypt.
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+UPDATE users SET password = crypt(password, gen_salt('bf', 10))
+WHERE password NOT LIKE '$2a$%' AND password NOT LIKE '$2b$%' AND password NOT LIKE '$2y$%';
@@ -0,0 +1,2 @@
+-- Refresh tokens issued before this point in time are rejected, it is moved forward when the password changes
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_valid_after TIMESTAMP;
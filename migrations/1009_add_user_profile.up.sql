@@ -0,0 +1,5 @@
+-- Profile fields users maintain themselves through /protected/me. Empty means not set.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale VARCHAR(35) NOT NULL DEFAULT ''; -- BCP 47 language tag
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT ''; -- IANA time zone name
+ALTER TABLE users ALTER COLUMN email TYPE VARCHAR(255);
@@ -0,0 +1,26 @@
+-- Only active users can log in. pending accounts wait for something (like an accepted invitation),
+-- disabled ones were switched off by an admin and locked ones by a security measure.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'disabled', 'locked', 'pending'));
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+
+UPDATE users SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL;
+UPDATE users SET updated_at = created_at WHERE updated_at IS NULL;
+ALTER TABLE users ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE users ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE users ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP;
+
+-- updated_at follows every change of the row except logins, which only move last_login_at
+CREATE OR REPLACE FUNCTION users_set_updated_at() RETURNS trigger AS $$
+BEGIN
+    IF (to_jsonb(NEW) - 'last_login_at' - 'updated_at') IS DISTINCT FROM (to_jsonb(OLD) - 'last_login_at' - 'updated_at') THEN
+        NEW.updated_at = CURRENT_TIMESTAMP;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_updated_at ON users;
+CREATE TRIGGER users_updated_at BEFORE UPDATE ON users
+    FOR EACH ROW EXECUTE FUNCTION users_set_updated_at();
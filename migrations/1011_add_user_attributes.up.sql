@@ -0,0 +1,13 @@
+-- Free-form per user metadata like department or cost center, validated against the admin-defined schema on write
+ALTER TABLE users ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+
+-- Serves the containment queries (attributes @> '{"department": "sales"}') of the user list
+CREATE INDEX IF NOT EXISTS idx_users_attributes ON users USING GIN (attributes jsonb_path_ops);
+
+-- The single JSON Schema attributes are validated against, and the attributes copied into access tokens
+CREATE TABLE IF NOT EXISTS user_attribute_schema (
+    id INT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    schema JSONB NOT NULL,
+    claim_attributes TEXT NOT NULL DEFAULT '', -- space separated attribute names
+    updated_at TIMESTAMP NOT NULL
+);
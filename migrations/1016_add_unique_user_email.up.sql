@@ -0,0 +1,3 @@
+-- An email address belongs to one user at most, compared case-insensitively like GetUserByEmail does.
+-- Users without an address are left out. Addresses already shared by several users have to be changed first.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_unique ON users (LOWER(email)) WHERE email <> '';
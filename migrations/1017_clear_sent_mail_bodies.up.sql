@@ -0,0 +1,2 @@
+-- Sent mails no longer keep their bodies, the links in them carry live tokens. Clear the ones sent so far.
+UPDATE mail_outbox SET text_body = '', html_body = '' WHERE status = 'sent';
@@ -0,0 +1,2 @@
+-- Attributes users may change themselves through /v1/me/attributes, all others only admins change
+ALTER TABLE user_attribute_schema ADD COLUMN IF NOT EXISTS user_editable_attributes TEXT NOT NULL DEFAULT ''; -- space separated attribute names
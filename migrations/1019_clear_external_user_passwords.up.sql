@@ -0,0 +1,9 @@
+-- Users provisioned from the directory or an upstream identity provider got a random password, which a password
+-- reset could replace with one the local login accepts. They have no local password now, so they sign in only
+-- where they were provisioned from. Federated users are told apart from linked local accounts by the identity
+-- being linked as the user was created.
+UPDATE users SET password = ''
+WHERE id IN (
+    SELECT i.user_id FROM external_identities i JOIN users u ON u.id = i.user_id
+    WHERE i.provider = 'ldap' OR i.created_at - u.created_at < INTERVAL '1 minute'
+);